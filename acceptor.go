@@ -8,10 +8,13 @@ import (
 	"fmt"
 	"math"
 	"math/big"
+	"os"
 	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/jcmturner/gokrb5/v8/config"
 	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
 	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
 	ianaflags "github.com/jcmturner/gokrb5/v8/iana/flags"
 	"github.com/jcmturner/gokrb5/v8/keytab"
@@ -20,13 +23,24 @@ import (
 	"github.com/jcmturner/gokrb5/v8/types"
 )
 
+var errAnonymousRefused = errors.New("anonymous initiator refused")
+
 // Acceptor represents the server side of the GSSAPI protocol.
 type Acceptor struct {
 	context
 
 	keytab    string
+	kt        *keytab.Keytab
 	principal *types.PrincipalName
 	clockSkew time.Duration
+	encTypes  []int32
+
+	refuseAnonymous bool
+	dcePending      bool
+
+	sources *sources
+	config  *config.Config
+	profile *profile
 
 	logger logr.Logger
 }
@@ -40,6 +54,7 @@ func NewAcceptor(options ...Option[Acceptor]) (*Acceptor, error) {
 			logger:       logr.Discard(),
 		},
 		clockSkew: 10 * time.Second,
+		sources:   defaultSources(),
 		logger:    logr.Discard(),
 	}
 
@@ -59,7 +74,81 @@ func (ctx *Acceptor) Close() error {
 	return nil
 }
 
-func verifyAPReq(apreq *messages.APReq, kt *keytab.Keytab, skew time.Duration, sname *types.PrincipalName) error {
+func (ctx *Acceptor) loadConfig() error {
+	if ctx.config != nil {
+		return nil
+	}
+
+	var err error
+
+	ctx.config, ctx.profile, err = ctx.sources.loadConfig(ctx.logger)
+
+	return err
+}
+
+// permittedEncTypes returns the encryption types passed with WithEncTypes or
+// else those permitted by the configuration, which is optional.
+func (ctx *Acceptor) permittedEncTypes() ([]int32, error) {
+	if ctx.encTypes != nil {
+		return ctx.encTypes, nil
+	}
+
+	if err := ctx.loadConfig(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	return profileEncTypes(ctx.profile, permittedEncTypesTag), nil
+}
+
+func (ctx *Acceptor) loadKeytab() (*keytab.Keytab, error) {
+	switch {
+	case ctx.kt != nil:
+		return ctx.kt, nil
+	case ctx.keytab != "":
+		return ctx.sources.resolveKeytab(ctx.keytab)
+	}
+
+	return ctx.sources.loadKeytab(ctx.logger)
+}
+
+// LocalName maps the peer of an established context to a local account name
+// using the auth_to_local_names and auth_to_local relations in krb5.conf.
+func (ctx *Acceptor) LocalName() (string, error) {
+	if !ctx.established {
+		return "", errNotEstablished
+	}
+
+	if err := ctx.loadConfig(); err != nil {
+		return "", err
+	}
+
+	return localName(ctx.profile, ctx.config.LibDefaults.DefaultRealm, ctx.peerName)
+}
+
+// UserOK reports whether the peer of an established context is authorized to
+// access the local account named username. If the account has a .k5login
+// file then the peer must be listed in it, otherwise the peer must map to
+// the account via LocalName.
+func (ctx *Acceptor) UserOK(username string) (bool, error) {
+	if !ctx.established {
+		return false, errNotEstablished
+	}
+
+	if err := ctx.loadConfig(); err != nil {
+		return false, err
+	}
+
+	return kuserok(ctx.sources.fs, ctx.profile, ctx.config.LibDefaults.DefaultRealm, ctx.peerName, username)
+}
+
+//nolint:cyclop
+func verifyAPReq(apreq *messages.APReq, kt *keytab.Keytab, skew time.Duration, sname *types.PrincipalName,
+	permitted []int32,
+) error {
+	if err := checkEncType(permitted, "ticket", apreq.Ticket.EncPart.EType); err != nil {
+		return err
+	}
+
 	err := apreq.Ticket.DecryptEncPart(kt, sname)
 
 	if _, ok := err.(messages.KRBError); ok { //nolint:errorlint
@@ -73,11 +162,21 @@ func verifyAPReq(apreq *messages.APReq, kt *keytab.Keytab, skew time.Duration, s
 		return err
 	}
 
+	if err := checkEncType(permitted, "session key", apreq.Ticket.DecryptedEncPart.Key.KeyType); err != nil {
+		return err
+	}
+
 	if err := apreq.DecryptAuthenticator(apreq.Ticket.DecryptedEncPart.Key); err != nil {
 		return messages.NewKRBError(apreq.Ticket.SName, apreq.Ticket.Realm,
 			errorcode.KRB_AP_ERR_BAD_INTEGRITY, "could not decrypt authenticator")
 	}
 
+	if subkey := apreq.Authenticator.SubKey; subkey.KeyType != 0 {
+		if err := checkEncType(permitted, "authenticator subkey", subkey.KeyType); err != nil {
+			return err
+		}
+	}
+
 	if !apreq.Authenticator.CName.Equal(apreq.Ticket.DecryptedEncPart.CName) {
 		return messages.NewKRBError(apreq.Ticket.SName, apreq.Ticket.Realm,
 			errorcode.KRB_AP_ERR_BADMATCH, "CName in Authenticator does not match that in service ticket")
@@ -124,33 +223,58 @@ func (ctx *Acceptor) Accept(input []byte) ([]byte, bool, error) {
 		return nil, false, nil
 	}
 
-	var apreq spnego.KRB5Token
-	if err := apreq.Unmarshal(input); err != nil {
-		return nil, false, err
+	if ctx.dcePending {
+		return ctx.acceptDCE(input)
 	}
 
-	if apreq.IsKRBError() {
-		return nil, false, errors.New("received kerberos error")
-	}
+	var apReq messages.APReq
+
+	// DCE style initiators may send the AP-REQ without any framing
+	raw := isRawToken(input, asnAppTag.APREQ)
+	if raw {
+		if err := apReq.Unmarshal(input); err != nil {
+			return nil, false, err
+		}
+	} else {
+		var apreq spnego.KRB5Token
+		if err := apreq.Unmarshal(input); err != nil {
+			return nil, false, err
+		}
 
-	// FIXME check invalid token ID
+		if apreq.IsKRBError() {
+			return nil, false, errors.New("received kerberos error")
+		}
 
-	if !apreq.IsAPReq() {
-		return nil, false, errors.New("didn't receive an AP-REQ")
+		// FIXME check invalid token ID
+
+		if !apreq.IsAPReq() {
+			return nil, false, errors.New("didn't receive an AP-REQ")
+		}
+
+		apReq = apreq.APReq
 	}
 
-	kt, err := loadKeytab(ctx.logger)
+	kt, err := ctx.loadKeytab()
+	if err != nil {
+		return nil, false, err
+	}
+
+	permitted, err := ctx.permittedEncTypes()
 	if err != nil {
 		return nil, false, err
 	}
 
 	var output []byte
 
-	// if _, err := apreq.APReq.Verify(kt, ctx.clockSkew, FIXME, nil); err != nil {
-	if err = verifyAPReq(&apreq.APReq, kt, ctx.clockSkew, ctx.principal); err != nil {
+	// if _, err := apReq.Verify(kt, ctx.clockSkew, FIXME, nil); err != nil {
+	if err = verifyAPReq(&apReq, kt, ctx.clockSkew, ctx.principal, permitted); err != nil {
 		var krbError messages.KRBError
 
-		if errors.As(err, &krbError) {
+		if errors.As(err, &krbError) && raw {
+			if output, err = krbError.Marshal(); err == nil {
+				return output, true, nil
+			}
+		} else if errors.As(err, &krbError) {
 			tb, _ := hex.DecodeString(spnego.TOK_ID_KRB_ERROR)
 
 			m := krb5Token{
@@ -167,33 +291,64 @@ func (ctx *Acceptor) Accept(input []byte) ([]byte, bool, error) {
 		return nil, false, err
 	}
 
-	ctx.baseSequenceNumber = uint64(apreq.APReq.Authenticator.SeqNumber)
+	anonymous := isAnonymous(apReq.Ticket.DecryptedEncPart)
+	if anonymous && ctx.refuseAnonymous {
+		return nil, false, errAnonymousRefused
+	}
+
+	ctx.baseSequenceNumber = uint64(apReq.Authenticator.SeqNumber)
 
-	ctx.ctime = apreq.APReq.Authenticator.CTime
-	ctx.cusec = apreq.APReq.Authenticator.Cusec
+	ctx.ctime = apReq.Authenticator.CTime
+	ctx.cusec = apReq.Authenticator.Cusec
 
-	ctx.key = apreq.APReq.Ticket.DecryptedEncPart.Key
+	ctx.key = apReq.Ticket.DecryptedEncPart.Key
 
-	if apreq.APReq.Authenticator.SubKey.KeyType != 0 {
-		ctx.peerSubkey = apreq.APReq.Authenticator.SubKey
+	if apReq.Authenticator.SubKey.KeyType != 0 {
+		ctx.peerSubkey = apReq.Authenticator.SubKey
 	}
 
-	ctx.flags = int(supportedFlags & binary.LittleEndian.Uint32(apreq.APReq.Authenticator.Cksum.Checksum[20:24]))
+	ctx.requestedFlags = int(binary.LittleEndian.Uint32(apReq.Authenticator.Cksum.Checksum[20:24]))
+	ctx.flags = ctx.requestedFlags & supportedFlags
 
-	ctx.expiry = apreq.APReq.Ticket.DecryptedEncPart.EndTime
+	part := apReq.Ticket.DecryptedEncPart
+	ctx.setTicketTimes(part.AuthTime, part.StartTime, part.EndTime, part.RenewTill)
 
-	ctx.peerName = fmt.Sprintf("%s@%s", apreq.APReq.Ticket.DecryptedEncPart.CName.PrincipalNameString(),
-		apreq.APReq.Ticket.DecryptedEncPart.CRealm)
+	ctx.localPrincipal = NewNameFromPrincipal(apReq.Ticket.SName, apReq.Ticket.Realm)
+	ctx.peerName = NewNameFromPrincipal(part.CName, part.CRealm)
 
-	if types.IsFlagSet(&apreq.APReq.APOptions, ianaflags.APOptionMutualRequired) {
+	// Only the ticket decides whether the context is anonymous
+	ctx.flags &^= gssapi.ContextFlagAnon
+
+	if anonymous {
+		ctx.flags |= gssapi.ContextFlagAnon
+		ctx.peerName = newAnonymousName()
+	}
+
+	if ctx.doDCEStyle() {
+		ctx.flags |= gssapi.ContextFlagMutual
+	}
+
+	//nolint:nestif
+	if types.IsFlagSet(&apReq.APOptions, ianaflags.APOptionMutualRequired) || ctx.doDCEStyle() {
 		var aprep *apRep
 
-		aprep, ctx.sequenceNumber, err = getAPRepMessage(apreq.APReq.Ticket, ctx.key,
+		aprep, ctx.sequenceNumber, err = getAPRepMessage(apReq.Ticket, ctx.key,
 			ctx.ctime, ctx.cusec)
 		if err != nil {
 			return nil, false, err
 		}
 
+		// The AP-REP is unframed and answered by one from the Initiator
+		if ctx.doDCEStyle() {
+			if output, err = aprep.marshal(); err != nil {
+				return nil, false, err
+			}
+
+			ctx.dcePending = true
+
+			return output, true, nil
+		}
+
 		tb, _ := hex.DecodeString(spnego.TOK_ID_KRB_AP_REP)
 
 		m := krb5Token{
@@ -211,6 +366,7 @@ func (ctx *Acceptor) Accept(input []byte) ([]byte, bool, error) {
 	}
 
 	ctx.established = true
+	ctx.logEncType()
 
 	return output, false, nil
 }
@@ -0,0 +1,284 @@
+package gssapi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// The github.com/jcmturner/gokrb5/v8/credentials package can only read
+// credential caches so this implements writing the MIT version 4 format as
+// described at
+// https://web.mit.edu/kerberos/krb5-latest/doc/formats/ccache_file_format.html.
+
+const (
+	ccacheMagic   = 5
+	ccacheVersion = 4
+	ccacheMode    = 0o600
+)
+
+func writeCount(b *bytes.Buffer, data []byte) {
+	_ = binary.Write(b, binary.BigEndian, uint32(len(data))) //nolint:gosec
+	b.Write(data)
+}
+
+func writeTimestamp(b *bytes.Buffer, t time.Time) {
+	var v uint32
+	if !t.IsZero() {
+		v = uint32(t.Unix()) //nolint:gosec
+	}
+
+	_ = binary.Write(b, binary.BigEndian, v)
+}
+
+func marshalCCachePrincipal(b *bytes.Buffer, pn types.PrincipalName, realm string) {
+	_ = binary.Write(b, binary.BigEndian, uint32(pn.NameType))        //nolint:gosec
+	_ = binary.Write(b, binary.BigEndian, uint32(len(pn.NameString))) //nolint:gosec
+	writeCount(b, []byte(realm))
+
+	for _, c := range pn.NameString {
+		writeCount(b, []byte(c))
+	}
+}
+
+func marshalCCacheCredential(b *bytes.Buffer, cred *credentials.Credential) {
+	marshalCCachePrincipal(b, cred.Client.PrincipalName, cred.Client.Realm)
+	marshalCCachePrincipal(b, cred.Server.PrincipalName, cred.Server.Realm)
+
+	_ = binary.Write(b, binary.BigEndian, uint16(cred.Key.KeyType)) //nolint:gosec
+	writeCount(b, cred.Key.KeyValue)
+
+	writeTimestamp(b, cred.AuthTime)
+	writeTimestamp(b, cred.StartTime)
+	writeTimestamp(b, cred.EndTime)
+	writeTimestamp(b, cred.RenewTill)
+
+	if cred.IsSKey {
+		b.WriteByte(1)
+	} else {
+		b.WriteByte(0)
+	}
+
+	flags := make([]byte, 4)
+	copy(flags, cred.TicketFlags.Bytes)
+	b.Write(flags)
+
+	_ = binary.Write(b, binary.BigEndian, uint32(len(cred.Addresses))) //nolint:gosec
+
+	for _, a := range cred.Addresses {
+		_ = binary.Write(b, binary.BigEndian, uint16(a.AddrType)) //nolint:gosec
+		writeCount(b, a.Address)
+	}
+
+	_ = binary.Write(b, binary.BigEndian, uint32(len(cred.AuthData))) //nolint:gosec
+
+	for _, a := range cred.AuthData {
+		_ = binary.Write(b, binary.BigEndian, uint16(a.ADType)) //nolint:gosec
+		writeCount(b, a.ADData)
+	}
+
+	writeCount(b, cred.Ticket)
+	writeCount(b, cred.SecondTicket)
+}
+
+// marshalCCache returns the credential cache in the version 4 file format.
+func marshalCCache(cache *credentials.CCache) []byte {
+	b := new(bytes.Buffer)
+	b.WriteByte(ccacheMagic)
+	b.WriteByte(ccacheVersion)
+
+	// No header fields
+	_ = binary.Write(b, binary.BigEndian, uint16(0))
+
+	marshalCCachePrincipal(b, cache.DefaultPrincipal.PrincipalName, cache.DefaultPrincipal.Realm)
+
+	for _, cred := range cache.Credentials {
+		marshalCCacheCredential(b, cred)
+	}
+
+	return b.Bytes()
+}
+
+// newCCache returns an empty credential cache for the client.
+func newCCache(cname types.PrincipalName, crealm string) *credentials.CCache {
+	cache := &credentials.CCache{
+		Version: ccacheVersion,
+	}
+	cache.DefaultPrincipal.PrincipalName = cname
+	cache.DefaultPrincipal.Realm = crealm
+
+	return cache
+}
+
+// newCredential returns a credential cache entry for a ticket obtained by
+// the client from either an AS or TGS exchange.
+func newCredential(cname types.PrincipalName, crealm string, ticket messages.Ticket,
+	part messages.EncKDCRepPart,
+) (*credentials.Credential, error) {
+	b, err := ticket.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	cred := &credentials.Credential{
+		Key:         part.Key,
+		AuthTime:    part.AuthTime,
+		StartTime:   part.StartTime,
+		EndTime:     part.EndTime,
+		RenewTill:   part.RenewTill,
+		TicketFlags: part.Flags,
+		Addresses:   part.CAddr,
+		Ticket:      b,
+	}
+	cred.Client.PrincipalName = cname
+	cred.Client.Realm = crealm
+	cred.Server.PrincipalName = ticket.SName
+	cred.Server.Realm = ticket.Realm
+
+	return cred, nil
+}
+
+// addCredential adds the credential to the cache, replacing any existing
+// credential for the same server.
+func addCredential(cache *credentials.CCache, cred *credentials.Credential) {
+	for i, c := range cache.Credentials {
+		if c.Server.Realm == cred.Server.Realm && c.Server.PrincipalName.Equal(cred.Server.PrincipalName) {
+			cache.Credentials[i] = cred
+
+			return
+		}
+	}
+
+	cache.Credentials = append(cache.Credentials, cred)
+}
+
+// unmarshalCCache builds a credential cache from a separately marshalled
+// default principal and credentials, as stored by the KEYRING and KCM cache
+// types.
+func unmarshalCCache(principal []byte, creds [][]byte) (*credentials.CCache, error) {
+	b := new(bytes.Buffer)
+	b.WriteByte(ccacheMagic)
+	b.WriteByte(ccacheVersion)
+	_ = binary.Write(b, binary.BigEndian, uint16(0))
+	b.Write(principal)
+
+	for _, cred := range creds {
+		b.Write(cred)
+	}
+
+	cache := new(credentials.CCache)
+	if err := cache.Unmarshal(b.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return cache, nil
+}
+
+func (ctx *Initiator) storeCCacheName() string {
+	if *ctx.storeCCache != "" {
+		return *ctx.storeCCache
+	}
+
+	return ctx.sources.defaultCCacheName(ctx.profile)
+}
+
+// reuse attempts to use a valid TGT for the client from the credential cache
+// that is being stored to rather than contacting the KDC.
+func (ctx *Initiator) reuse(creds *credentials.Credentials) (bool, error) {
+	cc, err := ctx.sources.resolveCCache(ctx.storeCCacheName(), ctx.profile)
+	if err != nil {
+		return false, err
+	}
+
+	cache, err := cc.read()
+	if err != nil || cache == nil {
+		return false, err
+	}
+
+	if cache.DefaultPrincipal.Realm != creds.Domain() || !cache.DefaultPrincipal.PrincipalName.Equal(creds.CName()) {
+		return false, nil
+	}
+
+	session, err := newTGTSessionFromCCache(cache)
+	if err != nil || session.expired() || session.needsRefresh() {
+		return false, nil //nolint:nilerr
+	}
+
+	cl, err := client.NewFromCCache(cache, ctx.krb5conf, ctx.settings...)
+	if err != nil {
+		return false, nil //nolint:nilerr
+	}
+
+	// Keep the password or keytab so the TGT can be reacquired later
+	cl.Credentials = creds
+
+	ctx.client, ctx.session = cl, session
+	ctx.tickets = ticketsFromCCache(cache)
+
+	ctx.logger.Info("reusing credential cache", "name", cc.name(), "client", session.name())
+
+	return true, nil
+}
+
+// storeCredentials adds the credentials to the credential cache along with
+// the TGT, if the Initiator has been configured to do so. Any failure is
+// logged but otherwise ignored. The caller must hold ctx.mu.
+func (ctx *Initiator) storeCredentials(creds ...*credentials.Credential) {
+	if ctx.storeCCache == nil {
+		return
+	}
+
+	name := ctx.storeCCacheName()
+
+	cc, err := ctx.sources.resolveCCache(name, ctx.profile)
+	if err == nil {
+		err = ctx.storeCredentialsTo(cc, creds...)
+	}
+
+	if err != nil {
+		ctx.logger.Error(err, "unable to store credentials", "name", name)
+	}
+}
+
+func (ctx *Initiator) storeCredentialsTo(cc credCache, creds ...*credentials.Credential) error {
+	cache, err := cc.read()
+	if err != nil {
+		ctx.logger.Info("replacing unreadable credential cache", "name", cc.name(), "error", err)
+	}
+
+	if cache == nil || cache.DefaultPrincipal.Realm != ctx.session.crealm ||
+		!cache.DefaultPrincipal.PrincipalName.Equal(ctx.session.cname) {
+		cache = newCCache(ctx.session.cname, ctx.session.crealm)
+	}
+
+	tgt, err := ctx.session.credential()
+	if err != nil {
+		return err
+	}
+
+	addCredential(cache, tgt)
+
+	for _, cred := range creds {
+		addCredential(cache, cred)
+	}
+
+	if err = cc.write(cache); err != nil {
+		return err
+	}
+
+	// Don't treat our own update as a reason to reload
+	if ctx.usingCCache() && ctx.ccache != nil && ctx.ccache.name() == cc.name() {
+		if ctx.ccacheStamp, err = cc.stamp(); err != nil {
+			return err
+		}
+	}
+
+	ctx.logger.Info("stored credentials", "name", cc.name(), "count", len(creds)+1)
+
+	return nil
+}
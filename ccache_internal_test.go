@@ -0,0 +1,86 @@
+package gssapi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshalCCache(t *testing.T) {
+	env := newTestEnvironment(t, etypeID.AES256_CTS_HMAC_SHA1_96)
+
+	b, err := os.ReadFile(env.ccache)
+	require.NoError(t, err)
+
+	cache := new(credentials.CCache)
+	require.NoError(t, cache.Unmarshal(b))
+
+	assert.Equal(t, testClient, cache.DefaultPrincipal.PrincipalName.PrincipalNameString())
+	assert.Equal(t, testRealm, cache.DefaultPrincipal.Realm)
+	assert.Len(t, cache.Credentials, 2)
+	assert.True(t, cache.Contains(types.NewPrincipalName(nametype.KRB_NT_SRV_HST, testService)))
+
+	// Round-trips byte for byte
+	assert.Equal(t, b, marshalCCache(cache))
+}
+
+func TestStoreCCache(t *testing.T) {
+	env := newTestEnvironment(t, etypeID.AES256_CTS_HMAC_SHA1_96)
+
+	_, cache, err := defaultSources().loadCCache(logr.Discard(), nil)
+	require.NoError(t, err)
+
+	// Replacing an existing credential doesn't grow the cache
+	addCredential(cache, cache.Credentials[0])
+	assert.Len(t, cache.Credentials, 2)
+
+	path := filepath.Join(env.dir, "stored")
+	cc := &fileCCache{fs: fs, path: path}
+
+	require.NoError(t, cc.write(cache))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(ccacheMode), info.Mode().Perm())
+
+	// No temporary files are left behind
+	matches, err := filepath.Glob(path + ".*")
+	require.NoError(t, err)
+	assert.Empty(t, matches)
+
+	stored, err := cc.read()
+	require.NoError(t, err)
+	assert.Len(t, stored.Credentials, 2)
+
+	missing, err := (&fileCCache{fs: fs, path: filepath.Join(env.dir, "missing")}).read()
+	require.NoError(t, err)
+	assert.Nil(t, missing)
+}
+
+func TestStoreCredentials(t *testing.T) {
+	env := newTestEnvironment(t, etypeID.AES256_CTS_HMAC_SHA1_96)
+
+	path := filepath.Join(env.dir, "stored")
+
+	initiator, _ := establish(t, 0, []Option[Initiator]{WithStoreCredentials[Initiator](krb5FilePrefix + path)}, nil)
+
+	// The ticket came from the cache so only the TGT is stored
+	initiator.mu.Lock()
+	initiator.storeCredentials()
+	initiator.mu.Unlock()
+
+	stored, err := (&fileCCache{fs: fs, path: path}).read()
+	require.NoError(t, err)
+	assert.Len(t, stored.Credentials, 1)
+
+	_, err = newTGTSessionFromCCache(stored)
+	assert.NoError(t, err)
+}
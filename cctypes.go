@@ -0,0 +1,374 @@
+package gssapi
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/spf13/afero"
+)
+
+const (
+	ccacheTypeFile    = "FILE"
+	ccacheTypeDir     = "DIR"
+	ccacheTypeKeyring = "KEYRING"
+	ccacheTypeKCM     = "KCM"
+	ccacheTypeMemory  = "MEMORY"
+
+	defaultCCacheNameTag = "default_ccache_name"
+	dirPrimary           = "primary"
+	dirDefaultSubsidiary = "tkt"
+	dirMode              = 0o700
+)
+
+var (
+	errUnknownCCacheType = errors.New("unknown credential cache type")
+	errBadCCacheName     = errors.New("malformed credential cache name")
+)
+
+// credCache is a credential cache of one of the types supported by MIT
+// Kerberos, identified by a name such as "FILE:/tmp/krb5cc_1000" or
+// "KEYRING:persistent:1000".
+type credCache interface {
+	// name returns the fully qualified name of the cache.
+	name() string
+	// read returns the contents of the cache, or nil if it doesn't exist.
+	read() (*credentials.CCache, error)
+	// write replaces the contents of the cache.
+	write(cache *credentials.CCache) error
+	// stamp returns an opaque value that changes whenever the cache is
+	// modified, or an empty string if it doesn't exist.
+	stamp() (string, error)
+}
+
+// resolveCCache returns the credential cache for name. A name without a
+// type prefix is treated as a FILE cache.
+func (s *sources) resolveCCache(name string, p *profile) (credCache, error) {
+	typ, residual, ok := strings.Cut(name, ":")
+	if !ok || strings.ContainsRune(typ, filepath.Separator) {
+		return &fileCCache{fs: s.fs, path: name}, nil
+	}
+
+	switch typ {
+	case ccacheTypeFile:
+		return &fileCCache{fs: s.fs, path: residual}, nil
+	case ccacheTypeDir:
+		return newDirCCache(s.fs, residual)
+	case ccacheTypeKeyring:
+		return newKeyringCCache(residual)
+	case ccacheTypeKCM:
+		return newKCMCCache(residual, p), nil
+	case ccacheTypeMemory:
+		return &memoryCCache{residual}, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", errUnknownCCacheType, typ)
+}
+
+// defaultCCacheName returns the name of the default credential cache, taken
+// from WithCCache, the KRB5CCNAME environment variable, then the
+// default_ccache_name setting, and finally falling back to a FILE cache in
+// /tmp.
+func (s *sources) defaultCCacheName(p *profile) string {
+	if s.ccacheName != "" {
+		return s.ccacheName
+	}
+
+	if name, ok := s.lookupEnv(krb5CCName); ok {
+		return name
+	}
+
+	if name, ok := p.value("libdefaults", defaultCCacheNameTag); ok {
+		return expandPath(name)
+	}
+
+	return krb5FilePrefix + defaultCCacheNames()[0]
+}
+
+// expandPath expands the parameters supported by MIT Kerberos in paths
+// such as default_ccache_name.
+func expandPath(path string) string {
+	uid, euid := strconv.Itoa(os.Getuid()), strconv.Itoa(os.Geteuid())
+
+	return strings.NewReplacer(
+		"%{uid}", uid,
+		"%{euid}", euid,
+		"%{USERID}", euid,
+		"%{TEMP}", os.TempDir(),
+		"%{null}", "",
+		"%%", "%",
+	).Replace(path)
+}
+
+// contentStamp is used as the stamp for cache types that have no cheap way
+// of detecting modification.
+func contentStamp(cc credCache) (string, error) {
+	cache, err := cc.read()
+	if err != nil || cache == nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(marshalCCache(cache))
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// fileCCache is a FILE credential cache.
+type fileCCache struct {
+	fs   afero.Fs
+	path string
+}
+
+func (c *fileCCache) name() string {
+	return ccacheTypeFile + ":" + c.path
+}
+
+func (c *fileCCache) read() (*credentials.CCache, error) {
+	if _, err := c.fs.Stat(c.path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil //nolint:nilnil
+		}
+
+		return nil, err
+	}
+
+	b, err := afero.ReadFile(c.fs, c.path)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := new(credentials.CCache)
+	if err = cache.Unmarshal(b); err != nil {
+		return nil, err
+	}
+
+	cache.Path = c.path
+
+	return cache, nil
+}
+
+// write atomically writes the credential cache by writing to a temporary
+// file in the same directory and renaming it over the original.
+func (c *fileCCache) write(cache *credentials.CCache) error {
+	return writeFileAtomic(c.fs, c.path, marshalCCache(cache))
+}
+
+func (c *fileCCache) stamp() (string, error) {
+	info, err := c.fs.Stat(c.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+
+		return "", err
+	}
+
+	return fmt.Sprintf("%d:%d", info.ModTime().UnixNano(), info.Size()), nil
+}
+
+func writeFileAtomic(fsys afero.Fs, path string, b []byte) error {
+	f, err := afero.TempFile(fsys, filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = fsys.Remove(f.Name())
+	}()
+
+	if _, err = f.Write(b); err != nil {
+		_ = f.Close()
+
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	if err = fsys.Chmod(f.Name(), ccacheMode); err != nil {
+		return err
+	}
+
+	return fsys.Rename(f.Name(), path)
+}
+
+// dirCCache is a DIR credential cache. A name of the form "DIR:dir" refers
+// to the primary cache of the collection in dir, which is named by the
+// "primary" file, while "DIR::dir/tktname" refers to a specific cache.
+type dirCCache struct {
+	fs         afero.Fs
+	dir        string
+	subsidiary string
+}
+
+func newDirCCache(fsys afero.Fs, residual string) (*dirCCache, error) {
+	if path, ok := strings.CutPrefix(residual, ":"); ok {
+		if !strings.HasPrefix(filepath.Base(path), dirDefaultSubsidiary) {
+			return nil, fmt.Errorf("%w: %s", errBadCCacheName, residual)
+		}
+
+		return &dirCCache{fs: fsys, dir: filepath.Dir(path), subsidiary: filepath.Base(path)}, nil
+	}
+
+	if residual == "" {
+		return nil, fmt.Errorf("%w: %s", errBadCCacheName, residual)
+	}
+
+	return &dirCCache{fs: fsys, dir: residual}, nil
+}
+
+// primary returns the name of the primary cache in the collection, and
+// whether the primary file exists.
+func (c *dirCCache) primary() (string, bool, error) {
+	if c.subsidiary != "" {
+		return c.subsidiary, true, nil
+	}
+
+	f, err := c.fs.Open(filepath.Join(c.dir, dirPrimary))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return dirDefaultSubsidiary, false, nil
+		}
+
+		return "", false, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	if !s.Scan() {
+		if err = s.Err(); err != nil {
+			return "", false, err
+		}
+
+		return dirDefaultSubsidiary, false, nil
+	}
+
+	primary := strings.TrimSpace(s.Text())
+	if !strings.HasPrefix(primary, dirDefaultSubsidiary) || strings.ContainsRune(primary, filepath.Separator) {
+		return "", false, fmt.Errorf("%w: bad primary %q", errBadCCacheName, primary)
+	}
+
+	return primary, true, nil
+}
+
+func (c *dirCCache) file() (*fileCCache, bool, error) {
+	primary, ok, err := c.primary()
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &fileCCache{fs: c.fs, path: filepath.Join(c.dir, primary)}, ok, nil
+}
+
+func (c *dirCCache) name() string {
+	if c.subsidiary != "" {
+		return ccacheTypeDir + "::" + filepath.Join(c.dir, c.subsidiary)
+	}
+
+	return ccacheTypeDir + ":" + c.dir
+}
+
+func (c *dirCCache) read() (*credentials.CCache, error) {
+	f, _, err := c.file()
+	if err != nil {
+		return nil, err
+	}
+
+	return f.read()
+}
+
+func (c *dirCCache) write(cache *credentials.CCache) error {
+	if err := c.fs.MkdirAll(c.dir, dirMode); err != nil {
+		return err
+	}
+
+	f, ok, err := c.file()
+	if err != nil {
+		return err
+	}
+
+	if err = f.write(cache); err != nil {
+		return err
+	}
+
+	if ok {
+		return nil
+	}
+
+	// Make the new cache the primary
+	return writeFileAtomic(c.fs, filepath.Join(c.dir, dirPrimary), []byte(filepath.Base(f.path)+"\n"))
+}
+
+func (c *dirCCache) stamp() (string, error) {
+	f, _, err := c.file()
+	if err != nil {
+		return "", err
+	}
+
+	stamp, err := f.stamp()
+	if err != nil || stamp == "" {
+		return "", err
+	}
+
+	// Switching the primary is also a modification
+	return f.path + ":" + stamp, nil
+}
+
+//nolint:gochecknoglobals
+var memoryCCaches = struct {
+	sync.Mutex
+	caches map[string][]byte
+}{
+	caches: make(map[string][]byte),
+}
+
+// memoryCCache is a MEMORY credential cache which is shared by everything
+// within the process using the same name.
+type memoryCCache struct {
+	residual string
+}
+
+func (c *memoryCCache) name() string {
+	return ccacheTypeMemory + ":" + c.residual
+}
+
+func (c *memoryCCache) read() (*credentials.CCache, error) {
+	memoryCCaches.Lock()
+	b, ok := memoryCCaches.caches[c.residual]
+	memoryCCaches.Unlock()
+
+	if !ok {
+		return nil, nil //nolint:nilnil
+	}
+
+	cache := new(credentials.CCache)
+	if err := cache.Unmarshal(b); err != nil {
+		return nil, err
+	}
+
+	return cache, nil
+}
+
+func (c *memoryCCache) write(cache *credentials.CCache) error {
+	b := marshalCCache(cache)
+
+	memoryCCaches.Lock()
+	defer memoryCCaches.Unlock()
+
+	memoryCCaches.caches[c.residual] = b
+
+	return nil
+}
+
+func (c *memoryCCache) stamp() (string, error) {
+	return contentStamp(c)
+}
@@ -0,0 +1,184 @@
+package gssapi
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveCCache(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		name   string
+		result string
+		err    error
+	}{
+		{"/tmp/krb5cc_1000", "FILE:/tmp/krb5cc_1000", nil},
+		{"FILE:/tmp/krb5cc_1000", "FILE:/tmp/krb5cc_1000", nil},
+		{"DIR:/run/user/1000/krb5cc", "DIR:/run/user/1000/krb5cc", nil},
+		{"DIR::/run/user/1000/krb5cc/tktABCDEF", "DIR::/run/user/1000/krb5cc/tktABCDEF", nil},
+		{"DIR::/run/user/1000/krb5cc/foo", "", errBadCCacheName},
+		{"DIR:", "", errBadCCacheName},
+		{"KCM:", "KCM:", nil},
+		{"KCM:1000", "KCM:1000", nil},
+		{"MEMORY:foo", "MEMORY:foo", nil},
+		{"API:foo", "", errUnknownCCacheType},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			cc, err := defaultSources().resolveCCache(table.name, nil)
+			if table.err != nil {
+				assert.ErrorIs(t, err, table.err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, table.result, cc.name())
+		})
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "KEYRING:persistent:"+strconv.Itoa(os.Getuid()), expandPath("KEYRING:persistent:%{uid}"))
+	assert.Equal(t, "FILE:/tmp/100%", expandPath("FILE:/tmp/100%%"))
+}
+
+//nolint:paralleltest
+func TestDefaultCCacheName(t *testing.T) {
+	p, err := parseProfile(fs, strings.NewReader(`[libdefaults]
+  default_ccache_name = DIR:/run/user/%{uid}/krb5cc
+`))
+	require.NoError(t, err)
+
+	t.Setenv(krb5CCName, "MEMORY:foo")
+	assert.Equal(t, "MEMORY:foo", defaultSources().defaultCCacheName(p))
+
+	require.NoError(t, os.Unsetenv(krb5CCName))
+	assert.Equal(t, "DIR:/run/user/"+strconv.Itoa(os.Getuid())+"/krb5cc", defaultSources().defaultCCacheName(p))
+	assert.Equal(t, "FILE:"+defaultCCacheNames()[0], defaultSources().defaultCCacheName(nil))
+}
+
+func testCCache(t *testing.T) *credentials.CCache {
+	t.Helper()
+
+	env := newTestEnvironment(t, etypeID.AES256_CTS_HMAC_SHA1_96)
+
+	cache, err := (&fileCCache{fs: fs, path: env.ccache}).read()
+	require.NoError(t, err)
+
+	return cache
+}
+
+func testCCacheType(t *testing.T, cc credCache, cache *credentials.CCache) {
+	t.Helper()
+
+	missing, err := cc.read()
+	require.NoError(t, err)
+	assert.Nil(t, missing)
+
+	stamp, err := cc.stamp()
+	require.NoError(t, err)
+	assert.Empty(t, stamp)
+
+	require.NoError(t, cc.write(cache))
+
+	stored, err := cc.read()
+	require.NoError(t, err)
+	require.NotNil(t, stored)
+	assert.Equal(t, cache.DefaultPrincipal, stored.DefaultPrincipal)
+	// Not all cache types preserve the order of credentials
+	assert.ElementsMatch(t, cache.Credentials, stored.Credentials)
+
+	stamp, err = cc.stamp()
+	require.NoError(t, err)
+	assert.NotEmpty(t, stamp)
+
+	// Rewriting with fewer credentials changes the stamp
+	cache.Credentials = cache.Credentials[:1]
+	require.NoError(t, cc.write(cache))
+
+	stored, err = cc.read()
+	require.NoError(t, err)
+	assert.Len(t, stored.Credentials, 1)
+
+	newStamp, err := cc.stamp()
+	require.NoError(t, err)
+	assert.NotEqual(t, stamp, newStamp)
+}
+
+//nolint:paralleltest
+func TestDirCCache(t *testing.T) {
+	cache := testCCache(t)
+	dir := filepath.Join(t.TempDir(), "krb5cc")
+
+	cc, err := defaultSources().resolveCCache("DIR:"+dir, nil)
+	require.NoError(t, err)
+
+	testCCacheType(t, cc, cache)
+
+	b, err := os.ReadFile(filepath.Join(dir, dirPrimary))
+	require.NoError(t, err)
+	assert.Equal(t, "tkt\n", string(b))
+
+	// Switching the primary to another cache
+	other, err := defaultSources().resolveCCache("DIR::"+filepath.Join(dir, "tktother"), nil)
+	require.NoError(t, err)
+	require.NoError(t, other.write(cache))
+
+	stamp, err := cc.stamp()
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, dirPrimary), []byte("tktother\n"), 0o600))
+
+	newStamp, err := cc.stamp()
+	require.NoError(t, err)
+	assert.NotEqual(t, stamp, newStamp)
+}
+
+//nolint:paralleltest
+func TestMemoryCCache(t *testing.T) {
+	cc, err := defaultSources().resolveCCache("MEMORY:"+t.Name(), nil)
+	require.NoError(t, err)
+
+	testCCacheType(t, cc, testCCache(t))
+}
+
+//nolint:paralleltest
+func TestInitiatorCCacheTypes(t *testing.T) {
+	for _, name := range []string{"DIR:", "MEMORY:"} {
+		t.Run(name, func(t *testing.T) {
+			cache := testCCache(t)
+
+			switch name {
+			case "DIR:":
+				name += filepath.Join(t.TempDir(), "krb5cc")
+			case "MEMORY:":
+				name += t.Name()
+			}
+
+			cc, err := defaultSources().resolveCCache(name, nil)
+			require.NoError(t, err)
+			require.NoError(t, cc.write(cache))
+
+			t.Setenv(krb5CCName, name)
+
+			initiator, _ := establish(t, 0, nil, nil)
+			assert.Equal(t, name, initiator.ccache.name())
+			assert.False(t, initiator.ccacheModified())
+		})
+	}
+}
@@ -0,0 +1,463 @@
+package gssapi
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	stdasn1 "encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+)
+
+// These are the subset of RFC 5652 Cryptographic Message Syntax types needed
+// to sign and verify the PKINIT messages.
+
+//nolint:gochecknoglobals
+var (
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA1WithRSA     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA384WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSHA512WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidECDSAWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+)
+
+var (
+	errCMSContentType     = errors.New("unexpected CMS content type")
+	errCMSNoSigner        = errors.New("CMS message is not signed")
+	errCMSNoCertificate   = errors.New("CMS signer certificate not found")
+	errCMSDigest          = errors.New("CMS message digest does not match")
+	errCMSUnsupportedAlgo = errors.New("unsupported CMS signature algorithm")
+	errCMSUnsupportedKey  = errors.New("unsupported signer key type")
+)
+
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+// algorithmIdentifierSET is encoded as a SET OF because of the type name
+// suffix, the "set" parameter would otherwise also be applied to each element.
+type algorithmIdentifierSET []algorithmIdentifier
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type encapsulatedContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms algorithmIdentifierSET
+	EncapContentInfo encapsulatedContentInfo
+	Certificates     []asn1.RawValue `asn1:"optional,tag:0"`
+	// SignerInfos are left encoded as the optional signed attributes in
+	// each one can't be unmarshalled directly into a RawValue
+	SignerInfos []asn1.RawValue `asn1:"set"`
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+// attribute holds the SET OF values as a single value as the decoder can only
+// unmarshal a slice of RawValue if every element is a SEQUENCE.
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+type signerInfo struct {
+	Version            int
+	SID                issuerAndSerialNumber
+	DigestAlgorithm    algorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm algorithmIdentifier
+	Signature          []byte
+}
+
+// parseSignerInfo unmarshals a SignerInfo one element at a time so that the
+// optional signed attributes are handled.
+func parseSignerInfo(b []byte) (signerInfo, error) {
+	var (
+		si  signerInfo
+		seq asn1.RawValue
+	)
+
+	if _, err := asn1.Unmarshal(b, &seq); err != nil {
+		return si, err
+	}
+
+	rest, err := asn1.Unmarshal(seq.Bytes, &si.Version)
+	if err != nil {
+		return si, err
+	}
+
+	if rest, err = asn1.Unmarshal(rest, &si.SID); err != nil {
+		return si, err
+	}
+
+	if rest, err = asn1.Unmarshal(rest, &si.DigestAlgorithm); err != nil {
+		return si, err
+	}
+
+	var raw asn1.RawValue
+	if _, err = asn1.Unmarshal(rest, &raw); err != nil {
+		return si, err
+	}
+
+	if raw.Class == asn1.ClassContextSpecific && raw.Tag == 0 {
+		if rest, err = asn1.Unmarshal(rest, &si.SignedAttrs); err != nil {
+			return si, err
+		}
+	}
+
+	if rest, err = asn1.Unmarshal(rest, &si.SignatureAlgorithm); err != nil {
+		return si, err
+	}
+
+	_, err = asn1.Unmarshal(rest, &si.Signature)
+
+	return si, err
+}
+
+// cmsDigests maps digest algorithms to hash functions.
+//
+//nolint:gochecknoglobals
+var cmsDigests = map[string]crypto.Hash{
+	oidSHA1.String():   crypto.SHA1,
+	oidSHA256.String(): crypto.SHA256,
+	oidSHA384.String(): crypto.SHA384,
+	oidSHA512.String(): crypto.SHA512,
+}
+
+// cmsSignatures maps signature algorithms to the x509 equivalent.
+//
+//nolint:gochecknoglobals
+var cmsSignatures = map[string]x509.SignatureAlgorithm{
+	oidSHA1WithRSA.String():     x509.SHA1WithRSA,
+	oidSHA256WithRSA.String():   x509.SHA256WithRSA,
+	oidSHA384WithRSA.String():   x509.SHA384WithRSA,
+	oidSHA512WithRSA.String():   x509.SHA512WithRSA,
+	oidECDSAWithSHA1.String():   x509.ECDSAWithSHA1,
+	oidECDSAWithSHA256.String(): x509.ECDSAWithSHA256,
+	oidECDSAWithSHA384.String(): x509.ECDSAWithSHA384,
+	oidECDSAWithSHA512.String(): x509.ECDSAWithSHA512,
+}
+
+// signatureAlgorithm returns the x509 signature algorithm for a signer, where
+// some implementations use rsaEncryption along with the digest algorithm.
+func (si *signerInfo) signatureAlgorithm() (x509.SignatureAlgorithm, error) {
+	if alg, ok := cmsSignatures[si.SignatureAlgorithm.Algorithm.String()]; ok {
+		return alg, nil
+	}
+
+	if si.SignatureAlgorithm.Algorithm.Equal(oidRSAEncryption) {
+		switch cmsDigests[si.DigestAlgorithm.Algorithm.String()] { //nolint:exhaustive
+		case crypto.SHA1:
+			return x509.SHA1WithRSA, nil
+		case crypto.SHA256:
+			return x509.SHA256WithRSA, nil
+		case crypto.SHA384:
+			return x509.SHA384WithRSA, nil
+		case crypto.SHA512:
+			return x509.SHA512WithRSA, nil
+		}
+	}
+
+	return x509.UnknownSignatureAlgorithm, errCMSUnsupportedAlgo
+}
+
+func marshalContentInfo(contentType asn1.ObjectIdentifier, v any) ([]byte, error) {
+	b, err := asn1.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(contentInfo{
+		ContentType: contentType,
+		Content:     explicitRawValue(0, b),
+	})
+}
+
+// signAttributes creates the signed attributes and returns them along with
+// the encoding that is signed, which uses a SET tag rather than [0].
+func signAttributes(contentType asn1.ObjectIdentifier, digest []byte) (asn1.RawValue, []byte, error) {
+	ct, err := asn1.Marshal(contentType)
+	if err != nil {
+		return asn1.RawValue{}, nil, err
+	}
+
+	md, err := asn1.Marshal(digest)
+	if err != nil {
+		return asn1.RawValue{}, nil, err
+	}
+
+	var encoded [][]byte
+
+	for _, attr := range []attribute{
+		{Type: oidContentType, Values: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: ct}},
+		{Type: oidMessageDigest, Values: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: md}},
+	} {
+		b, err := asn1.Marshal(attr)
+		if err != nil {
+			return asn1.RawValue{}, nil, err
+		}
+
+		encoded = append(encoded, b)
+	}
+
+	// DER requires the elements of a SET OF to be sorted
+	slices.SortFunc(encoded, bytes.Compare)
+
+	content := bytes.Join(encoded, nil)
+
+	b, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: content})
+	if err != nil {
+		return asn1.RawValue{}, nil, err
+	}
+
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: content}, b, nil
+}
+
+func signingAlgorithm(pub crypto.PublicKey) (asn1.ObjectIdentifier, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return oidSHA256WithRSA, nil
+	case *ecdsa.PublicKey:
+		return oidECDSAWithSHA256, nil
+	}
+
+	return nil, errCMSUnsupportedKey
+}
+
+// signData wraps content in a SignedData ContentInfo signed by signer with
+// certificate cert, including any intermediate certificates in chain. If
+// signer is nil the SignedData has no signers, as used by anonymous PKINIT.
+func signData(contentType asn1.ObjectIdentifier, content []byte, cert *x509.Certificate,
+	chain []*x509.Certificate, signer crypto.Signer,
+) ([]byte, error) {
+	sd := signedData{
+		Version:          3,
+		DigestAlgorithms: algorithmIdentifierSET{},
+		EncapContentInfo: encapsulatedContentInfo{EContentType: contentType, EContent: content},
+		SignerInfos:      []asn1.RawValue{},
+	}
+
+	if signer == nil {
+		return marshalContentInfo(oidSignedData, sd)
+	}
+
+	sigAlg, err := signingAlgorithm(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	digest := crypto.SHA256.New()
+	digest.Write(content)
+
+	signedAttrs, b, err := signAttributes(contentType, digest.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	digest.Reset()
+	digest.Write(b)
+
+	sig, err := signer.Sign(rand.Reader, digest.Sum(nil), crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	digestAlg := algorithmIdentifier{Algorithm: oidSHA256}
+
+	if b, err = asn1.Marshal(signerInfo{
+		Version: 1,
+		SID: issuerAndSerialNumber{
+			Issuer:       asn1.RawValue{FullBytes: cert.RawIssuer},
+			SerialNumber: cert.SerialNumber,
+		},
+		DigestAlgorithm:    digestAlg,
+		SignedAttrs:        signedAttrs,
+		SignatureAlgorithm: algorithmIdentifier{Algorithm: sigAlg},
+		Signature:          sig,
+	}); err != nil {
+		return nil, err
+	}
+
+	sd.DigestAlgorithms = append(sd.DigestAlgorithms, digestAlg)
+	sd.SignerInfos = append(sd.SignerInfos, asn1.RawValue{FullBytes: b})
+
+	for _, c := range append([]*x509.Certificate{cert}, chain...) {
+		sd.Certificates = append(sd.Certificates, asn1.RawValue{FullBytes: c.Raw})
+	}
+
+	return marshalContentInfo(oidSignedData, sd)
+}
+
+// parsedSignedData is a SignedData message of which the signature has been
+// checked but not the signer certificate.
+type parsedSignedData struct {
+	content      []byte
+	signer       *x509.Certificate
+	certificates []*x509.Certificate
+}
+
+// parseSignedData parses a SignedData ContentInfo with the expected content
+// type. If it is signed then the first signature is checked against the
+// included certificate.
+//
+//nolint:cyclop,funlen
+func parseSignedData(b []byte, contentType asn1.ObjectIdentifier) (*parsedSignedData, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(b, &ci); err != nil {
+		return nil, err
+	}
+
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, errCMSContentType
+	}
+
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, err
+	}
+
+	if !sd.EncapContentInfo.EContentType.Equal(contentType) {
+		return nil, fmt.Errorf("%w: %s", errCMSContentType, sd.EncapContentInfo.EContentType)
+	}
+
+	parsed := &parsedSignedData{content: sd.EncapContentInfo.EContent}
+
+	for _, raw := range sd.Certificates {
+		cert, err := x509.ParseCertificate(raw.FullBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		parsed.certificates = append(parsed.certificates, cert)
+	}
+
+	if len(sd.SignerInfos) == 0 {
+		return parsed, nil
+	}
+
+	si, err := parseSignerInfo(sd.SignerInfos[0].FullBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if i := slices.IndexFunc(parsed.certificates, func(c *x509.Certificate) bool {
+		return bytes.Equal(c.RawIssuer, si.SID.Issuer.FullBytes) && c.SerialNumber.Cmp(si.SID.SerialNumber) == 0
+	}); i >= 0 {
+		parsed.signer = parsed.certificates[i]
+	} else {
+		return nil, errCMSNoCertificate
+	}
+
+	alg, err := si.signatureAlgorithm()
+	if err != nil {
+		return nil, err
+	}
+
+	signed := parsed.content
+
+	if len(si.SignedAttrs.Bytes) > 0 {
+		hash, ok := cmsDigests[si.DigestAlgorithm.Algorithm.String()]
+		if !ok {
+			return nil, errCMSUnsupportedAlgo
+		}
+
+		var attrs []attribute
+
+		for rest := si.SignedAttrs.Bytes; len(rest) > 0; {
+			var attr attribute
+			if rest, err = asn1.Unmarshal(rest, &attr); err != nil {
+				return nil, err
+			}
+
+			attrs = append(attrs, attr)
+		}
+
+		h := hash.New()
+		h.Write(parsed.content)
+
+		if !slices.ContainsFunc(attrs, func(a attribute) bool {
+			var digest []byte
+
+			if !a.Type.Equal(oidMessageDigest) || a.Values.Tag != asn1.TagSet {
+				return false
+			}
+
+			rest, err := asn1.Unmarshal(a.Values.Bytes, &digest)
+
+			return err == nil && len(rest) == 0 && bytes.Equal(digest, h.Sum(nil))
+		}) {
+			return nil, errCMSDigest
+		}
+
+		// The signature covers the attributes encoded with a SET tag
+		signed = slices.Clone(si.SignedAttrs.FullBytes)
+		signed[0] = 0x31
+	}
+
+	if err = parsed.signer.CheckSignature(alg, signed, si.Signature); err != nil {
+		return nil, err
+	}
+
+	return parsed, nil
+}
+
+// verify checks the signer certificate chains to one of roots, using any
+// other certificates in the message as intermediates, and has the extended
+// key usage eku.
+func (p *parsedSignedData) verify(roots *x509.CertPool, eku asn1.ObjectIdentifier) error {
+	if p.signer == nil {
+		return errCMSNoSigner
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range p.certificates {
+		intermediates.AddCert(cert)
+	}
+
+	if _, err := p.signer.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return err
+	}
+
+	if !slices.ContainsFunc(p.signer.UnknownExtKeyUsage, func(oid stdasn1.ObjectIdentifier) bool {
+		return slices.Equal(oid, stdasn1.ObjectIdentifier(eku))
+	}) {
+		return fmt.Errorf("certificate %q lacks extended key usage %s", p.signer.Subject, eku)
+	}
+
+	return nil
+}
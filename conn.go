@@ -0,0 +1,341 @@
+package gssapi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+)
+
+// Protection is the protection applied to data sent over a Conn.
+type Protection int
+
+const (
+	// ProtectionConfidentiality sends each message as an encrypted wrap
+	// token.
+	ProtectionConfidentiality Protection = iota
+	// ProtectionIntegrity sends each message as a wrap token without
+	// encryption.
+	ProtectionIntegrity
+	// ProtectionMIC sends each message in the clear followed by a separate
+	// MIC token.
+	ProtectionMIC
+)
+
+const (
+	defaultMaxSendSize    = 64 * 1024
+	defaultMaxReceiveSize = 0xffffff
+)
+
+var (
+	errTokenTooLong        = errors.New("token is too long")
+	errBadProtection       = errors.New("unknown protection")
+	errConfUnavailable     = errors.New("context does not provide confidentiality")
+	errNotConfidential     = errors.New("received token is not encrypted")
+	errMaxSendSize         = errors.New("maximum send size is too small")
+	errHalfCloseNotAllowed = errors.New("connection does not support half-close")
+)
+
+// Framing reads and writes tokens on a byte stream. Implementations must not
+// read beyond the end of the token.
+type Framing interface {
+	// ReadToken reads a token, returning an error if it is longer than
+	// maxLength.
+	ReadToken(r io.Reader, maxLength int) ([]byte, error)
+	// WriteToken writes a token.
+	WriteToken(w io.Writer, token []byte) error
+}
+
+// LengthPrefixFraming frames each token with a 4-byte big-endian length, as
+// used by the SASL GSSAPI mechanism.
+type LengthPrefixFraming struct{}
+
+// ReadToken reads a length-prefixed token.
+func (LengthPrefixFraming) ReadToken(r io.Reader, maxLength int) ([]byte, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(b[:])
+	if uint64(n) > uint64(maxLength) { //nolint:gosec
+		return nil, errTokenTooLong
+	}
+
+	token := make([]byte, n)
+	if _, err := io.ReadFull(r, token); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// WriteToken writes a length-prefixed token.
+func (LengthPrefixFraming) WriteToken(w io.Writer, token []byte) error {
+	if uint64(len(token)) > math.MaxUint32 {
+		return errTokenTooLong
+	}
+
+	b := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(token)), uint32(len(token))) //nolint:gosec
+	_, err := w.Write(append(b, token...))
+
+	return err
+}
+
+// Conn is a net.Conn that protects the data sent over an underlying net.Conn
+// with per-message tokens from an established context. Deadlines and
+// half-close are passed through to the underlying net.Conn.
+type Conn struct {
+	net.Conn
+
+	ctx            *context
+	framing        Framing
+	protection     Protection
+	maxSendSize    int
+	maxReceiveSize int
+
+	rmu sync.Mutex
+	// pending holds bytes read from the underlying net.Conn while
+	// reading a token that was interrupted, such as by a deadline
+	pending []byte
+	buf     []byte
+
+	wmu       sync.Mutex
+	chunkSize int
+}
+
+func contextOf(a any) *context {
+	switch x := a.(type) {
+	case *Initiator:
+		return &x.context
+	case *Acceptor:
+		return &x.context
+	}
+
+	return nil
+}
+
+// NewConn returns a Conn that protects the data sent over conn with the
+// established context, either an Initiator or an Acceptor. By default
+// messages are sent as encrypted wrap tokens of at most 64 KiB, framed with
+// LengthPrefixFraming.
+func NewConn[T Initiator | Acceptor](ctx *T, conn net.Conn, options ...Option[Conn]) (*Conn, error) {
+	return newConn(contextOf(ctx), conn, options...)
+}
+
+func newConn(ctx *context, conn net.Conn, options ...Option[Conn]) (*Conn, error) {
+	if !ctx.Established() {
+		return nil, errNotEstablished
+	}
+
+	c := &Conn{
+		Conn:           conn,
+		ctx:            ctx,
+		framing:        LengthPrefixFraming{},
+		maxSendSize:    defaultMaxSendSize,
+		maxReceiveSize: defaultMaxReceiveSize,
+	}
+
+	for _, option := range options {
+		if err := option(c); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+
+	switch c.protection {
+	case ProtectionConfidentiality:
+		if ctx.flags&gssapi.ContextFlagConf == 0 {
+			return nil, errConfUnavailable
+		}
+
+		fallthrough
+	case ProtectionIntegrity:
+		c.chunkSize, err = ctx.WrapSizeLimit(c.protection == ProtectionConfidentiality, c.maxSendSize)
+		if err != nil {
+			return nil, err
+		}
+	case ProtectionMIC:
+		c.chunkSize = c.maxSendSize
+	default:
+		return nil, errBadProtection
+	}
+
+	if c.chunkSize <= 0 {
+		return nil, errMaxSendSize
+	}
+
+	return c, nil
+}
+
+// readToken reads a token from the underlying net.Conn. If reading the token
+// fails, any bytes read are kept so that reading can resume, for example
+// after a deadline is extended.
+func (c *Conn) readToken() ([]byte, error) {
+	var (
+		pending = bytes.NewReader(c.pending)
+		read    bytes.Buffer
+	)
+
+	token, err := c.framing.ReadToken(io.MultiReader(pending, io.TeeReader(c.Conn, &read)), c.maxReceiveSize)
+	if err != nil {
+		if !errors.Is(err, errTokenTooLong) {
+			c.pending = append(c.pending, read.Bytes()...)
+		}
+
+		return nil, err
+	}
+
+	c.pending = c.pending[len(c.pending)-pending.Len():]
+
+	return token, nil
+}
+
+func (c *Conn) readMessage() ([]byte, error) {
+	token, err := c.readToken()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.protection == ProtectionMIC {
+		mic, err := c.readToken()
+		if err != nil {
+			// Read the message again along with its MIC
+			c.pending = append(c.framedToken(token), c.pending...)
+
+			return nil, err
+		}
+
+		if err = c.ctx.VerifySignature(token, mic); err != nil {
+			return nil, err
+		}
+
+		return token, nil
+	}
+
+	message, conf, err := c.ctx.Unwrap(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.protection == ProtectionConfidentiality && !conf {
+		return nil, errNotConfidential
+	}
+
+	return message, nil
+}
+
+func (c *Conn) framedToken(token []byte) []byte {
+	var b bytes.Buffer
+
+	_ = c.framing.WriteToken(&b, token)
+
+	return b.Bytes()
+}
+
+// Read reads data from the connection, reading and unprotecting a new
+// message as required.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.buf) == 0 {
+		message, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+
+		c.buf = message
+	}
+
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+
+	return n, nil
+}
+
+// Write writes data to the connection, split into as many messages as
+// required to keep each token within the maximum send size.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var n int
+
+	for len(b) > 0 {
+		chunk := b[:min(len(b), c.chunkSize)]
+
+		if err := c.writeMessage(chunk); err != nil {
+			return n, err
+		}
+
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+
+	return n, nil
+}
+
+func (c *Conn) writeMessage(message []byte) error {
+	if c.protection == ProtectionMIC {
+		mic, err := c.ctx.MakeSignature(message)
+		if err != nil {
+			return err
+		}
+
+		var b bytes.Buffer
+
+		for _, token := range [][]byte{message, mic} {
+			if err = c.framing.WriteToken(&b, token); err != nil {
+				return err
+			}
+		}
+
+		_, err = c.Conn.Write(b.Bytes())
+
+		return err
+	}
+
+	token, err := c.ctx.Wrap(message, c.protection == ProtectionConfidentiality)
+	if err != nil {
+		return err
+	}
+
+	return c.framing.WriteToken(c.Conn, token)
+}
+
+// CloseRead shuts down the reading side of the underlying net.Conn, if it
+// supports it.
+func (c *Conn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+
+	return fmt.Errorf("%w: %T", errHalfCloseNotAllowed, c.Conn)
+}
+
+// CloseWrite shuts down the writing side of the underlying net.Conn, if it
+// supports it.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return fmt.Errorf("%w: %T", errHalfCloseNotAllowed, c.Conn)
+}
+
+// MaxMessageSize returns the largest message that is sent in a single token.
+func (c *Conn) MaxMessageSize() int {
+	return c.chunkSize
+}
@@ -0,0 +1,202 @@
+package gssapi
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testConnFlags = gssapi.ContextFlagConf | gssapi.ContextFlagInteg | gssapi.ContextFlagReplay |
+	gssapi.ContextFlagSequence
+
+func newConnPair(t *testing.T, initiator, acceptor *context, options ...Option[Conn]) (*Conn, *Conn) {
+	t.Helper()
+
+	client, server := net.Pipe()
+
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	c, err := newConn(initiator, client, options...)
+	require.NoError(t, err)
+
+	s, err := newConn(acceptor, server, options...)
+	require.NoError(t, err)
+
+	return c, s
+}
+
+func TestConn(t *testing.T) {
+	t.Parallel()
+
+	message := make([]byte, 200*1024)
+	_, err := rand.Read(message)
+	require.NoError(t, err)
+
+	tables := []struct {
+		name       string
+		protection Protection
+		maxMessage int
+	}{
+		{"confidentiality", ProtectionConfidentiality, 1024 - 60},
+		{"integrity", ProtectionIntegrity, 1024 - 28},
+		{"mic", ProtectionMIC, 1024},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			initiator, acceptor := newContextPair(t, etypeID.AES128_CTS_HMAC_SHA1_96, testConnFlags)
+
+			c, s := newConnPair(t, initiator, acceptor, WithProtection[Conn](table.protection),
+				WithMaxSendSize[Conn](1024))
+			assert.Equal(t, table.maxMessage, c.MaxMessageSize())
+
+			go func() {
+				n, err := c.Write(message)
+				assert.NoError(t, err)
+				assert.Equal(t, len(message), n)
+				assert.NoError(t, c.Close())
+			}()
+
+			b, err := io.ReadAll(s)
+			require.NoError(t, err)
+			assert.Equal(t, message, b)
+		})
+	}
+}
+
+func TestConnDeadline(t *testing.T) {
+	t.Parallel()
+
+	initiator, acceptor := newContextPair(t, etypeID.AES256_CTS_HMAC_SHA1_96, testConnFlags)
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	s, err := newConn(acceptor, server)
+	require.NoError(t, err)
+
+	defer s.Close()
+
+	token, err := initiator.Wrap([]byte("message"), true)
+	require.NoError(t, err)
+
+	var b bytes.Buffer
+	require.NoError(t, LengthPrefixFraming{}.WriteToken(&b, token))
+
+	frame := b.Bytes()
+
+	go func() {
+		_, _ = client.Write(frame[:10])
+	}()
+
+	require.NoError(t, s.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+
+	buf := make([]byte, 64)
+
+	_, err = s.Read(buf)
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	go func() {
+		_, _ = client.Write(frame[10:])
+	}()
+
+	require.NoError(t, s.SetReadDeadline(time.Time{}))
+
+	n, err := s.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("message"), buf[:n])
+}
+
+func TestConnHalfClose(t *testing.T) {
+	t.Parallel()
+
+	initiator, acceptor := newContextPair(t, etypeID.AES256_CTS_HMAC_SHA1_96, testConnFlags)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		s, err := newConn(acceptor, conn)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		defer s.Close()
+
+		b, err := io.ReadAll(s)
+		assert.NoError(t, err)
+
+		_, err = s.Write(append(b, " received"...))
+		assert.NoError(t, err)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+
+	c, err := newConn(initiator, conn)
+	require.NoError(t, err)
+
+	defer c.Close()
+
+	_, err = c.Write([]byte("request"))
+	require.NoError(t, err)
+	require.NoError(t, c.CloseWrite())
+
+	b, err := io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("request received"), b)
+
+	pipe, _ := net.Pipe()
+
+	c, err = newConn(initiator, pipe)
+	require.NoError(t, err)
+	assert.ErrorIs(t, c.CloseWrite(), errHalfCloseNotAllowed)
+}
+
+func TestNewConn(t *testing.T) {
+	t.Parallel()
+
+	initiator, acceptor := newContextPair(t, etypeID.AES256_CTS_HMAC_SHA1_96, gssapi.ContextFlagInteg)
+
+	pipe, _ := net.Pipe()
+
+	_, err := newConn(initiator, pipe)
+	assert.ErrorIs(t, err, errConfUnavailable)
+
+	_, err = newConn(initiator, pipe, WithProtection[Conn](ProtectionIntegrity), WithMaxSendSize[Conn](16))
+	assert.ErrorIs(t, err, errMaxSendSize)
+
+	_, err = newConn(initiator, pipe, WithProtection[Conn](Protection(3)))
+	assert.ErrorIs(t, err, errBadProtection)
+
+	c, s := newConnPair(t, initiator, acceptor, WithProtection[Conn](ProtectionIntegrity),
+		WithMaxReceiveSize[Conn](16))
+
+	go func() {
+		_, _ = c.Write([]byte("message"))
+	}()
+
+	_, err = s.Read(make([]byte, 64))
+	assert.ErrorIs(t, err, errTokenTooLong)
+}
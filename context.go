@@ -15,6 +15,7 @@ var (
 	errOldToken       = errors.New("timed-out per-message token detected")
 	errUnseqToken     = errors.New("reordered (early) per-message token detected")
 	errGapToken       = errors.New("skipped predecessor token(s) detected")
+	errNotEstablished = errors.New("context is not established")
 )
 
 type context struct {
@@ -29,7 +30,13 @@ type context struct {
 	cusec      int
 	expiry     time.Time
 
-	peerName string
+	requestedFlags int
+	authTime       time.Time
+	startTime      time.Time
+	renewTill      time.Time
+
+	localPrincipal *Name
+	peerName       *Name
 
 	sequenceNumber uint64
 
@@ -38,6 +45,9 @@ type context struct {
 	receiveMask        uint64
 	sequenceMask       uint64
 
+	establishRounds    int
+	establishTokenSize int
+
 	logger logr.Logger
 }
 
@@ -49,6 +59,74 @@ func (ctx *context) hasPeerSubkey() bool {
 	return ctx.peerSubkey.KeyType != 0
 }
 
+// initiatorSubkey returns the subkey from the Initiator's authenticator, if
+// any.
+func (ctx *context) initiatorSubkey() types.EncryptionKey {
+	if ctx.acceptor {
+		return ctx.peerSubkey
+	}
+
+	return ctx.subkey
+}
+
+// acceptorSubkey returns the subkey from the Acceptor's AP-REP, if any.
+func (ctx *context) acceptorSubkey() types.EncryptionKey {
+	if ctx.acceptor {
+		return ctx.subkey
+	}
+
+	return ctx.peerSubkey
+}
+
+// contextKey returns the subkey asserted by the Acceptor, otherwise the one
+// asserted by the Initiator, otherwise the session key.
+func (ctx *context) contextKey() types.EncryptionKey {
+	if key := ctx.acceptorSubkey(); key.KeyType != 0 {
+		return key
+	}
+
+	if key := ctx.initiatorSubkey(); key.KeyType != 0 {
+		return key
+	}
+
+	return ctx.key
+}
+
+// setTicketTimes records the times from the ticket used to establish the
+// context.
+func (ctx *context) setTicketTimes(authTime, startTime, endTime, renewTill time.Time) {
+	ctx.authTime = authTime
+	ctx.startTime = startTime
+	ctx.expiry = endTime
+	ctx.renewTill = renewTill
+}
+
+// logEncType logs the encryption type of the key used for per-message
+// tokens.
+func (ctx *context) logEncType() {
+	ctx.logger.Info("negotiated encryption type", "enctype", encTypeName(ctx.contextKey().KeyType))
+}
+
+// maxRounds returns the number of tokens that EstablishInitiator or
+// EstablishAcceptor will read.
+func (ctx *context) maxRounds() int {
+	if ctx.establishRounds > 0 {
+		return ctx.establishRounds
+	}
+
+	return defaultMaxRounds
+}
+
+// maxTokenSize returns the largest token that EstablishInitiator or
+// EstablishAcceptor will read.
+func (ctx *context) maxTokenSize() int {
+	if ctx.establishTokenSize > 0 {
+		return ctx.establishTokenSize
+	}
+
+	return defaultMaxTokenSize
+}
+
 func (ctx *context) doMutual() bool {
 	return ctx.flags&gssapi.ContextFlagMutual != 0
 }
@@ -106,10 +184,16 @@ func (ctx *context) checkSequenceNumber(sequenceNumber uint64) error {
 }
 
 // PeerName returns the peer Kerberos principal.
-func (ctx *context) PeerName() string {
+func (ctx *context) PeerName() *Name {
 	return ctx.peerName
 }
 
+// IsAnonymous returns whether the context is anonymous as per RFC 6112, in
+// which case the Initiator is not identified to the Acceptor.
+func (ctx *context) IsAnonymous() bool {
+	return ctx.flags&gssapi.ContextFlagAnon != 0
+}
+
 // Established returns the context state.
 func (ctx *context) Established() bool {
 	return ctx.established
@@ -120,16 +204,13 @@ func (ctx *context) Expiry() time.Time {
 	return ctx.expiry
 }
 
-// MakeSignature creates a MIC token against the provided input.
-func (ctx *context) MakeSignature(message []byte) ([]byte, error) {
-	var (
-		flags byte
-		usage uint32 = keyusage.GSSAPI_INITIATOR_SIGN
-	)
+// sendKey returns the key protecting per-message tokens sent by this side of
+// the context along with the token flags that describe it.
+func (ctx *context) sendKey() (types.EncryptionKey, byte) {
+	var flags byte
 
 	if ctx.acceptor {
 		flags |= gssapi.MICTokenFlagSentByAcceptor
-		usage = keyusage.GSSAPI_ACCEPTOR_SIGN
 	}
 
 	key := ctx.key
@@ -144,6 +225,33 @@ func (ctx *context) MakeSignature(message []byte) ([]byte, error) {
 		flags |= gssapi.MICTokenFlagAcceptorSubkey
 	}
 
+	return key, flags
+}
+
+// receiveKey returns the key protecting per-message tokens sent by the peer.
+func (ctx *context) receiveKey() types.EncryptionKey {
+	if ctx.hasPeerSubkey() {
+		return ctx.peerSubkey
+	}
+
+	return ctx.key
+}
+
+// MakeSignature creates a MIC token against the provided input. RFC 4121
+// tokens are used unless the key is one of the DES, Triple DES or RC4
+// encryption types, in which case RFC 1964 or RFC 4757 tokens are used.
+func (ctx *context) MakeSignature(message []byte) ([]byte, error) {
+	var usage uint32 = keyusage.GSSAPI_INITIATOR_SIGN
+	if ctx.acceptor {
+		usage = keyusage.GSSAPI_ACCEPTOR_SIGN
+	}
+
+	key, flags := ctx.sendKey()
+
+	if c, ok := newLegacyCipher(key); ok {
+		return ctx.makeLegacySignature(c, message)
+	}
+
 	token := gssapi.MICToken{
 		Flags:     flags,
 		SndSeqNum: ctx.sequenceNumber,
@@ -166,6 +274,12 @@ func (ctx *context) MakeSignature(message []byte) ([]byte, error) {
 
 // VerifySignature verifies the MIC token against the provided input.
 func (ctx *context) VerifySignature(message, signature []byte) error {
+	key := ctx.receiveKey()
+
+	if c, ok := newLegacyCipher(key); ok {
+		return ctx.verifyLegacySignature(c, message, signature)
+	}
+
 	var (
 		token gssapi.MICToken
 		err   error
@@ -186,11 +300,6 @@ func (ctx *context) VerifySignature(message, signature []byte) error {
 		usage = keyusage.GSSAPI_INITIATOR_SIGN
 	}
 
-	key := ctx.key
-	if ctx.hasPeerSubkey() {
-		key = ctx.peerSubkey
-	}
-
 	if _, err = token.Verify(key, usage); err != nil {
 		return err
 	}
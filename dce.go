@@ -0,0 +1,107 @@
+package gssapi
+
+import (
+	"errors"
+
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/krberror"
+	"github.com/jcmturner/gokrb5/v8/messages"
+)
+
+// ContextFlagDCEStyle is the GSS_C_DCE_STYLE flag used by MS-RPC and DCOM.
+// The Acceptor's AP-REP is answered by a third AP-REP from the Initiator and
+// the context tokens are exchanged without the usual GSS-API framing. It
+// implies gssapi.ContextFlagMutual.
+//
+// MS-RPC header signing is done by passing the RPC header and trailer as
+// IOVBufferTypeSignOnly buffers to WrapIOV and UnwrapIOV, which protect them
+// alongside the data without encrypting them. This is only supported with
+// the RFC 4121 encryption types; header signing with RFC 1964 or RFC 4757
+// tokens is not implemented.
+const ContextFlagDCEStyle = 0x1000
+
+var errDCEStyle = errors.New("DCE style context token expected")
+
+func (ctx *context) doDCEStyle() bool {
+	return ctx.flags&ContextFlagDCEStyle != 0
+}
+
+// isRawToken reports whether the context token is an unframed Kerberos
+// message with the given application tag, as used with DCE style.
+func isRawToken(b []byte, tag int) bool {
+	return len(b) > 0 && b[0] == byte(0x60|tag)
+}
+
+// unmarshalRawAPRep parses an unframed AP-REP, or returns the KRB-ERROR sent
+// instead of one.
+func unmarshalRawAPRep(b []byte) (messages.APRep, error) {
+	var aprep messages.APRep
+
+	switch {
+	case isRawToken(b, asnAppTag.APREP):
+		if err := aprep.Unmarshal(b); err != nil {
+			return aprep, err
+		}
+	case isRawToken(b, asnAppTag.KRBError):
+		var krbError messages.KRBError
+		if err := krbError.Unmarshal(b); err != nil {
+			return aprep, err
+		}
+
+		return aprep, krbError
+	default:
+		return aprep, errDCEStyle
+	}
+
+	return aprep, nil
+}
+
+// dceAPRep returns the final AP-REP sent by the Initiator, which echoes the
+// sequence number from the AP-REP of the Acceptor.
+func (ctx *Initiator) dceAPRep(sequenceNumber int64) ([]byte, error) {
+	// There's no key version number as only the session key is used
+	aprep, err := newAPRep(messages.Ticket{}, ctx.key, encAPRepPart{
+		CTime:          ctx.ctime.UTC(),
+		Cusec:          ctx.cusec,
+		SequenceNumber: sequenceNumber,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return aprep.marshal()
+}
+
+// acceptDCE handles the final AP-REP from the Initiator, which must echo the
+// sequence number sent in the AP-REP of the Acceptor and carry no subkey.
+// Implementations differ in the timestamp they use so, as with MIT Kerberos,
+// that isn't checked.
+func (ctx *Acceptor) acceptDCE(input []byte) ([]byte, bool, error) {
+	aprep, err := unmarshalRawAPRep(input)
+	if err != nil {
+		return nil, false, err
+	}
+
+	b, err := crypto.DecryptEncPart(aprep.EncPart, ctx.key, keyusage.AP_REP_ENCPART)
+	if err != nil {
+		return nil, false, krberror.Errorf(err, krberror.DecryptingError, "error decrypting AP-REP enc-part")
+	}
+
+	var payload messages.EncAPRepPart
+	if err = payload.Unmarshal(b); err != nil {
+		return nil, false, krberror.Errorf(err, krberror.EncodingError, "error unmarshalling decrypted AP-REP enc-part")
+	}
+
+	if uint64(payload.SequenceNumber) != ctx.sequenceNumber || payload.Subkey.KeyType != 0 { //nolint:gosec
+		return nil, false, messages.NewKRBError(ctx.localPrincipal.PrincipalName(), ctx.localPrincipal.Realm(),
+			errorcode.KRB_AP_ERR_MUT_FAIL, "DCE style AP-REP does not match")
+	}
+
+	ctx.established = true
+	ctx.logEncType()
+
+	return nil, false, nil
+}
@@ -0,0 +1,164 @@
+package gssapi
+
+import (
+	"testing"
+
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//nolint:funlen
+func TestDCEStyle(t *testing.T) {
+	newTestEnvironment(t, etypeID.AES256_CTS_HMAC_SHA1_96)
+
+	initiator, err := NewInitiator()
+	require.NoError(t, err)
+
+	defer initiator.Close()
+
+	acceptor, err := NewAcceptor()
+	require.NoError(t, err)
+
+	defer acceptor.Close()
+
+	output, cont, err := initiator.Initiate(testService, ContextFlagDCEStyle|gssapi.ContextFlagInteg, nil)
+	require.NoError(t, err)
+	assert.True(t, cont)
+	assert.True(t, isRawToken(output, asnAppTag.APREQ))
+
+	input, cont, err := acceptor.Accept(output)
+	require.NoError(t, err)
+	assert.True(t, cont)
+	assert.True(t, isRawToken(input, asnAppTag.APREP))
+	assert.False(t, acceptor.Established())
+
+	output, cont, err = initiator.Initiate(testService, 0, input)
+	require.NoError(t, err)
+	assert.False(t, cont)
+	assert.True(t, isRawToken(output, asnAppTag.APREP))
+	assert.True(t, initiator.Established())
+
+	input, cont, err = acceptor.Accept(output)
+	require.NoError(t, err)
+	assert.False(t, cont)
+	assert.Empty(t, input)
+	assert.True(t, acceptor.Established())
+
+	for _, ctx := range []*context{&initiator.context, &acceptor.context} {
+		assert.True(t, ctx.doDCEStyle())
+		assert.True(t, ctx.doMutual())
+	}
+
+	// Sequence numbers continue from the handshake in both directions
+	for range 2 {
+		signature, err := initiator.MakeSignature([]byte("request"))
+		require.NoError(t, err)
+		require.NoError(t, acceptor.VerifySignature([]byte("request"), signature))
+
+		signature, err = acceptor.MakeSignature([]byte("response"))
+		require.NoError(t, err)
+		require.NoError(t, initiator.VerifySignature([]byte("response"), signature))
+	}
+}
+
+func TestDCEStyleEstablish(t *testing.T) {
+	newTestEnvironment(t, etypeID.AES128_CTS_HMAC_SHA256_128)
+
+	initiator, acceptor := establish(t, ContextFlagDCEStyle, nil, nil)
+
+	assert.True(t, initiator.doDCEStyle())
+	assert.True(t, acceptor.doDCEStyle())
+}
+
+func TestDCEStyleHeaderSigning(t *testing.T) {
+	newTestEnvironment(t, etypeID.AES256_CTS_HMAC_SHA1_96)
+
+	initiator, acceptor := establish(t, ContextFlagDCEStyle|gssapi.ContextFlagConf, nil, nil)
+
+	// The RPC header and trailer are signed but not encrypted
+	buffers := []IOVBuffer{
+		{Type: IOVBufferTypeSignOnly, Data: []byte("rpc header")},
+		{Type: IOVBufferTypeData, Data: []byte("stub data")},
+		{Type: IOVBufferTypeSignOnly, Data: []byte("rpc trailer")},
+		{Type: IOVBufferTypeHeader},
+	}
+
+	require.NoError(t, initiator.WrapIOVLength(true, buffers))
+	require.NoError(t, initiator.WrapIOV(true, buffers))
+	assert.Equal(t, []byte("rpc header"), buffers[0].Data)
+	assert.NotEqual(t, []byte("stub data"), buffers[1].Data)
+
+	tampered := append([]IOVBuffer(nil), buffers...)
+	tampered[0] = IOVBuffer{Type: IOVBufferTypeSignOnly, Data: []byte("RPC header")}
+	tampered[1] = IOVBuffer{Type: IOVBufferTypeData, Data: append([]byte(nil), buffers[1].Data...)}
+
+	_, err := acceptor.UnwrapIOV(tampered)
+	require.Error(t, err)
+
+	conf, err := acceptor.UnwrapIOV(buffers)
+	require.NoError(t, err)
+	assert.True(t, conf)
+	assert.Equal(t, []byte("stub data"), buffers[1].Data)
+}
+
+func TestDCEStyleSequenceMismatch(t *testing.T) {
+	newTestEnvironment(t, etypeID.AES256_CTS_HMAC_SHA1_96)
+
+	initiator, err := NewInitiator()
+	require.NoError(t, err)
+
+	defer initiator.Close()
+
+	acceptor, err := NewAcceptor()
+	require.NoError(t, err)
+
+	defer acceptor.Close()
+
+	output, _, err := initiator.Initiate(testService, ContextFlagDCEStyle, nil)
+	require.NoError(t, err)
+
+	_, _, err = acceptor.Accept(output)
+	require.NoError(t, err)
+
+	// An AP-REP under the session key that doesn't echo the sequence number
+	output, err = initiator.dceAPRep(int64(acceptor.sequenceNumber) + 1) //nolint:gosec
+	require.NoError(t, err)
+
+	_, _, err = acceptor.Accept(output)
+
+	var krbError messages.KRBError
+	if assert.ErrorAs(t, err, &krbError) {
+		assert.Equal(t, errorcode.KRB_AP_ERR_MUT_FAIL, krbError.ErrorCode)
+	}
+
+	assert.False(t, acceptor.Established())
+}
+
+func TestDCEStyleBadToken(t *testing.T) {
+	newTestEnvironment(t, etypeID.AES256_CTS_HMAC_SHA1_96)
+
+	initiator, err := NewInitiator()
+	require.NoError(t, err)
+
+	defer initiator.Close()
+
+	acceptor, err := NewAcceptor()
+	require.NoError(t, err)
+
+	defer acceptor.Close()
+
+	output, _, err := initiator.Initiate(testService, ContextFlagDCEStyle, nil)
+	require.NoError(t, err)
+
+	_, _, err = acceptor.Accept(output)
+	require.NoError(t, err)
+
+	_, _, err = acceptor.Accept([]byte{0x30, 0x00})
+	assert.ErrorIs(t, err, errDCEStyle)
+	assert.False(t, acceptor.Established())
+}
@@ -0,0 +1,187 @@
+package gssapi
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+)
+
+const (
+	permittedEncTypesTag  = "permitted_enctypes"
+	defaultTGSEncTypesTag = "default_tgs_enctypes"
+	allowWeakCryptoTag    = "allow_weak_crypto"
+)
+
+// defaultEncTypes is the MIT Kerberos "DEFAULT" list of encryption types.
+//
+//nolint:gochecknoglobals
+var defaultEncTypes = []int32{
+	etypeID.AES256_CTS_HMAC_SHA1_96,
+	etypeID.AES128_CTS_HMAC_SHA1_96,
+	etypeID.AES256_CTS_HMAC_SHA384_192,
+	etypeID.AES128_CTS_HMAC_SHA256_128,
+	etypeID.DES3_CBC_SHA1_KD,
+	etypeID.RC4_HMAC,
+	etypeID.CAMELLIA256_CTS_CMAC,
+	etypeID.CAMELLIA128_CTS_CMAC,
+}
+
+// encTypeFamilies are the names that expand to several encryption types.
+//
+//nolint:gochecknoglobals
+var encTypeFamilies = map[string][]int32{
+	"des":      {etypeID.DES_CBC_CRC, etypeID.DES_CBC_MD5, etypeID.DES_CBC_MD4},
+	"des3":     {etypeID.DES3_CBC_SHA1_KD},
+	"rc4":      {etypeID.RC4_HMAC},
+	"aes":      {etypeID.AES256_CTS_HMAC_SHA1_96, etypeID.AES128_CTS_HMAC_SHA1_96, etypeID.AES256_CTS_HMAC_SHA384_192, etypeID.AES128_CTS_HMAC_SHA256_128}, //nolint:lll
+	"camellia": {etypeID.CAMELLIA256_CTS_CMAC, etypeID.CAMELLIA128_CTS_CMAC},
+}
+
+// encTypeNames are the canonical MIT Kerberos names of each encryption type.
+//
+//nolint:gochecknoglobals
+var encTypeNames = map[int32]string{
+	etypeID.DES_CBC_CRC:                "des-cbc-crc",
+	etypeID.DES_CBC_MD4:                "des-cbc-md4",
+	etypeID.DES_CBC_MD5:                "des-cbc-md5",
+	etypeID.DES_CBC_RAW:                "des-cbc-raw",
+	etypeID.DES3_CBC_RAW:               "des3-cbc-raw",
+	etypeID.DES_HMAC_SHA1:              "des-hmac-sha1",
+	etypeID.DES3_CBC_SHA1_KD:           "des3-cbc-sha1",
+	etypeID.AES128_CTS_HMAC_SHA1_96:    "aes128-cts-hmac-sha1-96",
+	etypeID.AES256_CTS_HMAC_SHA1_96:    "aes256-cts-hmac-sha1-96",
+	etypeID.AES128_CTS_HMAC_SHA256_128: "aes128-cts-hmac-sha256-128",
+	etypeID.AES256_CTS_HMAC_SHA384_192: "aes256-cts-hmac-sha384-192",
+	etypeID.RC4_HMAC:                   "arcfour-hmac",
+	etypeID.RC4_HMAC_EXP:               "arcfour-hmac-exp",
+	etypeID.CAMELLIA128_CTS_CMAC:       "camellia128-cts-cmac",
+	etypeID.CAMELLIA256_CTS_CMAC:       "camellia256-cts-cmac",
+}
+
+// weakEncTypes are removed from lists unless allow_weak_crypto is set.
+//
+//nolint:gochecknoglobals
+var weakEncTypes = []int32{
+	etypeID.DES_CBC_CRC,
+	etypeID.DES_CBC_MD4,
+	etypeID.DES_CBC_MD5,
+	etypeID.DES_CBC_RAW,
+	etypeID.DES3_CBC_RAW,
+	etypeID.DES_HMAC_SHA1,
+	etypeID.RC4_HMAC_EXP,
+}
+
+// EncTypeError is returned when the peer or KDC uses an encryption type that
+// isn't permitted by the permitted_enctypes, default_tgs_enctypes and
+// allow_weak_crypto settings, or the list passed with WithEncTypes.
+type EncTypeError struct {
+	// Usage describes where the encryption type was used, such as
+	// "ticket" or "authenticator subkey".
+	Usage string
+	// EncType is the encryption type, as per etypeID.
+	EncType int32
+}
+
+func (e *EncTypeError) Error() string {
+	return fmt.Sprintf("%s encryption type %s is not permitted", e.Usage, encTypeName(e.EncType))
+}
+
+// encTypeName returns the name of the encryption type for logging.
+func encTypeName(etype int32) string {
+	if name, ok := encTypeNames[etype]; ok {
+		return name
+	}
+
+	return strconv.Itoa(int(etype))
+}
+
+func lookupEncType(name string) []int32 {
+	if name == "DEFAULT" {
+		return defaultEncTypes
+	}
+
+	if family, ok := encTypeFamilies[name]; ok {
+		return family
+	}
+
+	switch name {
+	case "des3-cbc-sha1", "des3-hmac-sha1":
+		// gokrb5 maps these to the wrong assigned numbers
+		return []int32{etypeID.DES3_CBC_SHA1_KD}
+	}
+
+	if etype, ok := etypeID.ETypesByName[name]; ok {
+		return []int32{etype}
+	}
+
+	return nil
+}
+
+// parseEncTypes parses an MIT Kerberos list of encryption types separated by
+// whitespace or commas. Each entry is a name, an alias, a family such as
+// "aes" or "DEFAULT", and a leading '-' removes the entry from the list built
+// so far. Unknown names are ignored.
+func parseEncTypes(s string) []int32 {
+	var etypes []int32
+
+	for _, name := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	}) {
+		remove := strings.HasPrefix(name, "-")
+		name = strings.TrimLeft(name, "+-")
+
+		for _, etype := range lookupEncType(name) {
+			etypes = slices.DeleteFunc(etypes, func(e int32) bool { return e == etype })
+
+			if !remove {
+				etypes = append(etypes, etype)
+			}
+		}
+	}
+
+	return etypes
+}
+
+// parseBoolean parses a profile boolean the same way as MIT Kerberos,
+// returning def if the value is not recognised.
+func parseBoolean(s string, def bool) bool {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "y", "yes", "true", "t", "1", "on":
+		return true
+	case "n", "no", "false", "nil", "0", "off":
+		return false
+	}
+
+	return def
+}
+
+// profileEncTypes returns the list of encryption types from the libdefaults
+// relation named tag, which defaults to the "DEFAULT" list. Weak encryption
+// types are removed unless allow_weak_crypto is true.
+func profileEncTypes(p *profile, tag string) []int32 {
+	etypes := defaultEncTypes
+
+	if v, ok := p.value("libdefaults", tag); ok {
+		etypes = parseEncTypes(v)
+	}
+
+	if v, _ := p.value("libdefaults", allowWeakCryptoTag); !parseBoolean(v, false) {
+		etypes = slices.DeleteFunc(slices.Clone(etypes), func(e int32) bool {
+			return slices.Contains(weakEncTypes, e)
+		})
+	}
+
+	return etypes
+}
+
+// checkEncType returns an *EncTypeError if etype isn't in permitted.
+func checkEncType(permitted []int32, usage string, etype int32) error {
+	if !slices.Contains(permitted, etype) {
+		return &EncTypeError{Usage: usage, EncType: etype}
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package gssapi
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEncTypes(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		input  string
+		etypes []int32
+	}{
+		{"", nil},
+		{"aes256-cts", []int32{etypeID.AES256_CTS_HMAC_SHA1_96}},
+		{
+			"aes256-cts-hmac-sha1-96, arcfour-hmac-md5",
+			[]int32{etypeID.AES256_CTS_HMAC_SHA1_96, etypeID.RC4_HMAC},
+		},
+		{"des3-cbc-sha1 des3-hmac-sha1", []int32{etypeID.DES3_CBC_SHA1_KD}},
+		{"DEFAULT -rc4 -des3 -camellia", encTypeFamilies["aes"]},
+		{"aes128-cts aes", encTypeFamilies["aes"]},
+		{"des unknown", encTypeFamilies["des"]},
+		{"-aes aes128-sha2", []int32{etypeID.AES128_CTS_HMAC_SHA256_128}},
+	}
+
+	for _, table := range tables {
+		t.Run(table.input, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, table.etypes, parseEncTypes(table.input))
+		})
+	}
+}
+
+func TestProfileEncTypes(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		name   string
+		config string
+		tag    string
+		etypes []int32
+	}{
+		{"default", "", permittedEncTypesTag, defaultEncTypes},
+		{
+			"weak",
+			"[libdefaults]\n  permitted_enctypes = des-cbc-crc aes256-cts\n",
+			permittedEncTypesTag,
+			[]int32{etypeID.AES256_CTS_HMAC_SHA1_96},
+		},
+		{
+			"allow weak",
+			"[libdefaults]\n  permitted_enctypes = des-cbc-crc aes256-cts\n  allow_weak_crypto = true\n",
+			permittedEncTypesTag,
+			[]int32{etypeID.DES_CBC_CRC, etypeID.AES256_CTS_HMAC_SHA1_96},
+		},
+		{
+			"tgs",
+			"[libdefaults]\n  permitted_enctypes = aes\n  default_tgs_enctypes = rc4\n",
+			defaultTGSEncTypesTag,
+			[]int32{etypeID.RC4_HMAC},
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			p, err := parseProfile(fs, strings.NewReader(table.config))
+			require.NoError(t, err)
+
+			assert.Equal(t, table.etypes, profileEncTypes(p, table.tag))
+		})
+	}
+}
+
+//nolint:paralleltest
+func TestEncTypePolicy(t *testing.T) {
+	newTestEnvironment(t, etypeID.RC4_HMAC)
+
+	// RC4 is in the default list
+	t.Run("default", func(t *testing.T) {
+		establish(t, 0, nil, nil)
+	})
+
+	t.Run("acceptor config", func(t *testing.T) {
+		initiator, err := NewInitiator()
+		require.NoError(t, err)
+
+		defer initiator.Close()
+
+		acceptor, err := NewAcceptor(
+			WithAcceptorConfigOverlay[Acceptor]("[libdefaults]\n  permitted_enctypes = aes\n"),
+		)
+		require.NoError(t, err)
+
+		output, _, err := initiator.Initiate(testService, 0, nil)
+		require.NoError(t, err)
+
+		_, _, err = acceptor.Accept(output)
+
+		var etypeErr *EncTypeError
+		if assert.True(t, errors.As(err, &etypeErr)) {
+			assert.Equal(t, "ticket", etypeErr.Usage)
+			assert.Equal(t, etypeID.RC4_HMAC, etypeErr.EncType)
+		}
+
+		assert.False(t, acceptor.Established())
+	})
+
+	t.Run("initiator option", func(t *testing.T) {
+		initiator, err := NewInitiator(WithEncTypes[Initiator](etypeID.AES256_CTS_HMAC_SHA1_96))
+		require.NoError(t, err)
+
+		defer initiator.Close()
+
+		_, _, err = initiator.Initiate(testService, 0, nil)
+
+		var etypeErr *EncTypeError
+		if assert.True(t, errors.As(err, &etypeErr)) {
+			assert.Equal(t, "session key", etypeErr.Usage)
+		}
+	})
+
+	t.Run("acceptor option", func(t *testing.T) {
+		establish(t, 0, nil, []Option[Acceptor]{
+			WithAcceptorConfigOverlay[Acceptor]("[libdefaults]\n  permitted_enctypes = aes\n"),
+			WithEncTypes[Acceptor](etypeID.RC4_HMAC),
+		})
+	})
+}
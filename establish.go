@@ -0,0 +1,334 @@
+package gssapi
+
+import (
+	"bufio"
+	stdcontext "context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bodgit/gssapi/internal/deadline"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+const (
+	defaultMaxRounds    = 8
+	defaultMaxTokenSize = 64 * 1024
+)
+
+var (
+	errTooManyRounds = errors.New("too many context establishment rounds")
+	errRejected      = errors.New("context rejected by acceptor")
+	errLineTooLong   = errors.New("token line is too long")
+)
+
+// TokenReadWriter reads and writes the tokens exchanged while establishing a
+// context.
+type TokenReadWriter interface {
+	// ReadToken reads a token, returning an error if it is longer than
+	// maxLength.
+	ReadToken(maxLength int) ([]byte, error)
+	// WriteToken writes a token.
+	WriteToken(token []byte) error
+}
+
+type streamTokenReadWriter struct {
+	rw      io.ReadWriter
+	framing Framing
+}
+
+// NewTokenReadWriter returns a TokenReadWriter that frames tokens on a byte
+// stream, such as a net.Conn. If rw has a SetDeadline method it is used to
+// interrupt establishing a context when its context is done.
+func NewTokenReadWriter(rw io.ReadWriter, framing Framing) TokenReadWriter {
+	return &streamTokenReadWriter{
+		rw:      rw,
+		framing: framing,
+	}
+}
+
+func (s *streamTokenReadWriter) ReadToken(maxLength int) ([]byte, error) {
+	return s.framing.ReadToken(s.rw, maxLength)
+}
+
+func (s *streamTokenReadWriter) WriteToken(token []byte) error {
+	return s.framing.WriteToken(s.rw, token)
+}
+
+func (s *streamTokenReadWriter) SetDeadline(t time.Time) error {
+	if d, ok := s.rw.(deadline.Setter); ok {
+		return d.SetDeadline(t)
+	}
+
+	return nil
+}
+
+// MessageTokenReadWriter adapts a message-oriented transport where each
+// message carries exactly one token, such as a WebSocket connection.
+type MessageTokenReadWriter struct {
+	// ReadMessage reads the next message.
+	ReadMessage func() ([]byte, error)
+	// WriteMessage writes a message.
+	WriteMessage func(message []byte) error
+}
+
+// ReadToken reads the next message as a token.
+func (m *MessageTokenReadWriter) ReadToken(maxLength int) ([]byte, error) {
+	token, err := m.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(token) > maxLength {
+		return nil, errTokenTooLong
+	}
+
+	return token, nil
+}
+
+// WriteToken writes the token as a message.
+func (m *MessageTokenReadWriter) WriteToken(token []byte) error {
+	return m.WriteMessage(token)
+}
+
+// Base64LineFraming frames each token as a line of base64, as used by many
+// text-based protocols. Lines are terminated with CRLF, a bare LF is also
+// accepted when reading.
+type Base64LineFraming struct{}
+
+// ReadToken reads a line of base64. The line is read a byte at a time so
+// nothing after it is consumed.
+func (Base64LineFraming) ReadToken(r io.Reader, maxLength int) ([]byte, error) {
+	var (
+		line  []byte
+		b     [1]byte
+		limit = base64.StdEncoding.EncodedLen(maxLength) + len("\r\n")
+	)
+
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			if len(line) > 0 && errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+
+			return nil, err
+		}
+
+		if b[0] == '\n' {
+			break
+		}
+
+		if line = append(line, b[0]); len(line) >= limit {
+			return nil, errLineTooLong
+		}
+	}
+
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+
+	token := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+
+	n, err := base64.StdEncoding.Decode(token, line)
+	if err != nil {
+		return nil, err
+	}
+
+	if n > maxLength {
+		return nil, errTokenTooLong
+	}
+
+	return token[:n], nil
+}
+
+// WriteToken writes the token as a line of base64.
+func (Base64LineFraming) WriteToken(w io.Writer, token []byte) error {
+	bw := bufio.NewWriter(w)
+
+	enc := base64.NewEncoder(base64.StdEncoding, bw)
+	if _, err := enc.Write(token); err != nil {
+		return err
+	}
+
+	if err := enc.Close(); err != nil {
+		return err
+	}
+
+	if _, err := bw.WriteString("\r\n"); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// runWithContext calls f with any blocked read or write on rw interrupted
+// when ctx is done, if rw supports deadlines, otherwise ctx is only checked
+// between rounds.
+func runWithContext(ctx stdcontext.Context, rw TokenReadWriter, f func() error) error {
+	if d, ok := rw.(deadline.Setter); ok {
+		return deadline.Run(ctx, d, f)
+	}
+
+	if err := f(); err != nil {
+		return deadline.Err(ctx, err)
+	}
+
+	return nil
+}
+
+func readToken(rw TokenReadWriter, maxLength int) ([]byte, error) {
+	token, err := rw.ReadToken(maxLength)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(token) > maxLength {
+		return nil, errTokenTooLong
+	}
+
+	return token, nil
+}
+
+// krbErrorToken returns the KRB-ERROR carried in a token, if any.
+func krbErrorToken(b []byte) (messages.KRBError, bool) {
+	var krbError messages.KRBError
+
+	if isRawToken(b, asnAppTag.KRBError) {
+		return krbError, krbError.Unmarshal(b) == nil
+	}
+
+	var token spnego.KRB5Token
+	if err := token.Unmarshal(b); err != nil || !token.IsKRBError() {
+		return krbError, false
+	}
+
+	return token.KRBError, true
+}
+
+// EstablishInitiator creates an Initiator with the given options and
+// establishes a context with the service, exchanging tokens over rw until
+// the context is established. Any KRB-ERROR sent by the Acceptor is returned
+// as a messages.KRBError. As the Acceptor only replies when
+// gssapi.ContextFlagMutual is requested, a rejection can only be detected
+// with mutual authentication.
+func EstablishInitiator(ctx stdcontext.Context, rw TokenReadWriter, service string, flags int,
+	options ...Option[Initiator],
+) (*Initiator, error) {
+	initiator, err := NewInitiator(options...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = runWithContext(ctx, rw, func() error {
+		return initiatorRounds(ctx, initiator, rw, service, flags)
+	})
+	if err == nil && !initiator.Established() {
+		err = errNotEstablished
+	}
+
+	if err != nil {
+		return nil, errors.Join(err, initiator.Close())
+	}
+
+	return initiator, nil
+}
+
+// EstablishAcceptor creates an Acceptor with the given options and accepts a
+// context from the Initiator, exchanging tokens over rw until the context is
+// established. If the context is rejected the KRB-ERROR is sent to the
+// Initiator and returned wrapped in the error.
+func EstablishAcceptor(ctx stdcontext.Context, rw TokenReadWriter,
+	options ...Option[Acceptor],
+) (*Acceptor, error) {
+	acceptor, err := NewAcceptor(options...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = runWithContext(ctx, rw, func() error {
+		return acceptorRounds(acceptor, rw)
+	})
+	if err != nil {
+		return nil, errors.Join(err, acceptor.Close())
+	}
+
+	return acceptor, nil
+}
+
+// initiatorRounds exchanges tokens until the Initiator no longer needs a reply.
+func initiatorRounds(ctx stdcontext.Context, initiator *Initiator, rw TokenReadWriter, service string,
+	flags int,
+) error {
+	var input []byte
+
+	for round := 0; ; round++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		output, cont, err := initiator.Initiate(service, flags, input)
+		if err != nil {
+			return err
+		}
+
+		if len(output) > 0 {
+			if err = rw.WriteToken(output); err != nil {
+				return err
+			}
+		}
+
+		// Without mutual authentication the context is established
+		// without waiting for a reply
+		if !cont || initiator.Established() {
+			return nil
+		}
+
+		if round >= initiator.maxRounds() {
+			return errTooManyRounds
+		}
+
+		if input, err = readToken(rw, initiator.maxTokenSize()); err != nil {
+			return err
+		}
+	}
+}
+
+// acceptorRounds exchanges tokens until the Acceptor is established or the
+// context is rejected.
+func acceptorRounds(acceptor *Acceptor, rw TokenReadWriter) error {
+	for round := 0; round < acceptor.maxRounds(); round++ {
+		input, err := readToken(rw, acceptor.maxTokenSize())
+		if err != nil {
+			return err
+		}
+
+		output, cont, err := acceptor.Accept(input)
+		if err != nil {
+			return err
+		}
+
+		if len(output) > 0 {
+			if err = rw.WriteToken(output); err != nil {
+				return err
+			}
+		}
+
+		if acceptor.Established() {
+			return nil
+		}
+
+		if krbError, ok := krbErrorToken(output); ok {
+			return fmt.Errorf("%w: %w", errRejected, krbError)
+		}
+
+		if !cont {
+			return errNotEstablished
+		}
+	}
+
+	return errTooManyRounds
+}
@@ -0,0 +1,210 @@
+package gssapi
+
+import (
+	"bytes"
+	stdcontext "context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type tokenReadWriterPair func(t *testing.T) (TokenReadWriter, TokenReadWriter)
+
+func streamPair(framing Framing) tokenReadWriterPair {
+	return func(t *testing.T) (TokenReadWriter, TokenReadWriter) {
+		t.Helper()
+
+		client, server := net.Pipe()
+
+		t.Cleanup(func() {
+			_ = client.Close()
+			_ = server.Close()
+		})
+
+		return NewTokenReadWriter(client, framing), NewTokenReadWriter(server, framing)
+	}
+}
+
+func messagePair(t *testing.T) (TokenReadWriter, TokenReadWriter) {
+	t.Helper()
+
+	a, b := make(chan []byte, 4), make(chan []byte, 4)
+
+	return &MessageTokenReadWriter{
+		ReadMessage:  func() ([]byte, error) { return <-a, nil },
+		WriteMessage: func(message []byte) error { b <- message; return nil },
+	}, &MessageTokenReadWriter{
+		ReadMessage:  func() ([]byte, error) { return <-b, nil },
+		WriteMessage: func(message []byte) error { a <- message; return nil },
+	}
+}
+
+type establishResult struct {
+	initiator    *Initiator
+	initiatorErr error
+	acceptor     *Acceptor
+	acceptorErr  error
+}
+
+func establishOver(t *testing.T, pair tokenReadWriterPair, flags int,
+	initiatorOptions []Option[Initiator], acceptorOptions []Option[Acceptor],
+) establishResult {
+	t.Helper()
+
+	client, server := pair(t)
+
+	var (
+		result establishResult
+		done   = make(chan struct{})
+	)
+
+	go func() {
+		defer close(done)
+
+		result.acceptor, result.acceptorErr = EstablishAcceptor(stdcontext.Background(), server, acceptorOptions...)
+
+		// Unblock the Initiator if the Acceptor gave up early
+		if c, ok := server.(*streamTokenReadWriter); ok && result.acceptorErr != nil {
+			_ = c.rw.(net.Conn).Close() //nolint:forcetypeassert
+		}
+	}()
+
+	result.initiator, result.initiatorErr = EstablishInitiator(stdcontext.Background(), client, testService, flags,
+		initiatorOptions...)
+
+	<-done
+
+	if result.initiator != nil {
+		t.Cleanup(func() { _ = result.initiator.Close() })
+	}
+
+	if result.acceptor != nil {
+		t.Cleanup(func() { _ = result.acceptor.Close() })
+	}
+
+	return result
+}
+
+//nolint:funlen,paralleltest
+func TestEstablish(t *testing.T) {
+	newTestEnvironment(t, etypeID.AES256_CTS_HMAC_SHA1_96)
+
+	pairs := []struct {
+		name string
+		pair tokenReadWriterPair
+	}{
+		{"length prefix", streamPair(LengthPrefixFraming{})},
+		{"base64 line", streamPair(Base64LineFraming{})},
+		{"message", messagePair},
+	}
+
+	flags := []struct {
+		name  string
+		flags int
+	}{
+		{"session", gssapi.ContextFlagInteg},
+		{"mutual", gssapi.ContextFlagInteg | gssapi.ContextFlagMutual},
+		{"dce", gssapi.ContextFlagInteg | ContextFlagDCEStyle},
+	}
+
+	for _, pair := range pairs {
+		for _, flag := range flags {
+			t.Run(pair.name+"/"+flag.name, func(t *testing.T) {
+				result := establishOver(t, pair.pair, flag.flags, nil, nil)
+				require.NoError(t, result.initiatorErr)
+				require.NoError(t, result.acceptorErr)
+
+				signature, err := result.initiator.MakeSignature([]byte("message"))
+				require.NoError(t, err)
+				assert.NoError(t, result.acceptor.VerifySignature([]byte("message"), signature))
+			})
+		}
+	}
+
+	t.Run("rejected", func(t *testing.T) {
+		kt := keytab.New()
+		require.NoError(t, kt.AddEntry(testService, testRealm, "wrong", time.Now(), 1,
+			etypeID.AES256_CTS_HMAC_SHA1_96))
+
+		result := establishOver(t, streamPair(LengthPrefixFraming{}), gssapi.ContextFlagMutual, nil,
+			[]Option[Acceptor]{WithKeytabValue[Acceptor](kt)})
+
+		var krbError messages.KRBError
+
+		require.ErrorAs(t, result.initiatorErr, &krbError)
+		assert.Equal(t, errorcode.KRB_AP_ERR_BAD_INTEGRITY, krbError.ErrorCode)
+
+		require.ErrorIs(t, result.acceptorErr, errRejected)
+		assert.ErrorAs(t, result.acceptorErr, &krbError)
+	})
+
+	t.Run("rounds", func(t *testing.T) {
+		result := establishOver(t, streamPair(LengthPrefixFraming{}), ContextFlagDCEStyle, nil,
+			[]Option[Acceptor]{WithMaxRounds[Acceptor](1)})
+		assert.ErrorIs(t, result.acceptorErr, errTooManyRounds)
+	})
+
+	t.Run("token size", func(t *testing.T) {
+		result := establishOver(t, streamPair(LengthPrefixFraming{}), 0, nil,
+			[]Option[Acceptor]{WithMaxTokenSize[Acceptor](16)})
+		assert.ErrorIs(t, result.acceptorErr, errTokenTooLong)
+	})
+}
+
+func TestEstablishContext(t *testing.T) {
+	t.Parallel()
+
+	_, server := streamPair(LengthPrefixFraming{})(t)
+
+	ctx, cancel := stdcontext.WithTimeout(stdcontext.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := EstablishAcceptor(ctx, server)
+	assert.ErrorIs(t, err, stdcontext.DeadlineExceeded)
+
+	ctx, cancel = stdcontext.WithCancel(stdcontext.Background())
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err = EstablishAcceptor(ctx, server)
+	assert.ErrorIs(t, err, stdcontext.Canceled)
+}
+
+func TestBase64LineFraming(t *testing.T) {
+	t.Parallel()
+
+	var (
+		framing Base64LineFraming
+		b       bytes.Buffer
+	)
+
+	require.NoError(t, framing.WriteToken(&b, []byte("token")))
+	assert.Equal(t, "dG9rZW4=\r\n", b.String())
+
+	b.WriteString("dG9rZW4=\nmore")
+
+	for range 2 {
+		token, err := framing.ReadToken(&b, 16)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("token"), token)
+	}
+
+	assert.Equal(t, "more", b.String())
+
+	_, err := framing.ReadToken(bytes.NewBufferString("dG9rZW4=\n"), 4)
+	assert.ErrorIs(t, err, errTokenTooLong)
+
+	_, err = framing.ReadToken(bytes.NewBufferString("dG9rZW4=dG9rZW4=\n"), 4)
+	assert.ErrorIs(t, err, errLineTooLong)
+}
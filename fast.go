@@ -0,0 +1,843 @@
+package gssapi
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/iana"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/iana/patype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+const (
+	fastArmorAPRequest = 1
+
+	fastMaxRounds = 3
+
+	// maxReferrals matches the limit in gokrb5.
+	maxReferrals = 5
+)
+
+var (
+	errFASTUnsupported  = errors.New("KDC does not support FAST")
+	errFASTReply        = errors.New("invalid FAST reply")
+	errNoPreauth        = errors.New("KDC did not offer encrypted challenge pre-authentication")
+	errTooManyReferrals = errors.New("maximum number of referrals exceeded")
+)
+
+// These types are from RFC 6113 section 5.4.
+
+type krbFastArmor struct {
+	ArmorType  int32  `asn1:"explicit,tag:0"`
+	ArmorValue []byte `asn1:"explicit,tag:1"`
+}
+
+type krbFastArmoredReq struct {
+	Armor       krbFastArmor        `asn1:"optional,explicit,tag:0"`
+	ReqChecksum types.Checksum      `asn1:"explicit,tag:1"`
+	EncFastReq  types.EncryptedData `asn1:"explicit,tag:2"`
+}
+
+type krbFastReq struct {
+	FastOptions asn1.BitString       `asn1:"explicit,tag:0"`
+	PAData      types.PADataSequence `asn1:"explicit,tag:1"`
+	ReqBody     asn1.RawValue        `asn1:"explicit,tag:2"`
+}
+
+type krbFastArmoredRep struct {
+	EncFastRep types.EncryptedData `asn1:"explicit,tag:0"`
+}
+
+type krbFastResponse struct {
+	PAData        types.PADataSequence `asn1:"explicit,tag:0"`
+	StrengthenKey types.EncryptionKey  `asn1:"optional,explicit,tag:1"`
+	Finished      krbFastFinished      `asn1:"optional,explicit,tag:2"`
+	Nonce         int                  `asn1:"explicit,tag:3"`
+}
+
+type krbFastFinished struct {
+	Timestamp      time.Time           `asn1:"generalized,explicit,tag:0"`
+	Usec           int                 `asn1:"explicit,tag:1"`
+	CRealm         string              `asn1:"generalstring,explicit,tag:2"`
+	CName          types.PrincipalName `asn1:"explicit,tag:3"`
+	TicketChecksum types.Checksum      `asn1:"explicit,tag:4"`
+}
+
+// rawKDCRep is used to get at the encoded ticket within a KDC-REP, which is
+// needed to verify the ticket checksum in KrbFastFinished.
+type rawKDCRep struct {
+	PVNO    int                  `asn1:"explicit,tag:0"`
+	MsgType int                  `asn1:"explicit,tag:1"`
+	PAData  types.PADataSequence `asn1:"explicit,optional,tag:2"`
+	CRealm  string               `asn1:"generalstring,explicit,tag:3"`
+	CName   types.PrincipalName  `asn1:"explicit,tag:4"`
+	Ticket  asn1.RawValue        `asn1:"explicit,tag:5"`
+	EncPart types.EncryptedData  `asn1:"explicit,tag:6"`
+}
+
+// explicitRawValue wraps b, an encoded value, with an explicit context tag.
+// This is needed as the tag parameters of a RawValue field are ignored when
+// marshalling, although they are honoured when unmarshalling.
+func explicitRawValue(tag int, b []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: b}
+}
+
+// marshalChoice encodes v as the [0] alternative of a CHOICE, which is how
+// both PA-FX-FAST-REQUEST and PA-FX-FAST-REPLY are defined.
+func marshalChoice(v any) ([]byte, error) {
+	b, err := asn1.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(explicitRawValue(0, b))
+}
+
+func unmarshalChoice(b []byte, v any) error {
+	var raw asn1.RawValue
+	if _, err := asn1.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	if raw.Class != asn1.ClassContextSpecific || raw.Tag != 0 {
+		return errFASTReply
+	}
+
+	_, err := asn1.Unmarshal(raw.Bytes, v)
+
+	return err
+}
+
+func checksum(key types.EncryptionKey, b []byte, usage uint32) (types.Checksum, error) {
+	e, err := crypto.GetEtype(key.KeyType)
+	if err != nil {
+		return types.Checksum{}, err
+	}
+
+	sum, err := e.GetChecksumHash(key.KeyValue, b, usage)
+	if err != nil {
+		return types.Checksum{}, err
+	}
+
+	return types.Checksum{CksumType: e.GetHashID(), Checksum: sum}, nil
+}
+
+func verifyChecksum(key types.EncryptionKey, b []byte, sum types.Checksum, usage uint32) bool {
+	e, err := crypto.GetChksumEtype(sum.CksumType)
+	if err != nil {
+		return false
+	}
+
+	return e.VerifyChecksum(key.KeyValue, b, sum.Checksum, usage)
+}
+
+func generateSubkey(keyType int32) (types.EncryptionKey, error) {
+	e, err := crypto.GetEtype(keyType)
+	if err != nil {
+		return types.EncryptionKey{}, err
+	}
+
+	return types.GenerateEncryptionKey(e)
+}
+
+// fastRequest is a single armored request and the state needed to process
+// the reply.
+type fastRequest struct {
+	armorKey types.EncryptionKey
+	nonce    int
+}
+
+// armor wraps the padata and request body in a PA-FX-FAST padata. For an AS
+// request the armor is an AP-REQ using the armor TGT, for a TGS request the
+// armor is implicit and the armor key is passed in.
+func (r *fastRequest) armor(armor *krbFastArmor, padata types.PADataSequence, body messages.KDCReqBody,
+	checksummed []byte,
+) (types.PAData, error) {
+	b, err := body.Marshal()
+	if err != nil {
+		return types.PAData{}, err
+	}
+
+	if checksummed == nil {
+		checksummed = b
+	}
+
+	req, err := asn1.Marshal(krbFastReq{
+		FastOptions: types.NewKrbFlags(),
+		PAData:      padata,
+		ReqBody:     explicitRawValue(2, b),
+	})
+	if err != nil {
+		return types.PAData{}, err
+	}
+
+	armored := krbFastArmoredReq{}
+	if armor != nil {
+		armored.Armor = *armor
+	}
+
+	if armored.ReqChecksum, err = checksum(r.armorKey, checksummed, keyusage.KEY_USAGE_FAST_REQ_CHKSUM); err != nil {
+		return types.PAData{}, err
+	}
+
+	if armored.EncFastReq, err = crypto.GetEncryptedData(req, r.armorKey, keyusage.KEY_USAGE_FAST_ENC, 0); err != nil {
+		return types.PAData{}, err
+	}
+
+	if b, err = marshalChoice(armored); err != nil {
+		return types.PAData{}, err
+	}
+
+	return types.PAData{PADataType: patype.PA_FX_FAST, PADataValue: b}, nil
+}
+
+// response decrypts the KrbFastResponse in the PA-FX-FAST padata.
+func (r *fastRequest) response(padata types.PADataSequence) (*krbFastResponse, error) {
+	for _, pa := range padata {
+		if pa.PADataType != patype.PA_FX_FAST {
+			continue
+		}
+
+		var armored krbFastArmoredRep
+		if err := unmarshalChoice(pa.PADataValue, &armored); err != nil {
+			return nil, fmt.Errorf("%w: %w", errFASTReply, err)
+		}
+
+		b, err := crypto.DecryptEncPart(armored.EncFastRep, r.armorKey, keyusage.KEY_USAGE_FAST_REP)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errFASTReply, err)
+		}
+
+		var resp krbFastResponse
+		if _, err = asn1.Unmarshal(b, &resp); err != nil {
+			return nil, fmt.Errorf("%w: %w", errFASTReply, err)
+		}
+
+		return &resp, nil
+	}
+
+	return nil, errFASTUnsupported
+}
+
+// krbError returns the FAST response and the protected KRB-ERROR from
+// within a KRB-ERROR. If the error isn't FAST-protected the original error is
+// returned wrapped with errFASTUnsupported.
+func (r *fastRequest) krbError(krbError messages.KRBError) (*krbFastResponse, messages.KRBError, error) {
+	var padata types.PADataSequence
+	if err := padata.Unmarshal(krbError.EData); err != nil {
+		return nil, krbError, fmt.Errorf("%w: %w", errFASTUnsupported, krbError)
+	}
+
+	resp, err := r.response(padata)
+	if errors.Is(err, errFASTUnsupported) {
+		return nil, krbError, fmt.Errorf("%w: %w", err, krbError)
+	} else if err != nil {
+		return nil, krbError, err
+	}
+
+	for _, pa := range resp.PAData {
+		if pa.PADataType != patype.PA_FX_ERROR {
+			continue
+		}
+
+		var inner messages.KRBError
+		if err = inner.Unmarshal(pa.PADataValue); err != nil {
+			return nil, krbError, fmt.Errorf("%w: %w", errFASTReply, err)
+		}
+
+		return resp, inner, nil
+	}
+
+	return resp, krbError, nil
+}
+
+// verify checks the nonce and finished fields in the FAST response to a
+// KDC-REP, returning the reply key strengthened if required.
+func (r *fastRequest) verify(resp *krbFastResponse, raw []byte, tag int, replyKey types.EncryptionKey,
+) (types.EncryptionKey, *krbFastFinished, error) {
+	if resp.Nonce != r.nonce {
+		return types.EncryptionKey{}, nil, fmt.Errorf("%w: nonce mismatch", errFASTReply)
+	}
+
+	var rep rawKDCRep
+	if _, err := asn1.UnmarshalWithParams(raw, &rep, fmt.Sprintf("application,explicit,tag:%d", tag)); err != nil {
+		return types.EncryptionKey{}, nil, err
+	}
+
+	if resp.Finished.TicketChecksum.CksumType == 0 ||
+		!verifyChecksum(r.armorKey, rep.Ticket.Bytes, resp.Finished.TicketChecksum, keyusage.KEY_USAGE_FAST_FINISHED) {
+		return types.EncryptionKey{}, nil, fmt.Errorf("%w: ticket checksum invalid", errFASTReply)
+	}
+
+	if resp.StrengthenKey.KeyType == 0 {
+		return replyKey, &resp.Finished, nil
+	}
+
+	key, err := cf2(resp.StrengthenKey, replyKey, "strengthenkey", "replykey")
+	if err != nil {
+		return types.EncryptionKey{}, nil, err
+	}
+
+	return key, &resp.Finished, nil
+}
+
+func decryptKDCRepPart(encPart types.EncryptedData, key types.EncryptionKey, usage uint32,
+) (messages.EncKDCRepPart, error) {
+	var part messages.EncKDCRepPart
+
+	b, err := crypto.DecryptEncPart(encPart, key, usage)
+	if err != nil {
+		return part, err
+	}
+
+	err = part.Unmarshal(b)
+
+	return part, err
+}
+
+// fastEnabled reports whether FAST armoring has been requested.
+func (ctx *Initiator) fastEnabled() bool {
+	return ctx.armorPrincipal != ""
+}
+
+// armorTGT returns a TGT for the armor principal, obtaining one with the
+// armor keytab or anonymous PKINIT if necessary. The AS exchange for the
+// armor TGT itself isn't armored.
+func (ctx *Initiator) armorTGT() (*tgtSession, error) {
+	if ctx.armor != nil && !ctx.armor.needsRefresh() {
+		return ctx.armor, nil
+	}
+
+	name, err := ParseName(ctx.armorPrincipal, NTKRB5PrincipalName)
+	if err != nil {
+		return nil, err
+	}
+
+	realm := name.Realm()
+	if realm == "" {
+		realm = ctx.client.Credentials.Domain()
+	}
+
+	if ctx.armorAnonymous {
+		asRep, err := ctx.pkinitASExchange(anonymousPrincipal(), realm, true)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx.logger.Info("obtained anonymous FAST armor TGT", "realm", realm)
+
+		ctx.armor = newTGTSession(asRep.CName, asRep.CRealm, asRep.Ticket, asRep.DecryptedEncPart)
+
+		return ctx.armor, nil
+	}
+
+	var kt *keytab.Keytab
+	if ctx.armorKeytab != "" {
+		kt, err = ctx.sources.resolveKeytab(ctx.armorKeytab)
+	} else {
+		kt, err = ctx.sources.loadKeytab(ctx.logger)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	cname := name.PrincipalName()
+
+	cl := client.NewWithKeytab(cname.PrincipalNameString(), realm, kt, ctx.krb5conf, client.DisablePAFXFAST(true))
+	defer cl.Destroy()
+
+	asReq, err := messages.NewASReqForTGT(realm, ctx.krb5conf, cname)
+	if err != nil {
+		return nil, err
+	}
+
+	asRep, err := cl.ASExchange(realm, asReq, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.logger.Info("obtained FAST armor TGT", "principal", NewNameFromPrincipal(asRep.CName, asRep.CRealm))
+
+	ctx.armor = newTGTSession(asRep.CName, asRep.CRealm, asRep.Ticket, asRep.DecryptedEncPart)
+
+	return ctx.armor, nil
+}
+
+// explicitArmor creates the AP-REQ armor from the armor TGT along with the
+// armor key.
+func explicitArmor(armor *tgtSession) (*krbFastArmor, types.EncryptionKey, error) {
+	auth, err := types.NewAuthenticator(armor.crealm, armor.cname)
+	if err != nil {
+		return nil, types.EncryptionKey{}, err
+	}
+
+	if auth.SubKey, err = generateSubkey(armor.key.KeyType); err != nil {
+		return nil, types.EncryptionKey{}, err
+	}
+
+	b, err := auth.Marshal()
+	if err != nil {
+		return nil, types.EncryptionKey{}, err
+	}
+
+	// This is a regular AP-REQ so gokrb5 can't be used to create it as it
+	// would use the TGS-REQ key usage for a krbtgt ticket
+	ed, err := crypto.GetEncryptedData(b, armor.key, keyusage.AP_REQ_AUTHENTICATOR, armor.ticket.EncPart.KVNO)
+	if err != nil {
+		return nil, types.EncryptionKey{}, err
+	}
+
+	apReq := messages.APReq{
+		PVNO:                   iana.PVNO,
+		MsgType:                msgtype.KRB_AP_REQ,
+		APOptions:              types.NewKrbFlags(),
+		Ticket:                 armor.ticket,
+		EncryptedAuthenticator: ed,
+	}
+
+	if b, err = apReq.Marshal(); err != nil {
+		return nil, types.EncryptionKey{}, err
+	}
+
+	armorKey, err := cf2(auth.SubKey, armor.key, "subkeyarmor", "ticketarmor")
+	if err != nil {
+		return nil, types.EncryptionKey{}, err
+	}
+
+	return &krbFastArmor{ArmorType: fastArmorAPRequest, ArmorValue: b}, armorKey, nil
+}
+
+// clientKey returns the long-term key of the client for the encryption type.
+func (ctx *Initiator) clientKey(etype int32, padata types.PADataSequence) (types.EncryptionKey, error) {
+	creds := ctx.client.Credentials
+
+	if creds.HasKeytab() {
+		key, _, err := creds.Keytab().GetEncryptionKey(creds.CName(), creds.Domain(), 0, etype)
+
+		return key, err
+	}
+
+	key, _, err := crypto.GetKeyFromPassword(creds.Password(), creds.CName(), creds.Domain(), etype, padata)
+
+	return key, err
+}
+
+// challengeEType picks the encryption type offered in the PA-ETYPE-INFO2
+// padata.
+func challengeEType(padata types.PADataSequence) (int32, error) {
+	for _, pa := range padata {
+		if pa.PADataType != patype.PA_ETYPE_INFO2 {
+			continue
+		}
+
+		info, err := pa.GetETypeInfo2()
+		if err != nil {
+			return 0, err
+		}
+
+		if len(info) > 0 {
+			return info[0].EType, nil
+		}
+	}
+
+	return 0, errNoPreauth
+}
+
+// encryptedChallenge creates the PA-ENCRYPTED-CHALLENGE padata from RFC 6113
+// section 5.4.6.
+func encryptedChallenge(armorKey, clientKey types.EncryptionKey) (types.PAData, error) {
+	key, err := cf2(armorKey, clientKey, "clientchallengearmor", "challengelongterm")
+	if err != nil {
+		return types.PAData{}, err
+	}
+
+	b, err := types.GetPAEncTSEncAsnMarshalled()
+	if err != nil {
+		return types.PAData{}, err
+	}
+
+	ed, err := crypto.GetEncryptedData(b, key, keyusage.KEY_USAGE_ENC_CHALLENGE_CLIENT, 0)
+	if err != nil {
+		return types.PAData{}, err
+	}
+
+	if b, err = ed.Marshal(); err != nil {
+		return types.PAData{}, err
+	}
+
+	return types.PAData{PADataType: patype.PA_ENCRYPTED_CHALLENGE, PADataValue: b}, nil
+}
+
+// verifyKDCChallenge checks the PA-ENCRYPTED-CHALLENGE returned by the KDC,
+// which proves it knows the client key.
+func verifyKDCChallenge(padata types.PADataSequence, armorKey, clientKey types.EncryptionKey,
+	skew time.Duration,
+) error {
+	key, err := cf2(armorKey, clientKey, "kdcchallengearmor", "challengelongterm")
+	if err != nil {
+		return err
+	}
+
+	for _, pa := range padata {
+		if pa.PADataType != patype.PA_ENCRYPTED_CHALLENGE {
+			continue
+		}
+
+		var ed types.EncryptedData
+		if err = ed.Unmarshal(pa.PADataValue); err != nil {
+			return err
+		}
+
+		b, err := crypto.DecryptEncPart(ed, key, keyusage.KEY_USAGE_ENC_CHALLENGE_KDC)
+		if err != nil {
+			return fmt.Errorf("%w: KDC challenge invalid: %w", errFASTReply, err)
+		}
+
+		var ts types.PAEncTSEnc
+		if err = ts.Unmarshal(b); err != nil {
+			return err
+		}
+
+		if time.Since(ts.PATimestamp).Abs() > skew {
+			return fmt.Errorf("%w: KDC challenge timestamp outside of clock skew", errFASTReply)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("%w: KDC challenge missing", errFASTReply)
+}
+
+// fastASExchange obtains a TGT with a FAST-armored AS exchange, using
+// encrypted challenge pre-authentication.
+//
+//nolint:cyclop,funlen
+func (ctx *Initiator) fastASExchange() (messages.ASRep, error) {
+	armor, err := ctx.armorTGT()
+	if err != nil {
+		return messages.ASRep{}, err
+	}
+
+	creds := ctx.client.Credentials
+	realm := creds.Domain()
+
+	asReq, err := messages.NewASReqForTGT(realm, ctx.krb5conf, creds.CName())
+	if err != nil {
+		return messages.ASRep{}, err
+	}
+
+	var (
+		padata    types.PADataSequence
+		clientKey types.EncryptionKey
+		rb        []byte
+		req       = &fastRequest{nonce: asReq.ReqBody.Nonce}
+	)
+
+	// The same armor is used for every round so the armor key used for the
+	// encrypted challenge matches the one the KDC returned the padata with
+	fx, armorKey, err := explicitArmor(armor)
+	if err != nil {
+		return messages.ASRep{}, err
+	}
+
+	req.armorKey = armorKey
+
+	for round := 0; ; round++ {
+		pa, err := req.armor(fx, padata, asReq.ReqBody, nil)
+		if err != nil {
+			return messages.ASRep{}, err
+		}
+
+		asReq.PAData = types.PADataSequence{pa}
+
+		b, err := asReq.Marshal()
+		if err != nil {
+			return messages.ASRep{}, err
+		}
+
+		rb, err = sendToKDC(ctx.krb5conf, realm, b)
+		if err == nil {
+			break
+		}
+
+		var krbError messages.KRBError
+		if !errors.As(err, &krbError) {
+			return messages.ASRep{}, err
+		}
+
+		resp, inner, err := req.krbError(krbError)
+		if err != nil {
+			return messages.ASRep{}, err
+		}
+
+		if inner.ErrorCode != errorcode.KDC_ERR_PREAUTH_REQUIRED || round == fastMaxRounds-1 {
+			return messages.ASRep{}, inner
+		}
+
+		etype, err := challengeEType(resp.PAData)
+		if err != nil {
+			return messages.ASRep{}, err
+		}
+
+		if clientKey, err = ctx.clientKey(etype, resp.PAData); err != nil {
+			return messages.ASRep{}, err
+		}
+
+		challenge, err := encryptedChallenge(req.armorKey, clientKey)
+		if err != nil {
+			return messages.ASRep{}, err
+		}
+
+		padata = types.PADataSequence{challenge}
+
+		// Echo back any cookie
+		for _, pa := range resp.PAData {
+			if pa.PADataType == patype.PA_FX_COOKIE {
+				padata = append(padata, pa)
+			}
+		}
+	}
+
+	var asRep messages.ASRep
+	if err = asRep.Unmarshal(rb); err != nil {
+		return messages.ASRep{}, err
+	}
+
+	resp, err := req.response(asRep.PAData)
+	if err != nil {
+		return messages.ASRep{}, err
+	}
+
+	if clientKey.KeyType != asRep.EncPart.EType {
+		// The KDC didn't require pre-authentication
+		if clientKey, err = ctx.clientKey(asRep.EncPart.EType, resp.PAData); err != nil {
+			return messages.ASRep{}, err
+		}
+	} else if err = verifyKDCChallenge(resp.PAData, req.armorKey, clientKey,
+		ctx.krb5conf.LibDefaults.Clockskew); err != nil {
+		return messages.ASRep{}, err
+	}
+
+	replyKey, finished, err := req.verify(resp, rb, asnAppTag.ASREP, clientKey)
+	if err != nil {
+		return messages.ASRep{}, err
+	}
+
+	// The client name in the finished field is authoritative
+	asRep.CName, asRep.CRealm = finished.CName, finished.CRealm
+
+	if asRep.DecryptedEncPart, err = decryptKDCRepPart(asRep.EncPart, replyKey,
+		keyusage.AS_REP_ENCPART); err != nil {
+		return messages.ASRep{}, err
+	}
+
+	if asRep.DecryptedEncPart.Nonce != asReq.ReqBody.Nonce {
+		return messages.ASRep{}, fmt.Errorf("%w: nonce mismatch", errFASTReply)
+	}
+
+	return asRep, nil
+}
+
+// tgsRequest creates a TGS-REQ, replacing the PA-TGS-REQ created by gokrb5
+// with one where the authenticator names the client of the TGT, which is in
+// a different realm to the TGT for anonymous tickets, and optionally has a
+// subkey. The encoded AP-REQ is also returned.
+func (ctx *Initiator) tgsRequest(spn types.PrincipalName, realm string, tgt messages.Ticket,
+	key types.EncryptionKey, renewal, subkey bool,
+) (messages.TGSReq, types.Authenticator, []byte, error) {
+	tgsReq, err := messages.NewTGSReq(ctx.session.cname, realm, ctx.krb5conf, tgt, key, spn, renewal)
+	if err != nil {
+		return messages.TGSReq{}, types.Authenticator{}, nil, err
+	}
+
+	b, err := tgsReq.ReqBody.Marshal()
+	if err != nil {
+		return messages.TGSReq{}, types.Authenticator{}, nil, err
+	}
+
+	auth, err := types.NewAuthenticator(ctx.session.crealm, ctx.session.cname)
+	if err != nil {
+		return messages.TGSReq{}, types.Authenticator{}, nil, err
+	}
+
+	if auth.Cksum, err = checksum(key, b, keyusage.TGS_REQ_PA_TGS_REQ_AP_REQ_AUTHENTICATOR_CHKSUM); err != nil {
+		return messages.TGSReq{}, types.Authenticator{}, nil, err
+	}
+
+	if subkey {
+		if auth.SubKey, err = generateSubkey(key.KeyType); err != nil {
+			return messages.TGSReq{}, types.Authenticator{}, nil, err
+		}
+	}
+
+	apReq, err := messages.NewAPReq(tgt, key, auth)
+	if err != nil {
+		return messages.TGSReq{}, types.Authenticator{}, nil, err
+	}
+
+	if b, err = apReq.Marshal(); err != nil {
+		return messages.TGSReq{}, types.Authenticator{}, nil, err
+	}
+
+	tgsReq.PAData = types.PADataSequence{{PADataType: patype.PA_TGS_REQ, PADataValue: b}}
+
+	return tgsReq, auth, b, nil
+}
+
+// fastTGSExchange obtains a ticket with FAST-armored TGS exchanges, following
+// any referrals to other realms as gokrb5 does for unarmored exchanges.
+func (ctx *Initiator) fastTGSExchange(spn types.PrincipalName, realm string, tgt messages.Ticket,
+	key types.EncryptionKey, renewal bool,
+) (messages.TGSRep, error) {
+	for referrals := 0; ; referrals++ {
+		tgsRep, err := ctx.fastTGSRequest(spn, realm, tgt, key, renewal)
+		if err != nil {
+			return messages.TGSRep{}, err
+		}
+
+		sname := tgsRep.Ticket.SName
+		if len(sname.NameString) != 2 || sname.NameString[0] != "krbtgt" || sname.Equal(spn) {
+			return tgsRep, nil
+		}
+
+		if referrals == maxReferrals {
+			return messages.TGSRep{}, errTooManyReferrals
+		}
+
+		// Server referral, RFC 6806 section 8
+		realm, tgt, key = sname.NameString[1], tgsRep.Ticket, tgsRep.DecryptedEncPart.Key
+	}
+}
+
+// fastTGSRequest performs a single FAST-armored TGS exchange, using the TGT as
+// implicit armor.
+//
+//nolint:cyclop,funlen
+func (ctx *Initiator) fastTGSRequest(spn types.PrincipalName, realm string, tgt messages.Ticket,
+	key types.EncryptionKey, renewal bool,
+) (messages.TGSRep, error) {
+	tgsReq, auth, b, err := ctx.tgsRequest(spn, realm, tgt, key, renewal, true)
+	if err != nil {
+		return messages.TGSRep{}, err
+	}
+
+	req := &fastRequest{nonce: tgsReq.ReqBody.Nonce}
+
+	if req.armorKey, err = cf2(auth.SubKey, key, "subkeyarmor", "ticketarmor"); err != nil {
+		return messages.TGSRep{}, err
+	}
+
+	// The checksum covers the AP-REQ rather than the request body
+	pa, err := req.armor(nil, nil, tgsReq.ReqBody, b)
+	if err != nil {
+		return messages.TGSRep{}, err
+	}
+
+	tgsReq.PAData = append(tgsReq.PAData, pa)
+
+	if b, err = tgsReq.Marshal(); err != nil {
+		return messages.TGSRep{}, err
+	}
+
+	rb, err := sendToKDC(ctx.krb5conf, realm, b)
+	if err != nil {
+		var krbError messages.KRBError
+		if !errors.As(err, &krbError) {
+			return messages.TGSRep{}, err
+		}
+
+		_, inner, err := req.krbError(krbError)
+		if err != nil {
+			return messages.TGSRep{}, err
+		}
+
+		return messages.TGSRep{}, inner
+	}
+
+	var tgsRep messages.TGSRep
+	if err = tgsRep.Unmarshal(rb); err != nil {
+		return messages.TGSRep{}, err
+	}
+
+	resp, err := req.response(tgsRep.PAData)
+	if err != nil {
+		return messages.TGSRep{}, err
+	}
+
+	replyKey, _, err := req.verify(resp, rb, asnAppTag.TGSREP, auth.SubKey)
+	if err != nil {
+		return messages.TGSRep{}, err
+	}
+
+	if tgsRep.DecryptedEncPart, err = decryptKDCRepPart(tgsRep.EncPart, replyKey,
+		keyusage.TGS_REP_ENCPART_AUTHENTICATOR_SUB_KEY); err != nil {
+		return messages.TGSRep{}, err
+	}
+
+	if ok, err := tgsRep.Verify(ctx.krb5conf, tgsReq); !ok {
+		return messages.TGSRep{}, err
+	}
+
+	return tgsRep, nil
+}
+
+// asExchange obtains a TGT using the password, keytab or certificate, or
+// anonymously. PKINIT isn't armored as it doesn't rely on the client
+// long-term key.
+func (ctx *Initiator) asExchange() (messages.ASRep, error) {
+	if ctx.anonymous {
+		realm := ctx.domain
+		if realm == "" {
+			realm = ctx.krb5conf.LibDefaults.DefaultRealm
+		}
+
+		return ctx.pkinitASExchange(anonymousPrincipal(), realm, true)
+	}
+
+	if ctx.useCertificate() {
+		return ctx.pkinitASExchange(ctx.client.Credentials.CName(), ctx.client.Credentials.Domain(), false)
+	}
+
+	if ctx.fastEnabled() {
+		return ctx.fastASExchange()
+	}
+
+	cname := ctx.client.Credentials.CName()
+	realm := ctx.client.Credentials.Domain()
+
+	asReq, err := messages.NewASReqForTGT(realm, ctx.client.Config, cname)
+	if err != nil {
+		return messages.ASRep{}, err
+	}
+
+	return ctx.client.ASExchange(realm, asReq, 0)
+}
+
+// tgsExchange obtains a ticket for spn from the KDC for realm using the TGT.
+func (ctx *Initiator) tgsExchange(spn types.PrincipalName, realm string, tgt messages.Ticket,
+	key types.EncryptionKey, renewal bool,
+) (messages.TGSRep, error) {
+	if ctx.fastEnabled() {
+		return ctx.fastTGSExchange(spn, realm, tgt, key, renewal)
+	}
+
+	tgsReq, _, _, err := ctx.tgsRequest(spn, realm, tgt, key, renewal, false)
+	if err != nil {
+		return messages.TGSRep{}, err
+	}
+
+	_, tgsRep, err := ctx.client.TGSExchange(tgsReq, realm, tgt, key, 0)
+
+	return tgsRep, err
+}
@@ -0,0 +1,187 @@
+package gssapi
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testArmorPrincipal = "host/client.example.com"
+
+//nolint:funlen
+func TestFAST(t *testing.T) {
+	t.Parallel()
+
+	kdc := newTestKDC(t, etypeID.AES256_CTS_HMAC_SHA1_96)
+	kdc.addPrincipal(testClient, "password", true)
+	kdc.addPrincipal(testArmorPrincipal, "armor", false)
+	kdc.addPrincipal(testService, "service", false)
+
+	b, err := kdc.keytab.Marshal()
+	require.NoError(t, err)
+
+	kt := filepath.Join(t.TempDir(), "krb5.keytab")
+	require.NoError(t, os.WriteFile(kt, b, 0o600))
+
+	options := func(password string) []Option[Initiator] {
+		return []Option[Initiator]{
+			WithConfig[Initiator](kdc.config()),
+			WithDomain[Initiator](testRealm),
+			WithUsername[Initiator](testClient),
+			WithPassword[Initiator](password),
+			WithFAST[Initiator](testArmorPrincipal+"@"+testRealm, kt),
+		}
+	}
+
+	t.Run("established", func(t *testing.T) {
+		initiator, err := NewInitiator(options("password")...)
+		require.NoError(t, err)
+
+		defer initiator.Close()
+
+		acceptor, err := NewAcceptor(WithAcceptorConfig[Acceptor](kdc.config()), WithKeytab[Acceptor](kt))
+		require.NoError(t, err)
+
+		defer acceptor.Close()
+
+		output, _, err := initiator.Initiate(testService, 0, nil)
+		require.NoError(t, err)
+
+		_, _, err = acceptor.Accept(output)
+		require.NoError(t, err)
+
+		assert.True(t, acceptor.Established())
+		assert.Equal(t, testClient+"@"+testRealm, acceptor.PeerName().String())
+		assert.Positive(t, kdc.count("FAST TGS"))
+	})
+
+	t.Run("preauth failed", func(t *testing.T) {
+		_, err := NewInitiator(options("wrong")...)
+
+		var krbError messages.KRBError
+		if assert.True(t, errors.As(err, &krbError)) {
+			assert.Equal(t, errorcode.KDC_ERR_PREAUTH_FAILED, krbError.ErrorCode)
+		}
+	})
+
+	t.Run("without FAST", func(t *testing.T) {
+		// The KDC insists on FAST for the client
+		_, err := NewInitiator(options("password")[:4]...)
+		assert.Error(t, err)
+	})
+}
+
+func TestFASTReferral(t *testing.T) {
+	t.Parallel()
+
+	kdc := newTestKDC(t, etypeID.AES256_CTS_HMAC_SHA1_96)
+	kdc.addPrincipal(testClient, "password", true)
+	kdc.addPrincipal(testArmorPrincipal, "armor", false)
+	kdc.addPrincipal(testService, "service", false)
+	kdc.addPrincipal("krbtgt/"+testOtherRealm, "referral", false)
+	kdc.referrals[testService] = testOtherRealm
+
+	b, err := kdc.keytab.Marshal()
+	require.NoError(t, err)
+
+	kt := filepath.Join(t.TempDir(), "krb5.keytab")
+	require.NoError(t, os.WriteFile(kt, b, 0o600))
+
+	initiator, err := NewInitiator(
+		WithConfig[Initiator](kdc.config()),
+		WithDomain[Initiator](testRealm),
+		WithUsername[Initiator](testClient),
+		WithPassword[Initiator]("password"),
+		WithFAST[Initiator](testArmorPrincipal, kt),
+	)
+	require.NoError(t, err)
+
+	defer initiator.Close()
+
+	_, _, err = initiator.Initiate(testService, 0, nil)
+	require.NoError(t, err)
+
+	// The referral TGT and then the service ticket from the other realm
+	assert.Equal(t, 2, kdc.count("FAST TGS"))
+	assert.Equal(t, testService+"@"+testOtherRealm, initiator.PeerName().String())
+
+	// The service ticket is reused for the same target
+	initiator.Reset()
+
+	_, _, err = initiator.Initiate(testService, 0, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, kdc.count("FAST TGS"))
+	assert.False(t, initiator.Inquire().StartTime.IsZero())
+
+	// The same service requested in the other realm is a different target
+	initiator.Reset()
+
+	_, _, err = initiator.Initiate(testService+"@"+testOtherRealm, 0, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 4, kdc.count("FAST TGS"))
+	assert.Equal(t, testService+"@"+testOtherRealm, initiator.PeerName().String())
+}
+
+func TestFASTUnsupported(t *testing.T) {
+	t.Parallel()
+
+	kdc := newTestKDC(t, etypeID.AES128_CTS_HMAC_SHA256_128)
+	kdc.addPrincipal(testClient, "password", true)
+	kdc.addPrincipal(testArmorPrincipal, "armor", false)
+	kdc.noFAST = true
+
+	b, err := kdc.keytab.Marshal()
+	require.NoError(t, err)
+
+	kt := filepath.Join(t.TempDir(), "krb5.keytab")
+	require.NoError(t, os.WriteFile(kt, b, 0o600))
+
+	_, err = NewInitiator(
+		WithConfig[Initiator](kdc.config()),
+		WithDomain[Initiator](testRealm),
+		WithUsername[Initiator](testClient),
+		WithPassword[Initiator]("password"),
+		WithFAST[Initiator](testArmorPrincipal, kt),
+	)
+	assert.ErrorIs(t, err, errFASTUnsupported)
+}
+
+func TestFASTProtectedError(t *testing.T) {
+	t.Parallel()
+
+	kdc := newTestKDC(t, etypeID.AES256_CTS_HMAC_SHA1_96)
+	kdc.addPrincipal(testClient, "password", true)
+	kdc.addPrincipal(testArmorPrincipal, "armor", false)
+	kdc.tgsError = errorcode.KDC_ERR_S_PRINCIPAL_UNKNOWN
+
+	b, err := kdc.keytab.Marshal()
+	require.NoError(t, err)
+
+	kt := filepath.Join(t.TempDir(), "krb5.keytab")
+	require.NoError(t, os.WriteFile(kt, b, 0o600))
+
+	initiator, err := NewInitiator(
+		WithConfig[Initiator](kdc.config()),
+		WithDomain[Initiator](testRealm),
+		WithUsername[Initiator](testClient),
+		WithPassword[Initiator]("password"),
+		WithFAST[Initiator](testArmorPrincipal, kt),
+	)
+	require.NoError(t, err)
+
+	defer initiator.Close()
+
+	_, _, err = initiator.Initiate(testService, 0, nil)
+
+	var krbError messages.KRBError
+	if assert.True(t, errors.As(err, &krbError)) {
+		assert.Equal(t, errorcode.KDC_ERR_S_PRINCIPAL_UNKNOWN, krbError.ErrorCode)
+	}
+}
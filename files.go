@@ -1,7 +1,6 @@
 package gssapi
 
 import (
-	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -24,73 +23,150 @@ const (
 //nolint:gochecknoglobals
 var fs = afero.NewOsFs()
 
-func findFile(logger logr.Logger, env string, try []string) (string, error) {
-	logger.Info("looking for file", "env", env, "paths", try)
+// sources is where an Initiator or Acceptor reads its configuration,
+// credential caches and keytabs from. By default the KRB5* environment
+// variables are consulted, falling back to the usual paths, but each can be
+// overridden with options so that several independently configured
+// instances can coexist in one process.
+type sources struct {
+	fs        afero.Fs
+	lookupEnv func(string) (string, bool)
+
+	config        string
+	configOverlay bool
+	configPath    *string
+	ccacheName    string
+}
 
-	path, ok := os.LookupEnv(env)
-	if ok {
-		path = strings.TrimPrefix(path, krb5FilePrefix)
+func defaultSources() *sources {
+	return &sources{
+		fs:        fs,
+		lookupEnv: os.LookupEnv,
+	}
+}
 
-		if _, err := fs.Stat(path); err != nil {
-			return "", fmt.Errorf("%s: %w", env, err)
-		}
+// configPaths returns the configuration files to read, either from the
+// explicit path, the colon-separated KRB5_CONFIG environment variable or
+// the default.
+func (s *sources) configPaths() []string {
+	if s.configPath != nil {
+		return strings.Split(*s.configPath, ":")
+	}
 
-		return path, nil
+	if env, ok := s.lookupEnv(krb5Config); ok {
+		return strings.Split(env, ":")
 	}
 
-	errs := fmt.Errorf("%s: not found", env)
+	return []string{"/etc/krb5.conf"}
+}
+
+// loadProfile adds the configuration files into p, skipping any that don't
+// exist. If required is true then at least one file must exist.
+func (s *sources) loadProfile(logger logr.Logger, p *profile, required bool) error {
+	paths := s.configPaths()
+
+	logger.Info("loading configuration", "paths", paths)
+
+	found := false
 
-	for _, t := range try {
-		if _, err := fs.Stat(t); err != nil {
-			errs = errors.Join(errs, err)
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
 
+		if _, err := s.fs.Stat(path); err != nil {
 			if os.IsNotExist(err) {
 				continue
 			}
 
-			return "", errs
+			return fmt.Errorf("%s: %w", krb5Config, err)
+		}
+
+		if err := p.parseFile(s.fs, path); err != nil {
+			return err
 		}
 
-		return t, nil
+		found = true
+	}
+
+	if !found && required {
+		return fmt.Errorf("%s: %w", strings.Join(paths, ":"), os.ErrNotExist)
 	}
 
-	return "", errs
+	return nil
 }
 
-func loadConfig(logger logr.Logger) (*config.Config, error) {
-	path, err := findFile(logger, krb5Config, []string{"/etc/krb5.conf"})
+// newConfigFromProfile hands the merged profile to gokrb5.
+func newConfigFromProfile(p *profile) (*config.Config, *profile, error) {
+	var b strings.Builder
+	if err := p.render(&b); err != nil {
+		return nil, nil, err
+	}
+
+	cfg, err := config.NewFromString(b.String())
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return config.Load(path)
+	return cfg, p, nil
 }
 
-func loadCCache(logger logr.Logger) (*credentials.CCache, error) {
-	path, err := findFile(logger, krb5CCName, []string{fmt.Sprintf("/tmp/krb5cc_%d", os.Getuid())})
-	if err != nil {
-		return nil, err
+// loadConfig returns the configuration, which is either the contents passed
+// with WithConfig, those contents layered on top of the configuration files
+// with WithConfigOverlay, or just the configuration files.
+func (s *sources) loadConfig(logger logr.Logger) (*config.Config, *profile, error) {
+	p := new(profile)
+
+	if s.config != "" {
+		if err := p.parse(s.fs, strings.NewReader(s.config)); err != nil {
+			return nil, nil, err
+		}
+
+		if !s.configOverlay {
+			return newConfigFromProfile(p)
+		}
+	}
+
+	if err := s.loadProfile(logger, p, s.config == ""); err != nil {
+		return nil, nil, err
 	}
 
-	return credentials.LoadCCache(path)
+	return newConfigFromProfile(p)
 }
 
-func loadKeytab(logger logr.Logger) (*keytab.Keytab, error) {
-	path, err := findFile(logger, krb5KTName, []string{"/etc/krb5.keytab"})
+func defaultCCacheNames() []string {
+	return []string{fmt.Sprintf("/tmp/krb5cc_%d", os.Getuid())}
+}
+
+// loadCCache resolves and reads the default credential cache, which must
+// exist.
+func (s *sources) loadCCache(logger logr.Logger, p *profile) (credCache, *credentials.CCache, error) {
+	name := s.defaultCCacheName(p)
+
+	logger.Info("loading credential cache", "name", name)
+
+	cc, err := s.resolveCCache(name, p)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return keytab.Load(path)
-}
-
-func loadClientKeytab(logger logr.Logger) (*keytab.Keytab, error) {
-	path, err := findFile(logger,
-		krb5ClientKTName,
-		[]string{fmt.Sprintf("/var/kerberos/krb5/user/%d/client.keytab", os.Geteuid())})
+	cache, err := cc.read()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	if cache == nil {
+		return nil, nil, fmt.Errorf("%s: %w", cc.name(), os.ErrNotExist)
 	}
 
-	return keytab.Load(path)
+	return cc, cache, nil
+}
+
+func (s *sources) loadKeytab(logger logr.Logger) (*keytab.Keytab, error) {
+	return s.loadKeytabName(logger, krb5KTName, krb5FilePrefix+"/etc/krb5.keytab")
+}
+
+func (s *sources) loadClientKeytab(logger logr.Logger) (*keytab.Keytab, error) {
+	return s.loadKeytabName(logger, krb5ClientKTName,
+		fmt.Sprintf("%s/var/kerberos/krb5/user/%d/client.keytab", krb5FilePrefix, os.Geteuid()))
 }
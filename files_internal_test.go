@@ -4,15 +4,17 @@ import (
 	"errors"
 	iofs "io/fs"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/go-logr/logr/testr"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-const findFileEnvironment = "FIND_FILE"
-
 var errStatError = errors.New("stat error")
 
 type statErrorFs struct {
@@ -24,98 +26,140 @@ func (statErrorFs) Stat(_ string) (os.FileInfo, error) {
 }
 
 //nolint:funlen,paralleltest
-func TestFindFile(t *testing.T) {
+func TestLoadProfile(t *testing.T) {
+	files := map[string]string{
+		"/etc/krb5.conf": `includedir /etc/krb5.conf.d/
+
+[libdefaults]
+  default_realm = EXAMPLE.COM
+  dns_lookup_kdc = false
+
+[realms]
+  EXAMPLE.COM = {
+    kdc = kdc1.example.com
+  }
+`,
+		"/etc/krb5.conf.d/crypto-policies": `[libdefaults]
+  permitted_enctypes = aes256-cts-hmac-sha1-96
+`,
+		"/etc/krb5.conf.d/local.conf": `include /etc/krb5.local
+`,
+		"/etc/krb5.conf.d/ignored.rpmsave": `[libdefaults]
+  default_realm = IGNORED.COM
+`,
+		"/etc/krb5.local": `[realms]
+  EXAMPLE.COM = {
+    kdc = kdc2.example.com
+  }
+`,
+		"/home/user/krb5.conf": `[libdefaults]
+  default_realm = USER.COM
+  ticket_lifetime* = 1h
+
+[domain_realm] *
+  .example.com = USER.COM
+`,
+		"/etc/final.conf": `[libdefaults]
+  ticket_lifetime = 2h
+
+[domain_realm]
+  .example.com = EXAMPLE.COM
+  .example.org = EXAMPLE.COM
+`,
+		"/etc/relative.conf": `include krb5.local
+`,
+	}
+
 	tables := []struct {
 		name   string
-		fs     afero.Fs
-		files  []string
 		env    string
-		try    []string
-		result string
+		path   []string
+		values []string
 		err    error
 	}{
+		{"default", "", []string{"libdefaults", "default_realm"}, []string{"EXAMPLE.COM"}, nil},
+		{"includedir", "", []string{"libdefaults", "permitted_enctypes"}, []string{"aes256-cts-hmac-sha1-96"}, nil},
+		{"ignored", "", []string{"libdefaults", "default_realm"}, []string{"EXAMPLE.COM"}, nil},
+		{"include", "", []string{"realms", "EXAMPLE.COM", "kdc"}, []string{"kdc2.example.com", "kdc1.example.com"}, nil},
 		{
-			"goodenv",
-			afero.NewMemMapFs(),
-			[]string{"/foo"},
-			"/foo",
-			[]string{},
-			"/foo",
+			"first wins",
+			"/home/user/krb5.conf:/missing:/etc/krb5.conf",
+			[]string{"libdefaults", "default_realm"},
+			[]string{"USER.COM", "EXAMPLE.COM"},
 			nil,
 		},
 		{
-			"first",
-			afero.NewMemMapFs(),
-			[]string{"/foo"},
-			"",
-			[]string{"/foo", "/bar"},
-			"/foo",
+			"final relation",
+			"/home/user/krb5.conf:/etc/final.conf",
+			[]string{"libdefaults", "ticket_lifetime"},
+			[]string{"1h"},
 			nil,
 		},
 		{
-			"second",
-			afero.NewMemMapFs(),
-			[]string{"/bar"},
-			"",
-			[]string{"/foo", "/bar"},
-			"/bar",
+			"final section",
+			"/home/user/krb5.conf:/etc/final.conf",
+			[]string{"domain_realm", ".example.org"},
+			nil,
 			nil,
 		},
-		{
-			"badenv",
-			afero.NewMemMapFs(),
-			[]string{"/bar"},
-			"/foo",
-			[]string{},
-			"",
-			iofs.ErrNotExist,
-		},
-		{
-			"badstat",
-			statErrorFs{afero.NewMemMapFs()},
-			[]string{"/foo"},
-			"",
-			[]string{"/foo"},
-			"",
-			errStatError,
-		},
-		{
-			"none",
-			afero.NewMemMapFs(),
-			[]string{},
-			"",
-			[]string{"/foo"},
-			"",
-			iofs.ErrNotExist,
-		},
+		{"missing", "/missing:/also/missing", nil, nil, iofs.ErrNotExist},
+		{"relative", "/etc/relative.conf", nil, nil, errProfileSyntax},
 	}
 
-	//nolint:paralleltest
 	for _, table := range tables {
 		t.Run(table.name, func(t *testing.T) {
 			oldFs := fs
 			defer func() { fs = oldFs }()
 
-			fs = table.fs
+			fs = afero.NewMemMapFs()
 
-			for _, file := range table.files {
-				if err := afero.WriteFile(fs, file, nil, 0); err != nil {
+			for file, contents := range files {
+				if err := afero.WriteFile(fs, file, []byte(contents), 0o644); err != nil {
 					t.Fatal(err)
 				}
 			}
 
 			if table.env != "" {
-				t.Setenv(findFileEnvironment, table.env)
+				t.Setenv(krb5Config, table.env)
+			} else {
+				unsetenv(t, krb5Config)
 			}
 
-			result, err := findFile(testr.New(t), findFileEnvironment, table.try)
+			p := new(profile)
 
-			assert.Equal(t, table.result, result)
-			assert.ErrorIs(t, err, table.err)
+			err := defaultSources().loadProfile(testr.New(t), p, true)
+			if table.err != nil {
+				assert.ErrorIs(t, err, table.err)
+
+				return
+			}
+
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			assert.Equal(t, table.values, p.values(table.path...))
+
+			// gokrb5 sees the same first value
+			cfg, _, err := newConfigFromProfile(p)
+			if assert.NoError(t, err) && table.path[1] == "default_realm" {
+				assert.Equal(t, table.values[0], cfg.LibDefaults.DefaultRealm)
+			}
 		})
 	}
 }
 
+// unsetenv unsets the environment variable for the duration of the test.
+func unsetenv(t *testing.T, key string) {
+	t.Helper()
+
+	t.Setenv(key, "")
+
+	if err := os.Unsetenv(key); err != nil {
+		t.Fatal(err)
+	}
+}
+
 //nolint:paralleltest
 func TestLoadConfig(t *testing.T) {
 	oldFs := fs
@@ -123,7 +167,7 @@ func TestLoadConfig(t *testing.T) {
 
 	fs = statErrorFs{afero.NewMemMapFs()}
 
-	_, err := loadConfig(testr.New(t))
+	_, _, err := defaultSources().loadConfig(testr.New(t))
 
 	assert.ErrorIs(t, err, errStatError)
 }
@@ -135,7 +179,7 @@ func TestLoadCCache(t *testing.T) {
 
 	fs = statErrorFs{afero.NewMemMapFs()}
 
-	_, err := loadCCache(testr.New(t))
+	_, _, err := defaultSources().loadCCache(testr.New(t), nil)
 
 	assert.ErrorIs(t, err, errStatError)
 }
@@ -147,7 +191,7 @@ func TestLoadKeytab(t *testing.T) {
 
 	fs = statErrorFs{afero.NewMemMapFs()}
 
-	_, err := loadKeytab(testr.New(t))
+	_, err := defaultSources().loadKeytab(testr.New(t))
 
 	assert.ErrorIs(t, err, errStatError)
 }
@@ -159,7 +203,136 @@ func TestLoadClientKeytab(t *testing.T) {
 
 	fs = statErrorFs{afero.NewMemMapFs()}
 
-	_, err := loadClientKeytab(testr.New(t))
+	_, err := defaultSources().loadClientKeytab(testr.New(t))
 
 	assert.ErrorIs(t, err, errStatError)
 }
+
+func TestLoadConfigOverlay(t *testing.T) {
+	t.Parallel()
+
+	fsys := afero.NewMemMapFs()
+
+	if err := afero.WriteFile(fsys, "/etc/krb5.conf", []byte(`[libdefaults]
+  default_realm = EXAMPLE.COM
+  ticket_lifetime = 10h
+
+[realms]
+  EXAMPLE.COM = {
+    kdc = kdc.example.com
+  }
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &sources{
+		fs:            fsys,
+		lookupEnv:     func(string) (string, bool) { return "", false },
+		config:        "[libdefaults]\n  ticket_lifetime = 1h\n",
+		configOverlay: true,
+	}
+
+	cfg, _, err := s.loadConfig(testr.New(t))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, "EXAMPLE.COM", cfg.LibDefaults.DefaultRealm)
+	assert.Equal(t, time.Hour, cfg.LibDefaults.TicketLifetime)
+
+	_, kdcs, err := cfg.GetKDCs("EXAMPLE.COM", false)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]string{1: "kdc.example.com:88"}, kdcs)
+
+	// Without any system configuration the overlay is used alone
+	missing := "/missing"
+	s.configPath = &missing
+	s.config = "[libdefaults]\n  default_realm = OTHER.COM\n"
+
+	cfg, _, err = s.loadConfig(testr.New(t))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "OTHER.COM", cfg.LibDefaults.DefaultRealm)
+	}
+
+	// Without the overlay the system configuration is ignored entirely
+	s.configPath = nil
+	s.configOverlay = false
+
+	cfg, _, err = s.loadConfig(testr.New(t))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "OTHER.COM", cfg.LibDefaults.DefaultRealm)
+		assert.Equal(t, 24*time.Hour, cfg.LibDefaults.TicketLifetime)
+	}
+}
+
+//nolint:paralleltest
+func TestSourcesOptions(t *testing.T) {
+	env := newTestEnvironment(t, etypeID.AES256_CTS_HMAC_SHA1_96)
+
+	// Nothing usable via the environment
+	missing := filepath.Join(env.dir, "missing")
+	t.Setenv(krb5Config, missing)
+	t.Setenv(krb5CCName, krb5FilePrefix+missing)
+	t.Setenv(krb5KTName, krb5FilePrefix+missing)
+
+	noEnv := func(string) (string, bool) { return "", false }
+
+	t.Run("paths", func(t *testing.T) {
+		establish(t, 0, []Option[Initiator]{
+			WithLookupEnv[Initiator](noEnv),
+			WithConfigPath[Initiator](missing + ":" + env.config),
+			WithCCache[Initiator](krb5FilePrefix + env.ccache),
+		}, []Option[Acceptor]{
+			WithLookupEnv[Acceptor](noEnv),
+			WithAcceptorConfigPath[Acceptor](env.config),
+			WithKeytab[Acceptor](env.keytab),
+		})
+	})
+
+	t.Run("fs", func(t *testing.T) {
+		fsys := afero.NewMemMapFs()
+
+		for src, dst := range map[string]string{
+			env.config: "/etc/krb5.conf",
+			env.keytab: "/etc/krb5.keytab",
+			env.ccache: defaultCCacheNames()[0],
+		} {
+			b, err := os.ReadFile(src)
+			require.NoError(t, err)
+			require.NoError(t, afero.WriteFile(fsys, dst, b, 0o600))
+		}
+
+		establish(t, 0, []Option[Initiator]{
+			WithFs[Initiator](fsys),
+			WithLookupEnv[Initiator](noEnv),
+		}, []Option[Acceptor]{
+			WithFs[Acceptor](fsys),
+			WithLookupEnv[Acceptor](noEnv),
+		})
+	})
+
+	t.Run("config", func(t *testing.T) {
+		vars := map[string]string{
+			krb5CCName: krb5FilePrefix + env.ccache,
+			krb5KTName: krb5FilePrefix + env.keytab,
+		}
+
+		lookupEnv := func(key string) (string, bool) {
+			value, ok := vars[key]
+
+			return value, ok
+		}
+
+		_, acceptor := establish(t, 0, []Option[Initiator]{
+			WithLookupEnv[Initiator](lookupEnv),
+			WithConfig[Initiator](testConfig),
+		}, []Option[Acceptor]{
+			WithLookupEnv[Acceptor](lookupEnv),
+			WithAcceptorConfig[Acceptor](testConfig),
+		})
+
+		name, err := acceptor.LocalName()
+		require.NoError(t, err)
+		assert.Equal(t, testClient, name)
+	})
+}
@@ -0,0 +1,255 @@
+// Package grpcgss provides gRPC credentials and interceptors that
+// authenticate with Kerberos using the github.com/bodgit/gssapi package.
+package grpcgss
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"github.com/bodgit/gssapi"
+	krb5gssapi "github.com/jcmturner/gokrb5/v8/gssapi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	authorizationKey = "authorization"
+	authenticateKey  = "www-authenticate"
+	negotiatePrefix  = "Negotiate "
+)
+
+var (
+	errNoToken        = errors.New("no negotiate token")
+	errContinueNeeded = errors.New("negotiate requires more than one round")
+)
+
+type peerNameKey struct{}
+
+// PeerNameFromContext returns the authenticated client in the context of a
+// call received by a server using either UnaryServerInterceptor,
+// StreamServerInterceptor or the transport credentials returned by
+// NewServerTransportCredentials.
+func PeerNameFromContext(ctx context.Context) (*gssapi.Name, bool) {
+	if name, ok := ctx.Value(peerNameKey{}).(*gssapi.Name); ok {
+		return name, true
+	}
+
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(AuthInfo); ok {
+			return info.PeerName, true
+		}
+	}
+
+	return nil, false
+}
+
+// PerRPCCredentials attaches a Negotiate token to each outgoing call. A single
+// Initiator is created on first use and reset for each call so each token is
+// for a new context but the credentials and service ticket are reused.
+// Mutual authentication is not performed.
+type PerRPCCredentials struct {
+	// Insecure permits tokens to be sent over connections without
+	// transport security. Anyone who observes a token can replay it until
+	// it falls outside the Acceptor's clock skew.
+	Insecure bool
+
+	service string
+	options []gssapi.Option[gssapi.Initiator]
+
+	// lock is a semaphore rather than a sync.Mutex so waiting for it can
+	// be abandoned when a call is cancelled
+	lock      chan struct{}
+	initiator *gssapi.Initiator
+}
+
+// NewPerRPCCredentials returns PerRPCCredentials that authenticate to the
+// service using an Initiator created with the given options. The service is
+// in any form accepted by Initiator.Initiate.
+func NewPerRPCCredentials(service string, options ...gssapi.Option[gssapi.Initiator]) *PerRPCCredentials {
+	return &PerRPCCredentials{
+		service: service,
+		options: options,
+		lock:    make(chan struct{}, 1),
+	}
+}
+
+// initiate returns the initial token for a new context, creating the
+// Initiator if necessary. The caller must hold the lock.
+func (c *PerRPCCredentials) initiate() ([]byte, error) {
+	if c.initiator == nil {
+		initiator, err := gssapi.NewInitiator(c.options...)
+		if err != nil {
+			return nil, err
+		}
+
+		c.initiator = initiator
+	}
+
+	c.initiator.Reset()
+
+	token, _, err := c.initiator.Initiate(c.service, krb5gssapi.ContextFlagInteg, nil)
+
+	return token, err
+}
+
+// GetRequestMetadata returns the authorization metadata for a call. If ctx is
+// done before a token is available then its error is returned, any exchange
+// with the KDC that is in progress continues in the background.
+func (c *PerRPCCredentials) GetRequestMetadata(ctx context.Context, _ ...string) (map[string]string, error) {
+	select {
+	case c.lock <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	type result struct {
+		token []byte
+		err   error
+	}
+
+	done := make(chan result, 1)
+
+	go func() {
+		defer func() { <-c.lock }()
+
+		token, err := c.initiate()
+		done <- result{token, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		return map[string]string{
+			authorizationKey: negotiatePrefix + base64.StdEncoding.EncodeToString(r.token),
+		}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close releases the Initiator, a subsequent call will create a new one.
+func (c *PerRPCCredentials) Close() error {
+	c.lock <- struct{}{}
+	defer func() { <-c.lock }()
+
+	if c.initiator == nil {
+		return nil
+	}
+
+	err := c.initiator.Close()
+	c.initiator = nil
+
+	return err
+}
+
+// RequireTransportSecurity reports whether the credentials require transport
+// security.
+func (c *PerRPCCredentials) RequireTransportSecurity() bool {
+	return !c.Insecure
+}
+
+// authenticate accepts the Negotiate token in the incoming metadata and
+// returns the context with the peer name added and any output token for the
+// client.
+func authenticate(ctx context.Context, options []gssapi.Option[gssapi.Acceptor]) (context.Context, []byte, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	var token []byte
+
+	for _, v := range md.Get(authorizationKey) {
+		if len(v) < len(negotiatePrefix) || !strings.EqualFold(v[:len(negotiatePrefix)], negotiatePrefix) {
+			continue
+		}
+
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v[len(negotiatePrefix):]))
+		if err != nil {
+			return nil, nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+
+		token = b
+
+		break
+	}
+
+	if len(token) == 0 {
+		return nil, nil, status.Error(codes.Unauthenticated, errNoToken.Error())
+	}
+
+	acceptor, err := gssapi.NewAcceptor(options...)
+	if err != nil {
+		return nil, nil, status.Error(codes.Internal, err.Error())
+	}
+
+	defer acceptor.Close()
+
+	output, cont, err := acceptor.Accept(token)
+	if err != nil {
+		return nil, nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	if cont || !acceptor.Established() {
+		return nil, nil, status.Error(codes.Unauthenticated, errContinueNeeded.Error())
+	}
+
+	return context.WithValue(ctx, peerNameKey{}, acceptor.PeerName()), output, nil
+}
+
+func authenticateMetadata(output []byte) metadata.MD {
+	return metadata.Pairs(authenticateKey, negotiatePrefix+base64.StdEncoding.EncodeToString(output))
+}
+
+// UnaryServerInterceptor returns a server interceptor that authenticates each
+// unary call with an Acceptor created with the given options. The client
+// can be retrieved from the handler's context with PeerNameFromContext.
+func UnaryServerInterceptor(options ...gssapi.Option[gssapi.Acceptor]) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, output, err := authenticate(ctx, options)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(output) > 0 {
+			if err = grpc.SetHeader(ctx, authenticateMetadata(output)); err != nil {
+				return nil, err
+			}
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context //nolint:containedctx
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// StreamServerInterceptor is the same as UnaryServerInterceptor but for
+// streaming calls.
+func StreamServerInterceptor(options ...gssapi.Option[gssapi.Acceptor]) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, output, err := authenticate(ss.Context(), options)
+		if err != nil {
+			return err
+		}
+
+		if len(output) > 0 {
+			if err = ss.SetHeader(authenticateMetadata(output)); err != nil {
+				return err
+			}
+		}
+
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+}
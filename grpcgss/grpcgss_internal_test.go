@@ -0,0 +1,104 @@
+package grpcgss
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthenticate(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		name string
+		md   metadata.MD
+	}{
+		{"missing", metadata.MD{}},
+		{"basic", metadata.Pairs(authorizationKey, "Basic dXNlcjpwYXNz")},
+		{"bad base64", metadata.Pairs(authorizationKey, "Negotiate !!!")},
+		{"bad token", metadata.Pairs(authorizationKey, "negotiate YWJjZA==")},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, _, err := authenticate(metadata.NewIncomingContext(context.Background(), table.md), nil)
+			assert.Equal(t, codes.Unauthenticated, status.Code(err))
+		})
+	}
+}
+
+type testWrapper struct{}
+
+func (testWrapper) Wrap(message []byte, _ bool) ([]byte, error) {
+	return bytes.Clone(message), nil
+}
+
+func (testWrapper) Unwrap(token []byte) ([]byte, bool, error) {
+	return token, true, nil
+}
+
+func TestConn(t *testing.T) {
+	t.Parallel()
+
+	client, server := net.Pipe()
+
+	c := newConn(client, testWrapper{}, io.NopCloser(nil))
+	s := newConn(server, testWrapper{}, io.NopCloser(nil))
+
+	message := bytes.Repeat([]byte("0123456789"), maxChunkLength/4)
+
+	go func() {
+		n, err := c.Write(message)
+		assert.NoError(t, err)
+		assert.Equal(t, len(message), n)
+		assert.NoError(t, c.Close())
+	}()
+
+	b, err := io.ReadAll(s)
+	require.NoError(t, err)
+	assert.Equal(t, message, b)
+}
+
+func TestReadToken(t *testing.T) {
+	t.Parallel()
+
+	b := new(bytes.Buffer)
+	require.NoError(t, writeToken(b, []byte("token")))
+
+	token, err := readToken(b)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("token"), token)
+
+	_, err = readToken(bytes.NewReader([]byte{0, 1, 0, 1}))
+	assert.ErrorIs(t, err, errTokenTooLong)
+}
+
+func TestPerRPCCredentialsContext(t *testing.T) {
+	t.Parallel()
+
+	creds := NewPerRPCCredentials("host/test.example.com")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Simulate another call in progress
+	creds.lock <- struct{}{}
+
+	_, err := creds.GetRequestMetadata(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, creds.initiator)
+
+	<-creds.lock
+
+	require.NoError(t, creds.Close())
+}
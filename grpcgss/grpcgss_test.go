@@ -0,0 +1,133 @@
+package grpcgss_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bodgit/gssapi"
+	"github.com/bodgit/gssapi/grpcgss"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func environmentVariables(t *testing.T) (string, string, string, string) {
+	t.Helper()
+
+	var values [4]string
+
+	for i, name := range []string{"TEST_HOST", "TEST_REALM", "TEST_USERNAME", "TEST_PASSWORD"} {
+		var ok bool
+		if values[i], ok = os.LookupEnv(name); !ok {
+			t.Fatalf("%s is not set", name)
+		}
+	}
+
+	return values[0], values[1], values[2], values[3]
+}
+
+func peerNameInterceptor(t *testing.T, username string) grpc.UnaryServerInterceptor {
+	t.Helper()
+
+	return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		name, ok := grpcgss.PeerNameFromContext(ctx)
+		if assert.True(t, ok) {
+			assert.True(t, strings.HasPrefix(name.String(), username+"@"))
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+func check(t *testing.T, serverOptions []grpc.ServerOption, dialOptions []grpc.DialOption) {
+	t.Helper()
+
+	listener := bufconn.Listen(1024 * 1024)
+
+	server := grpc.NewServer(serverOptions...)
+	healthpb.RegisterHealthServer(server, health.NewServer())
+
+	go func() {
+		_ = server.Serve(listener)
+	}()
+
+	t.Cleanup(server.Stop)
+
+	dialOptions = append(dialOptions, grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return listener.DialContext(ctx)
+	}))
+
+	conn, err := grpc.NewClient("passthrough:///bufnet", dialOptions...)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = conn.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.GetStatus())
+}
+
+func TestGRPC(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	host, realm, username, password := environmentVariables(t)
+
+	service := "host/" + host
+	principal := types.NewPrincipalName(nametype.KRB_NT_SRV_HST, service)
+
+	initiatorOptions := []gssapi.Option[gssapi.Initiator]{
+		gssapi.WithRealm(realm),
+		gssapi.WithUsername(username),
+		gssapi.WithPassword(password),
+	}
+
+	acceptorOptions := []gssapi.Option[gssapi.Acceptor]{
+		gssapi.WithServicePrincipal(&principal),
+		gssapi.WithClockSkew(5 * time.Second),
+	}
+
+	t.Run("per-rpc", func(t *testing.T) {
+		t.Parallel()
+
+		creds := grpcgss.NewPerRPCCredentials(service, initiatorOptions...)
+		creds.Insecure = true
+
+		t.Cleanup(func() { _ = creds.Close() })
+
+		check(t, []grpc.ServerOption{
+			grpc.ChainUnaryInterceptor(grpcgss.UnaryServerInterceptor(acceptorOptions...),
+				peerNameInterceptor(t, username)),
+		}, []grpc.DialOption{
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithPerRPCCredentials(creds),
+		})
+	})
+
+	t.Run("transport", func(t *testing.T) {
+		t.Parallel()
+
+		check(t, []grpc.ServerOption{
+			grpc.Creds(grpcgss.NewServerTransportCredentials(acceptorOptions...)),
+			grpc.UnaryInterceptor(peerNameInterceptor(t, username)),
+		}, []grpc.DialOption{
+			grpc.WithTransportCredentials(grpcgss.NewClientTransportCredentials(service, initiatorOptions...)),
+		})
+	})
+}
@@ -0,0 +1,280 @@
+package grpcgss
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/bodgit/gssapi"
+	krb5gssapi "github.com/jcmturner/gokrb5/v8/gssapi"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	authType = "gssapi"
+
+	transportFlags = krb5gssapi.ContextFlagMutual | krb5gssapi.ContextFlagConf | krb5gssapi.ContextFlagInteg |
+		krb5gssapi.ContextFlagReplay | krb5gssapi.ContextFlagSequence
+
+	// maxTokenLength limits the size of any token read from the peer.
+	maxTokenLength = 64 * 1024
+	// maxChunkLength limits the plaintext wrapped in a single token.
+	maxChunkLength = 16 * 1024
+)
+
+var (
+	errTokenTooLong      = errors.New("token is too long")
+	errNotInitiator      = errors.New("transport credentials are not for a client")
+	errNotAcceptor       = errors.New("transport credentials are not for a server")
+	errNotConfidential   = errors.New("received token is not encrypted")
+	errNoConfidentiality = errors.New("context does not provide confidentiality")
+)
+
+// AuthInfo is the credentials.AuthInfo for connections using the transport
+// credentials returned by NewClientTransportCredentials and
+// NewServerTransportCredentials.
+type AuthInfo struct {
+	credentials.CommonAuthInfo
+	// PeerName is the authenticated peer.
+	PeerName *gssapi.Name
+}
+
+// AuthType returns the authentication type.
+func (AuthInfo) AuthType() string {
+	return authType
+}
+
+type transportCredentials struct {
+	initiator        bool
+	service          string
+	initiatorOptions []gssapi.Option[gssapi.Initiator]
+	acceptorOptions  []gssapi.Option[gssapi.Acceptor]
+	serverName       string
+}
+
+// NewClientTransportCredentials returns client transport credentials that
+// establish a context with the service using an Initiator created with the
+// given options and then protect all traffic with wrap tokens. If service
+// is empty the host-based "host" service of the server is used.
+//
+// This is intended for deployments without TLS; it provides neither the
+// performance nor the peer authentication of the server's hostname that TLS
+// does.
+func NewClientTransportCredentials(service string,
+	options ...gssapi.Option[gssapi.Initiator],
+) credentials.TransportCredentials {
+	return &transportCredentials{
+		initiator:        true,
+		service:          service,
+		initiatorOptions: options,
+	}
+}
+
+// NewServerTransportCredentials returns the server transport credentials
+// matching NewClientTransportCredentials, which accept a context using an
+// Acceptor created with the given options.
+func NewServerTransportCredentials(options ...gssapi.Option[gssapi.Acceptor]) credentials.TransportCredentials {
+	return &transportCredentials{
+		acceptorOptions: options,
+	}
+}
+
+func readToken(r io.Reader) ([]byte, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(b[:])
+	if n > maxTokenLength {
+		return nil, errTokenTooLong
+	}
+
+	token := make([]byte, n)
+	if _, err := io.ReadFull(r, token); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func writeToken(w io.Writer, token []byte) error {
+	b := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(token)), uint32(len(token))) //nolint:gosec
+	_, err := w.Write(append(b, token...))
+
+	return err
+}
+
+func (c *transportCredentials) ClientHandshake(ctx context.Context, authority string,
+	rawConn net.Conn,
+) (net.Conn, credentials.AuthInfo, error) {
+	if !c.initiator {
+		return nil, nil, errNotInitiator
+	}
+
+	service := c.service
+	if service == "" {
+		host := authority
+		if c.serverName != "" {
+			host = c.serverName
+		}
+
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		service = "host@" + host
+	}
+
+	options := append([]gssapi.Option[gssapi.Initiator]{
+		gssapi.WithMaxTokenSize[gssapi.Initiator](maxTokenLength),
+	}, c.initiatorOptions...)
+
+	initiator, err := gssapi.EstablishInitiator(ctx, gssapi.NewTokenReadWriter(rawConn, gssapi.LengthPrefixFraming{}),
+		service, transportFlags, options...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if initiator.Inquire().Flags&krb5gssapi.ContextFlagConf == 0 {
+		return nil, nil, errors.Join(errNoConfidentiality, initiator.Close())
+	}
+
+	return newConn(rawConn, initiator, initiator), newAuthInfo(initiator.PeerName()), nil
+}
+
+func (c *transportCredentials) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	if c.initiator {
+		return nil, nil, errNotAcceptor
+	}
+
+	options := append([]gssapi.Option[gssapi.Acceptor]{
+		gssapi.WithMaxTokenSize[gssapi.Acceptor](maxTokenLength),
+	}, c.acceptorOptions...)
+
+	acceptor, err := gssapi.EstablishAcceptor(context.Background(),
+		gssapi.NewTokenReadWriter(rawConn, gssapi.LengthPrefixFraming{}), options...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if acceptor.Inquire().Flags&krb5gssapi.ContextFlagConf == 0 {
+		return nil, nil, errors.Join(errNoConfidentiality, acceptor.Close())
+	}
+
+	return newConn(rawConn, acceptor, acceptor), newAuthInfo(acceptor.PeerName()), nil
+}
+
+func newAuthInfo(name *gssapi.Name) AuthInfo {
+	return AuthInfo{
+		CommonAuthInfo: credentials.CommonAuthInfo{
+			SecurityLevel: credentials.PrivacyAndIntegrity,
+		},
+		PeerName: name,
+	}
+}
+
+func (c *transportCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{
+		SecurityProtocol: authType,
+		ServerName:       c.serverName,
+	}
+}
+
+func (c *transportCredentials) Clone() credentials.TransportCredentials {
+	clone := *c
+
+	return &clone
+}
+
+func (c *transportCredentials) OverrideServerName(serverName string) error {
+	c.serverName = serverName
+
+	return nil
+}
+
+type wrapper interface {
+	Wrap(message []byte, conf bool) ([]byte, error)
+	Unwrap(token []byte) ([]byte, bool, error)
+}
+
+// conn protects the traffic on the underlying net.Conn with length-prefixed
+// wrap tokens.
+type conn struct {
+	net.Conn
+	wrapper wrapper
+	closer  io.Closer
+
+	rmu sync.Mutex
+	buf []byte
+
+	wmu sync.Mutex
+}
+
+func newConn(c net.Conn, w wrapper, closer io.Closer) *conn {
+	return &conn{
+		Conn:    c,
+		wrapper: w,
+		closer:  closer,
+	}
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.buf) == 0 {
+		token, err := readToken(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+
+		message, conf, err := c.wrapper.Unwrap(token)
+		if err != nil {
+			return 0, err
+		}
+
+		if !conf {
+			return 0, errNotConfidential
+		}
+
+		c.buf = message
+	}
+
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+
+	return n, nil
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var n int
+
+	for len(b) > 0 {
+		chunk := b[:min(len(b), maxChunkLength)]
+
+		token, err := c.wrapper.Wrap(chunk, true)
+		if err != nil {
+			return n, err
+		}
+
+		if err = writeToken(c.Conn, token); err != nil {
+			return n, err
+		}
+
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+
+	return n, nil
+}
+
+func (c *conn) Close() error {
+	return errors.Join(c.Conn.Close(), c.closer.Close())
+}
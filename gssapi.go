@@ -9,5 +9,6 @@ import "github.com/jcmturner/gokrb5/v8/gssapi"
 const (
 	supportedFlags = gssapi.ContextFlagMutual | gssapi.ContextFlagReplay |
 		gssapi.ContextFlagSequence | gssapi.ContextFlagConf |
-		gssapi.ContextFlagInteg
+		gssapi.ContextFlagInteg | gssapi.ContextFlagAnon |
+		ContextFlagDCEStyle
 )
@@ -0,0 +1,201 @@
+package gssapi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	ianaflags "github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+const (
+	testRealm      = "EXAMPLE.COM"
+	testOtherRealm = "OTHER.EXAMPLE.COM"
+	testService    = "host/test.example.com"
+	testClient     = "alice"
+	testConfig     = `[libdefaults]
+  default_realm = EXAMPLE.COM
+  ticket_lifetime = 24h
+
+[realms]
+  EXAMPLE.COM = {
+    kdc = 127.0.0.1:1
+  }
+
+[domain_realm]
+  .example.com = EXAMPLE.COM
+`
+)
+
+// testEnvironment is a self-contained Kerberos environment that doesn't need
+// a KDC. A credential cache is created containing a TGT and a service ticket
+// for testService so that an Initiator can build an AP-REQ entirely from the
+// cache, and a keytab is created for the Acceptor to decrypt it.
+type testEnvironment struct {
+	dir    string
+	ccache string
+	keytab string
+	config string
+}
+
+func newTicket(t *testing.T, kt *keytab.Keytab, sname types.PrincipalName, etype int32,
+	flags ...int,
+) (messages.Ticket, types.EncryptionKey, messages.EncKDCRepPart) {
+	t.Helper()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	f := types.NewKrbFlags()
+
+	for _, flag := range flags {
+		types.SetFlag(&f, flag)
+	}
+
+	cname := types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, testClient)
+
+	ticket, key, err := messages.NewTicket(cname, testRealm, sname, testRealm, f, kt, etype, 1,
+		now, now, now.Add(24*time.Hour), now.Add(7*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ticket, key, messages.EncKDCRepPart{
+		Key:       key,
+		Flags:     f,
+		AuthTime:  now,
+		StartTime: now,
+		EndTime:   now.Add(24 * time.Hour),
+		RenewTill: now.Add(7 * 24 * time.Hour),
+	}
+}
+
+//nolint:funlen
+func newTestEnvironment(t *testing.T, etype int32) *testEnvironment {
+	t.Helper()
+
+	dir := t.TempDir()
+	env := &testEnvironment{
+		dir:    dir,
+		ccache: filepath.Join(dir, "krb5cc"),
+		keytab: filepath.Join(dir, "krb5.keytab"),
+		config: filepath.Join(dir, "krb5.conf"),
+	}
+
+	if err := os.WriteFile(env.config, []byte(testConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	krbtgt := types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+testRealm)
+	service := types.NewPrincipalName(nametype.KRB_NT_SRV_HST, testService)
+
+	kdc := keytab.New()
+	if err := kdc.AddEntry(krbtgt.PrincipalNameString(), testRealm, "krbtgt", time.Now(), 1,
+		etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+		t.Fatal(err)
+	}
+
+	kt := keytab.New()
+	if err := kt.AddEntry(testService, testRealm, "service", time.Now(), 1, etype); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := kt.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.WriteFile(env.keytab, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cname := types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, testClient)
+	cache := newCCache(cname, testRealm)
+
+	for _, ticket := range []struct {
+		kt    *keytab.Keytab
+		sname types.PrincipalName
+		etype int32
+	}{
+		{kdc, krbtgt, etypeID.AES256_CTS_HMAC_SHA1_96},
+		{kt, service, etype},
+	} {
+		tkt, _, part := newTicket(t, ticket.kt, ticket.sname, ticket.etype,
+			ianaflags.Renewable, ianaflags.Initial)
+
+		var cred *credentials.Credential
+
+		if cred, err = newCredential(cname, testRealm, tkt, part); err != nil {
+			t.Fatal(err)
+		}
+
+		addCredential(cache, cred)
+	}
+
+	if err = os.WriteFile(env.ccache, marshalCCache(cache), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(krb5Config, env.config)
+	t.Setenv(krb5CCName, krb5FilePrefix+env.ccache)
+	t.Setenv(krb5KTName, krb5FilePrefix+env.keytab)
+
+	return env
+}
+
+// establish runs the handshake between a new Initiator and Acceptor created
+// from the test environment.
+func establish(t *testing.T, flags int,
+	initiatorOptions []Option[Initiator], acceptorOptions []Option[Acceptor],
+) (*Initiator, *Acceptor) {
+	t.Helper()
+
+	initiator, err := NewInitiator(initiatorOptions...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = initiator.Close() })
+
+	acceptor, err := NewAcceptor(acceptorOptions...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = acceptor.Close() })
+
+	var (
+		output, input []byte
+		cont          bool
+	)
+
+	for {
+		if output, cont, err = initiator.Initiate(testService, flags, input); err != nil {
+			t.Fatal(err)
+		}
+
+		// The final DCE style token is sent even though no reply is expected
+		if len(output) == 0 {
+			break
+		}
+
+		if input, _, err = acceptor.Accept(output); err != nil {
+			t.Fatal(err)
+		}
+
+		if !cont || len(input) == 0 {
+			break
+		}
+	}
+
+	if !initiator.Established() || !acceptor.Established() {
+		t.Fatal("context not established")
+	}
+
+	return initiator, acceptor
+}
@@ -1,17 +1,21 @@
 package gssapi
 
 import (
+	stdcrypto "crypto"
+	"crypto/x509"
 	"errors"
-	"fmt"
 	"math"
 	"math/bits"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/jcmturner/gokrb5/v8/client"
 	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
 	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
 	ianaflags "github.com/jcmturner/gokrb5/v8/iana/flags"
 	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
 	"github.com/jcmturner/gokrb5/v8/keytab"
@@ -21,27 +25,63 @@ import (
 	"github.com/jcmturner/gokrb5/v8/types"
 )
 
+var (
+	errAnonymousCredentials = errors.New("anonymous context requires anonymous credentials")
+	errNoTarget             = errors.New("no target name")
+)
+
 // Initiator represents the client side of the GSSAPI protocol.
 type Initiator struct {
 	context
 
-	config   string
 	domain   string
 	username string
 	password string
 	keytab   *string
-
-	client *client.Client
+	kt       *keytab.Keytab
+	encTypes []int32
+
+	refreshInterval time.Duration
+	refreshCallback func(RefreshEvent)
+	refreshEvents   []RefreshEvent
+	storeCCache     *string
+
+	armorPrincipal string
+	armorKeytab    string
+	armorAnonymous bool
+	armor          *tgtSession
+
+	certificate      *x509.Certificate
+	certificateChain []*x509.Certificate
+	signer           stdcrypto.Signer
+	keyAgreement     KeyAgreement
+	pkinitRoots      *x509.CertPool
+	anonymous        bool
+
+	mu          sync.Mutex
+	sources     *sources
+	krb5conf    *config.Config
+	profile     *profile
+	client      *client.Client
+	settings    []func(*client.Settings)
+	session     *tgtSession
+	tickets     map[string]cachedTicket
+	ccache      credCache
+	ccacheStamp string
+	stop        chan struct{}
+	done        chan struct{}
 
 	logger logr.Logger
 }
 
-func (ctx *Initiator) loadConfig() (*config.Config, error) {
-	if ctx.config != "" {
-		return config.NewFromString(ctx.config)
+// permittedEncTypes returns the encryption types passed with WithEncTypes or
+// else those in the libdefaults relation tag.
+func (ctx *Initiator) permittedEncTypes(tag string) []int32 {
+	if ctx.encTypes != nil {
+		return ctx.encTypes
 	}
 
-	return loadConfig(ctx.logger)
+	return profileEncTypes(ctx.profile, tag)
 }
 
 func (ctx *Initiator) usePassword() bool {
@@ -49,46 +89,88 @@ func (ctx *Initiator) usePassword() bool {
 }
 
 func (ctx *Initiator) useKeytab() bool {
-	return ctx.domain != "" && ctx.username != "" && ctx.keytab != nil
+	return ctx.domain != "" && ctx.username != "" && (ctx.keytab != nil || ctx.kt != nil)
 }
 
-func (ctx *Initiator) newClient() (*client.Client, error) {
-	cfg, err := ctx.loadConfig()
-	if err != nil {
-		return nil, err
-	}
-
-	settings := []func(*client.Settings){
-		client.DisablePAFXFAST(true),
-	}
+func (ctx *Initiator) useCertificate() bool {
+	return ctx.domain != "" && ctx.username != "" && ctx.certificate != nil && ctx.signer != nil
+}
 
+func (ctx *Initiator) credentials() (*credentials.Credentials, error) {
 	switch {
+	case ctx.anonymous:
+		creds := credentials.New(anonymousName, anonymousRealm)
+		creds.SetCName(anonymousPrincipal())
+
+		return creds, nil
+	case ctx.useCertificate():
+		return credentials.New(ctx.username, ctx.domain), nil
 	case ctx.usePassword():
-		return client.NewWithPassword(ctx.username, ctx.domain, ctx.password, cfg, settings...), nil
+		return credentials.New(ctx.username, ctx.domain).WithPassword(ctx.password), nil
 	case ctx.useKeytab():
-		var kt *keytab.Keytab
-
-		if *ctx.keytab != "" {
-			kt, err = keytab.Load(*ctx.keytab)
-		} else {
-			kt, err = loadClientKeytab(ctx.logger)
+		var (
+			kt  = ctx.kt
+			err error
+		)
+
+		switch {
+		case kt != nil:
+		case *ctx.keytab != "":
+			kt, err = ctx.sources.resolveKeytab(*ctx.keytab)
+		default:
+			kt, err = ctx.sources.loadClientKeytab(ctx.logger)
 		}
 
 		if err != nil {
 			return nil, err
 		}
 
-		return client.NewWithKeytab(ctx.username, ctx.domain, kt, cfg, settings...), nil
+		return credentials.New(ctx.username, ctx.domain).WithKeytab(kt), nil
 	}
 
-	ctx.logger.Info("using default session")
+	return nil, nil //nolint:nilnil
+}
+
+func (ctx *Initiator) newClient() error {
+	var err error
+
+	if ctx.krb5conf, ctx.profile, err = ctx.sources.loadConfig(ctx.logger); err != nil {
+		return err
+	}
+
+	ctx.settings = []func(*client.Settings){
+		client.DisablePAFXFAST(true),
+	}
 
-	cache, err := loadCCache(ctx.logger)
+	creds, err := ctx.credentials()
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	if creds == nil {
+		ctx.logger.Info("using default session")
+
+		return ctx.reload()
 	}
 
-	return client.NewFromCCache(cache, cfg, settings...)
+	if ctx.storeCCache != nil {
+		if ok, err := ctx.reuse(creds); ok || err != nil {
+			return err
+		}
+	}
+
+	if creds.HasKeytab() {
+		ctx.client = client.NewWithKeytab(ctx.username, ctx.domain, creds.Keytab(), ctx.krb5conf, ctx.settings...)
+	} else {
+		// The password is empty when using a certificate or anonymous
+		// PKINIT, which is fine as the client is then only used for TGS
+		// exchanges
+		ctx.client = client.NewWithPassword(creds.UserName(), creds.Domain(), ctx.password, ctx.krb5conf,
+			ctx.settings...)
+		ctx.client.Credentials.SetCName(creds.CName())
+	}
+
+	return ctx.login()
 }
 
 // NewInitiator returns a new Initiator.
@@ -98,7 +180,8 @@ func NewInitiator(options ...Option[Initiator]) (*Initiator, error) {
 			sequenceMask: math.MaxUint32,
 			logger:       logr.Discard(),
 		},
-		logger: logr.Discard(),
+		sources: defaultSources(),
+		logger:  logr.Discard(),
 	}
 
 	var err error
@@ -109,12 +192,18 @@ func NewInitiator(options ...Option[Initiator]) (*Initiator, error) {
 		}
 	}
 
-	if ctx.client, err = ctx.newClient(); err != nil {
+	if err = ctx.newClient(); err != nil {
 		return nil, err
 	}
 
-	if err = ctx.client.AffirmLogin(); err != nil {
-		return nil, err
+	if ctx.session.expired() {
+		return nil, errTGTExpired
+	}
+
+	if ctx.refreshInterval > 0 {
+		ctx.stop, ctx.done = make(chan struct{}), make(chan struct{})
+
+		go ctx.refreshLoop(ctx.refreshInterval)
 	}
 
 	return ctx, nil
@@ -122,17 +211,74 @@ func NewInitiator(options ...Option[Initiator]) (*Initiator, error) {
 
 // Close releases any resources held by the Initiator.
 func (ctx *Initiator) Close() error {
+	if ctx.stop != nil {
+		close(ctx.stop)
+		<-ctx.done
+	}
+
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
 	ctx.client.Destroy()
 
 	return nil
 }
 
+// Reset discards the context so the Initiator can be used to create another
+// one. The credentials and any cached service tickets are kept so a new
+// context only requires a new AP-REQ.
+func (ctx *Initiator) Reset() {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	ctx.context = context{
+		sequenceMask:       math.MaxUint32,
+		establishRounds:    ctx.establishRounds,
+		establishTokenSize: ctx.establishTokenSize,
+		logger:             ctx.context.logger,
+	}
+}
+
+// parseServiceName parses a service name passed to Initiate. Names containing
+// a '/' are treated as Kerberos principal names, anything else is treated as
+// a host-based service name.
+func parseServiceName(service string) (*Name, error) {
+	if strings.ContainsRune(service, componentSeparator) {
+		return ParseName(service, NTKRB5PrincipalName)
+	}
+
+	return ParseName(service, NTHostBasedService)
+}
+
 // Initiate creates a new context targeting the service with the desired flags
 // along with the initial input token, which will initially be nil. The output
-// token is returned and whether another round is required.
+// token is returned and whether another round is required. Any output token
+// must be sent to the Acceptor even if no further round is required, as is
+// the case for the final AP-REP of a ContextFlagDCEStyle context.
 //
-//nolint:cyclop,funlen
+// The service may be either a host-based service name such as
+// "host@ssh.example.com" or a Kerberos principal name such as
+// "host/ssh.example.com".
 func (ctx *Initiator) Initiate(service string, flags int, input []byte) ([]byte, bool, error) {
+	var (
+		target *Name
+		err    error
+	)
+
+	if len(input) == 0 && !ctx.established {
+		if target, err = parseServiceName(service); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return ctx.InitiateName(target, flags, input)
+}
+
+// InitiateName is the same as Initiate except the service is passed as a
+// previously parsed Name. The target is ignored for all but the first call.
+//
+//nolint:cyclop,funlen
+func (ctx *Initiator) InitiateName(target *Name, flags int, input []byte) ([]byte, bool, error) {
 	if ctx.established {
 		return nil, false, nil
 	}
@@ -141,18 +287,64 @@ func (ctx *Initiator) Initiate(service string, flags int, input []byte) ([]byte,
 
 	//nolint:nestif
 	if len(input) == 0 {
+		// Registered first so the callback runs after the mutex is released
+		defer ctx.dispatchRefreshEvents()
+
+		if target == nil {
+			return nil, false, errNoTarget
+		}
+
+		ctx.mu.Lock()
+		defer ctx.mu.Unlock()
+
+		if target, err = target.CanonicalizeName(ctx.krb5conf); err != nil {
+			return nil, false, err
+		}
+
+		ctx.requestedFlags = flags
 		ctx.flags = flags & supportedFlags
 
-		// BUG(bodgit): see https://github.com/jcmturner/gokrb5/issues/529
-		ctx.expiry = time.Now().Add(ctx.client.Config.LibDefaults.TicketLifetime)
+		switch {
+		case ctx.anonymous:
+			ctx.flags |= gssapi.ContextFlagAnon
+		case ctx.IsAnonymous():
+			return nil, false, errAnonymousCredentials
+		}
 
-		var ticket messages.Ticket
+		if ctx.doDCEStyle() {
+			ctx.flags |= gssapi.ContextFlagMutual
+		}
+
+		if err = ctx.refresh(); err != nil {
+			return nil, false, err
+		}
 
-		if ticket, ctx.key, err = ctx.client.GetServiceTicket(strings.ReplaceAll(service, "@", "/")); err != nil {
+		ticket, part, err := ctx.serviceTicket(target)
+		if err != nil {
 			return nil, false, err
 		}
 
-		ctx.peerName = fmt.Sprintf("%s@%s", ticket.SName.PrincipalNameString(), ticket.Realm)
+		ctx.key = part.Key
+
+		for _, tag := range []string{defaultTGSEncTypesTag, permittedEncTypesTag} {
+			if err = checkEncType(ctx.permittedEncTypes(tag), "session key", ctx.key.KeyType); err != nil {
+				return nil, false, err
+			}
+		}
+
+		ctx.setTicketTimes(part.AuthTime, part.StartTime, part.EndTime, part.RenewTill)
+		if ctx.expiry.IsZero() {
+			// BUG(bodgit): see https://github.com/jcmturner/gokrb5/issues/529
+			ctx.expiry = time.Now().Add(ctx.krb5conf.LibDefaults.TicketLifetime)
+		}
+
+		ctx.peerName = NewNameFromPrincipal(ticket.SName, ticket.Realm)
+
+		if ctx.IsAnonymous() {
+			ctx.localPrincipal = newAnonymousName()
+		} else {
+			ctx.localPrincipal = NewNameFromPrincipal(ctx.session.cname, ctx.session.crealm)
+		}
 
 		f := make([]int, 0, bits.OnesCount(uint(ctx.flags)))
 
@@ -180,7 +372,14 @@ func (ctx *Initiator) Initiate(service string, flags int, input []byte) ([]byte,
 		ctx.ctime = apreq.APReq.Authenticator.CTime
 		ctx.cusec = apreq.APReq.Authenticator.Cusec
 
-		output, err := apreq.Marshal()
+		var output []byte
+
+		if ctx.doDCEStyle() {
+			output, err = apreq.APReq.Marshal()
+		} else {
+			output, err = apreq.Marshal()
+		}
+
 		if err != nil {
 			return nil, false, err
 		}
@@ -188,6 +387,7 @@ func (ctx *Initiator) Initiate(service string, flags int, input []byte) ([]byte,
 		if !ctx.doMutual() {
 			ctx.established = true
 			ctx.baseSequenceNumber = ctx.sequenceNumber
+			ctx.logEncType()
 		}
 
 		return output, true, nil
@@ -197,20 +397,30 @@ func (ctx *Initiator) Initiate(service string, flags int, input []byte) ([]byte,
 		return nil, false, errors.New("not mutual")
 	}
 
-	var aprep spnego.KRB5Token
-	if err = aprep.Unmarshal(input); err != nil {
-		return nil, false, err
-	}
+	var aprep messages.APRep
 
-	if aprep.IsKRBError() {
-		return nil, false, errors.New("received Kerberos error")
-	}
+	if ctx.doDCEStyle() {
+		if aprep, err = unmarshalRawAPRep(input); err != nil {
+			return nil, false, err
+		}
+	} else {
+		var token spnego.KRB5Token
+		if err = token.Unmarshal(input); err != nil {
+			return nil, false, err
+		}
 
-	if !aprep.IsAPRep() {
-		return nil, false, errors.New("didn't receive an AP-REP")
+		if token.IsKRBError() {
+			return nil, false, token.KRBError
+		}
+
+		if !token.IsAPRep() {
+			return nil, false, errors.New("didn't receive an AP-REP")
+		}
+
+		aprep = token.APRep
 	}
 
-	b, err := crypto.DecryptEncPart(aprep.APRep.EncPart, ctx.key, keyusage.AP_REP_ENCPART)
+	b, err := crypto.DecryptEncPart(aprep.EncPart, ctx.key, keyusage.AP_REP_ENCPART)
 	if err != nil {
 		return nil, false, krberror.Errorf(err, krberror.DecryptingError, "error decrypting AP-REP enc-part")
 	}
@@ -223,6 +433,11 @@ func (ctx *Initiator) Initiate(service string, flags int, input []byte) ([]byte,
 	ctx.baseSequenceNumber = uint64(payload.SequenceNumber)
 
 	if payload.Subkey.KeyType != 0 {
+		if err = checkEncType(ctx.permittedEncTypes(permittedEncTypesTag), "AP-REP subkey",
+			payload.Subkey.KeyType); err != nil {
+			return nil, false, err
+		}
+
 		ctx.peerSubkey = payload.Subkey
 	}
 
@@ -231,7 +446,16 @@ func (ctx *Initiator) Initiate(service string, flags int, input []byte) ([]byte,
 		return nil, false, errors.New("mutual failed")
 	}
 
+	var output []byte
+
+	if ctx.doDCEStyle() {
+		if output, err = ctx.dceAPRep(payload.SequenceNumber); err != nil {
+			return nil, false, err
+		}
+	}
+
 	ctx.established = true
+	ctx.logEncType()
 
-	return nil, false, nil
+	return output, false, nil
 }
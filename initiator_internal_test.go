@@ -0,0 +1,83 @@
+package gssapi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInitiatorReset(t *testing.T) {
+	t.Parallel()
+
+	kdc := newTestKDC(t, etypeID.AES256_CTS_HMAC_SHA1_96)
+	kdc.addPrincipal(testClient, "password", false)
+	kdc.addPrincipal(testService, "service", false)
+
+	b, err := kdc.keytab.Marshal()
+	require.NoError(t, err)
+
+	kt := filepath.Join(t.TempDir(), "krb5.keytab")
+	require.NoError(t, os.WriteFile(kt, b, 0o600))
+
+	initiator, err := NewInitiator(WithConfig[Initiator](kdc.config()), WithDomain[Initiator](testRealm),
+		WithUsername[Initiator](testClient), WithPassword[Initiator]("password"))
+	require.NoError(t, err)
+
+	defer initiator.Close()
+
+	var (
+		keys  [2][]byte
+		infos [2]ContextInfo
+	)
+
+	for i := range keys {
+		initiator.Reset()
+		assert.False(t, initiator.Established())
+
+		output, _, err := initiator.Initiate(testService, gssapi.ContextFlagInteg, nil)
+		require.NoError(t, err)
+		assert.True(t, initiator.Established())
+
+		infos[i] = initiator.Inquire()
+
+		acceptor, err := NewAcceptor(WithAcceptorConfig[Acceptor](kdc.config()), WithKeytab[Acceptor](kt))
+		require.NoError(t, err)
+
+		defer acceptor.Close()
+
+		_, _, err = acceptor.Accept(output)
+		require.NoError(t, err)
+		assert.True(t, acceptor.Established())
+
+		key, err := acceptor.SessionKey()
+		require.NoError(t, err)
+
+		keys[i] = key.KeyValue
+	}
+
+	// The second context reuses the cached service ticket
+	assert.Equal(t, 1, kdc.count("TGS"))
+	assert.Equal(t, keys[0], keys[1])
+
+	// The cached ticket retains its times
+	assert.False(t, infos[1].StartTime.IsZero())
+	assert.Equal(t, infos[0].StartTime, infos[1].StartTime)
+	assert.Equal(t, infos[0].EndTime, infos[1].EndTime)
+}
+
+func TestInitiateNameNoTarget(t *testing.T) {
+	newTestEnvironment(t, etypeID.AES256_CTS_HMAC_SHA1_96)
+
+	initiator, err := NewInitiator()
+	require.NoError(t, err)
+
+	defer initiator.Close()
+
+	_, _, err = initiator.InitiateName(nil, gssapi.ContextFlagInteg, nil)
+	require.ErrorIs(t, err, errNoTarget)
+}
@@ -0,0 +1,108 @@
+package gssapi
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+//nolint:gochecknoglobals
+var (
+	// OIDInquireSessionKey is the GSS_C_INQ_SSPI_SESSION_KEY OID for
+	// InquireByOID.
+	OIDInquireSessionKey = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2, 5, 5}
+
+	// oidSessionKeyEncType is the prefix of the OID identifying the
+	// encryption type of the session key, the encryption type is appended.
+	oidSessionKeyEncType = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2, 4}
+)
+
+var errUnsupportedOID = errors.New("unsupported inquiry OID")
+
+// ContextInfo describes a context, as returned by Inquire.
+type ContextInfo struct {
+	// LocalName is the Kerberos principal of this side of the context.
+	LocalName *Name
+	// PeerName is the Kerberos principal of the peer.
+	PeerName *Name
+	// Mechanism is the mechanism OID, which is always Kerberos.
+	Mechanism asn1.ObjectIdentifier
+	// Flags are the negotiated context flags.
+	Flags int
+	// DroppedFlags are the flags that were requested but not negotiated.
+	DroppedFlags int
+	// Initiator is set if this side initiated the context.
+	Initiator bool
+	// Open is set once the context is established.
+	Open bool
+	// AuthTime, StartTime, EndTime and RenewTill are the times from the
+	// ticket, any that aren't known are zero.
+	AuthTime  time.Time
+	StartTime time.Time
+	EndTime   time.Time
+	RenewTill time.Time
+	// EncType is the encryption type of the key protecting per-message
+	// tokens.
+	EncType int32
+}
+
+// Inquire returns the details of the context, as with gss_inquire_context.
+func (ctx *context) Inquire() ContextInfo {
+	return ContextInfo{
+		LocalName:    ctx.localPrincipal,
+		PeerName:     ctx.peerName,
+		Mechanism:    gssapi.OIDKRB5.OID(),
+		Flags:        ctx.flags,
+		DroppedFlags: ctx.requestedFlags &^ ctx.flags,
+		Initiator:    !ctx.acceptor,
+		Open:         ctx.established,
+		AuthTime:     ctx.authTime,
+		StartTime:    ctx.startTime,
+		EndTime:      ctx.expiry,
+		RenewTill:    ctx.renewTill,
+		EncType:      ctx.contextKey().KeyType,
+	}
+}
+
+// SessionKey returns the key protecting per-message tokens, which is the
+// subkey asserted by the Acceptor, otherwise the one asserted by the
+// Initiator, otherwise the ticket session key. Protocols such as SMB use it
+// for key derivation. The key value is a copy so the caller may modify it
+// without affecting the context.
+func (ctx *context) SessionKey() (types.EncryptionKey, error) {
+	if !ctx.established {
+		return types.EncryptionKey{}, errNotEstablished
+	}
+
+	key := ctx.contextKey()
+	key.KeyValue = bytes.Clone(key.KeyValue)
+
+	return key, nil
+}
+
+// InquireByOID implements gss_inquire_sec_context_by_oid. Only
+// OIDInquireSessionKey is supported which returns the value of the key
+// returned by SessionKey followed by the encoded OID identifying its
+// encryption type, as with MIT Kerberos.
+func (ctx *context) InquireByOID(oid asn1.ObjectIdentifier) ([][]byte, error) {
+	if !oid.Equal(OIDInquireSessionKey) {
+		return nil, errUnsupportedOID
+	}
+
+	key, err := ctx.SessionKey()
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := asn1.Marshal(append(append(asn1.ObjectIdentifier{}, oidSessionKeyEncType...), int(key.KeyType)))
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the contents of the OID are returned, not the tag and length
+	return [][]byte{bytes.Clone(key.KeyValue), b[2:]}, nil
+}
@@ -0,0 +1,111 @@
+package gssapi
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//nolint:funlen
+func TestInquire(t *testing.T) {
+	newTestEnvironment(t, etypeID.AES256_CTS_HMAC_SHA1_96)
+
+	initiator, err := NewInitiator()
+	require.NoError(t, err)
+
+	defer initiator.Close()
+
+	info := initiator.Inquire()
+	assert.True(t, info.Initiator)
+	assert.False(t, info.Open)
+
+	_, err = initiator.SessionKey()
+	require.ErrorIs(t, err, errNotEstablished)
+
+	initiator, acceptor := establish(t, gssapi.ContextFlagMutual|gssapi.ContextFlagInteg|gssapi.ContextFlagDeleg,
+		nil, nil)
+
+	info = initiator.Inquire()
+	assert.Equal(t, testClient+"@"+testRealm, info.LocalName.String())
+	assert.Equal(t, testService+"@"+testRealm, info.PeerName.String())
+	assert.True(t, info.Mechanism.Equal(gssapi.OIDKRB5.OID()))
+	assert.Equal(t, gssapi.ContextFlagMutual|gssapi.ContextFlagInteg, info.Flags)
+	assert.Equal(t, gssapi.ContextFlagDeleg, info.DroppedFlags)
+	assert.True(t, info.Initiator)
+	assert.True(t, info.Open)
+	assert.False(t, info.EndTime.IsZero())
+	assert.Equal(t, int32(etypeID.AES256_CTS_HMAC_SHA1_96), info.EncType)
+
+	info = acceptor.Inquire()
+	assert.Equal(t, testService+"@"+testRealm, info.LocalName.String())
+	assert.Equal(t, testClient+"@"+testRealm, info.PeerName.String())
+	assert.Equal(t, gssapi.ContextFlagMutual|gssapi.ContextFlagInteg, info.Flags)
+	assert.Zero(t, info.DroppedFlags) // The Initiator never sent the flag
+	assert.False(t, info.Initiator)
+	assert.True(t, info.Open)
+	assert.False(t, info.AuthTime.IsZero())
+	assert.False(t, info.StartTime.IsZero())
+	assert.True(t, info.EndTime.After(info.StartTime))
+	assert.True(t, info.RenewTill.After(info.EndTime))
+
+	key, err := initiator.SessionKey()
+	require.NoError(t, err)
+
+	peerKey, err := acceptor.SessionKey()
+	require.NoError(t, err)
+	assert.Equal(t, key, peerKey)
+
+	b, err := acceptor.InquireByOID(OIDInquireSessionKey)
+	require.NoError(t, err)
+	require.Len(t, b, 2)
+	assert.Equal(t, key.KeyValue, b[0])
+	assert.Equal(t, "2a864886f7120102020412", hex.EncodeToString(b[1]))
+
+	_, err = acceptor.InquireByOID(gssapi.OIDKRB5.OID())
+	assert.ErrorIs(t, err, errUnsupportedOID)
+}
+
+func TestSessionKeyCopy(t *testing.T) {
+	newTestEnvironment(t, etypeID.AES256_CTS_HMAC_SHA1_96)
+
+	initiator, acceptor := establish(t, gssapi.ContextFlagMutual|gssapi.ContextFlagInteg|gssapi.ContextFlagConf,
+		nil, nil)
+
+	key, err := initiator.SessionKey()
+	require.NoError(t, err)
+
+	clear(key.KeyValue)
+
+	b, err := initiator.InquireByOID(OIDInquireSessionKey)
+	require.NoError(t, err)
+	require.Len(t, b, 2)
+
+	clear(b[0])
+
+	token, err := initiator.Wrap([]byte("message"), true)
+	require.NoError(t, err)
+
+	plaintext, sealed, err := acceptor.Unwrap(token)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("message"), plaintext)
+	assert.True(t, sealed)
+
+	token, err = acceptor.Wrap([]byte("reply"), true)
+	require.NoError(t, err)
+
+	plaintext, _, err = initiator.Unwrap(token)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("reply"), plaintext)
+
+	// The PRF uses the key directly rather than any derived keys
+	prf, err := initiator.PseudoRandom(PRFKeyFull, []byte("input"), 32)
+	require.NoError(t, err)
+
+	peerPRF, err := acceptor.PseudoRandom(PRFKeyFull, []byte("input"), 32)
+	require.NoError(t, err)
+	assert.Equal(t, prf, peerPRF)
+}
@@ -0,0 +1,71 @@
+// Package deadline interrupts blocking reads and writes when a context is
+// done by using the deadline of the connection.
+package deadline
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+// Setter is implemented by connections that support deadlines, such as
+// net.Conn.
+type Setter interface {
+	SetDeadline(t time.Time) error
+}
+
+// Run calls f with any blocked read or write on c interrupted when ctx is
+// done. The deadline of c is set to that of ctx, if any, and moved to the past
+// when ctx is done, it is always cleared before returning. If f fails once
+// ctx is done, the error from ctx is returned instead.
+func Run(ctx context.Context, c Setter, f func() error) error {
+	if ctx.Done() == nil {
+		return f()
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := c.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	done := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(done)
+
+		_ = c.SetDeadline(time.Unix(1, 0))
+	})
+
+	err := f()
+
+	// Wait for the deadline to be set before clearing it
+	if !stop() {
+		<-done
+	}
+
+	if dErr := c.SetDeadline(time.Time{}); err == nil {
+		err = dErr
+	}
+
+	if err != nil {
+		return Err(ctx, err)
+	}
+
+	return nil
+}
+
+// Err returns the error from ctx if err is the result of Run interrupting a
+// read or write, otherwise err.
+func Err(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// The deadline can expire fractionally before ctx notices
+	if deadline, ok := ctx.Deadline(); ok && errors.Is(err, os.ErrDeadlineExceeded) && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+
+	return err
+}
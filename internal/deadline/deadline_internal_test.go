@@ -0,0 +1,67 @@
+package deadline
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//nolint:funlen
+func TestRun(t *testing.T) {
+	t.Parallel()
+
+	client, server := net.Pipe()
+
+	defer client.Close()
+	defer server.Close()
+
+	read := func() error {
+		_, err := server.Read(make([]byte, 1))
+
+		return err
+	}
+
+	t.Run("deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		assert.ErrorIs(t, Run(ctx, server, read), context.DeadlineExceeded)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		// Without a deadline only cancellation interrupts the read
+		ctx, cancel := context.WithCancel(context.Background())
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			cancel()
+		}()
+
+		assert.ErrorIs(t, Run(ctx, server, read), context.Canceled)
+	})
+
+	t.Run("cancelled after success", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		go func() {
+			_, _ = client.Write([]byte{0})
+		}()
+
+		assert.NoError(t, Run(ctx, server, func() error {
+			defer cancel()
+
+			return read()
+		}))
+	})
+
+	// The deadline is cleared each time so the connection is still usable
+	go func() {
+		_, _ = client.Write([]byte{0})
+	}()
+
+	require.NoError(t, read())
+}
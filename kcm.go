@@ -0,0 +1,224 @@
+package gssapi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/credentials"
+)
+
+// KCM is the credential cache daemon protocol originally from Heimdal and
+// implemented by MIT Kerberos, SSSD and macOS. Requests and replies are sent
+// over a Unix socket, each prefixed with a 4 byte big-endian length.
+
+const (
+	kcmSocketTag     = "kcm_socket"
+	kcmDefaultSocket = "/var/run/.heim_org.h5l.kcm-socket"
+	kcmTimeout       = 5 * time.Second
+	kcmMaxReply      = 10 << 20
+	kcmVersionMajor  = 2
+	kcmVersionMinor  = 0
+	kcmUUIDLength    = 16
+)
+
+const (
+	kcmOpInitialize       uint16 = 4
+	kcmOpStore            uint16 = 6
+	kcmOpGetPrincipal     uint16 = 8
+	kcmOpGetCredUUIDList  uint16 = 9
+	kcmOpGetCredByUUID    uint16 = 10
+	kcmOpGetDefaultCache  uint16 = 20
+	kcmCodeCCNotFound     int32  = -1765328243
+	kcmCodeCCEnd          int32  = -1765328242
+	kcmCodeFCCNoFile      int32  = -1765328189
+	kcmStatusOK           int32  = 0
+	kcmStatusLength              = 4
+	kcmLengthPrefixLength        = 4
+)
+
+var errKCMReply = errors.New("malformed KCM reply")
+
+// kcmError is a non-zero status code returned by the KCM daemon, which is
+// normally a com_err code such as KRB5_CC_NOTFOUND.
+type kcmError int32
+
+func (e kcmError) Error() string {
+	return fmt.Sprintf("KCM error code %d", int32(e))
+}
+
+func (e kcmError) notFound() bool {
+	return int32(e) == kcmCodeCCNotFound || int32(e) == kcmCodeFCCNoFile
+}
+
+// kcmCCache is a KCM credential cache. A name of "KCM:" refers to the
+// default cache as reported by the daemon.
+type kcmCCache struct {
+	socket   string
+	residual string
+}
+
+func newKCMCCache(residual string, p *profile) *kcmCCache {
+	socket, ok := p.value("libdefaults", kcmSocketTag)
+	if !ok {
+		socket = kcmDefaultSocket
+	}
+
+	return &kcmCCache{
+		socket:   socket,
+		residual: residual,
+	}
+}
+
+func (c *kcmCCache) call(op uint16, payload ...[]byte) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", c.socket, kcmTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err = conn.SetDeadline(time.Now().Add(kcmTimeout)); err != nil {
+		return nil, err
+	}
+
+	req := new(bytes.Buffer)
+	req.Write(make([]byte, kcmLengthPrefixLength))
+	req.WriteByte(kcmVersionMajor)
+	req.WriteByte(kcmVersionMinor)
+	_ = binary.Write(req, binary.BigEndian, op)
+
+	for _, p := range payload {
+		req.Write(p)
+	}
+
+	b := req.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-kcmLengthPrefixLength)) //nolint:gosec
+
+	if _, err = conn.Write(b); err != nil {
+		return nil, err
+	}
+
+	var length uint32
+	if err = binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	if length < kcmStatusLength || length > kcmMaxReply {
+		return nil, fmt.Errorf("%w: length %d", errKCMReply, length)
+	}
+
+	reply := make([]byte, length)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+
+	if status := int32(binary.BigEndian.Uint32(reply)); status != kcmStatusOK { //nolint:gosec
+		return nil, kcmError(status)
+	}
+
+	return reply[kcmStatusLength:], nil
+}
+
+// cacheName returns the name of the cache on the daemon, asking for the
+// default if necessary.
+func (c *kcmCCache) cacheName() ([]byte, error) {
+	if c.residual != "" {
+		return append([]byte(c.residual), 0), nil
+	}
+
+	reply, err := c.call(kcmOpGetDefaultCache)
+	if err != nil {
+		return nil, err
+	}
+
+	i := bytes.IndexByte(reply, 0)
+	if i < 1 {
+		return nil, fmt.Errorf("%w: bad default cache name", errKCMReply)
+	}
+
+	return reply[:i+1], nil
+}
+
+func (c *kcmCCache) name() string {
+	return ccacheTypeKCM + ":" + c.residual
+}
+
+func (c *kcmCCache) read() (*credentials.CCache, error) {
+	name, err := c.cacheName()
+	if err != nil {
+		return nil, err
+	}
+
+	principal, err := c.call(kcmOpGetPrincipal, name)
+	if err != nil {
+		var kcmErr kcmError
+		if errors.As(err, &kcmErr) && kcmErr.notFound() {
+			return nil, nil //nolint:nilnil
+		}
+
+		return nil, err
+	}
+
+	// An initialized but empty cache
+	if len(principal) == 0 {
+		return nil, nil //nolint:nilnil
+	}
+
+	uuids, err := c.call(kcmOpGetCredUUIDList, name)
+	if err != nil {
+		var kcmErr kcmError
+		if !errors.As(err, &kcmErr) || int32(kcmErr) != kcmCodeCCEnd {
+			return nil, err
+		}
+	}
+
+	if len(uuids)%kcmUUIDLength != 0 {
+		return nil, fmt.Errorf("%w: bad UUID list", errKCMReply)
+	}
+
+	creds := make([][]byte, 0, len(uuids)/kcmUUIDLength)
+
+	for i := 0; i < len(uuids); i += kcmUUIDLength {
+		cred, err := c.call(kcmOpGetCredByUUID, name, uuids[i:i+kcmUUIDLength])
+		if err != nil {
+			return nil, err
+		}
+
+		creds = append(creds, cred)
+	}
+
+	return unmarshalCCache(principal, creds)
+}
+
+func (c *kcmCCache) write(cache *credentials.CCache) error {
+	name, err := c.cacheName()
+	if err != nil {
+		return err
+	}
+
+	b := new(bytes.Buffer)
+	marshalCCachePrincipal(b, cache.DefaultPrincipal.PrincipalName, cache.DefaultPrincipal.Realm)
+
+	if _, err = c.call(kcmOpInitialize, name, b.Bytes()); err != nil {
+		return err
+	}
+
+	for _, cred := range cache.Credentials {
+		b.Reset()
+		marshalCCacheCredential(b, cred)
+
+		if _, err = c.call(kcmOpStore, name, b.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *kcmCCache) stamp() (string, error) {
+	return contentStamp(c)
+}
@@ -0,0 +1,183 @@
+package gssapi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// kcmDaemon is a minimal stand-in for a KCM daemon, implementing just enough
+// of the protocol to store and retrieve caches.
+type kcmDaemon struct {
+	mu       sync.Mutex
+	listener net.Listener
+	socket   string
+	def      string
+	caches   map[string]*kcmDaemonCache
+}
+
+type kcmDaemonCache struct {
+	principal []byte
+	creds     [][]byte
+}
+
+func newKCMDaemon(t *testing.T) *kcmDaemon {
+	t.Helper()
+
+	d := &kcmDaemon{
+		socket: filepath.Join(t.TempDir(), "kcm"),
+		def:    "1000",
+		caches: make(map[string]*kcmDaemonCache),
+	}
+
+	var err error
+	if d.listener, err = net.Listen("unix", d.socket); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = d.listener.Close() })
+
+	go d.serve()
+
+	return d
+}
+
+func (d *kcmDaemon) serve() {
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go d.handle(conn)
+	}
+}
+
+func (d *kcmDaemon) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var length uint32
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return
+	}
+
+	req := make([]byte, length)
+	if _, err := io.ReadFull(conn, req); err != nil || len(req) < 4 || req[0] != kcmVersionMajor {
+		return
+	}
+
+	status, reply := d.dispatch(binary.BigEndian.Uint16(req[2:]), req[4:])
+
+	b := new(bytes.Buffer)
+	_ = binary.Write(b, binary.BigEndian, uint32(kcmStatusLength+len(reply))) //nolint:gosec
+	_ = binary.Write(b, binary.BigEndian, status)
+	b.Write(reply)
+
+	_, _ = conn.Write(b.Bytes())
+}
+
+//nolint:cyclop
+func (d *kcmDaemon) dispatch(op uint16, payload []byte) (int32, []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if op == kcmOpGetDefaultCache {
+		return kcmStatusOK, append([]byte(d.def), 0)
+	}
+
+	name, payload, ok := bytes.Cut(payload, []byte{0})
+	if !ok {
+		return kcmCodeCCNotFound, nil
+	}
+
+	if op == kcmOpInitialize {
+		d.caches[string(name)] = &kcmDaemonCache{principal: payload}
+
+		return kcmStatusOK, nil
+	}
+
+	cache, ok := d.caches[string(name)]
+	if !ok {
+		return kcmCodeCCNotFound, nil
+	}
+
+	switch op {
+	case kcmOpStore:
+		cache.creds = append(cache.creds, payload)
+
+		return kcmStatusOK, nil
+	case kcmOpGetPrincipal:
+		return kcmStatusOK, cache.principal
+	case kcmOpGetCredUUIDList:
+		if len(cache.creds) == 0 {
+			return kcmCodeCCEnd, nil
+		}
+
+		uuids := make([]byte, 0, len(cache.creds)*kcmUUIDLength)
+		for i := range cache.creds {
+			uuid := make([]byte, kcmUUIDLength)
+			uuid[0] = byte(i)
+			uuids = append(uuids, uuid...)
+		}
+
+		return kcmStatusOK, uuids
+	case kcmOpGetCredByUUID:
+		if len(payload) != kcmUUIDLength || int(payload[0]) >= len(cache.creds) {
+			return kcmCodeCCNotFound, nil
+		}
+
+		return kcmStatusOK, cache.creds[payload[0]]
+	}
+
+	return kcmCodeCCNotFound, nil
+}
+
+//nolint:paralleltest
+func TestKCMCCache(t *testing.T) {
+	d := newKCMDaemon(t)
+
+	p, err := parseProfile(fs, strings.NewReader("[libdefaults]\n  kcm_socket = "+d.socket+"\n"))
+	require.NoError(t, err)
+
+	cc, err := defaultSources().resolveCCache("KCM:", p)
+	require.NoError(t, err)
+
+	testCCacheType(t, cc, testCCache(t))
+
+	// The default cache was used
+	d.mu.Lock()
+	assert.Contains(t, d.caches, d.def)
+	d.mu.Unlock()
+
+	named, err := defaultSources().resolveCCache("KCM:other", p)
+	require.NoError(t, err)
+
+	missing, err := named.read()
+	require.NoError(t, err)
+	assert.Nil(t, missing)
+}
+
+func TestKCMCCacheUnavailable(t *testing.T) {
+	t.Parallel()
+
+	p, err := parseProfile(fs, strings.NewReader("[libdefaults]\n  kcm_socket = "+
+		filepath.Join(t.TempDir(), "missing")+"\n"))
+	require.NoError(t, err)
+
+	cc, err := defaultSources().resolveCCache("KCM:", p)
+	require.NoError(t, err)
+
+	_, err = cc.read()
+
+	var opErr *net.OpError
+	assert.True(t, errors.As(err, &opErr))
+}
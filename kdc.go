@@ -0,0 +1,171 @@
+package gssapi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/messages"
+)
+
+const (
+	kdcTimeout       = 5 * time.Second
+	kdcUDPBufferSize = 4096
+	kdcAlwaysTCP     = 1
+	kdcMaxReply      = 1 << 20
+)
+
+var (
+	errNoKDCResponse = errors.New("no response from KDC")
+	errKDCReply      = errors.New("invalid KDC reply")
+)
+
+// sendToKDC sends the request to a KDC for the realm and returns the reply.
+// This mirrors the transport in gokrb5, which isn't exported, trying UDP
+// or TCP first depending on udp_preference_limit and falling back to the
+// other. A KRB-ERROR reply is returned as a messages.KRBError error.
+func sendToKDC(cfg *config.Config, realm string, b []byte) ([]byte, error) {
+	limit := cfg.LibDefaults.UDPPreferenceLimit
+
+	transports := []bool{false, true}
+	if limit == kdcAlwaysTCP {
+		transports = transports[1:]
+	} else if len(b) > limit {
+		transports[0], transports[1] = true, false
+	}
+
+	var errs error
+
+	for _, tcp := range transports {
+		rb, err := sendToKDCs(cfg, realm, b, tcp)
+		if err == nil {
+			return checkKRBError(rb)
+		}
+
+		errs = errors.Join(errs, err)
+	}
+
+	return nil, errs
+}
+
+func checkKRBError(b []byte) ([]byte, error) {
+	var krbError messages.KRBError
+	if err := krbError.Unmarshal(b); err == nil {
+		return b, krbError
+	}
+
+	return b, nil
+}
+
+func sendToKDCs(cfg *config.Config, realm string, b []byte, tcp bool) ([]byte, error) {
+	_, kdcs, err := cfg.GetKDCs(realm, tcp)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs error
+
+	for i := 1; i <= len(kdcs); i++ {
+		var rb []byte
+
+		if tcp {
+			rb, err = sendTCP(kdcs[i], b)
+		} else {
+			rb, err = sendUDP(kdcs[i], b)
+		}
+
+		if err == nil {
+			// Give up on this transport if the reply didn't fit
+			if _, err = checkKRBError(rb); tooBig(err) {
+				return nil, err
+			}
+
+			return rb, nil
+		}
+
+		errs = errors.Join(errs, fmt.Errorf("%s: %w", kdcs[i], err))
+	}
+
+	return nil, errs
+}
+
+func tooBig(err error) bool {
+	var krbError messages.KRBError
+
+	return errors.As(err, &krbError) && krbError.ErrorCode == errorcode.KRB_ERR_RESPONSE_TOO_BIG
+}
+
+func sendUDP(address string, b []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", address, kdcTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err = conn.SetDeadline(time.Now().Add(kdcTimeout)); err != nil {
+		return nil, err
+	}
+
+	if _, err = conn.Write(b); err != nil {
+		return nil, err
+	}
+
+	rb := make([]byte, kdcUDPBufferSize)
+
+	n, err := conn.Read(rb)
+	if err != nil {
+		return nil, err
+	}
+
+	if n == 0 {
+		return nil, errNoKDCResponse
+	}
+
+	return rb[:n], nil
+}
+
+func sendTCP(address string, b []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", address, kdcTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err = conn.SetDeadline(time.Now().Add(kdcTimeout)); err != nil {
+		return nil, err
+	}
+
+	// RFC 4120 section 7.2.2, each message is prefixed with its length
+	if err = binary.Write(conn, binary.BigEndian, uint32(len(b))); err != nil { //nolint:gosec
+		return nil, err
+	}
+
+	if _, err = conn.Write(b); err != nil {
+		return nil, err
+	}
+
+	var length uint32
+	if err = binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	if length == 0 {
+		return nil, errNoKDCResponse
+	}
+
+	if length > kdcMaxReply {
+		return nil, fmt.Errorf("%w: length %d", errKDCReply, length)
+	}
+
+	rb := make([]byte, length)
+	if _, err = io.ReadFull(conn, rb); err != nil {
+		return nil, err
+	}
+
+	return rb, nil
+}
@@ -0,0 +1,705 @@
+package gssapi
+
+import (
+	stdcrypto "crypto"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/iana"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	ianaflags "github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/iana/patype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// testKDC is a minimal KDC listening on TCP. It issues tickets for any
+// principal in its keytab and supports just enough of RFC 6113 to exercise
+// FAST: principals in fast must use FAST with encrypted challenge, other
+// principals get a TGT without pre-authentication. Services in referrals
+// are answered with a referral to the given realm, which the KDC also serves.
+type testKDC struct {
+	t         *testing.T
+	listener  net.Listener
+	keytab    *keytab.Keytab
+	etype     int32
+	fast      map[string]bool
+	referrals map[string]string
+	cookie    []byte
+
+	pki    *testPKI
+	cert   *x509.Certificate
+	signer stdcrypto.Signer
+
+	mu       sync.Mutex
+	requests map[string]int
+	noFAST   bool
+	tgsError int32
+}
+
+func newTestKDC(t *testing.T, etype int32) *testKDC {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kdc := &testKDC{
+		t:         t,
+		listener:  listener,
+		keytab:    keytab.New(),
+		etype:     etype,
+		fast:      map[string]bool{},
+		referrals: map[string]string{},
+		cookie:    []byte("cookie"),
+		requests:  map[string]int{},
+	}
+
+	kdc.addPrincipal("krbtgt/"+testRealm, "krbtgt", false)
+
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go kdc.serve()
+
+	return kdc
+}
+
+// config returns a krb5.conf pointing at the KDC.
+func (kdc *testKDC) config() string {
+	return fmt.Sprintf(`[libdefaults]
+  default_realm = %s
+  udp_preference_limit = 1
+
+[realms]
+  %s = {
+    kdc = %s
+  }
+  %s = {
+    kdc = %s
+  }
+
+[domain_realm]
+  .example.com = %s
+`, testRealm, testRealm, kdc.listener.Addr(), testOtherRealm, kdc.listener.Addr(), testRealm)
+}
+
+func (kdc *testKDC) addPrincipal(principal, password string, fast bool) {
+	if err := kdc.keytab.AddEntry(principal, testRealm, password, time.Now(), 1, kdc.etype); err != nil {
+		kdc.t.Fatal(err)
+	}
+
+	kdc.fast[principal] = fast
+}
+
+func (kdc *testKDC) key(principal types.PrincipalName) (types.EncryptionKey, error) {
+	key, _, err := kdc.keytab.GetEncryptionKey(principal, testRealm, 0, kdc.etype)
+
+	return key, err
+}
+
+func (kdc *testKDC) count(name string) int {
+	kdc.mu.Lock()
+	defer kdc.mu.Unlock()
+
+	return kdc.requests[name]
+}
+
+func (kdc *testKDC) serve() {
+	for {
+		conn, err := kdc.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			var length uint32
+			if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+				return
+			}
+
+			b := make([]byte, length)
+			if _, err := io.ReadFull(conn, b); err != nil {
+				return
+			}
+
+			rb, err := kdc.handle(b)
+			if err != nil {
+				kdc.t.Error(err)
+
+				return
+			}
+
+			_ = binary.Write(conn, binary.BigEndian, uint32(len(rb))) //nolint:gosec
+			_, _ = conn.Write(rb)
+		}()
+	}
+}
+
+func (kdc *testKDC) handle(b []byte) ([]byte, error) {
+	var asReq messages.ASReq
+	if err := asReq.Unmarshal(b); err == nil {
+		return kdc.handleAS(asReq)
+	}
+
+	var tgsReq messages.TGSReq
+	if err := tgsReq.Unmarshal(b); err != nil {
+		return nil, err
+	}
+
+	return kdc.handleTGS(tgsReq)
+}
+
+func (kdc *testKDC) record(name string) {
+	kdc.mu.Lock()
+	defer kdc.mu.Unlock()
+
+	kdc.requests[name]++
+}
+
+func (kdc *testKDC) krbError(code int32, edata []byte) ([]byte, error) {
+	krbError := messages.NewKRBError(types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+testRealm),
+		testRealm, code, "")
+	krbError.EData = edata
+
+	return krbError.Marshal()
+}
+
+// fastError returns a KRB-ERROR with the real error and padata protected
+// inside the armored FAST response.
+func (kdc *testKDC) fastError(armorKey types.EncryptionKey, code int32, padata types.PADataSequence,
+) ([]byte, error) {
+	inner, err := kdc.krbError(code, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	padata = append(types.PADataSequence{{PADataType: patype.PA_FX_ERROR, PADataValue: inner}}, padata...)
+
+	pa, err := fastReply(armorKey, krbFastResponse{PAData: padata})
+	if err != nil {
+		return nil, err
+	}
+
+	edata, err := asn1.Marshal(types.PADataSequence{pa})
+	if err != nil {
+		return nil, err
+	}
+
+	return kdc.krbError(code, edata)
+}
+
+func fastReply(armorKey types.EncryptionKey, resp krbFastResponse) (types.PAData, error) {
+	b, err := asn1.Marshal(resp)
+	if err != nil {
+		return types.PAData{}, err
+	}
+
+	ed, err := crypto.GetEncryptedData(b, armorKey, keyusage.KEY_USAGE_FAST_REP, 0)
+	if err != nil {
+		return types.PAData{}, err
+	}
+
+	if b, err = marshalChoice(krbFastArmoredRep{EncFastRep: ed}); err != nil {
+		return types.PAData{}, err
+	}
+
+	return types.PAData{PADataType: patype.PA_FX_FAST, PADataValue: b}, nil
+}
+
+// fastRequest decrypts the PA-FX-FAST padata, verifying the checksum over
+// checksummed. If armorKey is empty the armor must be an AP-REQ.
+func (kdc *testKDC) fastRequest(padata types.PADataSequence, armorKey types.EncryptionKey, checksummed []byte,
+) (*krbFastReq, types.EncryptionKey, error) {
+	for _, pa := range padata {
+		if pa.PADataType != patype.PA_FX_FAST {
+			continue
+		}
+
+		var armored krbFastArmoredReq
+		if err := unmarshalChoice(pa.PADataValue, &armored); err != nil {
+			return nil, armorKey, err
+		}
+
+		if armored.Armor.ArmorType == fastArmorAPRequest {
+			var err error
+			if armorKey, err = kdc.armorKey(armored.Armor.ArmorValue); err != nil {
+				return nil, armorKey, err
+			}
+		}
+
+		if !verifyChecksum(armorKey, checksummed, armored.ReqChecksum, keyusage.KEY_USAGE_FAST_REQ_CHKSUM) {
+			return nil, armorKey, errors.New("FAST request checksum invalid")
+		}
+
+		b, err := crypto.DecryptEncPart(armored.EncFastReq, armorKey, keyusage.KEY_USAGE_FAST_ENC)
+		if err != nil {
+			return nil, armorKey, err
+		}
+
+		var req krbFastReq
+		if _, err = asn1.Unmarshal(b, &req); err != nil {
+			return nil, armorKey, err
+		}
+
+		var body messages.KDCReqBody
+		if err = body.Unmarshal(req.ReqBody.Bytes); err != nil {
+			return nil, armorKey, err
+		}
+
+		return &req, armorKey, nil
+	}
+
+	return nil, armorKey, nil
+}
+
+func (kdc *testKDC) armorKey(b []byte) (types.EncryptionKey, error) {
+	var apReq messages.APReq
+	if err := apReq.Unmarshal(b); err != nil {
+		return types.EncryptionKey{}, err
+	}
+
+	if err := apReq.Ticket.DecryptEncPart(kdc.keytab, nil); err != nil {
+		return types.EncryptionKey{}, err
+	}
+
+	key := apReq.Ticket.DecryptedEncPart.Key
+
+	b, err := crypto.DecryptEncPart(apReq.EncryptedAuthenticator, key, keyusage.AP_REQ_AUTHENTICATOR)
+	if err != nil {
+		return types.EncryptionKey{}, err
+	}
+
+	var auth types.Authenticator
+	if err = auth.Unmarshal(b); err != nil {
+		return types.EncryptionKey{}, err
+	}
+
+	return cf2(auth.SubKey, key, "subkeyarmor", "ticketarmor")
+}
+
+func (kdc *testKDC) ticket(cname types.PrincipalName, sname types.PrincipalName, nonce int,
+) (messages.Ticket, messages.EncKDCRepPart, error) {
+	key, err := generateSubkey(kdc.etype)
+	if err != nil {
+		return messages.Ticket{}, messages.EncKDCRepPart{}, err
+	}
+
+	return kdc.issue(cname, testRealm, sname, nonce, key)
+}
+
+// issue creates a ticket with the given session key.
+func (kdc *testKDC) issue(cname types.PrincipalName, crealm string, sname types.PrincipalName, nonce int,
+	key types.EncryptionKey,
+) (messages.Ticket, messages.EncKDCRepPart, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	flags := types.NewKrbFlags()
+	types.SetFlag(&flags, ianaflags.Renewable)
+
+	if crealm == anonymousRealm {
+		types.SetFlag(&flags, ticketFlagAnonymous)
+	}
+
+	b, err := asn1.Marshal(messages.EncTicketPart{
+		Flags:     flags,
+		Key:       key,
+		CRealm:    crealm,
+		CName:     cname,
+		AuthTime:  now,
+		StartTime: now,
+		EndTime:   now.Add(24 * time.Hour),
+		RenewTill: now.Add(7 * 24 * time.Hour),
+	})
+	if err != nil {
+		return messages.Ticket{}, messages.EncKDCRepPart{}, err
+	}
+
+	serviceKey, err := kdc.key(sname)
+	if err != nil {
+		return messages.Ticket{}, messages.EncKDCRepPart{}, err
+	}
+
+	ed, err := crypto.GetEncryptedData(asn1tools.AddASNAppTag(b, asnAppTag.EncTicketPart), serviceKey,
+		keyusage.KDC_REP_TICKET, 1)
+	if err != nil {
+		return messages.Ticket{}, messages.EncKDCRepPart{}, err
+	}
+
+	return messages.Ticket{
+		TktVNO:  iana.PVNO,
+		Realm:   testRealm,
+		SName:   sname,
+		EncPart: ed,
+	}, messages.EncKDCRepPart{
+		Key:       key,
+		LastReqs:  []messages.LastReq{},
+		Nonce:     nonce,
+		Flags:     flags,
+		AuthTime:  now,
+		StartTime: now,
+		EndTime:   now.Add(24 * time.Hour),
+		RenewTill: now.Add(7 * 24 * time.Hour),
+		SRealm:    testRealm,
+		SName:     sname,
+	}, nil
+}
+
+// finish strengthens the reply key and adds the FAST response to the reply.
+func finish(fields *messages.KDCRepFields, armorKey, replyKey types.EncryptionKey, nonce int,
+	padata types.PADataSequence, usage uint32,
+) error {
+	strengthenKey, err := generateSubkey(replyKey.KeyType)
+	if err != nil {
+		return err
+	}
+
+	b, err := fields.Ticket.Marshal()
+	if err != nil {
+		return err
+	}
+
+	sum, err := checksum(armorKey, b, keyusage.KEY_USAGE_FAST_FINISHED)
+	if err != nil {
+		return err
+	}
+
+	pa, err := fastReply(armorKey, krbFastResponse{
+		PAData:        padata,
+		StrengthenKey: strengthenKey,
+		Finished: krbFastFinished{
+			Timestamp:      time.Now().UTC().Truncate(time.Second),
+			CRealm:         fields.CRealm,
+			CName:          fields.CName,
+			TicketChecksum: sum,
+		},
+		Nonce: nonce,
+	})
+	if err != nil {
+		return err
+	}
+
+	fields.PAData = types.PADataSequence{pa}
+
+	if replyKey, err = cf2(strengthenKey, replyKey, "strengthenkey", "replykey"); err != nil {
+		return err
+	}
+
+	if b, err = fields.DecryptedEncPart.Marshal(); err != nil {
+		return err
+	}
+
+	fields.EncPart, err = crypto.GetEncryptedData(b, replyKey, usage, 0)
+
+	return err
+}
+
+//nolint:cyclop,funlen
+func (kdc *testKDC) handleAS(asReq messages.ASReq) ([]byte, error) {
+	if asReq.PAData.Contains(patype.PA_PK_AS_REQ) {
+		return kdc.handlePKINIT(asReq)
+	}
+
+	cname := asReq.ReqBody.CName
+
+	clientKey, err := kdc.key(cname)
+	if err != nil {
+		return kdc.krbError(errorcode.KDC_ERR_C_PRINCIPAL_UNKNOWN, nil)
+	}
+
+	body, err := asReq.ReqBody.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	req, armorKey, err := kdc.fastRequest(asReq.PAData, types.EncryptionKey{}, body)
+	if err != nil {
+		return nil, err
+	}
+
+	ticket, part, err := kdc.ticket(cname, asReq.ReqBody.SName, asReq.ReqBody.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	asRep := messages.ASRep{
+		KDCRepFields: messages.KDCRepFields{
+			PVNO:             iana.PVNO,
+			MsgType:          msgtype.KRB_AS_REP,
+			CRealm:           testRealm,
+			CName:            cname,
+			Ticket:           ticket,
+			DecryptedEncPart: part,
+		},
+	}
+
+	if !kdc.fast[cname.PrincipalNameString()] {
+		kdc.record("AS")
+
+		b, err := part.Marshal()
+		if err != nil {
+			return nil, err
+		}
+
+		if asRep.EncPart, err = crypto.GetEncryptedData(b, clientKey, keyusage.AS_REP_ENCPART, 1); err != nil {
+			return nil, err
+		}
+
+		return asRep.Marshal()
+	}
+
+	if req == nil || kdc.noFAST {
+		return kdc.krbError(errorcode.KDC_ERR_PREAUTH_REQUIRED, nil)
+	}
+
+	kdc.record("FAST AS")
+
+	var challenge, cookie *types.PAData
+
+	for i, pa := range req.PAData {
+		switch pa.PADataType {
+		case patype.PA_ENCRYPTED_CHALLENGE:
+			challenge = &req.PAData[i]
+		case patype.PA_FX_COOKIE:
+			cookie = &req.PAData[i]
+		}
+	}
+
+	if challenge == nil || cookie == nil || string(cookie.PADataValue) != string(kdc.cookie) {
+		info, err := asn1.Marshal(types.ETypeInfo2{{EType: kdc.etype}})
+		if err != nil {
+			return nil, err
+		}
+
+		return kdc.fastError(armorKey, errorcode.KDC_ERR_PREAUTH_REQUIRED, types.PADataSequence{
+			{PADataType: patype.PA_ETYPE_INFO2, PADataValue: info},
+			{PADataType: patype.PA_FX_COOKIE, PADataValue: kdc.cookie},
+			{PADataType: patype.PA_ENCRYPTED_CHALLENGE},
+		})
+	}
+
+	var ed types.EncryptedData
+	if err = ed.Unmarshal(challenge.PADataValue); err != nil {
+		return nil, err
+	}
+
+	key, err := cf2(armorKey, clientKey, "clientchallengearmor", "challengelongterm")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = crypto.DecryptEncPart(ed, key, keyusage.KEY_USAGE_ENC_CHALLENGE_CLIENT); err != nil {
+		return kdc.fastError(armorKey, errorcode.KDC_ERR_PREAUTH_FAILED, nil)
+	}
+
+	if key, err = cf2(armorKey, clientKey, "kdcchallengearmor", "challengelongterm"); err != nil {
+		return nil, err
+	}
+
+	ts, err := types.GetPAEncTSEncAsnMarshalled()
+	if err != nil {
+		return nil, err
+	}
+
+	if ed, err = crypto.GetEncryptedData(ts, key, keyusage.KEY_USAGE_ENC_CHALLENGE_KDC, 0); err != nil {
+		return nil, err
+	}
+
+	b, err := ed.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = finish(&asRep.KDCRepFields, armorKey, clientKey, asReq.ReqBody.Nonce, types.PADataSequence{
+		{PADataType: patype.PA_ENCRYPTED_CHALLENGE, PADataValue: b},
+	}, keyusage.AS_REP_ENCPART); err != nil {
+		return nil, err
+	}
+
+	return asRep.Marshal()
+}
+
+//nolint:cyclop
+func (kdc *testKDC) handleTGS(tgsReq messages.TGSReq) ([]byte, error) {
+	var apReqBytes []byte
+
+	for _, pa := range tgsReq.PAData {
+		if pa.PADataType == patype.PA_TGS_REQ {
+			apReqBytes = pa.PADataValue
+		}
+	}
+
+	var apReq messages.APReq
+	if err := apReq.Unmarshal(apReqBytes); err != nil {
+		return nil, err
+	}
+
+	if err := apReq.Ticket.DecryptEncPart(kdc.keytab, nil); err != nil {
+		return nil, err
+	}
+
+	key := apReq.Ticket.DecryptedEncPart.Key
+
+	if err := apReq.DecryptAuthenticator(key); err != nil {
+		return nil, err
+	}
+
+	if apReq.Authenticator.CRealm != apReq.Ticket.DecryptedEncPart.CRealm {
+		return kdc.krbError(errorcode.KRB_AP_ERR_BADMATCH, nil)
+	}
+
+	subkey := apReq.Authenticator.SubKey
+	cname := apReq.Ticket.DecryptedEncPart.CName
+
+	// Without FAST there is no subkey so answer in the clear
+	if subkey.KeyType == 0 {
+		return kdc.plainTGS(tgsReq, cname, apReq.Ticket.DecryptedEncPart.CRealm, key)
+	}
+
+	armorKey, err := cf2(subkey, key, "subkeyarmor", "ticketarmor")
+	if err != nil {
+		return nil, err
+	}
+
+	req, _, err := kdc.fastRequest(tgsReq.PAData, armorKey, apReqBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if req == nil {
+		return kdc.krbError(errorcode.KDC_ERR_POLICY, nil)
+	}
+
+	kdc.record("FAST TGS")
+
+	if kdc.tgsError != 0 {
+		return kdc.fastError(armorKey, kdc.tgsError, nil)
+	}
+
+	sname, realm := tgsReq.ReqBody.SName, testRealm
+
+	if other, ok := kdc.referrals[sname.PrincipalNameString()]; ok {
+		if apReq.Ticket.SName.NameString[1] == other {
+			realm = other
+		} else {
+			sname = types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+other)
+		}
+	}
+
+	ticket, part, err := kdc.ticket(cname, sname, tgsReq.ReqBody.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	ticket.Realm, part.SRealm = realm, realm
+
+	tgsRep := messages.TGSRep{
+		KDCRepFields: messages.KDCRepFields{
+			PVNO:             iana.PVNO,
+			MsgType:          msgtype.KRB_TGS_REP,
+			CRealm:           testRealm,
+			CName:            cname,
+			Ticket:           ticket,
+			DecryptedEncPart: part,
+		},
+	}
+
+	if err = finish(&tgsRep.KDCRepFields, armorKey, subkey, tgsReq.ReqBody.Nonce, nil,
+		keyusage.TGS_REP_ENCPART_AUTHENTICATOR_SUB_KEY); err != nil {
+		return nil, err
+	}
+
+	return tgsRep.Marshal()
+}
+
+// plainTGS issues a service ticket without FAST, the reply is encrypted with
+// the session key of the TGT.
+func (kdc *testKDC) plainTGS(tgsReq messages.TGSReq, cname types.PrincipalName, crealm string,
+	key types.EncryptionKey,
+) ([]byte, error) {
+	kdc.record("TGS")
+
+	sessionKey, err := generateSubkey(kdc.etype)
+	if err != nil {
+		return nil, err
+	}
+
+	ticket, part, err := kdc.issue(cname, crealm, tgsReq.ReqBody.SName, tgsReq.ReqBody.Nonce, sessionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := part.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	ed, err := crypto.GetEncryptedData(b, key, keyusage.TGS_REP_ENCPART_SESSION_KEY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	tgsRep := messages.TGSRep{
+		KDCRepFields: messages.KDCRepFields{
+			PVNO:    iana.PVNO,
+			MsgType: msgtype.KRB_TGS_REP,
+			CRealm:  crealm,
+			CName:   cname,
+			Ticket:  ticket,
+			EncPart: ed,
+		},
+	}
+
+	return tgsRep.Marshal()
+}
+
+func TestSendTCPReplyTooLong(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		var length uint32
+		if err = binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+
+		if _, err = io.CopyN(io.Discard, conn, int64(length)); err != nil {
+			return
+		}
+
+		_ = binary.Write(conn, binary.BigEndian, uint32(kdcMaxReply+1))
+	}()
+
+	if _, err = sendTCP(listener.Addr().String(), []byte("request")); !errors.Is(err, errKDCReply) {
+		t.Fatalf("expected %v, got %v", errKDCReply, err)
+	}
+}
@@ -0,0 +1,86 @@
+//go:build linux
+
+package gssapi
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+//nolint:paralleltest
+func TestKeyringCCache(t *testing.T) {
+	if _, err := unix.KeyctlGetKeyringID(unix.KEY_SPEC_PROCESS_KEYRING, true); err != nil {
+		if errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+			t.Skip("kernel keyring not available:", err)
+		}
+
+		t.Fatal(err)
+	}
+
+	cc, err := defaultSources().resolveCCache("KEYRING:process:"+t.Name(), nil)
+	require.NoError(t, err)
+
+	testCCacheType(t, cc, testCCache(t))
+
+	kc, ok := cc.(*keyringCCache)
+	require.True(t, ok)
+
+	collection, err := kc.collectionID(false)
+	require.NoError(t, err)
+
+	primary, ok, err := kc.primary(collection)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, keyringDefaultSubsidiary, primary)
+
+	// A specific cache in the same collection
+	other, err := defaultSources().resolveCCache("KEYRING:process:"+t.Name()+":other", nil)
+	require.NoError(t, err)
+
+	missing, err := other.read()
+	require.NoError(t, err)
+	assert.Nil(t, missing)
+}
+
+func TestNewKeyringCCache(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		residual   string
+		anchor     string
+		collection string
+		subsidiary string
+		err        error
+	}{
+		{"persistent:1000", keyringAnchorPersistent, keyringPersistentCollection, "", nil},
+		{"persistent:1000:tkt", keyringAnchorPersistent, keyringPersistentCollection, "tkt", nil},
+		{"session:foo", keyringAnchorSession, "_krb_foo", "", nil},
+		{"user:foo:bar", keyringAnchorUser, "_krb_foo", "bar", nil},
+		{"legacy", keyringAnchorSession, "", "legacy", nil},
+		{"persistent:bob", "", "", "", errBadCCacheName},
+		{"session:", "", "", "", errBadCCacheName},
+		{"bogus:foo", "", "", "", errBadCCacheName},
+	}
+
+	for _, table := range tables {
+		t.Run(table.residual, func(t *testing.T) {
+			t.Parallel()
+
+			c, err := newKeyringCCache(table.residual)
+			if table.err != nil {
+				assert.ErrorIs(t, err, table.err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, table.anchor, c.anchor)
+			assert.Equal(t, table.collection, c.collection)
+			assert.Equal(t, table.subsidiary, c.subsidiary)
+		})
+	}
+}
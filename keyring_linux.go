@@ -0,0 +1,377 @@
+package gssapi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"golang.org/x/sys/unix"
+)
+
+// The KEYRING credential cache uses the same layout in the Linux kernel
+// keyring as MIT Kerberos. A collection keyring is linked into the anchor
+// keyring, containing a key naming the primary cache and one keyring per
+// cache. Each cache keyring holds the default principal and one user key per
+// credential, all in the version 4 file format encoding.
+
+const (
+	keyringAnchorPersistent = "persistent"
+	keyringAnchorUser       = "user"
+	keyringAnchorSession    = "session"
+	keyringAnchorProcess    = "process"
+	keyringAnchorThread     = "thread"
+
+	keyringTypeKeyring = "keyring"
+	keyringTypeUser    = "user"
+
+	keyringPersistentCollection = "_krb"
+	keyringCollectionPrefix     = "_krb_"
+	keyringPrimaryKey           = "krb_ccache:primary"
+	keyringPrimaryVersion       = 1
+	keyringPrincipalKey         = "__krb5_princ__"
+	keyringTimeOffsetsKey       = "__krb5_time_offsets__"
+	keyringDefaultSubsidiary    = "tkt"
+)
+
+//nolint:gochecknoglobals
+var keyringAnchors = map[string]int{
+	keyringAnchorUser:    unix.KEY_SPEC_USER_KEYRING,
+	keyringAnchorSession: unix.KEY_SPEC_SESSION_KEYRING,
+	keyringAnchorProcess: unix.KEY_SPEC_PROCESS_KEYRING,
+	keyringAnchorThread:  unix.KEY_SPEC_THREAD_KEYRING,
+}
+
+// keyringCCache is a KEYRING credential cache. Names are of the form
+// "KEYRING:anchor:collection[:subsidiary]" or "KEYRING:persistent:uid" with
+// an optional subsidiary. A name without an anchor is a legacy cache linked
+// directly into the session keyring.
+//
+// Note that as goroutines move between threads, the thread keyring is only
+// usable if the calling goroutine is locked to its thread.
+type keyringCCache struct {
+	residual   string
+	anchor     string
+	collection string
+	subsidiary string
+	uid        int
+}
+
+func newKeyringCCache(residual string) (*keyringCCache, error) {
+	c := &keyringCCache{residual: residual}
+
+	anchor, rest, ok := strings.Cut(residual, ":")
+	if !ok {
+		if residual == "" {
+			return nil, fmt.Errorf("%w: %s", errBadCCacheName, residual)
+		}
+
+		c.anchor, c.subsidiary = keyringAnchorSession, residual
+
+		return c, nil
+	}
+
+	c.anchor = anchor
+
+	switch anchor {
+	case keyringAnchorPersistent:
+		c.uid = os.Getuid()
+
+		uid, subsidiary, _ := strings.Cut(rest, ":")
+		if uid != "" {
+			var err error
+			if c.uid, err = strconv.Atoi(uid); err != nil {
+				return nil, fmt.Errorf("%w: %s", errBadCCacheName, residual)
+			}
+		}
+
+		c.collection, c.subsidiary = keyringPersistentCollection, subsidiary
+	case keyringAnchorUser, keyringAnchorSession, keyringAnchorProcess, keyringAnchorThread:
+		collection, subsidiary, _ := strings.Cut(rest, ":")
+		if collection == "" {
+			return nil, fmt.Errorf("%w: %s", errBadCCacheName, residual)
+		}
+
+		c.collection, c.subsidiary = keyringCollectionPrefix+collection, subsidiary
+	default:
+		return nil, fmt.Errorf("%w: unknown keyring anchor %s", errBadCCacheName, anchor)
+	}
+
+	return c, nil
+}
+
+func (c *keyringCCache) name() string {
+	return ccacheTypeKeyring + ":" + c.residual
+}
+
+func (c *keyringCCache) anchorID(create bool) (int, error) {
+	if c.anchor == keyringAnchorPersistent {
+		return unix.KeyctlInt(unix.KEYCTL_GET_PERSISTENT, c.uid, unix.KEY_SPEC_PROCESS_KEYRING, 0, 0)
+	}
+
+	return unix.KeyctlGetKeyringID(keyringAnchors[c.anchor], create)
+}
+
+// keyringChildren returns the serial numbers of the keys in a keyring.
+func keyringChildren(id int) ([]int32, error) {
+	size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, size)
+	if size, err = unix.KeyctlBuffer(unix.KEYCTL_READ, id, b, 0); err != nil {
+		return nil, err
+	}
+
+	ids := make([]int32, min(size, len(b))/4) //nolint:mnd
+	if err = binary.Read(bytes.NewReader(b), binary.NativeEndian, ids); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// describeKey returns the type and description of a key.
+func describeKey(id int) (string, string, error) {
+	s, err := unix.KeyctlString(unix.KEYCTL_DESCRIBE, id)
+	if err != nil {
+		return "", "", err
+	}
+
+	// type;uid;gid;perm;description
+	fields := strings.SplitN(s, ";", 5) //nolint:mnd
+	if len(fields) != 5 {               //nolint:mnd
+		return "", "", fmt.Errorf("unexpected key description %q", s)
+	}
+
+	return fields[0], fields[4], nil
+}
+
+// findKey returns the key directly linked into the keyring, or zero if it
+// doesn't exist.
+func findKey(ring int, typ, description string) (int, error) {
+	ids, err := keyringChildren(ring)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		t, d, err := describeKey(int(id))
+		if err != nil {
+			// The key may have been revoked or unlinked meanwhile
+			continue
+		}
+
+		if t == typ && d == description {
+			return int(id), nil
+		}
+	}
+
+	return 0, nil
+}
+
+func readKey(id int) ([]byte, error) {
+	size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, size)
+	if size, err = unix.KeyctlBuffer(unix.KEYCTL_READ, id, b, 0); err != nil {
+		return nil, err
+	}
+
+	return b[:min(size, len(b))], nil
+}
+
+// collectionID returns the collection keyring, optionally creating it.
+func (c *keyringCCache) collectionID(create bool) (int, error) {
+	anchor, err := c.anchorID(create)
+	if err != nil {
+		return 0, err
+	}
+
+	if c.collection == "" {
+		return anchor, nil
+	}
+
+	id, err := findKey(anchor, keyringTypeKeyring, c.collection)
+	if err != nil || id != 0 || !create {
+		return id, err
+	}
+
+	return unix.AddKey(keyringTypeKeyring, c.collection, nil, anchor)
+}
+
+// primary returns the name of the cache keyring within the collection and
+// whether it is recorded as the primary.
+func (c *keyringCCache) primary(collection int) (string, bool, error) {
+	if c.subsidiary != "" {
+		return c.subsidiary, true, nil
+	}
+
+	id, err := findKey(collection, keyringTypeUser, keyringPrimaryKey)
+	if err != nil {
+		return "", false, err
+	}
+
+	if id == 0 {
+		return keyringDefaultSubsidiary, false, nil
+	}
+
+	b, err := readKey(id)
+	if err != nil {
+		return "", false, err
+	}
+
+	// version, length, name
+	if len(b) < 8 || binary.BigEndian.Uint32(b) != keyringPrimaryVersion || //nolint:mnd
+		int(binary.BigEndian.Uint32(b[4:])) != len(b)-8 {
+		return "", false, fmt.Errorf("%w: bad primary key", errBadCCacheName)
+	}
+
+	return string(b[8:]), true, nil
+}
+
+// cacheID returns the cache keyring, or zero if it doesn't exist.
+func (c *keyringCCache) cacheID() (int, string, error) {
+	collection, err := c.collectionID(false)
+	if err != nil || collection == 0 {
+		return 0, "", ignoreNoKey(err)
+	}
+
+	primary, _, err := c.primary(collection)
+	if err != nil {
+		return 0, "", err
+	}
+
+	id, err := findKey(collection, keyringTypeKeyring, primary)
+
+	return id, primary, err
+}
+
+func ignoreNoKey(err error) error {
+	if errors.Is(err, unix.ENOKEY) || errors.Is(err, unix.EKEYEXPIRED) || errors.Is(err, unix.EKEYREVOKED) {
+		return nil
+	}
+
+	return err
+}
+
+func (c *keyringCCache) read() (*credentials.CCache, error) {
+	cache, _, err := c.cacheID()
+	if err != nil || cache == 0 {
+		return nil, err
+	}
+
+	ids, err := keyringChildren(cache)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		principal []byte
+		creds     [][]byte
+	)
+
+	for _, id := range ids {
+		t, d, err := describeKey(int(id))
+		if err != nil || t != keyringTypeUser || d == keyringTimeOffsetsKey {
+			continue
+		}
+
+		b, err := readKey(int(id))
+		if err != nil {
+			return nil, err
+		}
+
+		if d == keyringPrincipalKey {
+			principal = b
+		} else {
+			creds = append(creds, b)
+		}
+	}
+
+	if principal == nil {
+		return nil, nil //nolint:nilnil
+	}
+
+	return unmarshalCCache(principal, creds)
+}
+
+func (c *keyringCCache) write(cache *credentials.CCache) error {
+	collection, err := c.collectionID(true)
+	if err != nil {
+		return err
+	}
+
+	primary, ok, err := c.primary(collection)
+	if err != nil {
+		return err
+	}
+
+	id, err := findKey(collection, keyringTypeKeyring, primary)
+	if err != nil {
+		return err
+	}
+
+	if id == 0 {
+		if id, err = unix.AddKey(keyringTypeKeyring, primary, nil, collection); err != nil {
+			return err
+		}
+	} else if _, err = unix.KeyctlInt(unix.KEYCTL_CLEAR, id, 0, 0, 0); err != nil {
+		return err
+	}
+
+	b := new(bytes.Buffer)
+	marshalCCachePrincipal(b, cache.DefaultPrincipal.PrincipalName, cache.DefaultPrincipal.Realm)
+
+	if _, err = unix.AddKey(keyringTypeUser, keyringPrincipalKey, b.Bytes(), id); err != nil {
+		return err
+	}
+
+	for _, cred := range cache.Credentials {
+		b.Reset()
+		marshalCCacheCredential(b, cred)
+
+		server := NewNameFromPrincipal(cred.Server.PrincipalName, cred.Server.Realm).String()
+
+		if _, err = unix.AddKey(keyringTypeUser, server, b.Bytes(), id); err != nil {
+			return err
+		}
+	}
+
+	if ok || c.collection == "" {
+		return nil
+	}
+
+	// Make the new cache the primary
+	b.Reset()
+	_ = binary.Write(b, binary.BigEndian, uint32(keyringPrimaryVersion))
+	_ = binary.Write(b, binary.BigEndian, uint32(len(primary))) //nolint:gosec
+	b.WriteString(primary)
+
+	_, err = unix.AddKey(keyringTypeUser, keyringPrimaryKey, b.Bytes(), collection)
+
+	return err
+}
+
+func (c *keyringCCache) stamp() (string, error) {
+	_, primary, err := c.cacheID()
+	if err != nil {
+		return "", err
+	}
+
+	stamp, err := contentStamp(c)
+	if err != nil || stamp == "" {
+		return "", err
+	}
+
+	// Switching the primary is also a modification
+	return primary + ":" + stamp, nil
+}
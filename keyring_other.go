@@ -0,0 +1,11 @@
+//go:build !linux
+
+package gssapi
+
+import "errors"
+
+var errKeyringUnsupported = errors.New("KEYRING credential caches are only supported on Linux")
+
+func newKeyringCCache(_ string) (credCache, error) {
+	return nil, errKeyringUnsupported
+}
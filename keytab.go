@@ -0,0 +1,159 @@
+package gssapi
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/spf13/afero"
+)
+
+const (
+	keytabTypeFile   = "FILE"
+	keytabTypeWRFile = "WRFILE"
+	keytabTypeMemory = "MEMORY"
+	keytabTypeDir    = "DIR"
+)
+
+var (
+	errUnknownKeytabType = errors.New("unknown keytab type")
+	errKeytabNotFound    = errors.New("keytab not found")
+)
+
+//nolint:gochecknoglobals
+var memoryKeytabs = struct {
+	sync.RWMutex
+	keytabs map[string]*keytab.Keytab
+}{
+	keytabs: make(map[string]*keytab.Keytab),
+}
+
+// RegisterKeytab makes kt available as the keytab named "MEMORY:name"
+// anywhere within the process, such as in the KRB5_KTNAME environment
+// variable or with WithKeytab. This allows keys to be fetched from a secret
+// manager without writing them to disk. Registering the same name again
+// replaces the keytab.
+func RegisterKeytab(name string, kt *keytab.Keytab) {
+	memoryKeytabs.Lock()
+	defer memoryKeytabs.Unlock()
+
+	memoryKeytabs.keytabs[name] = kt
+}
+
+// UnregisterKeytab removes the keytab previously registered with
+// RegisterKeytab.
+func UnregisterKeytab(name string) {
+	memoryKeytabs.Lock()
+	defer memoryKeytabs.Unlock()
+
+	delete(memoryKeytabs.keytabs, name)
+}
+
+// resolveKeytab loads the keytab for name. A name without a type prefix is
+// treated as a FILE keytab. As well as the MIT FILE, WRFILE and MEMORY types,
+// "DIR:path" merges every keytab file found in the directory, which suits
+// keys mounted as individual secrets.
+func (s *sources) resolveKeytab(name string) (*keytab.Keytab, error) {
+	typ, residual, ok := strings.Cut(name, ":")
+	if !ok || strings.ContainsRune(typ, filepath.Separator) {
+		return readKeytabFile(s.fs, name)
+	}
+
+	switch typ {
+	case keytabTypeFile, keytabTypeWRFile:
+		return readKeytabFile(s.fs, residual)
+	case keytabTypeMemory:
+		memoryKeytabs.RLock()
+		defer memoryKeytabs.RUnlock()
+
+		if kt, ok := memoryKeytabs.keytabs[residual]; ok {
+			return kt, nil
+		}
+
+		return nil, fmt.Errorf("%w: %s", errKeytabNotFound, name)
+	case keytabTypeDir:
+		return readKeytabDir(s.fs, residual)
+	}
+
+	return nil, fmt.Errorf("%w: %s", errUnknownKeytabType, typ)
+}
+
+func readKeytabFile(fsys afero.Fs, path string) (*keytab.Keytab, error) {
+	if _, err := fsys.Stat(path); err != nil {
+		return nil, err
+	}
+
+	b, err := afero.ReadFile(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseKeytab(b)
+}
+
+func parseKeytab(b []byte) (*keytab.Keytab, error) {
+	kt := keytab.New()
+	if err := kt.Unmarshal(b); err != nil {
+		return nil, err
+	}
+
+	return kt, nil
+}
+
+func readKeytabDir(fsys afero.Fs, dir string) (*keytab.Keytab, error) {
+	infos, err := afero.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := keytab.New()
+
+	for _, info := range infos {
+		// Skip dotfiles such as the ..data symlink used for Kubernetes
+		// secret volumes
+		if strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+
+		path := filepath.Join(dir, info.Name())
+
+		// Follow symlinks before checking for a regular file
+		if info, err = fsys.Stat(path); err != nil {
+			return nil, err
+		}
+
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		kt, err := readKeytabFile(fsys, path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", info.Name(), err)
+		}
+
+		merged.Entries = append(merged.Entries, kt.Entries...)
+	}
+
+	if len(merged.Entries) == 0 {
+		return nil, fmt.Errorf("%w: %s", errKeytabNotFound, dir)
+	}
+
+	return merged, nil
+}
+
+// loadKeytabName loads the keytab named by the environment variable env or
+// else the default.
+func (s *sources) loadKeytabName(logger logr.Logger, env, def string) (*keytab.Keytab, error) {
+	name, ok := s.lookupEnv(env)
+	if !ok {
+		name = def
+	}
+
+	logger.Info("loading keytab", "env", env, "name", name)
+
+	return s.resolveKeytab(name)
+}
@@ -0,0 +1,129 @@
+package gssapi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKeytab(t *testing.T, principal string) *keytab.Keytab {
+	t.Helper()
+
+	kt := keytab.New()
+	require.NoError(t, kt.AddEntry(principal, testRealm, "password", time.Now(), 1,
+		etypeID.AES256_CTS_HMAC_SHA1_96))
+
+	return kt
+}
+
+func writeTestKeytab(t *testing.T, path string, kt *keytab.Keytab) {
+	t.Helper()
+
+	b, err := kt.Marshal()
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, b, 0o600))
+}
+
+func TestResolveKeytab(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "krb5.keytab")
+	writeTestKeytab(t, path, testKeytab(t, "host/a.example.com"))
+
+	keytabs := filepath.Join(dir, "keytabs")
+	require.NoError(t, os.Mkdir(keytabs, 0o700))
+	writeTestKeytab(t, filepath.Join(keytabs, "a"), testKeytab(t, "host/a.example.com"))
+	writeTestKeytab(t, filepath.Join(keytabs, "b"), testKeytab(t, "host/b.example.com"))
+	require.NoError(t, os.Symlink("b", filepath.Join(keytabs, "c")))
+	require.NoError(t, os.WriteFile(filepath.Join(keytabs, ".hidden"), []byte("junk"), 0o600))
+
+	RegisterKeytab(t.Name(), testKeytab(t, "host/a.example.com"))
+	t.Cleanup(func() { UnregisterKeytab(t.Name()) })
+
+	tables := []struct {
+		name    string
+		entries int
+		err     error
+	}{
+		{path, 1, nil},
+		{"FILE:" + path, 1, nil},
+		{"WRFILE:" + path, 1, nil},
+		{"MEMORY:" + t.Name(), 1, nil},
+		{"MEMORY:missing", 0, errKeytabNotFound},
+		{"DIR:" + keytabs, 3, nil},
+		{"DIR:" + t.TempDir(), 0, errKeytabNotFound},
+		{"FILE:" + filepath.Join(dir, "missing"), 0, os.ErrNotExist},
+		{"HDB:foo", 0, errUnknownKeytabType},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			kt, err := defaultSources().resolveKeytab(table.name)
+			if table.err != nil {
+				assert.ErrorIs(t, err, table.err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Len(t, kt.Entries, table.entries)
+		})
+	}
+}
+
+//nolint:paralleltest
+func TestAcceptorKeytab(t *testing.T) {
+	env := newTestEnvironment(t, etypeID.AES256_CTS_HMAC_SHA1_96)
+
+	b, err := os.ReadFile(env.keytab)
+	require.NoError(t, err)
+
+	// Nothing usable in the default location
+	t.Setenv(krb5KTName, "MEMORY:missing")
+
+	t.Run("bytes", func(t *testing.T) {
+		establish(t, 0, nil, []Option[Acceptor]{WithKeytabBytes[Acceptor](b)})
+	})
+
+	t.Run("name", func(t *testing.T) {
+		establish(t, 0, nil, []Option[Acceptor]{WithKeytab[Acceptor](env.keytab)})
+	})
+
+	t.Run("memory", func(t *testing.T) {
+		kt, err := parseKeytab(b)
+		require.NoError(t, err)
+
+		RegisterKeytab(t.Name(), kt)
+		defer UnregisterKeytab(t.Name())
+
+		t.Setenv(krb5KTName, "MEMORY:"+t.Name())
+
+		establish(t, 0, nil, nil)
+	})
+}
+
+//nolint:paralleltest
+func TestInitiatorKeytab(t *testing.T) {
+	env := newTestEnvironment(t, etypeID.AES256_CTS_HMAC_SHA1_96)
+
+	// The valid TGT in the credential cache is reused so the keytab is
+	// loaded but the KDC is never contacted
+	initiator, _ := establish(t, 0, []Option[Initiator]{
+		WithUsername[Initiator](testClient),
+		WithRealm[Initiator](testRealm),
+		WithKeytabValue[Initiator](testKeytab(t, testClient)),
+		WithStoreCredentials[Initiator](""),
+	}, nil)
+
+	assert.True(t, initiator.client.Credentials.HasKeytab())
+	assert.Equal(t, krb5FilePrefix+env.ccache, defaultSources().defaultCCacheName(nil))
+}
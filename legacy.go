@@ -0,0 +1,508 @@
+package gssapi
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des" //nolint:gosec
+	"crypto/hmac"
+	"crypto/md5" //nolint:gosec
+	"crypto/rand"
+	"crypto/rc4" //nolint:gosec
+	"encoding/binary"
+	"errors"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/crypto/rfc4757"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// Algorithm identifiers used in RFC 1964 and RFC 4757 per-message tokens,
+// along with the Triple DES ones used by MIT Kerberos.
+const (
+	sgnAlgDESMACMD5       = 0x0000
+	sgnAlgHMACSHA1DES3KD  = 0x0004
+	sgnAlgHMACMD5         = 0x0011
+	sealAlgDES            = 0x0000
+	sealAlgDES3KD         = 0x0002
+	sealAlgRC4            = 0x0010
+	sealAlgNone           = 0xffff
+	legacyHeaderLength    = 8
+	legacyConfounderSize  = 8
+	legacyMaxPadding      = 8
+	legacyUsageSign       = 23 // KG_USAGE_SIGN in MIT Kerberos
+	legacyUsageRC4Wrap    = 13
+	legacyUsageRC4MIC     = 15
+	legacySequenceLength  = 8
+	legacyDirectionLength = 4
+)
+
+var (
+	errBadLegacyToken    = errors.New("invalid RFC 1964 per-message token")
+	errLegacyIntegrity   = errors.New("RFC 1964 per-message token integrity verification failed")
+	errBadSequenceNumber = errors.New("invalid per-message token sequence number")
+)
+
+//nolint:gochecknoglobals
+var (
+	legacyMICTokenID      = []byte{0x01, 0x01}
+	legacyWrapTokenID     = []byte{0x02, 0x01}
+	legacyFiller          = []byte{0xff, 0xff, 0xff, 0xff}
+	legacyInitiatorFiller = []byte{0x00, 0x00, 0x00, 0x00}
+)
+
+// frameToken adds the RFC 2743 section 3.1 framing that RFC 1964 requires
+// for all tokens, including per-message ones.
+func frameToken(b []byte) []byte {
+	oid, _ := asn1.Marshal(gssapi.OIDKRB5.OID())
+
+	return asn1tools.AddASNAppTag(append(oid, b...), 0)
+}
+
+// frameTokenLength returns the length of a token of length n once framed.
+func frameTokenLength(n int) int {
+	oid, _ := asn1.Marshal(gssapi.OIDKRB5.OID())
+	n += len(oid)
+
+	return 1 + len(asn1tools.MarshalLengthBytes(n)) + n
+}
+
+func unframeToken(b []byte) ([]byte, error) {
+	var raw asn1.RawValue
+	if rest, err := asn1.Unmarshal(b, &raw); err != nil || len(rest) != 0 ||
+		raw.Class != asn1.ClassApplication || raw.Tag != 0 {
+		return nil, errBadLegacyToken
+	}
+
+	var oid asn1.ObjectIdentifier
+
+	rest, err := asn1.Unmarshal(raw.Bytes, &oid)
+	if err != nil || !oid.Equal(gssapi.OIDKRB5.OID()) {
+		return nil, errBadLegacyToken
+	}
+
+	return rest, nil
+}
+
+// legacyCipher implements the per-message token algorithms used with the
+// encryption types that predate RFC 4121.
+type legacyCipher struct {
+	keyType int32
+	key     []byte
+}
+
+func newLegacyCipher(key types.EncryptionKey) (*legacyCipher, bool) {
+	switch key.KeyType {
+	case etypeID.DES_CBC_CRC, etypeID.DES_CBC_MD4, etypeID.DES_CBC_MD5, etypeID.DES3_CBC_SHA1_KD,
+		etypeID.RC4_HMAC:
+		return &legacyCipher{
+			keyType: key.KeyType,
+			key:     key.KeyValue,
+		}, true
+	}
+
+	return nil, false
+}
+
+func (c *legacyCipher) isRC4() bool {
+	return c.keyType == etypeID.RC4_HMAC
+}
+
+func (c *legacyCipher) isDES3() bool {
+	return c.keyType == etypeID.DES3_CBC_SHA1_KD
+}
+
+func (c *legacyCipher) sgnAlg() uint16 {
+	switch {
+	case c.isRC4():
+		return sgnAlgHMACMD5
+	case c.isDES3():
+		return sgnAlgHMACSHA1DES3KD
+	}
+
+	return sgnAlgDESMACMD5
+}
+
+func (c *legacyCipher) sealAlg() uint16 {
+	switch {
+	case c.isRC4():
+		return sealAlgRC4
+	case c.isDES3():
+		return sealAlgDES3KD
+	}
+
+	return sealAlgDES
+}
+
+func (c *legacyCipher) checksumLength() int {
+	if c.isDES3() {
+		return 20
+	}
+
+	return 8
+}
+
+// blockSize returns the block size the plaintext of a wrap token is padded
+// to. RC4 is a stream cipher so only a single byte of padding is used.
+func (c *legacyCipher) blockSize() int {
+	if c.isRC4() {
+		return 1
+	}
+
+	return des.BlockSize
+}
+
+func (c *legacyCipher) block(key []byte) (cipher.Block, error) {
+	if c.isDES3() {
+		return des.NewTripleDESCipher(key) //nolint:gosec
+	}
+
+	return des.NewCipher(key) //nolint:gosec
+}
+
+// header returns the first eight bytes of a token, which are covered by the
+// checksum.
+func (c *legacyCipher) header(tokenID []byte, sealAlg uint16) []byte {
+	b := make([]byte, legacyHeaderLength)
+	copy(b, tokenID)
+	binary.LittleEndian.PutUint16(b[2:], c.sgnAlg())
+
+	if bytes.Equal(tokenID, legacyMICTokenID) {
+		copy(b[4:], legacyFiller)
+	} else {
+		binary.LittleEndian.PutUint16(b[4:], sealAlg)
+		copy(b[6:], legacyFiller)
+	}
+
+	return b
+}
+
+func (c *legacyCipher) checksum(wrap bool, b []byte) ([]byte, error) {
+	switch {
+	case c.isRC4():
+		var usage uint32 = legacyUsageRC4MIC
+		if wrap {
+			usage = legacyUsageRC4Wrap
+		}
+
+		cksum, err := rfc4757.Checksum(c.key, usage, b)
+		if err != nil {
+			return nil, err
+		}
+
+		return cksum[:c.checksumLength()], nil
+	case c.isDES3():
+		e, err := crypto.GetEtype(c.keyType)
+		if err != nil {
+			return nil, err
+		}
+
+		return e.GetChecksumHash(c.key, b, legacyUsageSign)
+	}
+
+	// DES MAC MD5 is the last block of the MD5 hash encrypted with DES-CBC
+	block, err := c.block(c.key)
+	if err != nil {
+		return nil, err
+	}
+
+	h := md5.Sum(b) //nolint:gosec
+	cipher.NewCBCEncrypter(block, make([]byte, des.BlockSize)).CryptBlocks(h[:], h[:])
+
+	return h[des.BlockSize:], nil
+}
+
+// cryptSequenceNumber encrypts or decrypts the SND_SEQ field, using the
+// checksum as the IV.
+func (c *legacyCipher) cryptSequenceNumber(encrypt bool, cksum, b []byte) ([]byte, error) {
+	out := make([]byte, legacySequenceLength)
+
+	if c.isRC4() {
+		k, err := rc4.NewCipher(rfc4757.HMAC(rfc4757.HMAC(c.key, make([]byte, 4)), cksum[:8])) //nolint:gosec
+		if err != nil {
+			return nil, err
+		}
+
+		k.XORKeyStream(out, b)
+
+		return out, nil
+	}
+
+	block, err := c.block(c.key)
+	if err != nil {
+		return nil, err
+	}
+
+	if encrypt {
+		cipher.NewCBCEncrypter(block, cksum[:des.BlockSize]).CryptBlocks(out, b)
+	} else {
+		cipher.NewCBCDecrypter(block, cksum[:des.BlockSize]).CryptBlocks(out, b)
+	}
+
+	return out, nil
+}
+
+// sequenceNumber returns the encrypted SND_SEQ field.
+func (c *legacyCipher) sequenceNumber(cksum []byte, sequenceNumber uint32, acceptor bool) ([]byte, error) {
+	b := make([]byte, legacySequenceLength)
+
+	// RFC 4757 uses big-endian sequence numbers, unlike RFC 1964
+	if c.isRC4() {
+		binary.BigEndian.PutUint32(b, sequenceNumber)
+	} else {
+		binary.LittleEndian.PutUint32(b, sequenceNumber)
+	}
+
+	if acceptor {
+		copy(b[legacyDirectionLength:], legacyFiller)
+	}
+
+	return c.cryptSequenceNumber(true, cksum, b)
+}
+
+// openSequenceNumber decrypts the SND_SEQ field and returns the sequence
+// number and whether it was sent by the acceptor.
+func (c *legacyCipher) openSequenceNumber(cksum, b []byte) (uint32, bool, error) {
+	b, err := c.cryptSequenceNumber(false, cksum, b)
+	if err != nil {
+		return 0, false, err
+	}
+
+	var acceptor bool
+
+	switch {
+	case bytes.Equal(b[legacyDirectionLength:], legacyFiller):
+		acceptor = true
+	case bytes.Equal(b[legacyDirectionLength:], legacyInitiatorFiller):
+	default:
+		return 0, false, errBadSequenceNumber
+	}
+
+	if c.isRC4() {
+		return binary.BigEndian.Uint32(b), acceptor, nil
+	}
+
+	return binary.LittleEndian.Uint32(b), acceptor, nil
+}
+
+// crypt encrypts or decrypts the confounder, message and padding of a wrap
+// token in place.
+func (c *legacyCipher) crypt(encrypt bool, sequenceNumber uint32, b []byte) error {
+	key := bytes.Clone(c.key)
+
+	// Both DES and RC4 use the key XOR'd with 0xf0 but Triple DES uses it as is
+	if !c.isDES3() {
+		for i := range key {
+			key[i] ^= 0xf0
+		}
+	}
+
+	if c.isRC4() {
+		seq := binary.BigEndian.AppendUint32(nil, sequenceNumber)
+
+		k, err := rc4.NewCipher(rfc4757.HMAC(rfc4757.HMAC(key, make([]byte, 4)), seq)) //nolint:gosec
+		if err != nil {
+			return err
+		}
+
+		k.XORKeyStream(b, b)
+
+		return nil
+	}
+
+	block, err := c.block(key)
+	if err != nil {
+		return err
+	}
+
+	if encrypt {
+		cipher.NewCBCEncrypter(block, make([]byte, des.BlockSize)).CryptBlocks(b, b)
+	} else {
+		cipher.NewCBCDecrypter(block, make([]byte, des.BlockSize)).CryptBlocks(b, b)
+	}
+
+	return nil
+}
+
+// wrapLength returns the length of a wrap token containing a message of
+// length n.
+func (c *legacyCipher) wrapLength(n int) int {
+	n += legacyConfounderSize
+	n += c.blockSize() - n%c.blockSize()
+
+	return frameTokenLength(legacyHeaderLength + legacySequenceLength + c.checksumLength() + n)
+}
+
+func (ctx *context) makeLegacySignature(c *legacyCipher, message []byte) ([]byte, error) {
+	header := c.header(legacyMICTokenID, sealAlgNone)
+
+	cksum, err := c.checksum(false, append(bytes.Clone(header), message...))
+	if err != nil {
+		return nil, err
+	}
+
+	seq, err := c.sequenceNumber(cksum, uint32(ctx.sequenceNumber), ctx.acceptor) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.sequenceNumber++
+
+	return frameToken(append(append(header, seq...), cksum...)), nil
+}
+
+func (ctx *context) verifyLegacySignature(c *legacyCipher, message, signature []byte) error {
+	b, err := unframeToken(signature)
+	if err != nil {
+		return err
+	}
+
+	if len(b) != legacyHeaderLength+legacySequenceLength+c.checksumLength() ||
+		!bytes.Equal(b[:legacyHeaderLength], c.header(legacyMICTokenID, sealAlgNone)) {
+		return errBadLegacyToken
+	}
+
+	cksum := b[legacyHeaderLength+legacySequenceLength:]
+
+	expected, err := c.checksum(false, append(bytes.Clone(b[:legacyHeaderLength]), message...))
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(expected, cksum) {
+		return errLegacyIntegrity
+	}
+
+	seq, acceptor, err := c.openSequenceNumber(cksum, b[legacyHeaderLength:legacyHeaderLength+legacySequenceLength])
+	if err != nil {
+		return err
+	}
+
+	if acceptor == ctx.acceptor {
+		return errBadSequenceNumber
+	}
+
+	return ctx.checkSequenceNumber(uint64(seq))
+}
+
+func (ctx *context) legacyWrap(c *legacyCipher, message []byte, conf bool) ([]byte, error) {
+	var sealAlg uint16 = sealAlgNone
+	if conf {
+		sealAlg = c.sealAlg()
+	}
+
+	header := c.header(legacyWrapTokenID, sealAlg)
+
+	n := legacyConfounderSize + len(message)
+	padding := c.blockSize() - n%c.blockSize()
+
+	plaintext := make([]byte, legacyConfounderSize, n+padding)
+	if _, err := rand.Read(plaintext); err != nil {
+		return nil, err
+	}
+
+	plaintext = append(plaintext, message...)
+	plaintext = append(plaintext, bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	cksum, err := c.checksum(true, append(bytes.Clone(header), plaintext...))
+	if err != nil {
+		return nil, err
+	}
+
+	sequenceNumber := uint32(ctx.sequenceNumber) //nolint:gosec
+
+	seq, err := c.sequenceNumber(cksum, sequenceNumber, ctx.acceptor)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf {
+		if err = c.crypt(true, sequenceNumber, plaintext); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx.sequenceNumber++
+
+	token := make([]byte, 0, len(header)+len(seq)+len(cksum)+len(plaintext))
+	token = append(token, header...)
+	token = append(token, seq...)
+	token = append(token, cksum...)
+	token = append(token, plaintext...)
+
+	return frameToken(token), nil
+}
+
+//nolint:cyclop
+func (ctx *context) legacyUnwrap(c *legacyCipher, token []byte) ([]byte, bool, error) {
+	b, err := unframeToken(token)
+	if err != nil {
+		return nil, false, err
+	}
+
+	offset := legacyHeaderLength + legacySequenceLength + c.checksumLength()
+	if len(b) < offset+legacyConfounderSize+1 || (len(b)-offset)%c.blockSize() != 0 {
+		return nil, false, errBadLegacyToken
+	}
+
+	sealAlg := binary.LittleEndian.Uint16(b[4:])
+	conf := sealAlg != sealAlgNone
+
+	if !bytes.Equal(b[:legacyHeaderLength], c.header(legacyWrapTokenID, sealAlg)) ||
+		(conf && sealAlg != c.sealAlg()) {
+		return nil, false, errBadLegacyToken
+	}
+
+	cksum := b[legacyHeaderLength+legacySequenceLength : offset]
+
+	seq, acceptor, err := c.openSequenceNumber(cksum, b[legacyHeaderLength:legacyHeaderLength+legacySequenceLength])
+	if err != nil {
+		return nil, false, err
+	}
+
+	plaintext := bytes.Clone(b[offset:])
+
+	if conf {
+		if err = c.crypt(false, seq, plaintext); err != nil {
+			return nil, false, err
+		}
+	}
+
+	expected, err := c.checksum(true, append(bytes.Clone(b[:legacyHeaderLength]), plaintext...))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !hmac.Equal(expected, cksum) {
+		return nil, false, errLegacyIntegrity
+	}
+
+	if acceptor == ctx.acceptor {
+		return nil, false, errBadSequenceNumber
+	}
+
+	padding := int(plaintext[len(plaintext)-1])
+	if padding < 1 || padding > legacyMaxPadding || padding > len(plaintext)-legacyConfounderSize ||
+		!bytes.Equal(plaintext[len(plaintext)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, false, errBadLegacyToken
+	}
+
+	if err = ctx.checkSequenceNumber(uint64(seq)); err != nil {
+		return nil, false, err
+	}
+
+	return plaintext[legacyConfounderSize : len(plaintext)-padding], conf, nil
+}
+
+func legacyWrapSizeLimit(c *legacyCipher, maxOutput int) int {
+	n := maxOutput - c.wrapLength(0) + c.blockSize()
+
+	for n > 0 && c.wrapLength(n) > maxOutput {
+		n--
+	}
+
+	return max(n, 0)
+}
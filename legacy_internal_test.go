@@ -0,0 +1,154 @@
+package gssapi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//nolint:gochecknoglobals
+var legacyEncTypes = []struct {
+	etype   int32
+	sgnAlg  uint16
+	sealAlg uint16
+}{
+	{etypeID.DES_CBC_MD5, sgnAlgDESMACMD5, sealAlgDES},
+	{etypeID.DES3_CBC_SHA1_KD, sgnAlgHMACSHA1DES3KD, sealAlgDES3KD},
+	{etypeID.RC4_HMAC, sgnAlgHMACMD5, sealAlgRC4},
+}
+
+//nolint:funlen
+func TestLegacySignature(t *testing.T) {
+	t.Parallel()
+
+	message := []byte("the quick brown fox jumps over the lazy dog")
+
+	for _, table := range legacyEncTypes {
+		t.Run(encTypeName(table.etype), func(t *testing.T) {
+			t.Parallel()
+
+			initiator, acceptor := newContextPair(t, table.etype, gssapi.ContextFlagReplay)
+
+			for range 2 {
+				signature, err := initiator.MakeSignature(message)
+				require.NoError(t, err)
+
+				b, err := unframeToken(signature)
+				require.NoError(t, err)
+				assert.Equal(t, legacyMICTokenID, b[:2])
+				assert.Equal(t, table.sgnAlg, binary.LittleEndian.Uint16(b[2:]))
+
+				require.NoError(t, acceptor.VerifySignature(message, signature))
+				assert.ErrorIs(t, acceptor.VerifySignature(message, signature), errDuplicateToken)
+
+				signature, err = acceptor.MakeSignature(message)
+				require.NoError(t, err)
+				require.NoError(t, initiator.VerifySignature(message, signature))
+			}
+
+			signature, err := initiator.MakeSignature(message)
+			require.NoError(t, err)
+
+			assert.ErrorIs(t, acceptor.VerifySignature([]byte("tampered"), signature), errLegacyIntegrity)
+
+			// A token can't be reflected back to the sender
+			assert.ErrorIs(t, initiator.VerifySignature(message, signature), errBadSequenceNumber)
+
+			assert.ErrorIs(t, acceptor.VerifySignature(message, signature[1:]), errBadLegacyToken)
+		})
+	}
+}
+
+//nolint:funlen
+func TestLegacyWrap(t *testing.T) {
+	t.Parallel()
+
+	for _, table := range legacyEncTypes {
+		t.Run(encTypeName(table.etype), func(t *testing.T) {
+			t.Parallel()
+
+			initiator, acceptor := newContextPair(t, table.etype, gssapi.ContextFlagReplay)
+
+			for _, conf := range []bool{true, false} {
+				for _, message := range [][]byte{{}, []byte("message"), []byte("exactly 16 bytes")} {
+					token, err := initiator.Wrap(message, conf)
+					require.NoError(t, err)
+
+					b, err := unframeToken(token)
+					require.NoError(t, err)
+					assert.Equal(t, legacyWrapTokenID, b[:2])
+					assert.Equal(t, table.sgnAlg, binary.LittleEndian.Uint16(b[2:]))
+
+					if conf {
+						assert.Equal(t, table.sealAlg, binary.LittleEndian.Uint16(b[4:]))
+					} else {
+						assert.Equal(t, uint16(sealAlgNone), binary.LittleEndian.Uint16(b[4:]))
+						assert.True(t, bytes.Contains(b, message))
+					}
+
+					plaintext, sealed, err := acceptor.Unwrap(token)
+					require.NoError(t, err)
+					assert.Equal(t, conf, sealed)
+					assert.Equal(t, message, plaintext)
+
+					_, _, err = acceptor.Unwrap(token)
+					assert.ErrorIs(t, err, errDuplicateToken)
+
+					token, err = acceptor.Wrap(message, conf)
+					require.NoError(t, err)
+
+					plaintext, sealed, err = initiator.Unwrap(token)
+					require.NoError(t, err)
+					assert.Equal(t, conf, sealed)
+					assert.Equal(t, message, plaintext)
+				}
+
+				token, err := initiator.Wrap([]byte("message"), conf)
+				require.NoError(t, err)
+
+				token[len(token)-1] ^= 0xff
+
+				_, _, err = acceptor.Unwrap(token)
+				assert.ErrorIs(t, err, errLegacyIntegrity)
+			}
+		})
+	}
+}
+
+func TestLegacyWrapSizeLimit(t *testing.T) {
+	t.Parallel()
+
+	for _, table := range legacyEncTypes {
+		t.Run(encTypeName(table.etype), func(t *testing.T) {
+			t.Parallel()
+
+			initiator, _ := newContextPair(t, table.etype, 0)
+
+			for _, maxOutput := range []int{0, 40, 64, 127, 128, 1024, 65536} {
+				limit, err := initiator.WrapSizeLimit(true, maxOutput)
+				require.NoError(t, err)
+
+				if limit == 0 {
+					token, err := initiator.Wrap(nil, true)
+					require.NoError(t, err)
+					assert.Greater(t, len(token), maxOutput)
+
+					continue
+				}
+
+				token, err := initiator.Wrap(make([]byte, limit), true)
+				require.NoError(t, err)
+				assert.LessOrEqual(t, len(token), maxOutput)
+
+				token, err = initiator.Wrap(make([]byte, limit+1), true)
+				require.NoError(t, err)
+				assert.Greater(t, len(token), maxOutput)
+			}
+		})
+	}
+}
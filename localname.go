@@ -0,0 +1,329 @@
+package gssapi
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	authToLocal        = "auth_to_local"
+	authToLocalNames   = "auth_to_local_names"
+	k5loginDirectory   = "k5login_directory"
+	k5loginAuthority   = "k5login_authoritative"
+	k5loginFile        = ".k5login"
+	authToLocalRule    = "RULE:"
+	authToLocalDefault = "DEFAULT"
+)
+
+var (
+	errNoTranslation = errors.New("no translation available for principal")
+	errBadRule       = errors.New("malformed auth_to_local rule")
+	errK5LoginOwner  = errors.New("k5login file is not owned by the user or root")
+)
+
+//nolint:gochecknoglobals
+var lookupUser = user.Lookup
+
+// localName maps name to a local account name following the MIT
+// krb5_aname_to_localname semantics. Explicit auth_to_local_names mappings in
+// the principal's realm are tried first, followed by the auth_to_local rules
+// in the default realm, which themselves default to "DEFAULT".
+func localName(p *profile, defaultRealm string, name *Name) (string, error) {
+	if !name.IsMechName() {
+		return "", errNotMechName
+	}
+
+	unqualified := (&Name{principal: name.principal}).String()
+
+	if v, ok := p.value("realms", name.realm, authToLocalNames, unqualified); ok {
+		return v, nil
+	}
+
+	rules := p.values("realms", defaultRealm, authToLocal)
+	if len(rules) == 0 {
+		rules = []string{authToLocalDefault}
+	}
+
+	for _, rule := range rules {
+		result, err := applyAuthToLocal(rule, defaultRealm, name)
+		if errors.Is(err, errNoTranslation) {
+			continue
+		}
+
+		return result, err
+	}
+
+	return "", errNoTranslation
+}
+
+func applyAuthToLocal(rule, defaultRealm string, name *Name) (string, error) {
+	switch {
+	case rule == authToLocalDefault:
+		if name.realm != defaultRealm || len(name.principal.NameString) != 1 {
+			return "", errNoTranslation
+		}
+
+		return name.principal.NameString[0], nil
+	case strings.HasPrefix(rule, authToLocalRule):
+		return applyRule(strings.TrimPrefix(rule, authToLocalRule), name)
+	}
+
+	return "", fmt.Errorf("%w: %q", errBadRule, rule)
+}
+
+// applyRule evaluates a single "[n:fmt](regexp)s/pattern/replacement/g" rule.
+//
+//nolint:cyclop
+func applyRule(rule string, name *Name) (string, error) {
+	if !strings.HasPrefix(rule, "[") {
+		return "", fmt.Errorf("%w: %q", errBadRule, rule)
+	}
+
+	end := strings.IndexByte(rule, ']')
+	if end < 0 {
+		return "", fmt.Errorf("%w: %q", errBadRule, rule)
+	}
+
+	selection, ok, err := selectionString(rule[1:end], name)
+	if err != nil || !ok {
+		return "", err
+	}
+
+	rule = rule[end+1:]
+
+	if strings.HasPrefix(rule, "(") {
+		end = strings.IndexByte(rule, ')')
+		if end < 0 {
+			return "", fmt.Errorf("%w: %q", errBadRule, rule)
+		}
+
+		// The regular expression must match the whole selection string
+		re, err := regexp.Compile("^(?:" + rule[1:end] + ")$")
+		if err != nil {
+			return "", fmt.Errorf("%w: %w", errBadRule, err)
+		}
+
+		if !re.MatchString(selection) {
+			return "", errNoTranslation
+		}
+
+		rule = rule[end+1:]
+	}
+
+	for rule != "" {
+		if rule, selection, err = applySubstitution(rule, selection); err != nil {
+			return "", err
+		}
+	}
+
+	if selection == "" || strings.ContainsAny(selection, "/@") {
+		return "", errNoTranslation
+	}
+
+	return selection, nil
+}
+
+// selectionString formats the principal according to the "n:fmt" part of a
+// rule, returning false if the number of components doesn't match.
+func selectionString(format string, name *Name) (string, bool, error) {
+	count, format, ok := strings.Cut(format, ":")
+	if !ok {
+		return "", false, fmt.Errorf("%w: %q", errBadRule, format)
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil {
+		return "", false, fmt.Errorf("%w: %w", errBadRule, err)
+	}
+
+	if n != len(name.principal.NameString) {
+		return "", false, errNoTranslation
+	}
+
+	var b strings.Builder
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '$' {
+			b.WriteByte(format[i])
+
+			continue
+		}
+
+		j := i + 1
+		for j < len(format) && format[j] >= '0' && format[j] <= '9' {
+			j++
+		}
+
+		if j == i+1 {
+			return "", false, fmt.Errorf("%w: %q", errBadRule, format)
+		}
+
+		c, _ := strconv.Atoi(format[i+1 : j])
+
+		switch {
+		case c == 0:
+			b.WriteString(name.realm)
+		case c <= n:
+			b.WriteString(name.principal.NameString[c-1])
+		default:
+			return "", false, fmt.Errorf("%w: component %d out of range", errBadRule, c)
+		}
+
+		i = j - 1
+	}
+
+	return b.String(), true, nil
+}
+
+// applySubstitution applies the leading "s/pattern/replacement/[g]" from rule
+// to s, returning the remainder of the rule and the result.
+func applySubstitution(rule, s string) (string, string, error) {
+	if !strings.HasPrefix(rule, "s/") {
+		return "", "", fmt.Errorf("%w: %q", errBadRule, rule)
+	}
+
+	parts := strings.SplitN(rule[2:], "/", 3)
+	if len(parts) != 3 {
+		return "", "", fmt.Errorf("%w: %q", errBadRule, rule)
+	}
+
+	re, err := regexp.Compile(parts[0])
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %w", errBadRule, err)
+	}
+
+	rest := parts[2]
+	global := strings.HasPrefix(rest, "g")
+
+	if global {
+		rest = rest[1:]
+
+		return rest, re.ReplaceAllLiteralString(s, parts[1]), nil
+	}
+
+	if loc := re.FindStringIndex(s); loc != nil {
+		s = s[:loc[0]] + parts[1] + s[loc[1]:]
+	}
+
+	return rest, s, nil
+}
+
+// kuserok implements the krb5_kuserok semantics: if the user has a .k5login
+// file then the principal must be listed in it, otherwise the principal must
+// map to the user via localName. Entries without a realm are in the default
+// realm. As with MIT Kerberos, a .k5login file not owned by the user or root
+// is not trusted and no principal is allowed.
+//
+//nolint:cyclop
+func kuserok(fsys afero.Fs, p *profile, defaultRealm string, name *Name, username string) (bool, error) {
+	path, err := k5loginPath(p, username)
+	if err != nil {
+		return false, err
+	}
+
+	authoritative := true
+	if v, ok := p.value("libdefaults", k5loginAuthority); ok {
+		authoritative = parseBoolean(v, true)
+	}
+
+	f, err := fsys.Open(path)
+
+	switch {
+	case err == nil:
+		defer f.Close()
+
+		if err = checkK5LoginOwner(f, username); errors.Is(err, errK5LoginOwner) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+
+			allowed, err := ParseName(line, NTKRB5PrincipalName)
+			if err != nil {
+				continue
+			}
+
+			if allowed.realm == "" {
+				allowed.realm = defaultRealm
+			}
+
+			if allowed.CompareName(name) {
+				return true, nil
+			}
+		}
+
+		if err = scanner.Err(); err != nil {
+			return false, err
+		}
+
+		if authoritative {
+			return false, nil
+		}
+	case !os.IsNotExist(err):
+		return false, err
+	}
+
+	local, err := localName(p, defaultRealm, name)
+	if errors.Is(err, errNoTranslation) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return local == username, nil
+}
+
+// checkK5LoginOwner returns errK5LoginOwner if the .k5login file is owned by
+// neither the user nor root. Ownership is only checked where the file system
+// reports it.
+func checkK5LoginOwner(f afero.File, username string) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	owner, ok := fileOwner(fi)
+	if !ok || owner == 0 {
+		return nil
+	}
+
+	u, err := lookupUser(username)
+	if err != nil {
+		return err
+	}
+
+	if u.Uid != strconv.FormatUint(uint64(owner), 10) {
+		return errK5LoginOwner
+	}
+
+	return nil
+}
+
+func k5loginPath(p *profile, username string) (string, error) {
+	if dir, ok := p.value("libdefaults", k5loginDirectory); ok {
+		return filepath.Join(dir, username), nil
+	}
+
+	u, err := lookupUser(username)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(u.HomeDir, k5loginFile), nil
+}
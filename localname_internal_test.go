@@ -0,0 +1,265 @@
+package gssapi
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+const localNameConfig = `[libdefaults]
+  default_realm = EXAMPLE.COM
+
+[realms]
+  EXAMPLE.COM = {
+    auth_to_local_names = {
+      root/admin = admin
+    }
+    auth_to_local = RULE:[2:$1;$2](^.*;admin$)s/;admin$//
+    auth_to_local = RULE:[1:$1@$0](^.*@OTHER\.COM$)s/@.*//
+    auth_to_local = RULE:[1:$1@$0](^.*@CAPS\.COM$)s/@.*//s/A/a/g
+    auth_to_local = RULE:[1:$1](adm)s/.*/root/
+    auth_to_local = DEFAULT
+  }
+  OTHER.COM = {
+    auth_to_local_names = {
+      bob = robert
+    }
+  }
+`
+
+//nolint:funlen
+func TestLocalName(t *testing.T) {
+	t.Parallel()
+
+	p, err := parseProfile(fs, strings.NewReader(localNameConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tables := []struct {
+		name   string
+		input  string
+		result string
+		err    error
+	}{
+		{"names", "root/admin@EXAMPLE.COM", "admin", nil},
+		{"names other realm", "bob@OTHER.COM", "robert", nil},
+		{"rule", "alice/admin@EXAMPLE.COM", "alice", nil},
+		{"rule realm", "carol@OTHER.COM", "carol", nil},
+		{"rule global", "AAA@CAPS.COM", "aaa", nil},
+		{"rule unanchored", "adm@EXAMPLE.COM", "root", nil},
+		{"rule partial match", "sysadmin@EXAMPLE.COM", "sysadmin", nil},
+		{"default", "dave@EXAMPLE.COM", "dave", nil},
+		{"default instance", "dave/host@EXAMPLE.COM", "", errNoTranslation},
+		{"foreign", "eve@FOREIGN.COM", "", errNoTranslation},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			n, err := ParseName(table.input, NTKRB5PrincipalName)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := localName(p, "EXAMPLE.COM", n)
+
+			assert.Equal(t, table.result, result)
+			assert.ErrorIs(t, err, table.err)
+		})
+	}
+}
+
+func TestLocalNameNoRules(t *testing.T) {
+	t.Parallel()
+
+	n, err := ParseName("alice@EXAMPLE.COM", NTKRB5PrincipalName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := localName(new(profile), "EXAMPLE.COM", n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "alice", result)
+
+	_, err = applyAuthToLocal("RULE:[1:$1", "EXAMPLE.COM", n)
+	assert.ErrorIs(t, err, errBadRule)
+
+	_, err = applyAuthToLocal("BOGUS", "EXAMPLE.COM", n)
+	assert.ErrorIs(t, err, errBadRule)
+}
+
+//nolint:funlen,paralleltest
+func TestKUserOK(t *testing.T) {
+	oldFs, oldLookupUser := fs, lookupUser
+	defer func() { fs, lookupUser = oldFs, oldLookupUser }()
+
+	fs = afero.NewMemMapFs()
+	lookupUser = func(username string) (*user.User, error) {
+		if username == "nobody" {
+			return nil, errors.New("unknown user")
+		}
+
+		return &user.User{Username: username, HomeDir: "/home/" + username}, nil
+	}
+
+	if err := afero.WriteFile(fs, "/home/alice/.k5login",
+		[]byte("bob@EXAMPLE.COM\n\ncarol/admin@OTHER.COM\nfrank\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := parseProfile(fs, strings.NewReader(localNameConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tables := []struct {
+		name      string
+		principal string
+		username  string
+		result    bool
+		err       bool
+	}{
+		{"listed", "bob@EXAMPLE.COM", "alice", true, false},
+		{"listed instance", "carol/admin@OTHER.COM", "alice", true, false},
+		{"listed default realm", "frank@EXAMPLE.COM", "alice", true, false},
+		{"listed other realm", "frank@OTHER.COM", "alice", false, false},
+		{"not listed", "alice@EXAMPLE.COM", "alice", false, false},
+		{"no k5login", "dave@EXAMPLE.COM", "dave", true, false},
+		{"no k5login mismatch", "dave@EXAMPLE.COM", "erin", false, false},
+		{"no translation", "dave@FOREIGN.COM", "dave", false, false},
+		{"unknown user", "dave@EXAMPLE.COM", "nobody", false, true},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			n, err := ParseName(table.principal, NTKRB5PrincipalName)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := kuserok(fs, p, "EXAMPLE.COM", n, table.username)
+
+			assert.Equal(t, table.result, result)
+
+			if table.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+//nolint:paralleltest
+func TestKUserOKNotAuthoritative(t *testing.T) {
+	oldFs := fs
+	defer func() { fs = oldFs }()
+
+	fs = afero.NewMemMapFs()
+
+	if err := afero.WriteFile(fs, "/k5login/alice", []byte("bob@EXAMPLE.COM\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := ParseName("alice@EXAMPLE.COM", NTKRB5PrincipalName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tables := []struct {
+		value  string
+		result bool
+	}{
+		{"false", true},
+		{"off", true},
+		{"no", true},
+		{"yes", false},
+		{"on", false},
+		{"bogus", false},
+	}
+
+	for _, table := range tables {
+		t.Run(table.value, func(t *testing.T) {
+			p, err := parseProfile(fs, strings.NewReader(`[libdefaults]
+  k5login_directory = /k5login
+  k5login_authoritative = `+table.value+`
+`))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ok, err := kuserok(fs, p, "EXAMPLE.COM", n, "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, table.result, ok)
+		})
+	}
+}
+
+//nolint:paralleltest
+func TestKUserOKOwner(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "alice")
+
+	if err := os.WriteFile(path, []byte("bob@EXAMPLE.COM\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owner, ok := fileOwner(fi)
+	if !ok {
+		t.Skip("file ownership is not supported")
+	}
+
+	// Files owned by root are always trusted
+	if owner == 0 {
+		owner = 4242
+		if err = os.Chown(path, int(owner), -1); err != nil {
+			t.Skip(err)
+		}
+	}
+
+	oldLookupUser := lookupUser
+	defer func() { lookupUser = oldLookupUser }()
+
+	p, err := parseProfile(fs, strings.NewReader("[libdefaults]\n  k5login_directory = "+dir+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := ParseName("bob@EXAMPLE.COM", NTKRB5PrincipalName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, uid := range []uint32{owner, owner + 1} {
+		lookupUser = func(username string) (*user.User, error) {
+			return &user.User{Username: username, Uid: strconv.FormatUint(uint64(uid), 10)}, nil
+		}
+
+		ok, err := kuserok(afero.NewOsFs(), p, "EXAMPLE.COM", n, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, uid == owner, ok)
+	}
+}
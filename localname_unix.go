@@ -0,0 +1,17 @@
+//go:build unix
+
+package gssapi
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the user ID owning the file, if known.
+func fileOwner(fi os.FileInfo) (uint32, bool) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Uid, true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,419 @@
+package gssapi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+//nolint:gochecknoglobals
+var (
+	// NTHostBasedService is the GSS_C_NT_HOSTBASED_SERVICE name type, for
+	// names of the form "service@host".
+	NTHostBasedService = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 1, 4}
+	// NTUserName is the GSS_C_NT_USER_NAME name type, for names of the
+	// form "user".
+	NTUserName = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 1, 1}
+	// NTKRB5PrincipalName is the GSS_KRB5_NT_PRINCIPAL_NAME name type, for
+	// names of the form "primary/instance@REALM".
+	NTKRB5PrincipalName = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2, 1}
+	// NTEnterpriseName is the GSS_KRB5_NT_ENTERPRISE_NAME name type, for
+	// names of the form "user@domain" that the KDC maps to a principal.
+	NTEnterpriseName = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2, 6}
+	// NTExportName is the GSS_C_NT_EXPORT_NAME name type, for names
+	// previously produced by ExportName.
+	NTExportName = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 6, 4}
+	// NTAnonymous is the GSS_C_NT_ANONYMOUS name type, used for the peer
+	// name of an anonymous context.
+	NTAnonymous = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 6, 3}
+)
+
+const (
+	exportNameTokID    = 0x0401
+	exportNameMinimum  = 2 + 2 + 4
+	escapeCharacter    = '\\'
+	componentSeparator = '/'
+	realmSeparator     = '@'
+)
+
+var (
+	errBadNameType   = errors.New("unsupported name type")
+	errBadName       = errors.New("malformed name")
+	errNotMechName   = errors.New("name is not a canonical mechanism name")
+	errBadExportName = errors.New("malformed export name")
+)
+
+// Name represents a GSSAPI name, which for the Kerberos mechanism is a
+// principal name and realm.
+type Name struct {
+	nameType  asn1.ObjectIdentifier
+	principal types.PrincipalName
+	realm     string
+}
+
+// ParseName parses name according to nameType, which should be one of the
+// NT* name types. A nil nameType is treated as NTKRB5PrincipalName.
+func ParseName(name string, nameType asn1.ObjectIdentifier) (*Name, error) {
+	switch {
+	case nameType == nil, nameType.Equal(NTKRB5PrincipalName):
+		return parsePrincipalName(name, NTKRB5PrincipalName, nametype.KRB_NT_PRINCIPAL)
+	case nameType.Equal(NTHostBasedService):
+		return parseHostBasedService(name)
+	case nameType.Equal(NTUserName):
+		return parsePrincipalName(name, NTUserName, nametype.KRB_NT_PRINCIPAL)
+	case nameType.Equal(NTEnterpriseName):
+		return parseEnterpriseName(name)
+	case nameType.Equal(NTExportName):
+		return parseExportName([]byte(name))
+	case nameType.Equal(NTAnonymous):
+		return newAnonymousName(), nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", errBadNameType, nameType)
+}
+
+// ImportName parses a name previously produced by ExportName.
+func ImportName(b []byte) (*Name, error) {
+	return parseExportName(b)
+}
+
+// NewNameFromPrincipal returns a new Name from an existing Kerberos
+// principal name and realm.
+func NewNameFromPrincipal(principal types.PrincipalName, realm string) *Name {
+	return &Name{
+		nameType: NTKRB5PrincipalName,
+		principal: types.PrincipalName{
+			NameType:   principal.NameType,
+			NameString: append([]string(nil), principal.NameString...),
+		},
+		realm: realm,
+	}
+}
+
+// newAnonymousName returns the WELLKNOWN/ANONYMOUS@WELLKNOWN:ANONYMOUS name
+// from RFC 6112.
+func newAnonymousName() *Name {
+	n := NewNameFromPrincipal(anonymousPrincipal(), anonymousRealm)
+	n.nameType = NTAnonymous
+
+	return n
+}
+
+func parseHostBasedService(name string) (*Name, error) {
+	service, host, found := strings.Cut(name, string(realmSeparator))
+	if service == "" {
+		return nil, fmt.Errorf("%w: empty service", errBadName)
+	}
+
+	if !found || host == "" {
+		var err error
+		if host, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Name{
+		nameType:  NTHostBasedService,
+		principal: types.NewPrincipalName(nametype.KRB_NT_SRV_HST, service+"/"+strings.ToLower(host)),
+	}, nil
+}
+
+func parseEnterpriseName(name string) (*Name, error) {
+	components, realm, err := splitPrincipal(name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(components) != 1 || components[0] == "" {
+		return nil, fmt.Errorf("%w: %q", errBadName, name)
+	}
+
+	return &Name{
+		nameType: NTEnterpriseName,
+		principal: types.PrincipalName{
+			NameType:   nametype.KRB_NT_ENTERPRISE,
+			NameString: components,
+		},
+		realm: realm,
+	}, nil
+}
+
+func parsePrincipalName(name string, nameType asn1.ObjectIdentifier, ntype int32) (*Name, error) {
+	components, realm, err := splitPrincipal(name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range components {
+		if c == "" {
+			return nil, fmt.Errorf("%w: %q", errBadName, name)
+		}
+	}
+
+	if len(components) > 1 && ntype == nametype.KRB_NT_PRINCIPAL && components[0] == "krbtgt" {
+		ntype = nametype.KRB_NT_SRV_INST
+	}
+
+	return &Name{
+		nameType: nameType,
+		principal: types.PrincipalName{
+			NameType:   ntype,
+			NameString: components,
+		},
+		realm: realm,
+	}, nil
+}
+
+// splitPrincipal splits an escaped principal name into its components and
+// realm. If enterprise is true then the first '@', escaped or not, is treated
+// as part of the single component and only a second '@' introduces the realm,
+// so the escaped form produced by String round-trips.
+//
+//nolint:cyclop
+func splitPrincipal(name string, enterprise bool) ([]string, string, error) {
+	var (
+		components []string
+		current    strings.Builder
+		realm      strings.Builder
+		inRealm    bool
+		escaped    bool
+		seenAt     bool
+	)
+
+	for _, r := range name {
+		switch {
+		case escaped:
+			escaped = false
+
+			switch r {
+			case 'n':
+				r = '\n'
+			case 't':
+				r = '\t'
+			case 'b':
+				r = '\b'
+			case '0':
+				r = 0
+			case realmSeparator:
+				seenAt = seenAt || enterprise
+			}
+		case r == escapeCharacter:
+			escaped = true
+
+			continue
+		case r == componentSeparator && !inRealm && !enterprise:
+			components = append(components, current.String())
+			current.Reset()
+
+			continue
+		case r == realmSeparator && !inRealm:
+			if enterprise && !seenAt {
+				seenAt = true
+
+				break
+			}
+
+			inRealm = true
+
+			continue
+		case r == realmSeparator && inRealm:
+			return nil, "", fmt.Errorf("%w: %q", errBadName, name)
+		}
+
+		if inRealm {
+			realm.WriteRune(r)
+		} else {
+			current.WriteRune(r)
+		}
+	}
+
+	if escaped {
+		return nil, "", fmt.Errorf("%w: trailing escape in %q", errBadName, name)
+	}
+
+	components = append(components, current.String())
+
+	if inRealm && realm.Len() == 0 {
+		return nil, "", fmt.Errorf("%w: empty realm in %q", errBadName, name)
+	}
+
+	return components, realm.String(), nil
+}
+
+func escape(s string, special string) string {
+	var b strings.Builder
+
+	for _, r := range s {
+		switch {
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\b':
+			b.WriteString(`\b`)
+		case r == 0:
+			b.WriteString(`\0`)
+		case r == escapeCharacter || strings.ContainsRune(special, r):
+			b.WriteRune(escapeCharacter)
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+func parseExportName(b []byte) (*Name, error) {
+	if len(b) < exportNameMinimum || binary.BigEndian.Uint16(b) != exportNameTokID {
+		return nil, errBadExportName
+	}
+
+	oidLength := int(binary.BigEndian.Uint16(b[2:]))
+	if len(b) < 4+oidLength+4 {
+		return nil, errBadExportName
+	}
+
+	var oid asn1.ObjectIdentifier
+	if rest, err := asn1.Unmarshal(b[4:4+oidLength], &oid); err != nil || len(rest) != 0 {
+		return nil, errBadExportName
+	}
+
+	if !oid.Equal(gssapi.OIDKRB5.OID()) {
+		return nil, fmt.Errorf("%w: unsupported mechanism %s", errBadExportName, oid)
+	}
+
+	nameLength := int(binary.BigEndian.Uint32(b[4+oidLength:]))
+	if len(b) != 4+oidLength+4+nameLength {
+		return nil, errBadExportName
+	}
+
+	n, err := parsePrincipalName(string(b[4+oidLength+4:]), NTKRB5PrincipalName, nametype.KRB_NT_PRINCIPAL)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.realm == "" {
+		return nil, errNotMechName
+	}
+
+	return n, nil
+}
+
+// NameType returns the name type that the Name was parsed with.
+func (n *Name) NameType() asn1.ObjectIdentifier {
+	return n.nameType
+}
+
+// PrincipalName returns the Kerberos principal name.
+func (n *Name) PrincipalName() types.PrincipalName {
+	return n.principal
+}
+
+// Realm returns the Kerberos realm, which may be empty if the Name has not
+// been canonicalized.
+func (n *Name) Realm() string {
+	return n.realm
+}
+
+// IsMechName returns whether the Name is a canonical mechanism name, that is
+// whether it has a realm.
+func (n *Name) IsMechName() bool {
+	return n.realm != ""
+}
+
+// String returns the name in the escaped "primary/instance@REALM" form.
+func (n *Name) String() string {
+	components := make([]string, 0, len(n.principal.NameString))
+
+	special := string([]rune{componentSeparator, realmSeparator})
+	if n.principal.NameType == nametype.KRB_NT_ENTERPRISE {
+		special = string(realmSeparator)
+	}
+
+	for _, c := range n.principal.NameString {
+		components = append(components, escape(c, special))
+	}
+
+	s := strings.Join(components, string(componentSeparator))
+
+	if n.realm != "" {
+		s += string(realmSeparator) + escape(n.realm, string(realmSeparator))
+	}
+
+	return s
+}
+
+// CanonicalizeName returns a copy of the Name converted to a mechanism name.
+// If the Name has no realm then one is chosen; host-based services use the
+// [domain_realm] mapping for the host and fall back to the default realm,
+// all other names use the default realm.
+func (n *Name) CanonicalizeName(cfg *config.Config) (*Name, error) {
+	c := NewNameFromPrincipal(n.principal, n.realm)
+	c.nameType = n.nameType
+
+	if c.realm != "" {
+		return c, nil
+	}
+
+	if n.principal.NameType == nametype.KRB_NT_SRV_HST && len(n.principal.NameString) > 1 {
+		c.realm = cfg.ResolveRealm(n.principal.NameString[len(n.principal.NameString)-1])
+	}
+
+	if c.realm == "" {
+		c.realm = cfg.LibDefaults.DefaultRealm
+	}
+
+	if c.realm == "" {
+		return nil, fmt.Errorf("%w: no default realm", errNotMechName)
+	}
+
+	return c, nil
+}
+
+// CompareName returns whether the two names refer to the same principal. The
+// name type is not significant, as per RFC 4120 section 6.2.
+func (n *Name) CompareName(other *Name) bool {
+	if n == nil || other == nil {
+		return n == other
+	}
+
+	return n.realm == other.realm && n.principal.Equal(other.principal)
+}
+
+// ExportName returns the name in the RFC 2743 section 3.2 exported name
+// format, which is suitable for storing in an ACL and comparing bytewise.
+// The Name must have been canonicalized first.
+func (n *Name) ExportName() ([]byte, error) {
+	if !n.IsMechName() {
+		return nil, errNotMechName
+	}
+
+	oid, err := asn1.Marshal(gssapi.OIDKRB5.OID())
+	if err != nil {
+		return nil, err
+	}
+
+	name := (&Name{principal: types.PrincipalName{
+		NameType:   nametype.KRB_NT_PRINCIPAL,
+		NameString: n.principal.NameString,
+	}, realm: n.realm}).String()
+
+	b := new(bytes.Buffer)
+	_ = binary.Write(b, binary.BigEndian, uint16(exportNameTokID))
+	_ = binary.Write(b, binary.BigEndian, uint16(len(oid))) //nolint:gosec
+	b.Write(oid)
+	_ = binary.Write(b, binary.BigEndian, uint32(len(name))) //nolint:gosec
+	b.WriteString(name)
+
+	return b.Bytes(), nil
+}
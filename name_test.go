@@ -0,0 +1,280 @@
+//nolint:revive
+package gssapi_test
+
+import (
+	"testing"
+
+	. "github.com/bodgit/gssapi"
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/stretchr/testify/assert"
+)
+
+const nameConfig = `[libdefaults]
+  default_realm = EXAMPLE.COM
+
+[domain_realm]
+  .other.com = OTHER.COM
+  host.example.org = ORG.EXAMPLE
+`
+
+//nolint:funlen
+func TestParseName(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := config.NewFromString(nameConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tables := []struct {
+		name      string
+		input     string
+		nameType  asn1.ObjectIdentifier
+		ntype     int32
+		str       string
+		canonical string
+		err       bool
+	}{
+		{
+			"hostbased",
+			"HTTP@WWW.Other.com",
+			NTHostBasedService,
+			nametype.KRB_NT_SRV_HST,
+			"HTTP/www.other.com",
+			"HTTP/www.other.com@OTHER.COM",
+			false,
+		},
+		{
+			"hostbased exact",
+			"host@host.example.org",
+			NTHostBasedService,
+			nametype.KRB_NT_SRV_HST,
+			"host/host.example.org",
+			"host/host.example.org@ORG.EXAMPLE",
+			false,
+		},
+		{
+			"hostbased default",
+			"host@unknown.example.net",
+			NTHostBasedService,
+			nametype.KRB_NT_SRV_HST,
+			"host/unknown.example.net",
+			"host/unknown.example.net@EXAMPLE.COM",
+			false,
+		},
+		{
+			"user",
+			"alice",
+			NTUserName,
+			nametype.KRB_NT_PRINCIPAL,
+			"alice",
+			"alice@EXAMPLE.COM",
+			false,
+		},
+		{
+			"principal",
+			"alice/admin@OTHER.COM",
+			NTKRB5PrincipalName,
+			nametype.KRB_NT_PRINCIPAL,
+			"alice/admin@OTHER.COM",
+			"alice/admin@OTHER.COM",
+			false,
+		},
+		{
+			"escaped",
+			`a\/b\@c/d@EXAMPLE.COM`,
+			nil,
+			nametype.KRB_NT_PRINCIPAL,
+			`a\/b\@c/d@EXAMPLE.COM`,
+			`a\/b\@c/d@EXAMPLE.COM`,
+			false,
+		},
+		{
+			"enterprise",
+			"alice@example.org",
+			NTEnterpriseName,
+			nametype.KRB_NT_ENTERPRISE,
+			`alice\@example.org`,
+			`alice\@example.org@EXAMPLE.COM`,
+			false,
+		},
+		{
+			"enterprise realm",
+			"alice@example.org@OTHER.COM",
+			NTEnterpriseName,
+			nametype.KRB_NT_ENTERPRISE,
+			`alice\@example.org@OTHER.COM`,
+			`alice\@example.org@OTHER.COM`,
+			false,
+		},
+		{
+			"anonymous",
+			"",
+			NTAnonymous,
+			11,
+			"WELLKNOWN/ANONYMOUS@WELLKNOWN:ANONYMOUS",
+			"WELLKNOWN/ANONYMOUS@WELLKNOWN:ANONYMOUS",
+			false,
+		},
+		{
+			"empty component",
+			"alice//admin",
+			NTKRB5PrincipalName,
+			0,
+			"",
+			"",
+			true,
+		},
+		{
+			"trailing escape",
+			`alice\`,
+			NTKRB5PrincipalName,
+			0,
+			"",
+			"",
+			true,
+		},
+		{
+			"double realm",
+			"alice@A@B",
+			NTKRB5PrincipalName,
+			0,
+			"",
+			"",
+			true,
+		},
+		{
+			"bad type",
+			"alice",
+			asn1.ObjectIdentifier{1, 2, 3},
+			0,
+			"",
+			"",
+			true,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			n, err := ParseName(table.input, table.nameType)
+			if table.err {
+				assert.Error(t, err)
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, table.ntype, n.PrincipalName().NameType)
+			assert.Equal(t, table.str, n.String())
+
+			c, err := n.CanonicalizeName(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.True(t, c.IsMechName())
+			assert.Equal(t, table.canonical, c.String())
+			assert.True(t, c.CompareName(c))
+
+			b, err := c.ExportName()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			e, err := ImportName(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.True(t, c.CompareName(e))
+		})
+	}
+}
+
+func TestEnterpriseNameRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	for _, input := range []string{"alice@example.org", "alice@example.org@OTHER.COM", `alice\@example.org@OTHER.COM`} {
+		n, err := ParseName(input, NTEnterpriseName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := ParseName(n.String(), NTEnterpriseName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, n.PrincipalName(), r.PrincipalName())
+		assert.Equal(t, n.Realm(), r.Realm())
+		assert.Equal(t, n.String(), r.String())
+	}
+
+	n, err := ParseName(`alice\@example.org@OTHER.COM`, NTEnterpriseName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"alice@example.org"}, n.PrincipalName().NameString)
+	assert.Equal(t, "OTHER.COM", n.Realm())
+}
+
+func TestCompareName(t *testing.T) {
+	t.Parallel()
+
+	a, err := ParseName("host@server.example.com", NTHostBasedService)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ParseName("host/server.example.com@EXAMPLE.COM", NTKRB5PrincipalName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.False(t, a.CompareName(b))
+
+	_, err = a.ExportName()
+	assert.Error(t, err)
+
+	cfg, err := config.NewFromString(nameConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := a.CanonicalizeName(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, c.CompareName(b))
+}
+
+func TestExportName(t *testing.T) {
+	t.Parallel()
+
+	n, err := ParseName("alice@EXAMPLE.COM", NTKRB5PrincipalName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := n.ExportName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []byte{
+		0x04, 0x01, 0x00, 0x0b, 0x06, 0x09, 0x2a, 0x86, 0x48, 0x86, 0xf7, 0x12, 0x01, 0x02, 0x02,
+		0x00, 0x00, 0x00, 0x11, 'a', 'l', 'i', 'c', 'e', '@', 'E', 'X', 'A', 'M', 'P', 'L', 'E', '.', 'C', 'O', 'M',
+	}, b)
+
+	_, err = ParseName(string(b[:len(b)-1]), NTExportName)
+	assert.Error(t, err)
+}
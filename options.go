@@ -1,21 +1,113 @@
 package gssapi
 
 import (
+	"crypto"
+	"crypto/x509"
 	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/jcmturner/gokrb5/v8/keytab"
 	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/spf13/afero"
 )
 
 // Option is the signature for all constructor options.
-type Option[T Initiator | Acceptor] func(*T) error
+type Option[T Initiator | Acceptor | Conn] func(*T) error
 
-// WithConfig permits passing krb5.conf contents directly to an Initiator.
+func sourcesOf(a any) *sources {
+	switch x := a.(type) {
+	case *Initiator:
+		return x.sources
+	case *Acceptor:
+		return x.sources
+	}
+
+	return nil
+}
+
+// WithConfig permits passing krb5.conf contents directly to an Initiator,
+// replacing the system configuration.
 func WithConfig[T Initiator](config string) Option[T] {
+	return withConfig[T](config, false)
+}
+
+// WithConfigOverlay permits passing krb5.conf contents to an Initiator that
+// are layered on top of the system configuration, so any relations take
+// precedence over those in the system files.
+func WithConfigOverlay[T Initiator](config string) Option[T] {
+	return withConfig[T](config, true)
+}
+
+// WithConfigPath sets the colon-separated list of krb5.conf files read by an
+// Initiator, instead of consulting the KRB5_CONFIG environment variable.
+func WithConfigPath[T Initiator](path string) Option[T] {
+	return withConfigPath[T](path)
+}
+
+// WithAcceptorConfig is the same as WithConfig but for an Acceptor.
+func WithAcceptorConfig[T Acceptor](config string) Option[T] {
+	return withConfig[T](config, false)
+}
+
+// WithAcceptorConfigOverlay is the same as WithConfigOverlay but for an
+// Acceptor.
+func WithAcceptorConfigOverlay[T Acceptor](config string) Option[T] {
+	return withConfig[T](config, true)
+}
+
+// WithAcceptorConfigPath is the same as WithConfigPath but for an Acceptor.
+func WithAcceptorConfigPath[T Acceptor](path string) Option[T] {
+	return withConfigPath[T](path)
+}
+
+func withConfig[T Initiator | Acceptor](config string, overlay bool) Option[T] {
 	return func(a *T) error {
-		if x, ok := any(a).(*Initiator); ok {
-			x.config = config
-		}
+		s := sourcesOf(a)
+		s.config, s.configOverlay = config, overlay
+
+		return nil
+	}
+}
+
+func withConfigPath[T Initiator | Acceptor](path string) Option[T] {
+	return func(a *T) error {
+		sourcesOf(a).configPath = &path
+
+		return nil
+	}
+}
+
+// WithCCache sets the name of the credential cache used by the Initiator
+// when no password or keytab is configured, instead of consulting the
+// KRB5CCNAME environment variable. It is also the default for
+// WithStoreCredentials.
+func WithCCache[T Initiator](name string) Option[T] {
+	return func(a *T) error {
+		sourcesOf(a).ccacheName = name
+
+		return nil
+	}
+}
+
+// WithFs sets the filesystem that either an Initiator or Acceptor reads its
+// configuration, credential caches, keytabs and .k5login files from, and
+// writes credential caches to. The default is the operating system
+// filesystem.
+func WithFs[T Initiator | Acceptor](fsys afero.Fs) Option[T] {
+	return func(a *T) error {
+		sourcesOf(a).fs = fsys
+
+		return nil
+	}
+}
+
+// WithLookupEnv sets the function that either an Initiator or Acceptor uses
+// to read the KRB5_CONFIG, KRB5CCNAME, KRB5_KTNAME and KRB5_CLIENT_KTNAME
+// environment variables. The default is os.LookupEnv; a function that always
+// returns false isolates the instance from the environment.
+func WithLookupEnv[T Initiator | Acceptor](lookupEnv func(string) (string, bool)) Option[T] {
+	return func(a *T) error {
+		sourcesOf(a).lookupEnv = lookupEnv
 
 		return nil
 	}
@@ -69,22 +161,73 @@ func WithPassword[T Initiator](password string) Option[T] {
 	return func(a *T) error {
 		if x, ok := any(a).(*Initiator); ok {
 			x.password = password
-			x.keytab = nil
+			x.keytab, x.kt = nil, nil
 		}
 
 		return nil
 	}
 }
 
-// WithKeytab sets the keytab path in either an Initiator or Acceptor.
+// WithKeytab sets the keytab name in either an Initiator or Acceptor. The
+// name may be a path, or prefixed with a type such as "FILE:", "WRFILE:",
+// "DIR:" or "MEMORY:" for a keytab registered with RegisterKeytab. An empty
+// name uses the default client keytab for an Initiator, or the default
+// keytab for an Acceptor.
 func WithKeytab[T Initiator | Acceptor](keytab string) Option[T] {
 	return func(a *T) error {
 		switch x := any(a).(type) {
 		case *Initiator:
-			x.keytab = &keytab
+			x.keytab, x.kt = &keytab, nil
 			x.password = ""
 		case *Acceptor:
-			x.keytab = keytab
+			x.keytab, x.kt = keytab, nil
+		}
+
+		return nil
+	}
+}
+
+// WithKeytabValue sets an already loaded keytab in either an Initiator or
+// Acceptor.
+func WithKeytabValue[T Initiator | Acceptor](kt *keytab.Keytab) Option[T] {
+	return func(a *T) error {
+		switch x := any(a).(type) {
+		case *Initiator:
+			x.keytab, x.kt = nil, kt
+			x.password = ""
+		case *Acceptor:
+			x.keytab, x.kt = "", kt
+		}
+
+		return nil
+	}
+}
+
+// WithKeytabBytes sets the keytab in either an Initiator or Acceptor from
+// its encoded form, for example as fetched from a secret manager.
+func WithKeytabBytes[T Initiator | Acceptor](b []byte) Option[T] {
+	return func(a *T) error {
+		kt, err := parseKeytab(b)
+		if err != nil {
+			return err
+		}
+
+		return WithKeytabValue[T](kt)(a)
+	}
+}
+
+// WithEncTypes sets the encryption types permitted for tickets, session keys
+// and subkeys in either an Initiator or Acceptor, as per etypeID. This
+// replaces the permitted_enctypes and default_tgs_enctypes relations in
+// krb5.conf and the list is used as is, regardless of allow_weak_crypto.
+// A peer using any other encryption type results in an *EncTypeError.
+func WithEncTypes[T Initiator | Acceptor](etypes ...int32) Option[T] {
+	return func(a *T) error {
+		switch x := any(a).(type) {
+		case *Initiator:
+			x.encTypes = etypes
+		case *Acceptor:
+			x.encTypes = etypes
 		}
 
 		return nil
@@ -113,3 +256,222 @@ func WithClockSkew[T Acceptor](clockSkew time.Duration) Option[T] {
 		return nil
 	}
 }
+
+// WithRefreshInterval starts a background goroutine in the Initiator that
+// checks the TGT at the given interval, renewing it or obtaining a new one as
+// it nears expiry and re-reading the credential cache if another process has
+// updated it. Regardless of this option the TGT is always checked before
+// requesting a service ticket.
+func WithRefreshInterval[T Initiator](interval time.Duration) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Initiator); ok {
+			x.refreshInterval = interval
+		}
+
+		return nil
+	}
+}
+
+// WithRefreshCallback sets a function in the Initiator that is called each
+// time the TGT is refreshed, or fails to be refreshed. The callback is called
+// without any locks held so it may use the Initiator, however with
+// WithRefreshInterval it can be called from the background goroutine which
+// Close waits for, so it must not call Close.
+func WithRefreshCallback[T Initiator](callback func(RefreshEvent)) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Initiator); ok {
+			x.refreshCallback = callback
+		}
+
+		return nil
+	}
+}
+
+// WithStoreCredentials configures the Initiator to store its TGT and any
+// service tickets it obtains in the named credential cache, so they are
+// visible to other Kerberos tools and can be reused after a restart. The
+// name may be of any supported type such as "FILE:/tmp/krb5cc_1000",
+// "DIR:/run/user/1000/krb5cc", "KEYRING:persistent:1000", "KCM:" or
+// "MEMORY:name"; a name without a type is a FILE cache. If name is empty then
+// the default credential cache is used. When used with a password or keytab,
+// a valid TGT for the same client in the credential cache is reused rather
+// than contacting the KDC.
+func WithStoreCredentials[T Initiator](name string) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Initiator); ok {
+			x.storeCCache = &name
+		}
+
+		return nil
+	}
+}
+
+// WithFAST enables FAST armoring (RFC 6113) of the AS and TGS exchanges made
+// by the Initiator, which some domains require, particularly when logging in
+// with a password. The AS exchange is armored with a TGT for principal
+// obtained using the named keytab, typically the host principal and system
+// keytab; if keytab is empty then the default keytab is used. Errors
+// returned by the KDC inside the armor are returned as messages.KRBError.
+func WithFAST[T Initiator](principal, keytab string) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Initiator); ok {
+			x.armorPrincipal, x.armorKeytab = principal, keytab
+		}
+
+		return nil
+	}
+}
+
+// WithAnonymousFAST enables FAST armoring as per WithFAST, but armors the AS
+// exchange with a TGT obtained using anonymous PKINIT (RFC 8062) rather than
+// a keytab. The KDC certificate must be trusted, see WithPKINITAnchors.
+func WithAnonymousFAST[T Initiator]() Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Initiator); ok {
+			x.armorPrincipal, x.armorAnonymous = anonymousName, true
+		}
+
+		return nil
+	}
+}
+
+// WithAnonymous makes the Initiator obtain an anonymous TGT using anonymous
+// PKINIT (RFC 8062) instead of using a password, keytab or certificate, so
+// that every context it creates is anonymous as per RFC 6112. The KDC
+// certificate must be trusted, see WithPKINITAnchors. The realm is taken
+// from WithDomain or else the default realm.
+func WithAnonymous[T Initiator]() Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Initiator); ok {
+			x.anonymous = true
+		}
+
+		return nil
+	}
+}
+
+// WithRefuseAnonymous makes the Acceptor reject any Initiator that
+// authenticates with an anonymous ticket.
+func WithRefuseAnonymous[T Acceptor]() Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Acceptor); ok {
+			x.refuseAnonymous = true
+		}
+
+		return nil
+	}
+}
+
+// WithCertificate sets the certificate and corresponding signer used by the
+// Initiator to obtain a TGT with PKINIT (RFC 4556), which is used instead of
+// a password or keytab. The signer can be any crypto.Signer such as one
+// backed by a smartcard or HSM, with either an RSA or ECDSA key. Any
+// intermediate certificates needed by the KDC can be passed in chain. The
+// domain and username must also be set.
+func WithCertificate[T Initiator](cert *x509.Certificate, signer crypto.Signer,
+	chain ...*x509.Certificate,
+) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Initiator); ok {
+			x.certificate, x.signer, x.certificateChain = cert, signer, chain
+		}
+
+		return nil
+	}
+}
+
+// WithKeyAgreement sets the key agreement used by PKINIT in the Initiator.
+// The default is DiffieHellman.
+func WithKeyAgreement[T Initiator](keyAgreement KeyAgreement) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Initiator); ok {
+			x.keyAgreement = keyAgreement
+		}
+
+		return nil
+	}
+}
+
+// WithPKINITAnchors sets the root certificates trusted to issue the KDC
+// certificate used with PKINIT in the Initiator. This replaces the
+// pkinit_anchors relation in krb5.conf, if neither is set then PKINIT fails.
+// The KDC certificate must also have the id-pkinit-KPKdc extended key usage
+// and an id-pkinit-san subject alternative name for krbtgt/REALM@REALM.
+func WithPKINITAnchors[T Initiator](roots *x509.CertPool) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Initiator); ok {
+			x.pkinitRoots = roots
+		}
+
+		return nil
+	}
+}
+
+// WithMaxRounds limits the number of tokens that EstablishInitiator or
+// EstablishAcceptor read from the peer. The default is 8.
+func WithMaxRounds[T Initiator | Acceptor](rounds int) Option[T] {
+	return func(a *T) error {
+		contextOf(a).establishRounds = rounds
+
+		return nil
+	}
+}
+
+// WithMaxTokenSize limits the size of the tokens that EstablishInitiator or
+// EstablishAcceptor read from the peer. The default is 64 KiB.
+func WithMaxTokenSize[T Initiator | Acceptor](size int) Option[T] {
+	return func(a *T) error {
+		contextOf(a).establishTokenSize = size
+
+		return nil
+	}
+}
+
+// WithFraming sets how tokens are framed on the underlying net.Conn of a
+// Conn. The default is LengthPrefixFraming.
+func WithFraming[T Conn](framing Framing) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Conn); ok {
+			x.framing = framing
+		}
+
+		return nil
+	}
+}
+
+// WithProtection sets the protection applied to data sent over a Conn. The
+// default is ProtectionConfidentiality.
+func WithProtection[T Conn](protection Protection) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Conn); ok {
+			x.protection = protection
+		}
+
+		return nil
+	}
+}
+
+// WithMaxSendSize sets the largest token that a Conn sends, usually the
+// maximum buffer size advertised by the peer. Data is split across as many
+// tokens as required.
+func WithMaxSendSize[T Conn](size int) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Conn); ok {
+			x.maxSendSize = size
+		}
+
+		return nil
+	}
+}
+
+// WithMaxReceiveSize sets the largest token that a Conn accepts from the
+// peer, usually the maximum buffer size advertised to the peer.
+func WithMaxReceiveSize[T Conn](size int) Option[T] {
+	return func(a *T) error {
+		if x, ok := any(a).(*Conn); ok {
+			x.maxReceiveSize = size
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,199 @@
+package pggss
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/bodgit/gssapi"
+	"github.com/bodgit/gssapi/internal/deadline"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	krb5gssapi "github.com/jcmturner/gokrb5/v8/gssapi"
+)
+
+const (
+	gssEncRequestCode = 80877104
+
+	encryptFlags = krb5gssapi.ContextFlagMutual | krb5gssapi.ContextFlagConf | krb5gssapi.ContextFlagInteg |
+		krb5gssapi.ContextFlagReplay | krb5gssapi.ContextFlagSequence
+
+	// maxAuthTokenSize limits the size of the tokens read while
+	// establishing the context, PQ_GSS_AUTH_BUFFER_SIZE less the length.
+	maxAuthTokenSize = 65536 - 4
+	// maxPacketTokenSize limits the size of the wrap tokens sent and
+	// received, PQ_GSS_MAX_PACKET_SIZE less the length.
+	maxPacketTokenSize = 16384 - 4
+	// maxErrorLength limits the size of an ErrorResponse sent in the clear.
+	maxErrorLength = 30000
+
+	defaultService = "postgres"
+)
+
+var (
+	errEncryptionRefused = errors.New("server refused GSSAPI encryption")
+	errBadResponse       = errors.New("unexpected response to GSSENCRequest")
+	errErrorTooLong      = errors.New("error response is too long")
+	errUnixSocket        = errors.New("GSSAPI encryption is not supported over Unix sockets")
+)
+
+// readErrorResponse reads the remainder of an ErrorResponse message sent in
+// the clear after its type byte, returning it as a *pgconn.PgError.
+func readErrorResponse(r io.Reader) error {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return err
+	}
+
+	n := binary.BigEndian.Uint32(b[:])
+	if n < 4 || n > maxErrorLength {
+		return errErrorTooLong
+	}
+
+	body := make([]byte, n-4)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+
+	var msg pgproto3.ErrorResponse
+	if err := msg.Decode(body); err != nil {
+		return err
+	}
+
+	return pgconn.ErrorResponseToPgError(&msg)
+}
+
+// framing is gssapi.LengthPrefixFraming except the server may send an
+// ErrorResponse in the clear instead of a token while establishing the
+// context.
+type framing struct {
+	gssapi.LengthPrefixFraming
+}
+
+func (f framing) ReadToken(r io.Reader, maxLength int) ([]byte, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, err
+	}
+
+	if b[0] == 'E' {
+		return nil, readErrorResponse(io.MultiReader(bytes.NewReader(b[1:]), r))
+	}
+
+	return f.LengthPrefixFraming.ReadToken(io.MultiReader(bytes.NewReader(b[:]), r), maxLength)
+}
+
+func requestEncryption(ctx context.Context, c net.Conn) error {
+	return deadline.Run(ctx, c, func() error {
+		b := binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 8), gssEncRequestCode)
+		if _, err := c.Write(b); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(c, b[:1]); err != nil {
+			return err
+		}
+
+		switch b[0] {
+		case 'G':
+			return nil
+		case 'N':
+			return errEncryptionRefused
+		case 'E':
+			// Servers older than PostgreSQL 12 don't recognise the request
+			return readErrorResponse(c)
+		default:
+			return fmt.Errorf("%w: %q", errBadResponse, b[0])
+		}
+	})
+}
+
+// Encrypt sends a GSSENCRequest on c and establishes a context with the
+// service using an Initiator created with the given options. The returned
+// net.Conn encrypts all further traffic with wrap tokens, the PostgreSQL
+// startup message should be sent on it as normal. Closing it also closes the
+// Initiator. An error is returned if the server refuses encryption.
+func Encrypt(ctx context.Context, c net.Conn, service string,
+	options ...gssapi.Option[gssapi.Initiator],
+) (net.Conn, error) {
+	if err := requestEncryption(ctx, c); err != nil {
+		return nil, err
+	}
+
+	options = append([]gssapi.Option[gssapi.Initiator]{
+		gssapi.WithMaxTokenSize[gssapi.Initiator](maxAuthTokenSize),
+	}, options...)
+
+	initiator, err := gssapi.EstablishInitiator(ctx, gssapi.NewTokenReadWriter(c, framing{}), service, encryptFlags,
+		options...)
+	if err != nil {
+		return nil, err
+	}
+
+	gc, err := gssapi.NewConn(initiator, c, gssapi.WithMaxSendSize[gssapi.Conn](maxPacketTokenSize),
+		gssapi.WithMaxReceiveSize[gssapi.Conn](maxPacketTokenSize))
+	if err != nil {
+		return nil, errors.Join(err, initiator.Close())
+	}
+
+	return &conn{Conn: gc, closer: initiator}, nil
+}
+
+// DialFunc returns a pgconn.DialFunc that connects using dial and then calls
+// Encrypt. If service is empty the host-based "postgres" service of the
+// server is used. As the connection is already encrypted, TLS should be
+// disabled, for example:
+//
+//	config, err := pgconn.ParseConfig("host=db.example.com user=alice sslmode=disable")
+//	if err != nil {
+//		return err
+//	}
+//
+//	config.DialFunc = pggss.DialFunc(config.DialFunc, "")
+//
+// The server authenticates the user with the established context, so a GSS
+// provider only needs to be registered for servers that don't require
+// encryption.
+func DialFunc(dial pgconn.DialFunc, service string, options ...gssapi.Option[gssapi.Initiator]) pgconn.DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network == "unix" {
+			return nil, errUnixSocket
+		}
+
+		target := service
+		if target == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+
+			target = defaultService + "@" + host
+		}
+
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		ec, err := Encrypt(ctx, c, target, options...)
+		if err != nil {
+			return nil, errors.Join(err, c.Close())
+		}
+
+		return ec, nil
+	}
+}
+
+// conn closes the Initiator along with the connection.
+type conn struct {
+	*gssapi.Conn
+	closer io.Closer
+}
+
+func (c *conn) Close() error {
+	return errors.Join(c.Conn.Close(), c.closer.Close())
+}
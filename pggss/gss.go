@@ -0,0 +1,86 @@
+// Package pggss provides Kerberos authentication and encryption for
+// PostgreSQL connections made with github.com/jackc/pgx using the
+// github.com/bodgit/gssapi package.
+package pggss
+
+import (
+	"errors"
+
+	"github.com/bodgit/gssapi"
+	"github.com/jackc/pgx/v5/pgconn"
+	krb5gssapi "github.com/jcmturner/gokrb5/v8/gssapi"
+)
+
+var errAlreadyStarted = errors.New("authentication already started")
+
+// GSS implements the frontend side of the PostgreSQL AuthenticationGSS and
+// AuthenticationGSSContinue exchange. It satisfies the pgconn.GSS interface.
+// Mutual authentication is always requested as the server otherwise doesn't
+// send the AuthenticationGSSContinue message that pgx expects.
+type GSS struct {
+	initiator *gssapi.Initiator
+	service   string
+}
+
+// NewGSS returns a GSS that authenticates using an Initiator created with
+// the given options.
+func NewGSS(options ...gssapi.Option[gssapi.Initiator]) (*GSS, error) {
+	initiator, err := gssapi.NewInitiator(options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GSS{
+		initiator: initiator,
+	}, nil
+}
+
+// NewGSSFunc returns a function suitable for pgconn.RegisterGSSProvider that
+// creates a new GSS with the given options for each connection, for example:
+//
+//	pgconn.RegisterGSSProvider(pggss.NewGSSFunc())
+func NewGSSFunc(options ...gssapi.Option[gssapi.Initiator]) pgconn.NewGSSFunc {
+	return func() (pgconn.GSS, error) {
+		return NewGSS(options...)
+	}
+}
+
+// GetInitToken returns the initial token for the host-based service on the
+// host, usually "postgres".
+func (g *GSS) GetInitToken(host, service string) ([]byte, error) {
+	return g.GetInitTokenFromSPN(service + "@" + host)
+}
+
+// GetInitTokenFromSPN returns the initial token for the service, which is
+// in any form accepted by gssapi.Initiator.Initiate.
+func (g *GSS) GetInitTokenFromSPN(spn string) ([]byte, error) {
+	if g.service != "" {
+		return nil, errAlreadyStarted
+	}
+
+	g.service = spn
+
+	output, _, err := g.initiator.Initiate(g.service, krb5gssapi.ContextFlagMutual, nil)
+	if err != nil {
+		return nil, errors.Join(err, g.initiator.Close())
+	}
+
+	return output, nil
+}
+
+// Continue processes the token from an AuthenticationGSSContinue message,
+// returning whether authentication is complete and any token to send to the
+// server. The Initiator is closed once authentication is complete, as the
+// context isn't used afterwards.
+func (g *GSS) Continue(inToken []byte) (bool, []byte, error) {
+	output, cont, err := g.initiator.Initiate(g.service, krb5gssapi.ContextFlagMutual, inToken)
+	if err != nil {
+		return false, nil, errors.Join(err, g.initiator.Close())
+	}
+
+	if !cont || g.initiator.Established() {
+		return true, output, g.initiator.Close()
+	}
+
+	return false, output, nil
+}
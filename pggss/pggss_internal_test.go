@@ -0,0 +1,150 @@
+package pggss
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bodgit/gssapi"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func errorResponse(t *testing.T) []byte {
+	t.Helper()
+
+	b, err := (&pgproto3.ErrorResponse{
+		Severity: "FATAL",
+		Code:     "08P01",
+		Message:  "unsupported frontend protocol",
+	}).Encode(nil)
+	require.NoError(t, err)
+
+	return b
+}
+
+func TestRequestEncryption(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		name     string
+		response []byte
+		err      error
+	}{
+		{"accepted", []byte{'G'}, nil},
+		{"refused", []byte{'N'}, errEncryptionRefused},
+		{"unexpected", []byte{'S'}, errBadResponse},
+		{"error", errorResponse(t), new(pgconn.PgError)},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			client, server := net.Pipe()
+			defer client.Close()
+
+			go func() {
+				defer server.Close()
+
+				var b [8]byte
+				if _, err := io.ReadFull(server, b[:]); !assert.NoError(t, err) {
+					return
+				}
+
+				assert.Equal(t, uint32(8), binary.BigEndian.Uint32(b[:4]))
+				assert.Equal(t, uint32(gssEncRequestCode), binary.BigEndian.Uint32(b[4:]))
+
+				_, _ = server.Write(table.response)
+			}()
+
+			err := requestEncryption(context.Background(), client)
+
+			switch target := table.err.(type) {
+			case nil:
+				assert.NoError(t, err)
+			case *pgconn.PgError:
+				if assert.ErrorAs(t, err, &target) {
+					assert.Equal(t, "08P01", target.Code)
+				}
+			default:
+				assert.ErrorIs(t, err, table.err)
+			}
+		})
+	}
+}
+
+func TestRequestEncryptionCancel(t *testing.T) {
+	t.Parallel()
+
+	client, server := net.Pipe()
+
+	defer client.Close()
+	defer server.Close()
+
+	// The server reads the request but never replies
+	go func() {
+		_, _ = io.Copy(io.Discard, server)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	assert.ErrorIs(t, requestEncryption(ctx, client), context.Canceled)
+}
+
+func TestFraming(t *testing.T) {
+	t.Parallel()
+
+	var (
+		f framing
+		b bytes.Buffer
+	)
+
+	require.NoError(t, f.WriteToken(&b, []byte("token")))
+	b.Write(errorResponse(t))
+
+	token, err := f.ReadToken(&b, 16)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("token"), token)
+
+	_, err = f.ReadToken(&b, 16)
+
+	var pgErr *pgconn.PgError
+	require.ErrorAs(t, err, &pgErr)
+	assert.Equal(t, "unsupported frontend protocol", pgErr.Message)
+
+	_, err = f.ReadToken(bytes.NewReader([]byte{'E', 0xff, 0xff, 0xff, 0xff}), 16)
+	assert.ErrorIs(t, err, errErrorTooLong)
+
+	require.NoError(t, gssapi.LengthPrefixFraming{}.WriteToken(&b, []byte("long token")))
+
+	_, err = f.ReadToken(&b, 4)
+	assert.Error(t, err)
+}
+
+func TestDialFunc(t *testing.T) {
+	t.Parallel()
+
+	dial := func(context.Context, string, string) (net.Conn, error) {
+		t.Fatal("unexpected dial")
+
+		return nil, nil //nolint:nilnil
+	}
+
+	_, err := DialFunc(dial, "")(context.Background(), "unix", "/tmp/.s.PGSQL.5432")
+	assert.ErrorIs(t, err, errUnixSocket)
+
+	_, err = DialFunc(dial, "")(context.Background(), "tcp", "db.example.com")
+	assert.Error(t, err)
+}
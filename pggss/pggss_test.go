@@ -0,0 +1,148 @@
+package pggss_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bodgit/gssapi"
+	"github.com/bodgit/gssapi/pggss"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func environmentVariables(t *testing.T) (string, string, string, string) {
+	t.Helper()
+
+	var values [4]string
+
+	for i, name := range []string{"TEST_HOST", "TEST_REALM", "TEST_USERNAME", "TEST_PASSWORD"} {
+		var ok bool
+		if values[i], ok = os.LookupEnv(name); !ok {
+			t.Fatalf("%s is not set", name)
+		}
+	}
+
+	return values[0], values[1], values[2], values[3]
+}
+
+// serve accepts a GSSENCRequest and echoes back a single message.
+func serve(t *testing.T, c net.Conn, options ...gssapi.Option[gssapi.Acceptor]) {
+	t.Helper()
+
+	defer c.Close()
+
+	request := make([]byte, 8)
+	if _, err := io.ReadFull(c, request); !assert.NoError(t, err) {
+		return
+	}
+
+	if _, err := c.Write([]byte{'G'}); !assert.NoError(t, err) {
+		return
+	}
+
+	acceptor, err := gssapi.EstablishAcceptor(context.Background(),
+		gssapi.NewTokenReadWriter(c, gssapi.LengthPrefixFraming{}), options...)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	defer acceptor.Close()
+
+	gc, err := gssapi.NewConn(acceptor, c)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	b := make([]byte, 64)
+
+	n, err := gc.Read(b)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = gc.Write(b[:n])
+	assert.NoError(t, err)
+}
+
+func TestPostgreSQL(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	host, realm, username, password := environmentVariables(t)
+
+	service := "host/" + host
+	principal := types.NewPrincipalName(nametype.KRB_NT_SRV_HST, service)
+
+	initiatorOptions := []gssapi.Option[gssapi.Initiator]{
+		gssapi.WithRealm(realm),
+		gssapi.WithUsername(username),
+		gssapi.WithPassword(password),
+	}
+
+	acceptorOptions := []gssapi.Option[gssapi.Acceptor]{
+		gssapi.WithServicePrincipal(&principal),
+		gssapi.WithClockSkew(5 * time.Second),
+	}
+
+	t.Run("auth", func(t *testing.T) {
+		t.Parallel()
+
+		gss, err := pggss.NewGSSFunc(initiatorOptions...)()
+		require.NoError(t, err)
+
+		acceptor, err := gssapi.NewAcceptor(acceptorOptions...)
+		require.NoError(t, err)
+
+		defer acceptor.Close()
+
+		token, err := gss.GetInitTokenFromSPN(service)
+		require.NoError(t, err)
+
+		output, _, err := acceptor.Accept(token)
+		require.NoError(t, err)
+		require.True(t, acceptor.Established())
+
+		done, token, err := gss.Continue(output)
+		require.NoError(t, err)
+		assert.True(t, done)
+		assert.Empty(t, token)
+	})
+
+	t.Run("encrypt", func(t *testing.T) {
+		t.Parallel()
+
+		client, server := net.Pipe()
+
+		go serve(t, server, acceptorOptions...)
+
+		dial := pggss.DialFunc(func(context.Context, string, string) (net.Conn, error) {
+			return client, nil
+		}, service, initiatorOptions...)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		c, err := dial(ctx, "tcp", net.JoinHostPort(host, "5432"))
+		require.NoError(t, err)
+
+		defer c.Close()
+
+		_, err = c.Write([]byte("message"))
+		require.NoError(t, err)
+
+		b := make([]byte, 64)
+
+		n, err := c.Read(b)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("message"), b[:n])
+	})
+}
@@ -0,0 +1,642 @@
+package gssapi
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/patype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/spf13/afero"
+)
+
+// KeyAgreement is the key agreement method used for PKINIT.
+type KeyAgreement int
+
+const (
+	// DiffieHellman uses the 2048-bit MODP group from RFC 3526, which is
+	// supported by both MIT Kerberos and Active Directory.
+	DiffieHellman KeyAgreement = iota
+	// ECDHP256 uses elliptic curve Diffie-Hellman with NIST P-256.
+	ECDHP256
+	// ECDHP384 uses elliptic curve Diffie-Hellman with NIST P-384.
+	ECDHP384
+	// ECDHP521 uses elliptic curve Diffie-Hellman with NIST P-521.
+	ECDHP521
+)
+
+const (
+	pkinitAnchorsTag = "pkinit_anchors"
+
+	// nameTypeWellKnown is KRB_NT_WELLKNOWN from RFC 6111.
+	nameTypeWellKnown = 11
+	anonymousName     = "WELLKNOWN/ANONYMOUS"
+	anonymousRealm    = "WELLKNOWN:ANONYMOUS"
+
+	// kdcOptRequestAnonymous is the request-anonymous KDC option from
+	// RFC 8062, gokrb5 has the value from an earlier draft.
+	kdcOptRequestAnonymous = 16
+	// ticketFlagAnonymous is the anonymous ticket flag from RFC 8062.
+	ticketFlagAnonymous = 16
+
+	// keyUsagePKINITKX is KEY_USAGE_PA_PKINIT_KX from RFC 8062.
+	keyUsagePKINITKX = 44
+	patypePKINITKX   = 147
+)
+
+//nolint:gochecknoglobals
+var (
+	oidPKINITAuthData  = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 2, 3, 1}
+	oidPKINITDHKeyData = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 2, 3, 2}
+	oidPKINITKPKdc     = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 2, 3, 5}
+	oidPKINITSAN       = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 2, 2}
+	oidSubjectAltName  = asn1.ObjectIdentifier{2, 5, 29, 17}
+	oidDHPublicNumber  = asn1.ObjectIdentifier{1, 2, 840, 10046, 2, 1}
+
+	// modp2048 is the prime from RFC 3526 section 3, the generator is 2.
+	modp2048, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+		"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+		"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+		"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3D"+
+		"C2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F"+
+		"83655D23DCA3AD961C62F356208552BB9ED529077096966D"+
+		"670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B"+
+		"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9"+
+		"DE2BCBF6955817183995497CEA956AE515D2261898FA0510"+
+		"15728E5A8AACAA68FFFFFFFFFFFFFFFF", 16)
+)
+
+var (
+	errPKINITReply       = errors.New("invalid PKINIT reply")
+	errPKINITUnsupported = errors.New("unsupported key agreement")
+	errNoPKINITAnchors   = errors.New("no PKINIT trust anchors configured")
+	errKDCCertificate    = errors.New("KDC certificate not valid for realm")
+)
+
+// These types are from RFC 4556 section 3.2.
+
+type paPKASReq struct {
+	SignedAuthPack []byte `asn1:"tag:0"`
+}
+
+type pkAuthenticator struct {
+	Cusec      int       `asn1:"explicit,tag:0"`
+	CTime      time.Time `asn1:"generalized,explicit,tag:1"`
+	Nonce      int       `asn1:"explicit,tag:2"`
+	PAChecksum []byte    `asn1:"optional,explicit,tag:3"`
+}
+
+type authPack struct {
+	PKAuthenticator   pkAuthenticator `asn1:"explicit,tag:0"`
+	ClientPublicValue asn1.RawValue   `asn1:"optional,explicit,tag:1"`
+}
+
+type subjectPublicKeyInfo struct {
+	Algorithm algorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+type domainParameters struct {
+	P *big.Int
+	G *big.Int
+	Q *big.Int
+}
+
+type dhRepInfo struct {
+	DHSignedData  []byte        `asn1:"tag:0"`
+	ServerDHNonce []byte        `asn1:"optional,explicit,tag:1"`
+	KDF           asn1.RawValue `asn1:"optional,explicit,tag:2"`
+}
+
+// krb5PrincipalName is the id-pkinit-san otherName from RFC 4556 section
+// 3.2.2.
+type krb5PrincipalName struct {
+	Realm         string              `asn1:"generalstring,explicit,tag:0"`
+	PrincipalName types.PrincipalName `asn1:"explicit,tag:1"`
+}
+
+type kdcDHKeyInfo struct {
+	SubjectPublicKey asn1.BitString `asn1:"explicit,tag:0"`
+	Nonce            int            `asn1:"explicit,tag:1"`
+	DHKeyExpiration  time.Time      `asn1:"generalized,optional,explicit,tag:2"`
+}
+
+// keyAgreement is one side of a Diffie-Hellman or ECDH exchange.
+type keyAgreement interface {
+	// publicKeyInfo returns the encoded SubjectPublicKeyInfo.
+	publicKeyInfo() ([]byte, error)
+	// publicKey returns the public key as encoded in KDCDHKeyInfo.
+	publicKey() []byte
+	// sharedSecret returns the shared secret given the peer public key
+	// encoded as in KDCDHKeyInfo.
+	sharedSecret(peer []byte) ([]byte, error)
+}
+
+type dhAgreement struct {
+	params domainParameters
+	x, y   *big.Int
+}
+
+func newDHAgreement(params domainParameters) (*dhAgreement, error) {
+	x, err := rand.Int(rand.Reader, params.Q)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dhAgreement{
+		params: params,
+		x:      x,
+		y:      new(big.Int).Exp(params.G, x, params.P),
+	}, nil
+}
+
+func (a *dhAgreement) publicKeyInfo() ([]byte, error) {
+	params, err := asn1.Marshal(a.params)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(subjectPublicKeyInfo{
+		Algorithm: algorithmIdentifier{Algorithm: oidDHPublicNumber, Parameters: asn1.RawValue{FullBytes: params}},
+		PublicKey: asn1.BitString{Bytes: a.publicKey(), BitLength: len(a.publicKey()) * 8},
+	})
+}
+
+func (a *dhAgreement) publicKey() []byte {
+	b, _ := asn1.Marshal(a.y)
+
+	return b
+}
+
+func (a *dhAgreement) sharedSecret(peer []byte) ([]byte, error) {
+	y := new(big.Int)
+	if _, err := asn1.Unmarshal(peer, &y); err != nil {
+		return nil, err
+	}
+
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(new(big.Int).Sub(a.params.P, big.NewInt(1))) >= 0 {
+		return nil, fmt.Errorf("%w: Diffie-Hellman public value out of range", errPKINITReply)
+	}
+
+	// The shared secret is padded to the length of the prime
+	return new(big.Int).Exp(y, a.x, a.params.P).FillBytes(make([]byte, (a.params.P.BitLen()+7)/8)), nil
+}
+
+type ecdhAgreement struct {
+	key *ecdh.PrivateKey
+}
+
+func (a *ecdhAgreement) publicKeyInfo() ([]byte, error) {
+	return x509.MarshalPKIXPublicKey(a.key.PublicKey())
+}
+
+func (a *ecdhAgreement) publicKey() []byte {
+	return a.key.PublicKey().Bytes()
+}
+
+func (a *ecdhAgreement) sharedSecret(peer []byte) ([]byte, error) {
+	pub, err := a.key.Curve().NewPublicKey(peer)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errPKINITReply, err)
+	}
+
+	return a.key.ECDH(pub)
+}
+
+func newKeyAgreement(ka KeyAgreement) (keyAgreement, error) {
+	var curve ecdh.Curve
+
+	switch ka {
+	case DiffieHellman:
+		return newDHAgreement(domainParameters{
+			P: modp2048,
+			G: big.NewInt(2),
+			Q: new(big.Int).Rsh(modp2048, 1),
+		})
+	case ECDHP256:
+		curve = ecdh.P256()
+	case ECDHP384:
+		curve = ecdh.P384()
+	case ECDHP521:
+		curve = ecdh.P521()
+	default:
+		return nil, errPKINITUnsupported
+	}
+
+	key, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ecdhAgreement{key: key}, nil
+}
+
+// octetString2Key implements octetstring2key from RFC 4556 section 3.2.3.1.
+func octetString2Key(x []byte, etype int32) (types.EncryptionKey, error) {
+	e, err := crypto.GetEtype(etype)
+	if err != nil {
+		return types.EncryptionKey{}, err
+	}
+
+	n := e.GetKeySeedBitLength() / 8
+	out := make([]byte, 0, n+sha1.Size)
+
+	for i := byte(0); len(out) < n; i++ {
+		h := sha1.New() //nolint:gosec
+		h.Write([]byte{i})
+		h.Write(x)
+		out = h.Sum(out)
+	}
+
+	return types.EncryptionKey{KeyType: etype, KeyValue: e.RandomToKey(out[:n])}, nil
+}
+
+// anonymousPrincipal returns the WELLKNOWN/ANONYMOUS principal name.
+func anonymousPrincipal() types.PrincipalName {
+	return types.PrincipalName{NameType: nameTypeWellKnown, NameString: strings.Split(anonymousName, "/")}
+}
+
+// isAnonymous reports whether the ticket was issued to an anonymous client,
+// either fully anonymous or with just the anonymous principal name and the
+// realm of the KDC.
+func isAnonymous(part messages.EncTicketPart) bool {
+	return types.IsFlagSet(&part.Flags, ticketFlagAnonymous) || part.CName.Equal(anonymousPrincipal())
+}
+
+// readAnchors reads the certificates from a pkinit_anchors value, which is
+// either a FILE: or DIR: name of PEM-encoded certificates.
+func readAnchors(fsys afero.Fs, pool *x509.CertPool, name string) error {
+	residual, isDir := strings.CutPrefix(name, "DIR:")
+	if !isDir {
+		residual = strings.TrimPrefix(name, "FILE:")
+	}
+
+	paths := []string{residual}
+
+	if isDir {
+		entries, err := afero.ReadDir(fsys, residual)
+		if err != nil {
+			return err
+		}
+
+		paths = paths[:0]
+
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				paths = append(paths, filepath.Join(residual, entry.Name()))
+			}
+		}
+	}
+
+	for _, path := range paths {
+		b, err := afero.ReadFile(fsys, path)
+		if err != nil {
+			return err
+		}
+
+		if !pool.AppendCertsFromPEM(b) && !isDir {
+			return fmt.Errorf("%s: no certificates found", path)
+		}
+	}
+
+	return nil
+}
+
+// pkinitAnchors returns the trust anchors for the KDC certificate, either
+// passed with WithPKINITAnchors or from pkinit_anchors for the realm or in
+// libdefaults. If neither is set PKINIT fails, as with MIT Kerberos, rather
+// than trusting any certificate authority in the system roots.
+func (ctx *Initiator) pkinitAnchors(realm string) (*x509.CertPool, error) {
+	if ctx.pkinitRoots != nil {
+		return ctx.pkinitRoots, nil
+	}
+
+	names := ctx.profile.values("realms", realm, pkinitAnchorsTag)
+	if len(names) == 0 {
+		names = ctx.profile.values("libdefaults", pkinitAnchorsTag)
+	}
+
+	if len(names) == 0 {
+		return nil, errNoPKINITAnchors
+	}
+
+	pool := x509.NewCertPool()
+
+	for _, name := range names {
+		if err := readAnchors(ctx.sources.fs, pool, name); err != nil {
+			return nil, fmt.Errorf("%s: %w", pkinitAnchorsTag, err)
+		}
+	}
+
+	return pool, nil
+}
+
+// parsePKINITSAN returns the principal from a GeneralName if it is an otherName
+// with the id-pkinit-san type, which is encoded as
+// [0] IMPLICIT SEQUENCE { type-id OBJECT IDENTIFIER, value [0] EXPLICIT ANY }.
+func parsePKINITSAN(name asn1.RawValue) (*krb5PrincipalName, error) {
+	if name.Class != asn1.ClassContextSpecific || name.Tag != 0 {
+		return nil, nil //nolint:nilnil
+	}
+
+	var oid asn1.ObjectIdentifier
+
+	rest, err := asn1.Unmarshal(name.Bytes, &oid)
+	if err != nil || !oid.Equal(oidPKINITSAN) {
+		return nil, err
+	}
+
+	var value asn1.RawValue
+	if _, err = asn1.Unmarshal(rest, &value); err != nil {
+		return nil, err
+	}
+
+	san := new(krb5PrincipalName)
+	if _, err = asn1.Unmarshal(value.Bytes, san); err != nil {
+		return nil, err
+	}
+
+	return san, nil
+}
+
+// pkinitSANs returns the principals in the id-pkinit-san otherName entries
+// of the subject alternative name extension of the certificate.
+func pkinitSANs(cert *x509.Certificate) ([]krb5PrincipalName, error) {
+	var sans []krb5PrincipalName
+
+	for _, ext := range cert.Extensions {
+		if !oidSubjectAltName.Equal(asn1.ObjectIdentifier(ext.Id)) {
+			continue
+		}
+
+		var names asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			return nil, err
+		}
+
+		for b := names.Bytes; len(b) > 0; {
+			var (
+				name asn1.RawValue
+				err  error
+			)
+
+			if b, err = asn1.Unmarshal(b, &name); err != nil {
+				return nil, err
+			}
+
+			san, err := parsePKINITSAN(name)
+			if err != nil {
+				return nil, err
+			}
+
+			if san != nil {
+				sans = append(sans, *san)
+			}
+		}
+	}
+
+	return sans, nil
+}
+
+// verifyKDCCertificate checks the certificate has an id-pkinit-san for the
+// krbtgt/REALM@REALM principal, as per RFC 4556 section 3.2.4, which binds
+// it to the realm being authenticated to.
+func verifyKDCCertificate(cert *x509.Certificate, realm string) error {
+	sans, err := pkinitSANs(cert)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errKDCCertificate, err)
+	}
+
+	for _, san := range sans {
+		if san.Realm == realm && slices.Equal(san.PrincipalName.NameString, []string{"krbtgt", realm}) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s", errKDCCertificate, realm)
+}
+
+// pkinitRequest creates the PA-PK-AS-REQ padata. If anonymous is true the
+// AuthPack isn't signed.
+func (ctx *Initiator) pkinitRequest(asReq *messages.ASReq, agreement keyAgreement, anonymous bool,
+) (types.PAData, error) {
+	body, err := asReq.ReqBody.Marshal()
+	if err != nil {
+		return types.PAData{}, err
+	}
+
+	spki, err := agreement.publicKeyInfo()
+	if err != nil {
+		return types.PAData{}, err
+	}
+
+	now := time.Now().UTC()
+	sum := sha1.Sum(body) //nolint:gosec
+
+	b, err := asn1.Marshal(authPack{
+		PKAuthenticator: pkAuthenticator{
+			Cusec:      now.Nanosecond() / int(time.Microsecond),
+			CTime:      now.Truncate(time.Second),
+			Nonce:      asReq.ReqBody.Nonce,
+			PAChecksum: sum[:],
+		},
+		ClientPublicValue: explicitRawValue(1, spki),
+	})
+	if err != nil {
+		return types.PAData{}, err
+	}
+
+	if anonymous {
+		b, err = signData(oidPKINITAuthData, b, nil, nil, nil)
+	} else {
+		b, err = signData(oidPKINITAuthData, b, ctx.certificate, ctx.certificateChain, ctx.signer)
+	}
+
+	if err != nil {
+		return types.PAData{}, err
+	}
+
+	if b, err = asn1.Marshal(paPKASReq{SignedAuthPack: b}); err != nil {
+		return types.PAData{}, err
+	}
+
+	return types.PAData{PADataType: patype.PA_PK_AS_REQ, PADataValue: b}, nil
+}
+
+// pkinitReplyKey verifies the PA-PK-AS-REP padata and returns the reply key.
+//
+//nolint:cyclop
+func (ctx *Initiator) pkinitReplyKey(asRep messages.ASRep, realm string, agreement keyAgreement, nonce int,
+) (types.EncryptionKey, error) {
+	var rep *dhRepInfo
+
+	for _, pa := range asRep.PAData {
+		if pa.PADataType != patype.PA_PK_AS_REP {
+			continue
+		}
+
+		rep = new(dhRepInfo)
+		if err := unmarshalChoice(pa.PADataValue, rep); err != nil {
+			return types.EncryptionKey{}, fmt.Errorf("%w: %w", errPKINITReply, err)
+		}
+	}
+
+	if rep == nil {
+		return types.EncryptionKey{}, fmt.Errorf("%w: PA-PK-AS-REP missing", errPKINITReply)
+	}
+
+	if len(rep.KDF.FullBytes) > 0 {
+		return types.EncryptionKey{}, fmt.Errorf("%w: unexpected key derivation function", errPKINITReply)
+	}
+
+	sd, err := parseSignedData(rep.DHSignedData, oidPKINITDHKeyData)
+	if err != nil {
+		return types.EncryptionKey{}, fmt.Errorf("%w: %w", errPKINITReply, err)
+	}
+
+	roots, err := ctx.pkinitAnchors(realm)
+	if err != nil {
+		return types.EncryptionKey{}, err
+	}
+
+	if err = sd.verify(roots, oidPKINITKPKdc); err != nil {
+		return types.EncryptionKey{}, fmt.Errorf("KDC certificate not trusted: %w", err)
+	}
+
+	if err = verifyKDCCertificate(sd.signer, realm); err != nil {
+		return types.EncryptionKey{}, err
+	}
+
+	var info kdcDHKeyInfo
+	if _, err = asn1.Unmarshal(sd.content, &info); err != nil {
+		return types.EncryptionKey{}, fmt.Errorf("%w: %w", errPKINITReply, err)
+	}
+
+	if info.Nonce != nonce {
+		return types.EncryptionKey{}, fmt.Errorf("%w: nonce mismatch", errPKINITReply)
+	}
+
+	z, err := agreement.sharedSecret(info.SubjectPublicKey.Bytes)
+	if err != nil {
+		return types.EncryptionKey{}, err
+	}
+
+	return octetString2Key(z, asRep.EncPart.EType)
+}
+
+// verifyPKINITKX checks the PA_PKINIT_KX padata returned for anonymous
+// PKINIT, which binds the session key to the reply key, as per RFC 8062
+// section 7.
+func verifyPKINITKX(asRep messages.ASRep, replyKey types.EncryptionKey) error {
+	for _, pa := range asRep.PAData {
+		if pa.PADataType != patypePKINITKX {
+			continue
+		}
+
+		var ed types.EncryptedData
+		if err := ed.Unmarshal(pa.PADataValue); err != nil {
+			return err
+		}
+
+		b, err := crypto.DecryptEncPart(ed, replyKey, keyUsagePKINITKX)
+		if err != nil {
+			return err
+		}
+
+		var contribution types.EncryptionKey
+		if _, err = asn1.Unmarshal(b, &contribution); err != nil {
+			return err
+		}
+
+		key, err := cf2(contribution, replyKey, "PKINIT", "KeyExchange")
+		if err != nil {
+			return err
+		}
+
+		if key.KeyType != asRep.DecryptedEncPart.Key.KeyType ||
+			!bytes.Equal(key.KeyValue, asRep.DecryptedEncPart.Key.KeyValue) {
+			return fmt.Errorf("%w: session key doesn't match PA-PKINIT-KX", errPKINITReply)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("%w: PA-PKINIT-KX missing", errPKINITReply)
+}
+
+// pkinitASExchange obtains a TGT using PKINIT, either with the certificate
+// and signer or anonymously.
+func (ctx *Initiator) pkinitASExchange(cname types.PrincipalName, realm string, anonymous bool,
+) (messages.ASRep, error) {
+	asReq, err := messages.NewASReqForTGT(realm, ctx.krb5conf, cname)
+	if err != nil {
+		return messages.ASRep{}, err
+	}
+
+	if anonymous {
+		types.SetFlag(&asReq.ReqBody.KDCOptions, kdcOptRequestAnonymous)
+	}
+
+	agreement, err := newKeyAgreement(ctx.keyAgreement)
+	if err != nil {
+		return messages.ASRep{}, err
+	}
+
+	pa, err := ctx.pkinitRequest(&asReq, agreement, anonymous)
+	if err != nil {
+		return messages.ASRep{}, err
+	}
+
+	asReq.PAData = types.PADataSequence{pa}
+
+	b, err := asReq.Marshal()
+	if err != nil {
+		return messages.ASRep{}, err
+	}
+
+	rb, err := sendToKDC(ctx.krb5conf, realm, b)
+	if err != nil {
+		return messages.ASRep{}, err
+	}
+
+	var asRep messages.ASRep
+	if err = asRep.Unmarshal(rb); err != nil {
+		return messages.ASRep{}, err
+	}
+
+	replyKey, err := ctx.pkinitReplyKey(asRep, realm, agreement, asReq.ReqBody.Nonce)
+	if err != nil {
+		return messages.ASRep{}, err
+	}
+
+	if asRep.DecryptedEncPart, err = decryptKDCRepPart(asRep.EncPart, replyKey,
+		keyusage.AS_REP_ENCPART); err != nil {
+		return messages.ASRep{}, err
+	}
+
+	if asRep.DecryptedEncPart.Nonce != asReq.ReqBody.Nonce {
+		return messages.ASRep{}, fmt.Errorf("%w: nonce mismatch", errPKINITReply)
+	}
+
+	if anonymous {
+		if err = verifyPKINITKX(asRep, replyKey); err != nil {
+			return messages.ASRep{}, err
+		}
+	}
+
+	return asRep, nil
+}
@@ -0,0 +1,640 @@
+package gssapi
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec
+	"crypto/x509"
+	"crypto/x509/pkix"
+	stdasn1 "encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana"
+	"github.com/jcmturner/gokrb5/v8/iana/errorcode"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/iana/patype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//nolint:gochecknoglobals
+var (
+	oidPKINITKPClientAuth = stdasn1.ObjectIdentifier{1, 3, 6, 1, 5, 2, 3, 4}
+	oidPKINITKPKdcStd     = stdasn1.ObjectIdentifier{1, 3, 6, 1, 5, 2, 3, 5}
+)
+
+// testPKI is a certificate authority for PKINIT tests.
+type testPKI struct {
+	roots *x509.CertPool
+	cert  *x509.Certificate
+	key   *ecdsa.PrivateKey
+	pem   []byte
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	b, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(b)
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	return &testPKI{
+		roots: roots,
+		cert:  cert,
+		key:   key,
+		pem:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b}),
+	}
+}
+
+func (pki *testPKI) issue(t *testing.T, name string, eku stdasn1.ObjectIdentifier, extensions ...pkix.Extension,
+) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:       serial,
+		Subject:            pkix.Name{CommonName: name},
+		NotBefore:          time.Now().Add(-time.Hour),
+		NotAfter:           time.Now().Add(time.Hour),
+		KeyUsage:           x509.KeyUsageDigitalSignature,
+		UnknownExtKeyUsage: []stdasn1.ObjectIdentifier{eku},
+		ExtraExtensions:    extensions,
+	}
+
+	b, err := x509.CreateCertificate(rand.Reader, template, pki.cert, key.Public(), pki.key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(b)
+	require.NoError(t, err)
+
+	return cert, key
+}
+
+// pkinitSAN returns a subject alternative name extension with an
+// id-pkinit-san for krbtgt/realm@realm.
+func pkinitSAN(t *testing.T, realm string) pkix.Extension {
+	t.Helper()
+
+	name, err := asn1.Marshal(krb5PrincipalName{
+		Realm:         realm,
+		PrincipalName: types.NewPrincipalName(nametype.KRB_NT_SRV_INST, "krbtgt/"+realm),
+	})
+	require.NoError(t, err)
+
+	oid, err := asn1.Marshal(oidPKINITSAN)
+	require.NoError(t, err)
+
+	value, err := asn1.Marshal(explicitRawValue(0, name))
+	require.NoError(t, err)
+
+	b, err := asn1.Marshal([]asn1.RawValue{{
+		Class:      asn1.ClassContextSpecific,
+		Tag:        0,
+		IsCompound: true,
+		Bytes:      append(oid, value...),
+	}})
+	require.NoError(t, err)
+
+	return pkix.Extension{Id: stdasn1.ObjectIdentifier(oidSubjectAltName), Value: b}
+}
+
+// enablePKINIT issues the KDC a certificate from pki for realm.
+func (kdc *testKDC) enablePKINIT(t *testing.T, pki *testPKI, realm string) {
+	t.Helper()
+
+	kdc.pki = pki
+	kdc.cert, kdc.signer = pki.issue(t, "krbtgt/"+realm, oidPKINITKPKdcStd, pkinitSAN(t, realm))
+}
+
+// peerKeyAgreement creates the KDC side of the key agreement described by
+// the SubjectPublicKeyInfo in b, returning it along with the client public
+// key.
+func peerKeyAgreement(b []byte) (keyAgreement, []byte, error) {
+	var spki subjectPublicKeyInfo
+	if _, err := asn1.Unmarshal(b, &spki); err != nil {
+		return nil, nil, err
+	}
+
+	if spki.Algorithm.Algorithm.Equal(oidDHPublicNumber) {
+		var params domainParameters
+		if _, err := asn1.Unmarshal(spki.Algorithm.Parameters.FullBytes, &params); err != nil {
+			return nil, nil, err
+		}
+
+		a, err := newDHAgreement(params)
+
+		return a, spki.PublicKey.Bytes, err
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ecdsaPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, nil, errPKINITUnsupported
+	}
+
+	ecdhPub, err := ecdsaPub.ECDH()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := ecdhPub.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &ecdhAgreement{key: key}, ecdhPub.Bytes(), nil
+}
+
+//nolint:cyclop,funlen
+func (kdc *testKDC) handlePKINIT(asReq messages.ASReq) ([]byte, error) {
+	var req paPKASReq
+
+	for _, pa := range asReq.PAData {
+		if pa.PADataType == patype.PA_PK_AS_REQ {
+			if _, err := asn1.Unmarshal(pa.PADataValue, &req); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sd, err := parseSignedData(req.SignedAuthPack, oidPKINITAuthData)
+	if err != nil {
+		return nil, err
+	}
+
+	cname, crealm := asReq.ReqBody.CName, testRealm
+
+	if types.IsFlagSet(&asReq.ReqBody.KDCOptions, kdcOptRequestAnonymous) {
+		if sd.signer != nil || !cname.Equal(anonymousPrincipal()) {
+			return kdc.krbError(errorcode.KDC_ERR_BADOPTION, nil)
+		}
+
+		kdc.record("anonymous PKINIT")
+
+		crealm = anonymousRealm
+	} else {
+		if err = sd.verify(kdc.pki.roots, asn1.ObjectIdentifier(oidPKINITKPClientAuth)); err != nil ||
+			sd.signer.Subject.CommonName != cname.PrincipalNameString() {
+			return kdc.krbError(errorcode.KDC_ERROR_CLIENT_NOT_TRUSTED, nil)
+		}
+
+		kdc.record("PKINIT")
+	}
+
+	var auth authPack
+	if _, err = asn1.Unmarshal(sd.content, &auth); err != nil {
+		return nil, err
+	}
+
+	body, err := asReq.ReqBody.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	if sum := sha1.Sum(body); !bytes.Equal(sum[:], auth.PKAuthenticator.PAChecksum) { //nolint:gosec
+		return nil, errors.New("PKINIT checksum invalid")
+	}
+
+	agreement, peer, err := peerKeyAgreement(auth.ClientPublicValue.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	z, err := agreement.sharedSecret(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	replyKey, err := octetString2Key(z, kdc.etype)
+	if err != nil {
+		return nil, err
+	}
+
+	pub := agreement.publicKey()
+
+	b, err := asn1.Marshal(kdcDHKeyInfo{
+		SubjectPublicKey: asn1.BitString{Bytes: pub, BitLength: len(pub) * 8},
+		Nonce:            auth.PKAuthenticator.Nonce,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if b, err = signData(oidPKINITDHKeyData, b, kdc.cert, nil, kdc.signer); err != nil {
+		return nil, err
+	}
+
+	if b, err = marshalChoice(dhRepInfo{DHSignedData: b}); err != nil {
+		return nil, err
+	}
+
+	padata := types.PADataSequence{{PADataType: patype.PA_PK_AS_REP, PADataValue: b}}
+
+	sessionKey, err := generateSubkey(kdc.etype)
+	if err != nil {
+		return nil, err
+	}
+
+	if crealm == anonymousRealm {
+		// The session key is derived from a key contributed by the KDC
+		contribution := sessionKey
+
+		if sessionKey, err = cf2(contribution, replyKey, "PKINIT", "KeyExchange"); err != nil {
+			return nil, err
+		}
+
+		if b, err = asn1.Marshal(contribution); err != nil {
+			return nil, err
+		}
+
+		ed, err := crypto.GetEncryptedData(b, replyKey, keyUsagePKINITKX, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		if b, err = ed.Marshal(); err != nil {
+			return nil, err
+		}
+
+		padata = append(padata, types.PAData{PADataType: patypePKINITKX, PADataValue: b})
+	}
+
+	ticket, part, err := kdc.issue(cname, crealm, asReq.ReqBody.SName, asReq.ReqBody.Nonce, sessionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if b, err = part.Marshal(); err != nil {
+		return nil, err
+	}
+
+	ed, err := crypto.GetEncryptedData(b, replyKey, keyusage.AS_REP_ENCPART, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	asRep := messages.ASRep{
+		KDCRepFields: messages.KDCRepFields{
+			PVNO:    iana.PVNO,
+			MsgType: msgtype.KRB_AS_REP,
+			PAData:  padata,
+			CRealm:  crealm,
+			CName:   cname,
+			Ticket:  ticket,
+			EncPart: ed,
+		},
+	}
+
+	return asRep.Marshal()
+}
+
+func TestOctetString2Key(t *testing.T) {
+	t.Parallel()
+
+	// The key seed for AES256 is two SHA-1 blocks truncated to 32 bytes
+	x := []byte("shared secret")
+
+	key, err := octetString2Key(x, etypeID.AES256_CTS_HMAC_SHA1_96)
+	require.NoError(t, err)
+
+	h0 := sha1.Sum(append([]byte{0}, x...)) //nolint:gosec
+	h1 := sha1.Sum(append([]byte{1}, x...)) //nolint:gosec
+
+	assert.Equal(t, append(h0[:], h1[:12]...), key.KeyValue)
+}
+
+func TestKeyAgreement(t *testing.T) {
+	t.Parallel()
+
+	for _, ka := range []KeyAgreement{DiffieHellman, ECDHP256, ECDHP384, ECDHP521} {
+		t.Run(fmt.Sprint(ka), func(t *testing.T) {
+			t.Parallel()
+
+			client, err := newKeyAgreement(ka)
+			require.NoError(t, err)
+
+			spki, err := client.publicKeyInfo()
+			require.NoError(t, err)
+
+			kdc, peer, err := peerKeyAgreement(spki)
+			require.NoError(t, err)
+
+			z1, err := kdc.sharedSecret(peer)
+			require.NoError(t, err)
+
+			z2, err := client.sharedSecret(kdc.publicKey())
+			require.NoError(t, err)
+
+			assert.Equal(t, z1, z2)
+		})
+	}
+
+	_, err := newKeyAgreement(KeyAgreement(-1))
+	assert.ErrorIs(t, err, errPKINITUnsupported)
+}
+
+//nolint:funlen
+func TestPKINIT(t *testing.T) {
+	t.Parallel()
+
+	pki := newTestPKI(t)
+
+	kdc := newTestKDC(t, etypeID.AES256_CTS_HMAC_SHA1_96)
+	kdc.enablePKINIT(t, pki, testRealm)
+	kdc.addPrincipal(testClient, "password", true)
+	kdc.addPrincipal(testService, "service", false)
+
+	b, err := kdc.keytab.Marshal()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+
+	kt := filepath.Join(dir, "krb5.keytab")
+	require.NoError(t, os.WriteFile(kt, b, 0o600))
+
+	anchors := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(anchors, pki.pem, 0o600))
+
+	cert, key := pki.issue(t, testClient, oidPKINITKPClientAuth)
+
+	establishWith := func(t *testing.T, options ...Option[Initiator]) {
+		t.Helper()
+
+		initiator, err := NewInitiator(append([]Option[Initiator]{
+			WithConfig[Initiator](kdc.config()),
+			WithDomain[Initiator](testRealm),
+			WithUsername[Initiator](testClient),
+		}, options...)...)
+		require.NoError(t, err)
+
+		defer initiator.Close()
+
+		acceptor, err := NewAcceptor(WithAcceptorConfig[Acceptor](kdc.config()), WithKeytab[Acceptor](kt))
+		require.NoError(t, err)
+
+		defer acceptor.Close()
+
+		output, _, err := initiator.Initiate(testService, 0, nil)
+		require.NoError(t, err)
+
+		_, _, err = acceptor.Accept(output)
+		require.NoError(t, err)
+
+		assert.Equal(t, testClient+"@"+testRealm, acceptor.PeerName().String())
+	}
+
+	for _, ka := range []KeyAgreement{DiffieHellman, ECDHP256, ECDHP384} {
+		t.Run(fmt.Sprint("certificate ", ka), func(t *testing.T) {
+			establishWith(t,
+				WithCertificate[Initiator](cert, key),
+				WithKeyAgreement[Initiator](ka),
+				WithPKINITAnchors[Initiator](pki.roots),
+			)
+		})
+	}
+
+	t.Run("anchors from config", func(t *testing.T) {
+		establishWith(t,
+			WithConfig[Initiator](strings.Replace(kdc.config(), "[libdefaults]\n",
+				"[libdefaults]\n  pkinit_anchors = FILE:"+anchors+"\n", 1)),
+			WithCertificate[Initiator](cert, key),
+		)
+	})
+
+	t.Run("anonymous FAST", func(t *testing.T) {
+		establishWith(t,
+			WithPassword[Initiator]("password"),
+			WithAnonymousFAST[Initiator](),
+			WithPKINITAnchors[Initiator](pki.roots),
+		)
+
+		assert.Positive(t, kdc.count("anonymous PKINIT"))
+	})
+
+	t.Run("untrusted KDC", func(t *testing.T) {
+		_, err := NewInitiator(
+			WithConfig[Initiator](kdc.config()),
+			WithDomain[Initiator](testRealm),
+			WithUsername[Initiator](testClient),
+			WithCertificate[Initiator](cert, key),
+			WithPKINITAnchors[Initiator](newTestPKI(t).roots),
+		)
+
+		var unknown x509.UnknownAuthorityError
+		assert.ErrorAs(t, err, &unknown)
+	})
+
+	t.Run("no anchors", func(t *testing.T) {
+		_, err := NewInitiator(
+			WithConfig[Initiator](kdc.config()),
+			WithDomain[Initiator](testRealm),
+			WithUsername[Initiator](testClient),
+			WithCertificate[Initiator](cert, key),
+		)
+		assert.ErrorIs(t, err, errNoPKINITAnchors)
+	})
+
+	t.Run("untrusted client", func(t *testing.T) {
+		other, otherKey := newTestPKI(t).issue(t, testClient, oidPKINITKPClientAuth)
+
+		_, err := NewInitiator(
+			WithConfig[Initiator](kdc.config()),
+			WithDomain[Initiator](testRealm),
+			WithUsername[Initiator](testClient),
+			WithCertificate[Initiator](other, otherKey),
+			WithPKINITAnchors[Initiator](pki.roots),
+		)
+
+		var krbError messages.KRBError
+		if assert.ErrorAs(t, err, &krbError) {
+			assert.Equal(t, errorcode.KDC_ERROR_CLIENT_NOT_TRUSTED, krbError.ErrorCode)
+		}
+	})
+}
+
+func TestPKINITWrongRealm(t *testing.T) {
+	t.Parallel()
+
+	pki := newTestPKI(t)
+
+	// A trusted certificate, but for a different realm
+	kdc := newTestKDC(t, etypeID.AES256_CTS_HMAC_SHA1_96)
+	kdc.enablePKINIT(t, pki, testOtherRealm)
+	kdc.addPrincipal(testClient, "password", true)
+
+	cert, key := pki.issue(t, testClient, oidPKINITKPClientAuth)
+
+	_, err := NewInitiator(
+		WithConfig[Initiator](kdc.config()),
+		WithDomain[Initiator](testRealm),
+		WithUsername[Initiator](testClient),
+		WithCertificate[Initiator](cert, key),
+		WithPKINITAnchors[Initiator](pki.roots),
+	)
+	assert.ErrorIs(t, err, errKDCCertificate)
+
+	_, err = NewInitiator(
+		WithConfig[Initiator](kdc.config()),
+		WithAnonymous[Initiator](),
+		WithPKINITAnchors[Initiator](pki.roots),
+	)
+	assert.ErrorIs(t, err, errKDCCertificate)
+
+	assert.NoError(t, verifyKDCCertificate(kdc.cert, testOtherRealm))
+}
+
+//nolint:funlen
+func TestAnonymous(t *testing.T) {
+	t.Parallel()
+
+	pki := newTestPKI(t)
+
+	kdc := newTestKDC(t, etypeID.AES256_CTS_HMAC_SHA1_96)
+	kdc.enablePKINIT(t, pki, testRealm)
+	kdc.addPrincipal(testClient, "password", false)
+	kdc.addPrincipal(testService, "service", false)
+
+	b, err := kdc.keytab.Marshal()
+	require.NoError(t, err)
+
+	kt := filepath.Join(t.TempDir(), "krb5.keytab")
+	require.NoError(t, os.WriteFile(kt, b, 0o600))
+
+	anonymous := func(t *testing.T) *Initiator {
+		t.Helper()
+
+		initiator, err := NewInitiator(
+			WithConfig[Initiator](kdc.config()),
+			WithAnonymous[Initiator](),
+			WithPKINITAnchors[Initiator](pki.roots),
+		)
+		require.NoError(t, err)
+
+		t.Cleanup(func() { initiator.Close() })
+
+		return initiator
+	}
+
+	t.Run("established", func(t *testing.T) {
+		initiator := anonymous(t)
+
+		acceptor, err := NewAcceptor(WithAcceptorConfig[Acceptor](kdc.config()), WithKeytab[Acceptor](kt))
+		require.NoError(t, err)
+
+		defer acceptor.Close()
+
+		output, _, err := initiator.Initiate(testService, gssapi.ContextFlagMutual, nil)
+		require.NoError(t, err)
+
+		output, _, err = acceptor.Accept(output)
+		require.NoError(t, err)
+
+		_, _, err = initiator.Initiate(testService, 0, output)
+		require.NoError(t, err)
+
+		assert.True(t, initiator.IsAnonymous())
+		assert.True(t, acceptor.IsAnonymous())
+		assert.Equal(t, anonymousName+"@"+anonymousRealm, acceptor.PeerName().String())
+		assert.Equal(t, NTAnonymous, acceptor.PeerName().NameType())
+
+		// The context still protects messages
+		signature, err := initiator.MakeSignature([]byte("hello"))
+		require.NoError(t, err)
+
+		assert.NoError(t, acceptor.VerifySignature([]byte("hello"), signature))
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		initiator := anonymous(t)
+
+		acceptor, err := NewAcceptor(
+			WithAcceptorConfig[Acceptor](kdc.config()),
+			WithKeytab[Acceptor](kt),
+			WithRefuseAnonymous[Acceptor](),
+		)
+		require.NoError(t, err)
+
+		defer acceptor.Close()
+
+		output, _, err := initiator.Initiate(testService, 0, nil)
+		require.NoError(t, err)
+
+		_, _, err = acceptor.Accept(output)
+		assert.ErrorIs(t, err, errAnonymousRefused)
+		assert.False(t, acceptor.Established())
+	})
+
+	t.Run("named", func(t *testing.T) {
+		initiator, err := NewInitiator(
+			WithConfig[Initiator](kdc.config()),
+			WithDomain[Initiator](testRealm),
+			WithUsername[Initiator](testClient),
+			WithPassword[Initiator]("password"),
+		)
+		require.NoError(t, err)
+
+		defer initiator.Close()
+
+		_, _, err = initiator.Initiate(testService, gssapi.ContextFlagAnon, nil)
+		assert.ErrorIs(t, err, errAnonymousCredentials)
+
+		acceptor, err := NewAcceptor(WithAcceptorConfig[Acceptor](kdc.config()), WithKeytab[Acceptor](kt),
+			WithRefuseAnonymous[Acceptor]())
+		require.NoError(t, err)
+
+		defer acceptor.Close()
+
+		output, _, err := initiator.Initiate(testService, 0, nil)
+		require.NoError(t, err)
+
+		_, _, err = acceptor.Accept(output)
+		require.NoError(t, err)
+
+		assert.False(t, acceptor.IsAnonymous())
+	})
+}
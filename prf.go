@@ -0,0 +1,196 @@
+package gssapi
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des" //nolint:gosec
+	"crypto/hmac"
+	"crypto/sha1" //nolint:gosec
+	"encoding/binary"
+	"errors"
+
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/crypto/rfc8009"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+const (
+	prfConstant = "prf"
+	// prfMaxOutputLength limits the output of PseudoRandom, which is far
+	// more than any key derivation needs but stops a careless caller
+	// allocating an arbitrary amount of memory.
+	prfMaxOutputLength = 1 << 20
+)
+
+// PRFKey selects the context key used by PseudoRandom.
+type PRFKey int
+
+const (
+	// PRFKeyFull uses the subkey asserted by the Acceptor if there is one,
+	// otherwise it's the same as PRFKeyPartial.
+	PRFKeyFull PRFKey = iota
+	// PRFKeyPartial uses the subkey asserted by the Initiator if there is
+	// one, otherwise the session key.
+	PRFKeyPartial
+)
+
+var (
+	errPRFUnsupported = errors.New("pseudo-random function not supported for encryption type")
+	errBadPRFKey      = errors.New("invalid PRF key")
+	errBadPRFLength   = errors.New("invalid PRF output length")
+)
+
+// pseudoRandom implements the encryption type specific pseudo-random function
+// from RFC 3961 section 5.3. It's implemented here rather than using gokrb5
+// as its versions produce the wrong output for the AES encryption types.
+func pseudoRandom(key types.EncryptionKey, input []byte) ([]byte, error) {
+	e, err := crypto.GetEtype(key.KeyType)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.KeyType {
+	case etypeID.AES128_CTS_HMAC_SHA1_96, etypeID.AES256_CTS_HMAC_SHA1_96:
+		// RFC 3962 section 6
+		dk, err := e.DeriveKey(key.KeyValue, []byte(prfConstant))
+		if err != nil {
+			return nil, err
+		}
+
+		block, err := aes.NewCipher(dk)
+		if err != nil {
+			return nil, err
+		}
+
+		h := sha1.Sum(input) //nolint:gosec
+		out := make([]byte, aes.BlockSize)
+		block.Encrypt(out, h[:aes.BlockSize])
+
+		return out, nil
+	case etypeID.AES128_CTS_HMAC_SHA256_128, etypeID.AES256_CTS_HMAC_SHA384_192:
+		// RFC 8009 section 5
+		return rfc8009.KDF_HMAC_SHA2(key.KeyValue, []byte(prfConstant), input, e.GetHashFunc()().Size()*8, e), nil
+	case etypeID.DES3_CBC_SHA1_KD:
+		// RFC 3961 section 6.3
+		dk, err := e.DeriveKey(key.KeyValue, []byte(prfConstant))
+		if err != nil {
+			return nil, err
+		}
+
+		block, err := des.NewTripleDESCipher(dk) //nolint:gosec
+		if err != nil {
+			return nil, err
+		}
+
+		h := sha1.Sum(input) //nolint:gosec
+		out := make([]byte, 2*des.BlockSize)
+		cipher.NewCBCEncrypter(block, make([]byte, des.BlockSize)).CryptBlocks(out, h[:len(out)])
+
+		return out, nil
+	case etypeID.RC4_HMAC, etypeID.RC4_HMAC_EXP:
+		// RFC 4757 section 7.1
+		mac := hmac.New(sha1.New, key.KeyValue)
+		mac.Write(input)
+
+		return mac.Sum(nil), nil
+	}
+
+	return nil, errPRFUnsupported
+}
+
+// prfPlus implements PRF+ from RFC 6113 section 5.1, returning n bytes.
+func prfPlus(key types.EncryptionKey, info []byte, n int) ([]byte, error) {
+	out := make([]byte, 0, n)
+
+	for i := byte(1); len(out) < n; i++ {
+		b, err := pseudoRandom(key, append([]byte{i}, info...))
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, b...)
+	}
+
+	return out[:n], nil
+}
+
+// cf2 implements KRB-FX-CF2 from RFC 6113 section 5.1, combining two keys
+// into a new key of the same encryption type as key1.
+func cf2(key1, key2 types.EncryptionKey, pepper1, pepper2 string) (types.EncryptionKey, error) {
+	e, err := crypto.GetEtype(key1.KeyType)
+	if err != nil {
+		return types.EncryptionKey{}, err
+	}
+
+	n := e.GetKeySeedBitLength() / 8
+
+	b1, err := prfPlus(key1, []byte(pepper1), n)
+	if err != nil {
+		return types.EncryptionKey{}, err
+	}
+
+	b2, err := prfPlus(key2, []byte(pepper2), n)
+	if err != nil {
+		return types.EncryptionKey{}, err
+	}
+
+	for i := range b1 {
+		b1[i] ^= b2[i]
+	}
+
+	return types.EncryptionKey{
+		KeyType:  key1.KeyType,
+		KeyValue: e.RandomToKey(b1),
+	}, nil
+}
+
+// gssPRFPlus implements PRF+ from RFC 4402 section 2, returning n bytes. The
+// counter is four bytes rather than the one byte used by RFC 6113 and starts
+// at zero, as with MIT Kerberos and Heimdal.
+func gssPRFPlus(key types.EncryptionKey, input []byte, n int) ([]byte, error) {
+	out := make([]byte, 0, n)
+	b := make([]byte, 4+len(input))
+	copy(b[4:], input)
+
+	for i := uint32(0); len(out) < n; i++ {
+		binary.BigEndian.PutUint32(b, i)
+
+		t, err := pseudoRandom(key, b)
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, t...)
+	}
+
+	return out[:n], nil
+}
+
+// PseudoRandom implements GSS_Pseudo_random from RFC 4401, returning outLen
+// bytes derived from the input and the context key selected by prfKey as per
+// RFC 4402. The output is limited to 1 MiB.
+func (ctx *context) PseudoRandom(prfKey PRFKey, input []byte, outLen int) ([]byte, error) {
+	if !ctx.established {
+		return nil, errNotEstablished
+	}
+
+	if outLen < 0 || outLen > prfMaxOutputLength {
+		return nil, errBadPRFLength
+	}
+
+	var key types.EncryptionKey
+
+	switch prfKey {
+	case PRFKeyFull:
+		key = ctx.contextKey()
+	case PRFKeyPartial:
+		if key = ctx.initiatorSubkey(); key.KeyType == 0 {
+			key = ctx.key
+		}
+	default:
+		return nil, errBadPRFKey
+	}
+
+	return gssPRFPlus(key, input, outLen)
+}
@@ -0,0 +1,251 @@
+package gssapi
+
+import (
+	"encoding/hex"
+	"strconv"
+	"testing"
+
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func stringToKey(t *testing.T, etype int32, password string) types.EncryptionKey {
+	t.Helper()
+
+	e, err := crypto.GetEtype(etype)
+	require.NoError(t, err)
+
+	// The salt is the password
+	b, err := e.StringToKey(password, password, e.GetDefaultStringToKeyParams())
+	require.NoError(t, err)
+
+	return types.EncryptionKey{KeyType: etype, KeyValue: b}
+}
+
+// Test vectors from MIT Kerberos src/lib/crypto/crypto_tests/t_cf2.
+func TestCF2(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		etype int32
+		key   string
+	}{
+		{etypeID.AES128_CTS_HMAC_SHA1_96, "97df97e4b798b29eb31ed7280287a92a"},
+		{etypeID.AES256_CTS_HMAC_SHA1_96, "4d6ca4e629785c1f01baf55e2e548566b9617ae3a96868c337cb93b5e72b1c7b"},
+		{etypeID.DES3_CBC_SHA1_KD, "e58f9eb643862c13ad38e529313462a7f73e62834fe54a01"},
+	}
+
+	for _, table := range tables {
+		t.Run(strconv.Itoa(int(table.etype)), func(t *testing.T) {
+			t.Parallel()
+
+			key, err := cf2(stringToKey(t, table.etype, "key1"), stringToKey(t, table.etype, "key2"), "a", "b")
+			require.NoError(t, err)
+
+			assert.Equal(t, table.etype, key.KeyType)
+			assert.Equal(t, table.key, hex.EncodeToString(key.KeyValue))
+		})
+	}
+}
+
+func TestPseudoRandomUnsupported(t *testing.T) {
+	t.Parallel()
+
+	_, err := pseudoRandom(types.EncryptionKey{KeyType: etypeID.CAMELLIA128_CTS_CMAC}, nil)
+	assert.Error(t, err)
+}
+
+// Test vectors from RFC 8009 appendix A.
+func TestPseudoRandom(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		etype  int32
+		key    string
+		output string
+	}{
+		{
+			etypeID.AES128_CTS_HMAC_SHA256_128,
+			"3705d96080c17728a0e800eab6e0d23c",
+			"9d188616f63852fe86915bb840b4a886ff3e6bb0f819b49b893393d393854295",
+		},
+		{
+			etypeID.AES256_CTS_HMAC_SHA384_192,
+			"6d404d37faf79f9df0d33568d320669800eb4836472ea8a026d16b7182460c52",
+			"9801f69a368c2bf675e59521e177d9a07f67efe1cfde8d3c8d6f6a0256e3b17db3c1b62ad1b8553360d17367eb1514d2",
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(strconv.Itoa(int(table.etype)), func(t *testing.T) {
+			t.Parallel()
+
+			key, err := hex.DecodeString(table.key)
+			require.NoError(t, err)
+
+			b, err := pseudoRandom(types.EncryptionKey{KeyType: table.etype, KeyValue: key}, []byte("test"))
+			require.NoError(t, err)
+			assert.Equal(t, table.output, hex.EncodeToString(b))
+		})
+	}
+}
+
+// Known answers from gss_pseudo_random in MIT Kerberos 1.20.1 with the input
+// "input" and an output length of 44 bytes. For each encryption type a
+// ticket with a random session key was created for testService, an Initiator
+// created an AP-REQ from it requesting mutual authentication, and
+// testdata/mitprf.py accepted it with libgssapi_krb5 before calling
+// gss_pseudo_random with GSS_C_PRF_KEY_FULL and GSS_C_PRF_KEY_PARTIAL. The
+// acceptor subkey is the one chosen by MIT Kerberos, taken from the AP-REP.
+// There's no Initiator subkey so the partial key is always the session key,
+// and there's no acceptor subkey with rc4-hmac.
+func TestContextPseudoRandomMIT(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		name           string
+		etype          int32
+		sessionKey     string
+		acceptorSubkey string
+		full           string
+		partial        string
+	}{
+		{
+			"aes256-cts-hmac-sha1-96",
+			etypeID.AES256_CTS_HMAC_SHA1_96,
+			"431582acedf87e9cbb4ff6218670dabf490b77b3c4e5d82c6b0d204db1e77e81",
+			"081d663840ac9c39ceeedd68f7fcdce65a165eb75e4538b3fe675ba1076f5697",
+			"02536778ff196f7041b73b8fc290f3b9943deb212f99cbf50f34ec1849ef3b769507666dace5f3455fc182a4",
+			"989d1b57f0320fa53b51cd180f4f3214e9270840e1d47ec81edd7056eeba2e3832c6fb110198547a90d7e276",
+		},
+		{
+			"aes128-cts-hmac-sha1-96",
+			etypeID.AES128_CTS_HMAC_SHA1_96,
+			"50157f0d0e73218ea7153d2483875c9e",
+			"e7c3fe38936bb30ea87aae0b97e38b51",
+			"b98bab216beeab4772301891616a2c1c4b5e379fc28e14b0e3cfab6fafdafda26b982e70d39dd3ec62f42506",
+			"bb74d584eec64f2dbbbde316ae5ba54d4b330b08c5369a750c27851d46effd3127c9717b338cd23464b7897a",
+		},
+		{
+			"rc4-hmac",
+			etypeID.RC4_HMAC,
+			"8d8ec7c61853524e1bc92051ad8a6ba1",
+			"",
+			"fc4e1075c45727f250ccc5df3e7368768628450283104e8236abb8f5c3f236969a686830be1c9756627fd8ae",
+			"fc4e1075c45727f250ccc5df3e7368768628450283104e8236abb8f5c3f236969a686830be1c9756627fd8ae",
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			sessionKey, err := hex.DecodeString(table.sessionKey)
+			require.NoError(t, err)
+
+			ctx := &context{established: true, key: types.EncryptionKey{KeyType: table.etype, KeyValue: sessionKey}}
+
+			if table.acceptorSubkey != "" {
+				subkey, err := hex.DecodeString(table.acceptorSubkey)
+				require.NoError(t, err)
+
+				ctx.peerSubkey = types.EncryptionKey{KeyType: table.etype, KeyValue: subkey}
+			}
+
+			// 44 bytes needs the counter values 0, 1 and 2 with either PRF
+			for prfKey, output := range map[PRFKey]string{PRFKeyFull: table.full, PRFKeyPartial: table.partial} {
+				b, err := ctx.PseudoRandom(prfKey, []byte("input"), 44)
+				require.NoError(t, err)
+				assert.Equal(t, output, hex.EncodeToString(b))
+
+				b, err = ctx.PseudoRandom(prfKey, []byte("input"), 7)
+				require.NoError(t, err)
+				assert.Equal(t, output[:14], hex.EncodeToString(b))
+			}
+		})
+	}
+}
+
+//nolint:funlen
+func TestContextPseudoRandom(t *testing.T) {
+	t.Parallel()
+
+	var (
+		sessionKey     = stringToKey(t, etypeID.AES256_CTS_HMAC_SHA1_96, "session")
+		initiatorKey   = stringToKey(t, etypeID.AES256_CTS_HMAC_SHA1_96, "initiator")
+		acceptorSubkey = stringToKey(t, etypeID.AES128_CTS_HMAC_SHA256_128, "acceptor")
+	)
+
+	// RFC 4402 PRF+ with a four byte counter starting at zero
+	prfPlus := func(key types.EncryptionKey, n int) []byte {
+		var b []byte
+
+		for _, counter := range []string{"00000000", "00000001", "00000002"} {
+			c, err := hex.DecodeString(counter)
+			require.NoError(t, err)
+
+			out, err := pseudoRandom(key, append(c, "input"...))
+			require.NoError(t, err)
+
+			b = append(b, out...)
+		}
+
+		return b[:n]
+	}
+
+	tables := []struct {
+		name      string
+		initiator types.EncryptionKey
+		acceptor  types.EncryptionKey
+		full      types.EncryptionKey
+		partial   types.EncryptionKey
+	}{
+		{"session key", types.EncryptionKey{}, types.EncryptionKey{}, sessionKey, sessionKey},
+		{"initiator subkey", initiatorKey, types.EncryptionKey{}, initiatorKey, initiatorKey},
+		{"acceptor subkey", initiatorKey, acceptorSubkey, acceptorSubkey, initiatorKey},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			initiator := &context{established: true, key: sessionKey}
+			initiator.subkey, initiator.peerSubkey = table.initiator, table.acceptor
+
+			acceptor := &context{acceptor: true, established: true, key: sessionKey}
+			acceptor.subkey, acceptor.peerSubkey = table.acceptor, table.initiator
+
+			for _, n := range []int{0, 1, 16, 20, 44} {
+				for prfKey, key := range map[PRFKey]types.EncryptionKey{
+					PRFKeyFull:    table.full,
+					PRFKeyPartial: table.partial,
+				} {
+					b, err := initiator.PseudoRandom(prfKey, []byte("input"), n)
+					require.NoError(t, err)
+					assert.Equal(t, prfPlus(key, n), b)
+
+					c, err := acceptor.PseudoRandom(prfKey, []byte("input"), n)
+					require.NoError(t, err)
+					assert.Equal(t, b, c)
+				}
+			}
+		})
+	}
+
+	ctx := &context{established: true, key: sessionKey}
+
+	_, err := ctx.PseudoRandom(PRFKeyFull, nil, -1)
+	assert.ErrorIs(t, err, errBadPRFLength)
+
+	_, err = ctx.PseudoRandom(PRFKeyFull, nil, prfMaxOutputLength+1)
+	assert.ErrorIs(t, err, errBadPRFLength)
+
+	_, err = ctx.PseudoRandom(PRFKey(2), nil, 16)
+	assert.ErrorIs(t, err, errBadPRFKey)
+
+	_, err = (&context{}).PseudoRandom(PRFKeyFull, nil, 16)
+	assert.ErrorIs(t, err, errNotEstablished)
+}
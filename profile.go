@@ -0,0 +1,493 @@
+package gssapi
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/spf13/afero"
+)
+
+// The github.com/jcmturner/gokrb5/v8/config package only retains the
+// relations it understands, so the krb5.conf contents are also parsed into a
+// generic tree following the MIT profile library syntax so that relations
+// such as auth_to_local can be looked up.
+
+var errProfileSyntax = errors.New("profile syntax error")
+
+type profileRelation struct {
+	tag     string
+	value   string
+	section *profileSection
+	final   bool
+}
+
+type profileSection struct {
+	relations []profileRelation
+	final     bool
+}
+
+type profile struct {
+	root profileSection
+}
+
+func (s *profileSection) get(tag string) []profileRelation {
+	var relations []profileRelation
+
+	for _, r := range s.relations {
+		if r.tag == tag {
+			relations = append(relations, r)
+
+			if r.final {
+				break
+			}
+		}
+	}
+
+	return relations
+}
+
+// subsection returns the subsection for tag. If the tag is repeated, for
+// example because it appears in more than one file, the subsections are
+// merged in order up to and including the first one marked final.
+func (s *profileSection) subsection(tag string) *profileSection {
+	var sections []*profileSection
+
+	for _, r := range s.get(tag) {
+		if r.section == nil {
+			continue
+		}
+
+		sections = append(sections, r.section)
+
+		if r.section.final {
+			break
+		}
+	}
+
+	switch len(sections) {
+	case 0:
+		return nil
+	case 1:
+		return sections[0]
+	}
+
+	merged := new(profileSection)
+
+	for _, section := range sections {
+		merged.relations = append(merged.relations, section.relations...)
+	}
+
+	merged.final = sections[len(sections)-1].final
+
+	return merged
+}
+
+// lookup walks the profile tree following path and returns the final
+// section, or nil if any element is missing.
+func (p *profile) lookup(path ...string) *profileSection {
+	if p == nil {
+		return nil
+	}
+
+	s := &p.root
+
+	for _, tag := range path {
+		if s = s.subsection(tag); s == nil {
+			return nil
+		}
+	}
+
+	return s
+}
+
+// values returns all of the string values for the relation at the end of
+// path.
+func (p *profile) values(path ...string) []string {
+	if len(path) == 0 {
+		return nil
+	}
+
+	s := p.lookup(path[:len(path)-1]...)
+	if s == nil {
+		return nil
+	}
+
+	var values []string
+
+	for _, r := range s.get(path[len(path)-1]) {
+		if r.section == nil {
+			values = append(values, r.value)
+		}
+	}
+
+	return values
+}
+
+// value returns the first string value for the relation at the end of path.
+func (p *profile) value(path ...string) (string, bool) {
+	if values := p.values(path...); len(values) > 0 {
+		return values[0], true
+	}
+
+	return "", false
+}
+
+func unquoteProfileValue(v string) string {
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return v
+	}
+
+	var b strings.Builder
+
+	escaped := false
+
+	for _, r := range v[1 : len(v)-1] {
+		if escaped {
+			switch r {
+			case 'n':
+				r = '\n'
+			case 't':
+				r = '\t'
+			case 'b':
+				r = '\b'
+			}
+
+			b.WriteRune(r)
+
+			escaped = false
+
+			continue
+		}
+
+		if r == '\\' {
+			escaped = true
+
+			continue
+		}
+
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+const (
+	profileInclude    = "include"
+	profileIncludeDir = "includedir"
+	profileConfSuffix = ".conf"
+	maxIncludeDepth   = 5
+)
+
+// parseState is shared by a file and any files it includes.
+type parseState struct {
+	fs afero.Fs
+	// opened records the top-level sections opened by this file, so that
+	// a section marked final by an earlier file can be ignored
+	opened map[*profileSection]bool
+	depth  int
+}
+
+// parse adds the relations read from r into the profile. Relations from
+// earlier calls take precedence over later ones, matching how the MIT
+// profile library treats multiple files. Any include or includedir
+// directives are read from fsys.
+func (p *profile) parse(fsys afero.Fs, r io.Reader) error {
+	return p.parseState(r, &parseState{fs: fsys, opened: make(map[*profileSection]bool)})
+}
+
+// parseFile adds the relations read from the file at path into the profile.
+func (p *profile) parseFile(fsys afero.Fs, path string) error {
+	return p.parseFileState(path, &parseState{fs: fsys, opened: make(map[*profileSection]bool)})
+}
+
+func (p *profile) parseFileState(path string, state *parseState) error {
+	f, err := state.fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err = p.parseState(f, state); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+// validIncludeName returns true for the file names read by includedir,
+// which are either made up of only alphanumerics, dashes and underscores or
+// end in ".conf".
+func validIncludeName(name string) bool {
+	if strings.HasSuffix(name, profileConfSuffix) {
+		return true
+	}
+
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' {
+			return false
+		}
+	}
+
+	return name != ""
+}
+
+func (p *profile) include(directive, path string, state *parseState) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("%w: %s path must be absolute", errProfileSyntax, directive)
+	}
+
+	if state.depth >= maxIncludeDepth {
+		return fmt.Errorf("%w: too many levels of includes", errProfileSyntax)
+	}
+
+	// Each included file starts afresh, outside of any section
+	include := &parseState{fs: state.fs, opened: state.opened, depth: state.depth + 1}
+
+	if directive == profileInclude {
+		return p.parseFileState(path, include)
+	}
+
+	infos, err := afero.ReadDir(state.fs, path)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(infos))
+
+	for _, info := range infos {
+		if !info.IsDir() && validIncludeName(info.Name()) {
+			names = append(names, info.Name())
+		}
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err = p.parseFileState(filepath.Join(path, name), include); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// openSection returns the top-level section to add relations to.
+func (p *profile) openSection(name string, state *parseState) *profileSection {
+	var current *profileSection
+
+	for _, r := range p.root.relations {
+		if r.tag == name && r.section != nil {
+			current = r.section
+
+			break
+		}
+	}
+
+	switch {
+	case current == nil:
+		current = new(profileSection)
+		p.root.relations = append(p.root.relations, profileRelation{
+			tag:     name,
+			section: current,
+		})
+	case current.final && !state.opened[current]:
+		// Marked final by an earlier file so discard
+		return new(profileSection)
+	}
+
+	state.opened[current] = true
+
+	return current
+}
+
+//nolint:cyclop,funlen,gocognit
+func (p *profile) parseState(r io.Reader, state *parseState) error {
+	var (
+		stack   []*profileSection
+		current *profileSection
+		lineNum int
+	)
+
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		lineNum++
+
+		raw := scanner.Text()
+
+		// Directives must start at the beginning of the line
+		for _, directive := range []string{profileIncludeDir, profileInclude} {
+			if rest, ok := strings.CutPrefix(raw, directive); ok && rest != "" && unicode.IsSpace(rune(rest[0])) {
+				if err := p.include(directive, strings.TrimSpace(rest), state); err != nil {
+					return err
+				}
+
+				raw = ""
+
+				break
+			}
+		}
+
+		line := strings.TrimSpace(raw)
+
+		switch {
+		case line == "", line[0] == '#', line[0] == ';':
+			continue
+		case line[0] == '[':
+			if len(stack) > 0 {
+				return fmt.Errorf("%w: line %d: section header inside subsection", errProfileSyntax, lineNum)
+			}
+
+			end := strings.IndexByte(line, ']')
+			if end < 0 {
+				return fmt.Errorf("%w: line %d: unterminated section header", errProfileSyntax, lineNum)
+			}
+
+			name := strings.TrimSpace(line[1:end])
+			final := strings.HasPrefix(strings.TrimSpace(line[end+1:]), "*")
+
+			current = p.openSection(name, state)
+			current.final = current.final || final
+
+			continue
+		case line[0] == '}':
+			if len(stack) == 0 {
+				return fmt.Errorf("%w: line %d: unmatched '}'", errProfileSyntax, lineNum)
+			}
+
+			current.final = strings.HasPrefix(strings.TrimSpace(line[1:]), "*")
+			current, stack = stack[len(stack)-1], stack[:len(stack)-1]
+
+			continue
+		}
+
+		if current == nil {
+			return fmt.Errorf("%w: line %d: relation outside of section", errProfileSyntax, lineNum)
+		}
+
+		tag, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%w: line %d: missing '='", errProfileSyntax, lineNum)
+		}
+
+		tag, value = strings.TrimSpace(tag), strings.TrimSpace(value)
+
+		final := strings.HasSuffix(tag, "*")
+		tag = strings.TrimSpace(strings.TrimSuffix(tag, "*"))
+
+		if value == "{" {
+			section := new(profileSection)
+			current.relations = append(current.relations, profileRelation{
+				tag:     tag,
+				section: section,
+				final:   final,
+			})
+			stack = append(stack, current)
+			current = section
+
+			continue
+		}
+
+		current.relations = append(current.relations, profileRelation{
+			tag:   tag,
+			value: unquoteProfileValue(value),
+			final: final,
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if len(stack) > 0 {
+		return fmt.Errorf("%w: unterminated subsection", errProfileSyntax)
+	}
+
+	return nil
+}
+
+func parseProfile(fsys afero.Fs, r io.Reader) (*profile, error) {
+	p := new(profile)
+	if err := p.parse(fsys, r); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// gokrb5ListTags are the relations that github.com/jcmturner/gokrb5/v8/config
+// treats as lists. It keeps the last value of any other repeated relation
+// whereas the MIT profile library uses the first.
+//
+//nolint:gochecknoglobals
+var gokrb5ListTags = map[string]bool{
+	"kdc":            true,
+	"admin_server":   true,
+	"kpasswd_server": true,
+	"master_kdc":     true,
+}
+
+// render writes the profile in krb5.conf syntax with any repeated sections
+// merged, so that it can be parsed by gokrb5 with the same meaning.
+func (p *profile) render(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	for i, tag := range p.root.tags() {
+		s := p.root.subsection(tag)
+		if s == nil {
+			continue
+		}
+
+		if i > 0 {
+			fmt.Fprintln(bw)
+		}
+
+		fmt.Fprintf(bw, "[%s]\n", tag)
+		s.render(bw, "  ")
+	}
+
+	return bw.Flush()
+}
+
+// tags returns the unique relation tags in the section in order.
+func (s *profileSection) tags() []string {
+	var (
+		tags []string
+		seen = make(map[string]bool)
+	)
+
+	for _, r := range s.relations {
+		if !seen[r.tag] {
+			seen[r.tag] = true
+			tags = append(tags, r.tag)
+		}
+	}
+
+	return tags
+}
+
+func (s *profileSection) render(w io.Writer, indent string) {
+	for _, tag := range s.tags() {
+		if sub := s.subsection(tag); sub != nil {
+			fmt.Fprintf(w, "%s%s = {\n", indent, tag)
+			sub.render(w, indent+"  ")
+			fmt.Fprintf(w, "%s}\n", indent)
+
+			continue
+		}
+
+		for _, r := range s.get(tag) {
+			fmt.Fprintf(w, "%s%s = %s\n", indent, tag, r.value)
+
+			if !gokrb5ListTags[tag] {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,444 @@
+package gssapi
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	ianaflags "github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// RefreshEventType describes what happened during a credential refresh.
+type RefreshEventType int
+
+const (
+	// RefreshAcquired indicates a new TGT was obtained by logging in with
+	// a password or keytab.
+	RefreshAcquired RefreshEventType = iota
+	// RefreshRenewed indicates the existing TGT was renewed.
+	RefreshRenewed
+	// RefreshReloaded indicates the credential cache was re-read after it
+	// was updated by another process.
+	RefreshReloaded
+	// RefreshFailed indicates the TGT could not be refreshed.
+	RefreshFailed
+)
+
+func (t RefreshEventType) String() string {
+	switch t {
+	case RefreshAcquired:
+		return "acquired"
+	case RefreshRenewed:
+		return "renewed"
+	case RefreshReloaded:
+		return "reloaded"
+	case RefreshFailed:
+		return "failed"
+	}
+
+	return fmt.Sprintf("RefreshEventType(%d)", int(t))
+}
+
+// RefreshEvent is passed to the callback configured with WithRefreshCallback
+// whenever the Initiator refreshes its TGT.
+type RefreshEvent struct {
+	Type    RefreshEventType
+	Client  string
+	EndTime time.Time
+	Err     error
+}
+
+var errTGTExpired = errors.New("TGT has expired and cannot be refreshed")
+
+// tgtSession is the TGT held by an Initiator. The gokrb5 client is only used
+// for the AS and TGS exchanges so that the TGT lifecycle can be observed and
+// controlled.
+type tgtSession struct {
+	cname     types.PrincipalName
+	crealm    string
+	ticket    messages.Ticket
+	key       types.EncryptionKey
+	flags     asn1.BitString
+	authTime  time.Time
+	startTime time.Time
+	endTime   time.Time
+	renewTill time.Time
+}
+
+func newTGTSession(cname types.PrincipalName, crealm string, ticket messages.Ticket,
+	part messages.EncKDCRepPart,
+) *tgtSession {
+	return &tgtSession{
+		cname:     cname,
+		crealm:    crealm,
+		ticket:    ticket,
+		key:       part.Key,
+		flags:     part.Flags,
+		authTime:  part.AuthTime,
+		startTime: part.StartTime,
+		endTime:   part.EndTime,
+		renewTill: part.RenewTill,
+	}
+}
+
+func newTGTSessionFromCCache(cache *credentials.CCache) (*tgtSession, error) {
+	spn := types.PrincipalName{
+		NameType:   nametype.KRB_NT_SRV_INST,
+		NameString: []string{"krbtgt", cache.DefaultPrincipal.Realm},
+	}
+
+	cred, ok := cache.GetEntry(spn)
+	if !ok {
+		return nil, errors.New("TGT not found in credential cache")
+	}
+
+	var ticket messages.Ticket
+	if err := ticket.Unmarshal(cred.Ticket); err != nil {
+		return nil, fmt.Errorf("TGT in credential cache is not valid: %w", err)
+	}
+
+	return &tgtSession{
+		cname:     cache.DefaultPrincipal.PrincipalName,
+		crealm:    cache.DefaultPrincipal.Realm,
+		ticket:    ticket,
+		key:       cred.Key,
+		flags:     cred.TicketFlags,
+		authTime:  cred.AuthTime,
+		startTime: cred.StartTime,
+		endTime:   cred.EndTime,
+		renewTill: cred.RenewTill,
+	}, nil
+}
+
+// ticketsFromCCache returns the service tickets in the credential cache so
+// they can be reused.
+func ticketsFromCCache(cache *credentials.CCache) map[string]cachedTicket {
+	tickets := make(map[string]cachedTicket)
+
+	for _, cred := range cache.GetEntries() {
+		var ticket messages.Ticket
+		if err := ticket.Unmarshal(cred.Ticket); err != nil {
+			continue
+		}
+
+		tickets[NewNameFromPrincipal(cred.Server.PrincipalName, cred.Server.Realm).String()] = cachedTicket{
+			ticket: ticket,
+			part: messages.EncKDCRepPart{
+				Key:       cred.Key,
+				Flags:     cred.TicketFlags,
+				AuthTime:  cred.AuthTime,
+				StartTime: cred.StartTime,
+				EndTime:   cred.EndTime,
+				RenewTill: cred.RenewTill,
+				SRealm:    cred.Server.Realm,
+				SName:     cred.Server.PrincipalName,
+			},
+		}
+	}
+
+	return tickets
+}
+
+func (s *tgtSession) credential() (*credentials.Credential, error) {
+	return newCredential(s.cname, s.crealm, s.ticket, messages.EncKDCRepPart{
+		Key:       s.key,
+		Flags:     s.flags,
+		AuthTime:  s.authTime,
+		StartTime: s.startTime,
+		EndTime:   s.endTime,
+		RenewTill: s.renewTill,
+	})
+}
+
+func (s *tgtSession) name() string {
+	return NewNameFromPrincipal(s.cname, s.crealm).String()
+}
+
+// realm returns the realm of the TGT, which is the client realm except for
+// anonymous tickets.
+func (s *tgtSession) realm() string {
+	return s.ticket.Realm
+}
+
+func (s *tgtSession) renewable() bool {
+	return len(s.flags.Bytes) == 4 && types.IsFlagSet(&s.flags, ianaflags.Renewable) && time.Now().Before(s.renewTill)
+}
+
+// needsRefresh returns true once less than a sixth of the TGT lifetime
+// remains, which matches the threshold used by gokrb5.
+func (s *tgtSession) needsRefresh() bool {
+	start := s.startTime
+	if start.IsZero() {
+		start = s.authTime
+	}
+
+	return time.Until(s.endTime) < s.endTime.Sub(start)/6
+}
+
+func (s *tgtSession) expired() bool {
+	return !time.Now().Before(s.endTime)
+}
+
+func (ctx *Initiator) usingCCache() bool {
+	return !ctx.usePassword() && !ctx.useKeytab() && !ctx.useCertificate() && !ctx.anonymous
+}
+
+// notify logs the event and queues it for the callback. The caller must hold
+// ctx.mu.
+func (ctx *Initiator) notify(event RefreshEvent) {
+	if event.Err != nil {
+		ctx.logger.Error(event.Err, "credential refresh", "type", event.Type, "client", event.Client)
+	} else {
+		ctx.logger.Info("credential refresh", "type", event.Type, "client", event.Client, "endtime", event.EndTime)
+	}
+
+	if ctx.refreshCallback != nil {
+		ctx.refreshEvents = append(ctx.refreshEvents, event)
+	}
+}
+
+// dispatchRefreshEvents passes any queued events to the callback. The caller
+// must not hold ctx.mu so that the callback is free to use the Initiator.
+func (ctx *Initiator) dispatchRefreshEvents() {
+	ctx.mu.Lock()
+	events := ctx.refreshEvents
+	ctx.refreshEvents = nil
+	ctx.mu.Unlock()
+
+	for _, event := range events {
+		ctx.refreshCallback(event)
+	}
+}
+
+// login obtains a TGT from the KDC using the password or keytab.
+func (ctx *Initiator) login() error {
+	asRep, err := ctx.asExchange()
+	if err != nil {
+		return err
+	}
+
+	ctx.session = newTGTSession(asRep.CName, asRep.CRealm, asRep.Ticket, asRep.DecryptedEncPart)
+	ctx.storeCredentials()
+
+	return nil
+}
+
+// reload re-reads the credential cache and recreates the client from it.
+func (ctx *Initiator) reload() error {
+	cc, cache, err := ctx.sources.loadCCache(ctx.logger, ctx.profile)
+	if err != nil {
+		return err
+	}
+
+	session, err := newTGTSessionFromCCache(cache)
+	if err != nil {
+		return err
+	}
+
+	cl, err := client.NewFromCCache(cache, ctx.krb5conf, ctx.settings...)
+	if err != nil {
+		return err
+	}
+
+	stamp, err := cc.stamp()
+	if err != nil {
+		return err
+	}
+
+	if ctx.client != nil {
+		ctx.client.Destroy()
+	}
+
+	ctx.client, ctx.session = cl, session
+	ctx.ccache, ctx.ccacheStamp = cc, stamp
+
+	// The credential cache may now be for a different client
+	ctx.tickets = ticketsFromCCache(cache)
+
+	return nil
+}
+
+// renew renews the TGT with the KDC.
+func (ctx *Initiator) renew() error {
+	spn := types.PrincipalName{
+		NameType:   nametype.KRB_NT_SRV_INST,
+		NameString: []string{"krbtgt", ctx.session.realm()},
+	}
+
+	tgsRep, err := ctx.tgsExchange(spn, ctx.session.realm(), ctx.session.ticket, ctx.session.key, true)
+	if err != nil {
+		return err
+	}
+
+	ctx.session = newTGTSession(ctx.session.cname, ctx.session.crealm, tgsRep.Ticket, tgsRep.DecryptedEncPart)
+	ctx.storeCredentials()
+
+	return nil
+}
+
+func (ctx *Initiator) ccacheModified() bool {
+	if !ctx.usingCCache() {
+		return false
+	}
+
+	cc, err := ctx.sources.resolveCCache(ctx.sources.defaultCCacheName(ctx.profile), ctx.profile)
+	if err != nil {
+		return false
+	}
+
+	stamp, err := cc.stamp()
+	if err != nil || stamp == "" {
+		return false
+	}
+
+	return cc.name() != ctx.ccache.name() || stamp != ctx.ccacheStamp
+}
+
+// refresh makes sure the TGT is valid, reloading the credential cache if it
+// has changed, then renewing the TGT if it is close to expiry and finally
+// falling back to logging in again with the password or keytab. The caller
+// must hold ctx.mu.
+//
+//nolint:cyclop,funlen
+func (ctx *Initiator) refresh() error {
+	if ctx.ccacheModified() {
+		if err := ctx.reload(); err != nil {
+			ctx.notify(RefreshEvent{Type: RefreshFailed, Client: ctx.session.name(), Err: err})
+		} else {
+			ctx.notify(RefreshEvent{Type: RefreshReloaded, Client: ctx.session.name(), EndTime: ctx.session.endTime})
+		}
+	}
+
+	if !ctx.session.needsRefresh() {
+		return nil
+	}
+
+	var errs error
+
+	if ctx.session.renewable() {
+		err := ctx.renew()
+		if err == nil {
+			ctx.notify(RefreshEvent{Type: RefreshRenewed, Client: ctx.session.name(), EndTime: ctx.session.endTime})
+
+			return nil
+		}
+
+		errs = errors.Join(errs, err)
+	}
+
+	if !ctx.usingCCache() {
+		err := ctx.login()
+		if err == nil {
+			ctx.notify(RefreshEvent{Type: RefreshAcquired, Client: ctx.session.name(), EndTime: ctx.session.endTime})
+
+			return nil
+		}
+
+		errs = errors.Join(errs, err)
+	}
+
+	if ctx.session.expired() {
+		errs = errors.Join(errs, errTGTExpired)
+	}
+
+	if errs != nil {
+		ctx.notify(RefreshEvent{Type: RefreshFailed, Client: ctx.session.name(), Err: errs})
+	}
+
+	if ctx.session.expired() {
+		return errs
+	}
+
+	// The TGT is still usable so don't fail the caller yet
+	return nil
+}
+
+func (ctx *Initiator) refreshLoop(interval time.Duration) {
+	defer close(ctx.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx.mu.Lock()
+			_ = ctx.refresh()
+			ctx.mu.Unlock()
+
+			ctx.dispatchRefreshEvents()
+		case <-ctx.stop:
+			return
+		}
+	}
+}
+
+// cachedTicket is a service ticket along with its encrypted part.
+type cachedTicket struct {
+	ticket messages.Ticket
+	part   messages.EncKDCRepPart
+}
+
+// serviceTicket returns a service ticket for the target, reusing a previous
+// ticket for the same target until it expires. If the target is in a
+// different realm then a cross-realm TGT is obtained first.
+func (ctx *Initiator) serviceTicket(target *Name) (messages.Ticket, messages.EncKDCRepPart, error) {
+	spn := target.PrincipalName()
+
+	// The realm is part of the name so the same service in different
+	// realms has different entries
+	name := target.String()
+
+	if cached, ok := ctx.tickets[name]; ok && time.Now().Before(cached.part.EndTime) {
+		return cached.ticket, cached.part, nil
+	}
+
+	var creds []*credentials.Credential
+
+	realm, tgt, key := ctx.session.realm(), ctx.session.ticket, ctx.session.key
+
+	if target.Realm() != realm {
+		krbtgt := types.PrincipalName{
+			NameType:   nametype.KRB_NT_SRV_INST,
+			NameString: []string{"krbtgt", target.Realm()},
+		}
+
+		tgsRep, err := ctx.tgsExchange(krbtgt, realm, tgt, key, false)
+		if err != nil {
+			return messages.Ticket{}, messages.EncKDCRepPart{}, err
+		}
+
+		if cred, err := newCredential(ctx.session.cname, ctx.session.crealm, tgsRep.Ticket,
+			tgsRep.DecryptedEncPart); err == nil {
+			creds = append(creds, cred)
+		}
+
+		realm, tgt, key = target.Realm(), tgsRep.Ticket, tgsRep.DecryptedEncPart.Key
+	}
+
+	tgsRep, err := ctx.tgsExchange(spn, realm, tgt, key, false)
+	if err != nil {
+		return messages.Ticket{}, messages.EncKDCRepPart{}, err
+	}
+
+	if cred, err := newCredential(ctx.session.cname, ctx.session.crealm, tgsRep.Ticket,
+		tgsRep.DecryptedEncPart); err == nil {
+		creds = append(creds, cred)
+	}
+
+	ctx.storeCredentials(creds...)
+
+	if ctx.tickets == nil {
+		ctx.tickets = make(map[string]cachedTicket)
+	}
+
+	ctx.tickets[name] = cachedTicket{ticket: tgsRep.Ticket, part: tgsRep.DecryptedEncPart}
+
+	return tgsRep.Ticket, tgsRep.DecryptedEncPart, nil
+}
@@ -0,0 +1,119 @@
+package gssapi
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/jcmturner/gofork/encoding/asn1"
+	ianaflags "github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTGTSession(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+
+	flags := asn1.BitString{Bytes: make([]byte, 4), BitLength: 32}
+	types.SetFlag(&flags, ianaflags.Renewable)
+
+	tables := []struct {
+		name         string
+		session      tgtSession
+		needsRefresh bool
+		renewable    bool
+		expired      bool
+	}{
+		{
+			"fresh",
+			tgtSession{authTime: now, endTime: now.Add(10 * time.Hour)},
+			false,
+			false,
+			false,
+		},
+		{
+			"stale",
+			tgtSession{authTime: now.Add(-9 * time.Hour), endTime: now.Add(time.Hour)},
+			true,
+			false,
+			false,
+		},
+		{
+			"renewable",
+			tgtSession{
+				authTime:  now.Add(-9 * time.Hour),
+				startTime: now.Add(-9 * time.Hour),
+				endTime:   now.Add(time.Hour),
+				renewTill: now.Add(24 * time.Hour),
+				flags:     flags,
+			},
+			true,
+			true,
+			false,
+		},
+		{
+			"expired",
+			tgtSession{
+				authTime:  now.Add(-10 * time.Hour),
+				endTime:   now.Add(-time.Minute),
+				renewTill: now.Add(-time.Minute),
+				flags:     flags,
+			},
+			true,
+			false,
+			true,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, table.needsRefresh, table.session.needsRefresh())
+			assert.Equal(t, table.renewable, table.session.renewable())
+			assert.Equal(t, table.expired, table.session.expired())
+		})
+	}
+}
+
+func TestRefreshEventType(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "renewed", RefreshRenewed.String())
+	assert.Equal(t, "RefreshEventType(42)", RefreshEventType(42).String())
+}
+
+func TestRefreshCallbackUnlocked(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ctx    *Initiator
+		events []RefreshEvent
+	)
+
+	ctx = &Initiator{
+		logger: logr.Discard(),
+		refreshCallback: func(event RefreshEvent) {
+			// The callback must be able to use the Initiator
+			if assert.True(t, ctx.mu.TryLock()) {
+				ctx.mu.Unlock()
+			}
+
+			events = append(events, event)
+		},
+	}
+
+	ctx.mu.Lock()
+	ctx.notify(RefreshEvent{Type: RefreshRenewed, Client: "alice@EXAMPLE.COM"})
+	ctx.notify(RefreshEvent{Type: RefreshFailed, Client: "alice@EXAMPLE.COM", Err: errTGTExpired})
+	ctx.mu.Unlock()
+
+	assert.Empty(t, events)
+
+	ctx.dispatchRefreshEvents()
+
+	assert.Equal(t, []RefreshEventType{RefreshRenewed, RefreshFailed}, []RefreshEventType{events[0].Type, events[1].Type})
+	assert.Empty(t, ctx.refreshEvents)
+}
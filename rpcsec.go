@@ -0,0 +1,892 @@
+package gssapi
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+)
+
+// RPC authentication flavors, as per RFC 5531 and RFC 2203.
+const (
+	// AuthNone is the AUTH_NONE flavor.
+	AuthNone uint32 = 0
+	// AuthRPCSECGSS is the RPCSEC_GSS flavor.
+	AuthRPCSECGSS uint32 = 6
+)
+
+// RPCGSSService is the protection applied to the arguments and results of
+// RPCSEC_GSS data calls, as per RFC 2203.
+type RPCGSSService uint32
+
+const (
+	// RPCGSSServiceNone only authenticates the RPC header.
+	RPCGSSServiceNone RPCGSSService = iota + 1
+	// RPCGSSServiceIntegrity additionally protects the integrity of the
+	// arguments and results with a MIC.
+	RPCGSSServiceIntegrity
+	// RPCGSSServicePrivacy additionally encrypts the arguments and results
+	// with a wrap token.
+	RPCGSSServicePrivacy
+)
+
+// RPCGSSProc is the RPCSEC_GSS procedure in the credential.
+type RPCGSSProc uint32
+
+const (
+	// RPCGSSProcData is a normal RPC call.
+	RPCGSSProcData RPCGSSProc = iota
+	// RPCGSSProcInit starts establishing a context.
+	RPCGSSProcInit
+	// RPCGSSProcContinueInit continues establishing a context.
+	RPCGSSProcContinueInit
+	// RPCGSSProcDestroy destroys an established context.
+	RPCGSSProcDestroy
+)
+
+// RPC auth_stat values used when rejecting RPCSEC_GSS calls, as per RFC 5531
+// and RFC 2203.
+const (
+	AuthStatBadCred        uint32 = 1
+	AuthStatRejectedCred   uint32 = 2
+	AuthStatBadVerf        uint32 = 3
+	AuthStatGSSCredProblem uint32 = 13
+	AuthStatGSSCtxProblem  uint32 = 14
+)
+
+const (
+	rpcGSSVersion1 = 1
+	rpcGSSVersion2 = 2
+
+	rpcCall    = 0
+	rpcVersion = 2
+
+	// rpcGSSMaxSeq is MAXSEQ from RFC 2203, sequence numbers must be
+	// below this.
+	rpcGSSMaxSeq = 0x80000000
+
+	rpcGSSDefaultWindow = 128
+	rpcGSSHandleLength  = 16
+
+	// Limits on the opaque<> fields, the credential and verifier bodies
+	// are limited to 400 bytes by RFC 5531.
+	rpcMaxAuthBytes  = 400
+	rpcMaxTokenBytes = 64 * 1024
+
+	gssStatusComplete       = 0
+	gssStatusContinueNeeded = 1
+	gssStatusFailure        = 13 << 16
+)
+
+var (
+	errXDRShort          = errors.New("xdr data is too short")
+	errXDRTooLong        = errors.New("xdr opaque data is too long")
+	errRPCGSSFlavor      = errors.New("unexpected rpc authentication flavor")
+	errRPCGSSVersion     = errors.New("unsupported rpcsec_gss version")
+	errRPCGSSProc        = errors.New("unexpected rpcsec_gss procedure")
+	errRPCGSSService     = errors.New("unsupported rpcsec_gss service")
+	errRPCGSSSequence    = errors.New("rpcsec_gss sequence number mismatch")
+	errRPCGSSExhausted   = errors.New("rpcsec_gss sequence numbers exhausted")
+	errRPCGSSExpired     = errors.New("rpcsec_gss context has expired")
+	errRPCGSSEstablished = errors.New("rpcsec_gss context already established")
+	errRPCGSSNotSealed   = errors.New("rpcsec_gss privacy results were not encrypted")
+)
+
+// OpaqueAuth is the opaque_auth structure used for RPC credentials and
+// verifiers.
+type OpaqueAuth struct {
+	Flavor uint32
+	Body   []byte
+}
+
+// RPCGSSError is returned by RPCGSSServer when a call must be rejected. If
+// AuthStat is non-zero the call should be denied with an AUTH_ERROR reply
+// carrying it, otherwise the arguments couldn't be decoded and the call
+// should be answered with GARBAGE_ARGS.
+type RPCGSSError struct {
+	AuthStat uint32
+	Err      error
+}
+
+func (e *RPCGSSError) Error() string {
+	if e.AuthStat == 0 {
+		return fmt.Sprintf("rpcsec_gss garbage arguments: %v", e.Err)
+	}
+
+	return fmt.Sprintf("rpcsec_gss auth error %d: %v", e.AuthStat, e.Err)
+}
+
+func (e *RPCGSSError) Unwrap() error {
+	return e.Err
+}
+
+type xdrEncoder struct {
+	b []byte
+}
+
+func (e *xdrEncoder) uint32(v uint32) {
+	e.b = binary.BigEndian.AppendUint32(e.b, v)
+}
+
+func (e *xdrEncoder) opaque(b []byte) {
+	e.uint32(uint32(len(b))) //nolint:gosec
+	e.b = append(e.b, b...)
+	e.b = append(e.b, make([]byte, (4-len(b)%4)%4)...)
+}
+
+type xdrDecoder struct {
+	b []byte
+}
+
+func (d *xdrDecoder) uint32() (uint32, error) {
+	if len(d.b) < 4 {
+		return 0, errXDRShort
+	}
+
+	v := binary.BigEndian.Uint32(d.b)
+	d.b = d.b[4:]
+
+	return v, nil
+}
+
+func (d *xdrDecoder) opaque(limit int) ([]byte, error) {
+	n, err := d.uint32()
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(n) > int64(limit) {
+		return nil, errXDRTooLong
+	}
+
+	padded := int(n) + (4-int(n)%4)%4
+	if len(d.b) < padded {
+		return nil, errXDRShort
+	}
+
+	b := d.b[:n]
+	d.b = d.b[padded:]
+
+	return b, nil
+}
+
+// RPCGSSCred is the RPCSEC_GSS credential carried in the body of an
+// OpaqueAuth with the AuthRPCSECGSS flavor.
+type RPCGSSCred struct {
+	Version uint32
+	Proc    RPCGSSProc
+	SeqNum  uint32
+	Service RPCGSSService
+	Handle  []byte
+}
+
+// Marshal returns the XDR encoding of the credential.
+func (c *RPCGSSCred) Marshal() []byte {
+	e := new(xdrEncoder)
+	e.uint32(c.Version)
+	e.uint32(uint32(c.Proc))
+	e.uint32(c.SeqNum)
+	e.uint32(uint32(c.Service))
+	e.opaque(c.Handle)
+
+	return e.b
+}
+
+// Unmarshal decodes the XDR encoding of the credential. Both version 1 and
+// version 2 credentials are accepted; the RPCSEC_GSSv2 channel binding
+// procedure is not supported.
+func (c *RPCGSSCred) Unmarshal(b []byte) error {
+	d := &xdrDecoder{b: b}
+
+	var (
+		v   [4]uint32
+		err error
+	)
+
+	for i := range v {
+		if v[i], err = d.uint32(); err != nil {
+			return err
+		}
+	}
+
+	if c.Handle, err = d.opaque(rpcMaxAuthBytes); err != nil {
+		return err
+	}
+
+	c.Version, c.Proc, c.SeqNum, c.Service = v[0], RPCGSSProc(v[1]), v[2], RPCGSSService(v[3])
+
+	switch {
+	case c.Version != rpcGSSVersion1 && c.Version != rpcGSSVersion2:
+		return errRPCGSSVersion
+	case c.Proc > RPCGSSProcDestroy:
+		return errRPCGSSProc
+	case c.Service < RPCGSSServiceNone || c.Service > RPCGSSServicePrivacy:
+		return errRPCGSSService
+	}
+
+	return nil
+}
+
+// opaqueAuth returns the credential wrapped as an OpaqueAuth.
+func (c *RPCGSSCred) opaqueAuth() OpaqueAuth {
+	return OpaqueAuth{Flavor: AuthRPCSECGSS, Body: c.Marshal()}
+}
+
+// rpcGSSInitRes is the rpc_gss_init_res structure returned by the control
+// procedures.
+type rpcGSSInitRes struct {
+	handle []byte
+	major  uint32
+	minor  uint32
+	window uint32
+	token  []byte
+}
+
+func (r *rpcGSSInitRes) marshal() []byte {
+	e := new(xdrEncoder)
+	e.opaque(r.handle)
+	e.uint32(r.major)
+	e.uint32(r.minor)
+	e.uint32(r.window)
+	e.opaque(r.token)
+
+	return e.b
+}
+
+func (r *rpcGSSInitRes) unmarshal(b []byte) error {
+	d := &xdrDecoder{b: b}
+
+	var err error
+
+	if r.handle, err = d.opaque(rpcMaxAuthBytes); err != nil {
+		return err
+	}
+
+	for _, v := range []*uint32{&r.major, &r.minor, &r.window} {
+		if *v, err = d.uint32(); err != nil {
+			return err
+		}
+	}
+
+	r.token, err = d.opaque(rpcMaxTokenBytes)
+
+	return err
+}
+
+// rpcHeader returns the XDR encoding of the RPC call header from the xid up
+// to and including the credential, which is covered by the verifier.
+func rpcHeader(xid, prog, vers, proc uint32, cred OpaqueAuth) []byte {
+	e := new(xdrEncoder)
+	e.uint32(xid)
+	e.uint32(rpcCall)
+	e.uint32(rpcVersion)
+	e.uint32(prog)
+	e.uint32(vers)
+	e.uint32(proc)
+	e.uint32(cred.Flavor)
+	e.opaque(cred.Body)
+
+	return e.b
+}
+
+func xdrUint32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+// rpcGSSProtect applies the service to the arguments or results of a data
+// call.
+func rpcGSSProtect(ctx *context, service RPCGSSService, seqNum uint32, body []byte) ([]byte, error) {
+	if service == RPCGSSServiceNone {
+		return body, nil
+	}
+
+	data := append(xdrUint32(seqNum), body...)
+	e := new(xdrEncoder)
+
+	if service == RPCGSSServicePrivacy {
+		token, err := ctx.Wrap(data, true)
+		if err != nil {
+			return nil, err
+		}
+
+		e.opaque(token)
+
+		return e.b, nil
+	}
+
+	mic, err := ctx.MakeSignature(data)
+	if err != nil {
+		return nil, err
+	}
+
+	e.opaque(data)
+	e.opaque(mic)
+
+	return e.b, nil
+}
+
+// rpcGSSUnprotect reverses rpcGSSProtect, checking the embedded sequence
+// number matches the one in the credential.
+func rpcGSSUnprotect(ctx *context, service RPCGSSService, seqNum uint32, body []byte) ([]byte, error) {
+	if service == RPCGSSServiceNone {
+		return body, nil
+	}
+
+	var (
+		d    = &xdrDecoder{b: body}
+		data []byte
+		err  error
+	)
+
+	if service == RPCGSSServicePrivacy {
+		var token []byte
+		if token, err = d.opaque(len(body)); err != nil {
+			return nil, err
+		}
+
+		var sealed bool
+		if data, sealed, err = ctx.Unwrap(token); err != nil {
+			return nil, err
+		}
+
+		if !sealed {
+			return nil, errRPCGSSNotSealed
+		}
+	} else {
+		if data, err = d.opaque(len(body)); err != nil {
+			return nil, err
+		}
+
+		var mic []byte
+		if mic, err = d.opaque(len(body)); err != nil {
+			return nil, err
+		}
+
+		if err = ctx.VerifySignature(data, mic); err != nil {
+			return nil, err
+		}
+	}
+
+	d = &xdrDecoder{b: data}
+
+	n, err := d.uint32()
+	if err != nil {
+		return nil, err
+	}
+
+	if n != seqNum {
+		return nil, errRPCGSSSequence
+	}
+
+	return d.b, nil
+}
+
+// RPCGSSClient is the client side of RPCSEC_GSS as per RFC 2203. It
+// establishes a context with the server using the control procedures and
+// then protects each call. It doesn't send or receive RPC messages itself,
+// rather it produces the credentials, verifiers and bodies for the caller's
+// RPC implementation to send.
+type RPCGSSClient struct {
+	initiator *Initiator
+	target    string
+	service   RPCGSSService
+
+	mu     sync.Mutex
+	handle []byte
+	window uint32
+	seqNum uint32
+}
+
+// NewRPCGSSClient returns a new RPCGSSClient that establishes a context
+// with target using the Initiator and then protects calls with service. The
+// Initiator must not be used for any other context.
+func NewRPCGSSClient(initiator *Initiator, target string, service RPCGSSService) *RPCGSSClient {
+	return &RPCGSSClient{
+		initiator: initiator,
+		target:    target,
+		service:   service,
+	}
+}
+
+// Window returns the sequence window advertised by the server.
+func (c *RPCGSSClient) Window() uint32 {
+	return c.window
+}
+
+// Establish runs the INIT and CONTINUE_INIT control procedures to establish
+// the context. The call function must send a call to the NULL procedure of
+// the program with the credential, an AUTH_NONE verifier and the arguments,
+// returning the results and verifier from the reply.
+//
+//nolint:cyclop,funlen
+func (c *RPCGSSClient) Establish(call func(cred OpaqueAuth, args []byte) ([]byte, OpaqueAuth, error)) error {
+	if c.initiator.Established() {
+		return errRPCGSSEstablished
+	}
+
+	flags := gssapi.ContextFlagMutual | gssapi.ContextFlagInteg
+	if c.service == RPCGSSServicePrivacy {
+		flags |= gssapi.ContextFlagConf
+	}
+
+	output, _, err := c.initiator.Initiate(c.target, flags, nil)
+	if err != nil {
+		return err
+	}
+
+	proc := RPCGSSProcInit
+
+	for {
+		cred := RPCGSSCred{
+			Version: rpcGSSVersion1,
+			Proc:    proc,
+			Service: c.service,
+			Handle:  c.handle,
+		}
+
+		e := new(xdrEncoder)
+		e.opaque(output)
+
+		results, verf, err := call(cred.opaqueAuth(), e.b)
+		if err != nil {
+			return err
+		}
+
+		var res rpcGSSInitRes
+		if err = res.unmarshal(results); err != nil {
+			return err
+		}
+
+		if res.major != gssStatusComplete && res.major != gssStatusContinueNeeded {
+			return fmt.Errorf("rpcsec_gss context establishment failed: major %#x, minor %d", res.major, res.minor)
+		}
+
+		c.handle = bytes.Clone(res.handle)
+
+		if res.major == gssStatusContinueNeeded || !c.initiator.Established() {
+			if output, _, err = c.initiator.Initiate(c.target, flags, res.token); err != nil {
+				return err
+			}
+		}
+
+		if res.major == gssStatusContinueNeeded {
+			proc = RPCGSSProcContinueInit
+
+			continue
+		}
+
+		if !c.initiator.Established() || len(output) != 0 {
+			return errNotEstablished
+		}
+
+		// The server proves it established the context by signing the
+		// sequence window
+		if verf.Flavor != AuthRPCSECGSS {
+			return errRPCGSSFlavor
+		}
+
+		if err = c.initiator.VerifySignature(xdrUint32(res.window), verf.Body); err != nil {
+			return err
+		}
+
+		c.window = res.window
+
+		return nil
+	}
+}
+
+// RPCGSSClientCall is a call protected by RPCGSSClient.
+type RPCGSSClientCall struct {
+	// Credential and Verifier are sent in the call header.
+	Credential OpaqueAuth
+	Verifier   OpaqueAuth
+	// Args is the protected call body.
+	Args []byte
+
+	client  *RPCGSSClient
+	seqNum  uint32
+	service RPCGSSService
+}
+
+// WrapCall returns the credential, verifier and protected arguments for a
+// data call of procedure proc in program prog version vers with the given
+// xid.
+func (c *RPCGSSClient) WrapCall(xid, prog, vers, proc uint32, args []byte) (*RPCGSSClientCall, error) {
+	return c.wrapCall(RPCGSSProcData, xid, prog, vers, proc, args)
+}
+
+// DestroyCall returns the credential and verifier for a call to the NULL
+// procedure of program prog version vers with the given xid that destroys
+// the context on the server. The reply should be checked with UnwrapReply.
+func (c *RPCGSSClient) DestroyCall(xid, prog, vers uint32) (*RPCGSSClientCall, error) {
+	return c.wrapCall(RPCGSSProcDestroy, xid, prog, vers, 0, nil)
+}
+
+func (c *RPCGSSClient) wrapCall(gssProc RPCGSSProc, xid, prog, vers, proc uint32,
+	args []byte,
+) (*RPCGSSClientCall, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.initiator.Established() {
+		return nil, errNotEstablished
+	}
+
+	if c.seqNum+1 >= rpcGSSMaxSeq {
+		return nil, errRPCGSSExhausted
+	}
+
+	c.seqNum++
+
+	cred := RPCGSSCred{
+		Version: rpcGSSVersion1,
+		Proc:    gssProc,
+		SeqNum:  c.seqNum,
+		Service: c.service,
+		Handle:  c.handle,
+	}
+
+	call := &RPCGSSClientCall{
+		Credential: cred.opaqueAuth(),
+		client:     c,
+		seqNum:     cred.SeqNum,
+		service:    cred.Service,
+	}
+
+	mic, err := c.initiator.MakeSignature(rpcHeader(xid, prog, vers, proc, call.Credential))
+	if err != nil {
+		return nil, err
+	}
+
+	call.Verifier = OpaqueAuth{Flavor: AuthRPCSECGSS, Body: mic}
+
+	// The arguments of DESTROY aren't protected
+	if gssProc == RPCGSSProcDestroy {
+		return call, nil
+	}
+
+	if call.Args, err = rpcGSSProtect(&c.initiator.context, call.service, call.seqNum, args); err != nil {
+		return nil, err
+	}
+
+	return call, nil
+}
+
+// UnwrapReply checks the verifier from the reply to the call and returns
+// the unprotected results.
+func (call *RPCGSSClientCall) UnwrapReply(verf OpaqueAuth, results []byte) ([]byte, error) {
+	c := call.client
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if verf.Flavor != AuthRPCSECGSS {
+		return nil, errRPCGSSFlavor
+	}
+
+	if err := c.initiator.VerifySignature(xdrUint32(call.seqNum), verf.Body); err != nil {
+		return nil, err
+	}
+
+	if call.Args == nil {
+		return results, nil
+	}
+
+	return rpcGSSUnprotect(&c.initiator.context, call.service, call.seqNum, results)
+}
+
+// rpcGSSWindow tracks the sequence numbers seen within the window.
+type rpcGSSWindow struct {
+	seen []bool
+	last uint32
+	any  bool
+}
+
+// accept reports whether the sequence number is new and within the window.
+func (w *rpcGSSWindow) accept(seqNum uint32) bool {
+	n := uint32(len(w.seen)) //nolint:gosec
+
+	switch {
+	case !w.any || seqNum > w.last:
+		if w.any {
+			for i, s := w.last+1, seqNum; i != s && i-w.last <= n; i++ {
+				w.seen[i%n] = false
+			}
+		}
+
+		w.seen[seqNum%n] = true
+		w.last = seqNum
+		w.any = true
+
+		return true
+	case w.last-seqNum >= n, w.seen[seqNum%n]:
+		return false
+	default:
+		w.seen[seqNum%n] = true
+
+		return true
+	}
+}
+
+type rpcGSSContext struct {
+	mu       sync.Mutex
+	acceptor *Acceptor
+	window   rpcGSSWindow
+}
+
+// RPCGSSServer is the server side of RPCSEC_GSS as per RFC 2203. It creates
+// an Acceptor for each context established by the control procedures and
+// maintains the sequence window for each.
+type RPCGSSServer struct {
+	options []Option[Acceptor]
+	window  uint32
+
+	mu       sync.Mutex
+	contexts map[string]*rpcGSSContext
+}
+
+// NewRPCGSSServer returns a new RPCGSSServer that advertises a sequence
+// window of window calls, or 128 if zero, and creates Acceptors with the
+// given options.
+func NewRPCGSSServer(window uint32, options ...Option[Acceptor]) *RPCGSSServer {
+	if window == 0 {
+		window = rpcGSSDefaultWindow
+	}
+
+	return &RPCGSSServer{
+		options:  options,
+		window:   window,
+		contexts: make(map[string]*rpcGSSContext),
+	}
+}
+
+// Close destroys all contexts.
+func (s *RPCGSSServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+
+	for handle, c := range s.contexts {
+		errs = append(errs, c.acceptor.Close())
+
+		delete(s.contexts, handle)
+	}
+
+	return errors.Join(errs...)
+}
+
+// RPCGSSServerCall is a call received by RPCGSSServer.
+type RPCGSSServerCall struct {
+	// Control is set for the INIT, CONTINUE_INIT and DESTROY procedures,
+	// which are handled entirely by RPCGSSServer. Results holds the
+	// results to send in the reply.
+	Control bool
+	Results []byte
+	// Verifier is sent in the reply.
+	Verifier OpaqueAuth
+	// Args is the unprotected call body of a data call.
+	Args []byte
+	// PeerName is the authenticated client of a data call.
+	PeerName *Name
+
+	context *rpcGSSContext
+	cred    RPCGSSCred
+}
+
+// WrapReply returns the protected results of a data call.
+func (call *RPCGSSServerCall) WrapReply(results []byte) ([]byte, error) {
+	if call.Control {
+		return nil, errRPCGSSProc
+	}
+
+	call.context.mu.Lock()
+	defer call.context.mu.Unlock()
+
+	return rpcGSSProtect(&call.context.acceptor.context, call.cred.Service, call.cred.SeqNum, results)
+}
+
+// Call processes an RPCSEC_GSS call with the given header fields, credential,
+// verifier and arguments. Errors of type *RPCGSSError describe how the call
+// should be rejected. A nil call and error means the call must be silently
+// discarded, such as a replay or a call that has fallen behind the sequence
+// window.
+//
+//nolint:cyclop,funlen,nilnil
+func (s *RPCGSSServer) Call(xid, prog, vers, proc uint32, cred, verf OpaqueAuth,
+	args []byte,
+) (*RPCGSSServerCall, error) {
+	if cred.Flavor != AuthRPCSECGSS {
+		return nil, &RPCGSSError{AuthStat: AuthStatBadCred, Err: errRPCGSSFlavor}
+	}
+
+	var gc RPCGSSCred
+	if err := gc.Unmarshal(cred.Body); err != nil {
+		return nil, &RPCGSSError{AuthStat: AuthStatBadCred, Err: err}
+	}
+
+	if gc.Proc == RPCGSSProcInit || gc.Proc == RPCGSSProcContinueInit {
+		if proc != 0 {
+			return nil, &RPCGSSError{AuthStat: AuthStatBadCred, Err: errRPCGSSProc}
+		}
+
+		return s.init(gc, args)
+	}
+
+	c := s.lookup(gc.Handle)
+	if c == nil || !c.acceptor.Established() {
+		return nil, &RPCGSSError{AuthStat: AuthStatGSSCredProblem, Err: errNotEstablished}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if expiry := c.acceptor.Expiry(); !expiry.IsZero() && time.Now().After(expiry) {
+		return nil, &RPCGSSError{AuthStat: AuthStatGSSCtxProblem, Err: errRPCGSSExpired}
+	}
+
+	if verf.Flavor != AuthRPCSECGSS {
+		return nil, &RPCGSSError{AuthStat: AuthStatBadVerf, Err: errRPCGSSFlavor}
+	}
+
+	if err := c.acceptor.VerifySignature(rpcHeader(xid, prog, vers, proc, cred), verf.Body); err != nil {
+		return nil, &RPCGSSError{AuthStat: AuthStatGSSCredProblem, Err: err}
+	}
+
+	if gc.SeqNum >= rpcGSSMaxSeq {
+		return nil, &RPCGSSError{AuthStat: AuthStatGSSCtxProblem, Err: errRPCGSSExhausted}
+	}
+
+	if !c.window.accept(gc.SeqNum) {
+		return nil, nil
+	}
+
+	mic, err := c.acceptor.MakeSignature(xdrUint32(gc.SeqNum))
+	if err != nil {
+		return nil, err
+	}
+
+	call := &RPCGSSServerCall{
+		Verifier: OpaqueAuth{Flavor: AuthRPCSECGSS, Body: mic},
+		PeerName: c.acceptor.PeerName(),
+		context:  c,
+		cred:     gc,
+	}
+
+	if gc.Proc == RPCGSSProcDestroy {
+		s.remove(gc.Handle)
+
+		call.Control = true
+
+		return call, nil
+	}
+
+	if call.Args, err = rpcGSSUnprotect(&c.acceptor.context, gc.Service, gc.SeqNum, args); err != nil {
+		return nil, &RPCGSSError{Err: err}
+	}
+
+	return call, nil
+}
+
+//nolint:cyclop,funlen
+func (s *RPCGSSServer) init(gc RPCGSSCred, args []byte) (*RPCGSSServerCall, error) {
+	d := &xdrDecoder{b: args}
+
+	token, err := d.opaque(rpcMaxTokenBytes)
+	if err != nil {
+		return nil, &RPCGSSError{Err: err}
+	}
+
+	var c *rpcGSSContext
+
+	if gc.Proc == RPCGSSProcInit {
+		acceptor, err := NewAcceptor(s.options...)
+		if err != nil {
+			return nil, err
+		}
+
+		handle := make([]byte, rpcGSSHandleLength)
+		if _, err = rand.Read(handle); err != nil {
+			return nil, err
+		}
+
+		gc.Handle = handle
+		c = &rpcGSSContext{
+			acceptor: acceptor,
+			window:   rpcGSSWindow{seen: make([]bool, s.window)},
+		}
+	} else if c = s.lookup(gc.Handle); c == nil || c.acceptor.Established() {
+		return nil, &RPCGSSError{AuthStat: AuthStatGSSCredProblem, Err: errRPCGSSProc}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	call := &RPCGSSServerCall{
+		Control:  true,
+		Verifier: OpaqueAuth{Flavor: AuthNone},
+	}
+
+	output, cont, err := c.acceptor.Accept(token)
+	if err != nil {
+		_ = c.acceptor.Close()
+
+		s.remove(gc.Handle)
+
+		call.Results = (&rpcGSSInitRes{major: gssStatusFailure, token: output}).marshal()
+
+		return call, nil
+	}
+
+	s.mu.Lock()
+	s.contexts[string(gc.Handle)] = c
+	s.mu.Unlock()
+
+	res := rpcGSSInitRes{
+		handle: gc.Handle,
+		major:  gssStatusComplete,
+		token:  output,
+	}
+
+	if cont || !c.acceptor.Established() {
+		res.major = gssStatusContinueNeeded
+	} else {
+		res.window = s.window
+
+		mic, err := c.acceptor.MakeSignature(xdrUint32(s.window))
+		if err != nil {
+			s.remove(gc.Handle)
+
+			return nil, err
+		}
+
+		call.Verifier = OpaqueAuth{Flavor: AuthRPCSECGSS, Body: mic}
+	}
+
+	call.Results = res.marshal()
+
+	return call, nil
+}
+
+func (s *RPCGSSServer) lookup(handle []byte) *rpcGSSContext {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.contexts[string(handle)]
+}
+
+func (s *RPCGSSServer) remove(handle []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, ok := s.contexts[string(handle)]; ok {
+		_ = c.acceptor.Close()
+
+		delete(s.contexts, string(handle))
+	}
+}
@@ -0,0 +1,180 @@
+package gssapi
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testRPCProg = 100003
+	testRPCVers = 4
+)
+
+func newRPCGSSPair(t *testing.T, service RPCGSSService) (*RPCGSSClient, *RPCGSSServer) {
+	t.Helper()
+
+	newTestEnvironment(t, etypeID.AES256_CTS_HMAC_SHA1_96)
+
+	initiator, err := NewInitiator()
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = initiator.Close() })
+
+	server := NewRPCGSSServer(0)
+
+	t.Cleanup(func() { _ = server.Close() })
+
+	client := NewRPCGSSClient(initiator, testService, service)
+
+	var xid uint32
+
+	require.NoError(t, client.Establish(func(cred OpaqueAuth, args []byte) ([]byte, OpaqueAuth, error) {
+		xid++
+
+		call, err := server.Call(xid, testRPCProg, testRPCVers, 0, cred, OpaqueAuth{Flavor: AuthNone}, args)
+		if err != nil {
+			return nil, OpaqueAuth{}, err
+		}
+
+		assert.True(t, call.Control)
+
+		return call.Results, call.Verifier, nil
+	}))
+
+	assert.Equal(t, uint32(rpcGSSDefaultWindow), client.Window())
+
+	return client, server
+}
+
+//nolint:funlen,paralleltest
+func TestRPCGSS(t *testing.T) {
+	tables := []struct {
+		name    string
+		service RPCGSSService
+	}{
+		{"none", RPCGSSServiceNone},
+		{"integrity", RPCGSSServiceIntegrity},
+		{"privacy", RPCGSSServicePrivacy},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			client, server := newRPCGSSPair(t, table.service)
+
+			args := []byte("lookup arguments")
+
+			c, err := client.WrapCall(100, testRPCProg, testRPCVers, 3, args)
+			require.NoError(t, err)
+
+			assert.Equal(t, table.service != RPCGSSServicePrivacy,
+				bytes.Contains(c.Args, args))
+
+			s, err := server.Call(100, testRPCProg, testRPCVers, 3, c.Credential, c.Verifier, c.Args)
+			require.NoError(t, err)
+			require.NotNil(t, s)
+			assert.False(t, s.Control)
+			assert.Equal(t, args, s.Args)
+			assert.Equal(t, testClient, s.PeerName.PrincipalName().PrincipalNameString())
+
+			results, err := s.WrapReply([]byte("lookup results"))
+			require.NoError(t, err)
+
+			b, err := c.UnwrapReply(s.Verifier, results)
+			require.NoError(t, err)
+			assert.Equal(t, []byte("lookup results"), b)
+
+			// Replays are silently discarded
+			s, err = server.Call(100, testRPCProg, testRPCVers, 3, c.Credential, c.Verifier, c.Args)
+			require.NoError(t, err)
+			assert.Nil(t, s)
+
+			// The verifier covers the header
+			c, err = client.WrapCall(101, testRPCProg, testRPCVers, 3, args)
+			require.NoError(t, err)
+
+			_, err = server.Call(101, testRPCProg, testRPCVers, 4, c.Credential, c.Verifier, c.Args)
+
+			var rpcErr *RPCGSSError
+
+			require.ErrorAs(t, err, &rpcErr)
+			assert.Equal(t, AuthStatGSSCredProblem, rpcErr.AuthStat)
+
+			c, err = client.DestroyCall(102, testRPCProg, testRPCVers)
+			require.NoError(t, err)
+
+			s, err = server.Call(102, testRPCProg, testRPCVers, 0, c.Credential, c.Verifier, c.Args)
+			require.NoError(t, err)
+			assert.True(t, s.Control)
+
+			_, err = c.UnwrapReply(s.Verifier, s.Results)
+			require.NoError(t, err)
+
+			c, err = client.WrapCall(103, testRPCProg, testRPCVers, 3, args)
+			require.NoError(t, err)
+
+			_, err = server.Call(103, testRPCProg, testRPCVers, 3, c.Credential, c.Verifier, c.Args)
+			require.ErrorAs(t, err, &rpcErr)
+			assert.Equal(t, AuthStatGSSCredProblem, rpcErr.AuthStat)
+		})
+	}
+}
+
+func TestRPCGSSWindow(t *testing.T) {
+	t.Parallel()
+
+	w := rpcGSSWindow{seen: make([]bool, 4)}
+
+	assert.True(t, w.accept(10))
+	assert.False(t, w.accept(10))
+	assert.True(t, w.accept(8))
+	assert.True(t, w.accept(12))
+	assert.True(t, w.accept(9))
+	assert.False(t, w.accept(8))
+	assert.True(t, w.accept(11))
+	// Below the window
+	assert.False(t, w.accept(7))
+	assert.True(t, w.accept(100))
+	assert.True(t, w.accept(97))
+	assert.False(t, w.accept(96))
+	assert.False(t, w.accept(12))
+}
+
+func TestRPCGSSCred(t *testing.T) {
+	t.Parallel()
+
+	cred := RPCGSSCred{
+		Version: rpcGSSVersion1,
+		Proc:    RPCGSSProcData,
+		SeqNum:  42,
+		Service: RPCGSSServiceIntegrity,
+		Handle:  []byte{1, 2, 3, 4, 5},
+	}
+
+	b := cred.Marshal()
+	assert.Len(t, b, 28)
+
+	var c RPCGSSCred
+	require.NoError(t, c.Unmarshal(b))
+	assert.Equal(t, cred, c)
+
+	assert.ErrorIs(t, c.Unmarshal(b[:20]), errXDRShort)
+
+	cred.Version = 3
+	assert.ErrorIs(t, c.Unmarshal(cred.Marshal()), errRPCGSSVersion)
+
+	cred.Version, cred.Service = rpcGSSVersion1, 4
+	assert.ErrorIs(t, c.Unmarshal(cred.Marshal()), errRPCGSSService)
+
+	server := NewRPCGSSServer(0)
+
+	_, err := server.Call(1, testRPCProg, testRPCVers, 0, OpaqueAuth{Flavor: AuthNone}, OpaqueAuth{}, nil)
+
+	var rpcErr *RPCGSSError
+
+	require.ErrorAs(t, err, &rpcErr)
+	assert.Equal(t, AuthStatBadCred, rpcErr.AuthStat)
+}
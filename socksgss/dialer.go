@@ -0,0 +1,249 @@
+package socksgss
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/bodgit/gssapi"
+	"github.com/bodgit/gssapi/internal/deadline"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	socksVersion = 0x05
+
+	commandConnect = 0x01
+
+	addressIPv4   = 0x01
+	addressDomain = 0x03
+	addressIPv6   = 0x04
+
+	replySucceeded = 0x00
+
+	defaultService = "rcmd"
+)
+
+var (
+	errBadSOCKSVersion    = errors.New("unsupported SOCKS version")
+	errNoAcceptableMethod = errors.New("proxy does not accept GSS-API authentication")
+	errUnsupportedNetwork = errors.New("unsupported network")
+	errHostTooLong        = errors.New("host name is too long")
+	errBadAddressType     = errors.New("unsupported address type")
+	errRequestFailed      = errors.New("SOCKS request failed")
+)
+
+//nolint:gochecknoglobals
+var replyMessages = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// Dialer connects to addresses through a SOCKS5 proxy that requires GSS-API
+// authentication. It implements both proxy.Dialer and proxy.ContextDialer.
+type Dialer struct {
+	// Level is the protection level requested, the default is
+	// LevelConfidentiality.
+	Level Level
+
+	network string
+	address string
+	service string
+	forward proxy.Dialer
+	options []gssapi.Option[gssapi.Initiator]
+}
+
+// NewDialer returns a Dialer that connects to the proxy at address on
+// network using forward, or proxy.Direct if nil. The proxy is authenticated
+// as the service using an Initiator created with the given options. If
+// service is empty the host-based "rcmd" service of the proxy is used.
+func NewDialer(network, address, service string, forward proxy.Dialer,
+	options ...gssapi.Option[gssapi.Initiator],
+) *Dialer {
+	if forward == nil {
+		forward = proxy.Direct
+	}
+
+	return &Dialer{
+		Level:   LevelConfidentiality,
+		network: network,
+		address: address,
+		service: service,
+		forward: forward,
+		options: options,
+	}
+}
+
+// Dial connects to the address on the named network through the proxy.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address on the named network through the
+// proxy using the provided context. Only TCP networks are supported.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnsupportedNetwork, network)
+	}
+
+	request, err := connectRequest(address)
+	if err != nil {
+		return nil, err
+	}
+
+	service := d.service
+	if service == "" {
+		host, _, err := net.SplitHostPort(d.address)
+		if err != nil {
+			return nil, err
+		}
+
+		service = defaultService + "@" + host
+	}
+
+	var c net.Conn
+
+	if cd, ok := d.forward.(proxy.ContextDialer); ok {
+		c, err = cd.DialContext(ctx, d.network, d.address)
+	} else {
+		c, err = d.forward.Dial(d.network, d.address)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := d.connect(ctx, c, service, request)
+	if err != nil {
+		return nil, errors.Join(err, c.Close())
+	}
+
+	return conn, nil
+}
+
+func (d *Dialer) connect(ctx context.Context, c net.Conn, service string, request []byte) (*Conn, error) {
+	if err := deadline.Run(ctx, c, func() error {
+		if _, err := c.Write([]byte{socksVersion, 1, MethodGSSAPI}); err != nil {
+			return err
+		}
+
+		var b [2]byte
+		if _, err := io.ReadFull(c, b[:]); err != nil {
+			return err
+		}
+
+		switch {
+		case b[0] != socksVersion:
+			return fmt.Errorf("%w: %d", errBadSOCKSVersion, b[0])
+		case b[1] != MethodGSSAPI:
+			return errNoAcceptableMethod
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	conn, err := Authenticate(ctx, c, service, d.Level, d.options...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = deadline.Run(ctx, c, func() error {
+		if _, err := conn.Write(request); err != nil {
+			return err
+		}
+
+		return readReply(conn)
+	}); err != nil {
+		// The caller closes c
+		return nil, errors.Join(err, conn.closer.Close())
+	}
+
+	return conn, nil
+}
+
+// connectRequest returns the CONNECT request for the address.
+func connectRequest(address string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	b := []byte{socksVersion, commandConnect, 0x00}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(append(b, addressIPv4), ip4...)
+		} else {
+			b = append(append(b, addressIPv6), ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errHostTooLong
+		}
+
+		b = append(append(b, addressDomain, byte(len(host))), host...)
+	}
+
+	return binary.BigEndian.AppendUint16(b, uint16(n)), nil
+}
+
+// readReply reads the reply to a request, discarding the bound address.
+func readReply(r io.Reader) error {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return err
+	}
+
+	if b[0] != socksVersion {
+		return fmt.Errorf("%w: %d", errBadSOCKSVersion, b[0])
+	}
+
+	if b[1] != replySucceeded {
+		if message, ok := replyMessages[b[1]]; ok {
+			return fmt.Errorf("%w: %s", errRequestFailed, message)
+		}
+
+		return fmt.Errorf("%w: unknown reply %d", errRequestFailed, b[1])
+	}
+
+	var n int
+
+	switch b[3] {
+	case addressIPv4:
+		n = net.IPv4len
+	case addressIPv6:
+		n = net.IPv6len
+	case addressDomain:
+		if _, err := io.ReadFull(r, b[:1]); err != nil {
+			return err
+		}
+
+		n = int(b[0])
+	default:
+		return fmt.Errorf("%w: %d", errBadAddressType, b[3])
+	}
+
+	// Skip the address and port
+	_, err := io.CopyN(io.Discard, r, int64(n)+2)
+
+	return err
+}
@@ -0,0 +1,320 @@
+// Package socksgss implements the SOCKS Protocol Version 5 GSS-API
+// authentication method described in RFC 1961 using the
+// github.com/bodgit/gssapi package.
+package socksgss
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+
+	"github.com/bodgit/gssapi"
+	"github.com/bodgit/gssapi/internal/deadline"
+	krb5gssapi "github.com/jcmturner/gokrb5/v8/gssapi"
+)
+
+// MethodGSSAPI is the SOCKS5 authentication method number for GSS-API.
+const MethodGSSAPI = 0x01
+
+const (
+	subnegotiationVersion = 0x01
+
+	messageAuthentication = 0x01
+	messageProtection     = 0x02
+	messageEncapsulation  = 0x03
+	messageAbort          = 0xff
+
+	contextFlags = krb5gssapi.ContextFlagMutual | krb5gssapi.ContextFlagConf | krb5gssapi.ContextFlagInteg |
+		krb5gssapi.ContextFlagReplay | krb5gssapi.ContextFlagSequence
+
+	maxTokenLength = math.MaxUint16
+)
+
+var (
+	errBadVersion      = errors.New("unsupported sub-negotiation version")
+	errBadMessageType  = errors.New("unexpected sub-negotiation message type")
+	errAborted         = errors.New("sub-negotiation aborted by peer")
+	errTokenTooLong    = errors.New("token is too long")
+	errBadLevel        = errors.New("unsupported protection level")
+	errConfUnavailable = errors.New("context does not provide confidentiality")
+)
+
+// Level is the per-message protection level negotiated after the context is
+// established.
+type Level byte
+
+const (
+	// LevelIntegrity protects each message with integrity only.
+	LevelIntegrity Level = iota + 1
+	// LevelConfidentiality protects each message with integrity and
+	// confidentiality.
+	LevelConfidentiality
+	// LevelSelective lets the sender choose the protection of each
+	// message. It may be requested by a client but is never chosen by
+	// Accept.
+	LevelSelective
+)
+
+func (l Level) protection() (gssapi.Protection, error) {
+	switch l {
+	case LevelIntegrity:
+		return gssapi.ProtectionIntegrity, nil
+	case LevelConfidentiality:
+		return gssapi.ProtectionConfidentiality, nil
+	case LevelSelective:
+		fallthrough
+	default:
+		return 0, fmt.Errorf("%w: %d", errBadLevel, l)
+	}
+}
+
+// framing frames each token as a sub-negotiation message of the given type.
+type framing struct {
+	messageType byte
+}
+
+func (f framing) ReadToken(r io.Reader, maxLength int) ([]byte, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case b[0] != subnegotiationVersion:
+		return nil, fmt.Errorf("%w: %d", errBadVersion, b[0])
+	case b[1] == messageAbort:
+		return nil, errAborted
+	case b[1] != f.messageType:
+		return nil, fmt.Errorf("%w: %d", errBadMessageType, b[1])
+	}
+
+	if _, err := io.ReadFull(r, b[2:]); err != nil {
+		return nil, err
+	}
+
+	n := int(binary.BigEndian.Uint16(b[2:]))
+	if n > maxLength {
+		return nil, errTokenTooLong
+	}
+
+	token := make([]byte, n)
+	if _, err := io.ReadFull(r, token); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func (f framing) WriteToken(w io.Writer, token []byte) error {
+	if len(token) > maxTokenLength {
+		return errTokenTooLong
+	}
+
+	b := binary.BigEndian.AppendUint16([]byte{subnegotiationVersion, f.messageType}, uint16(len(token))) //nolint:gosec
+	_, err := w.Write(append(b, token...))
+
+	return err
+}
+
+// abort tells the peer the sub-negotiation has failed.
+func abort(w io.Writer) {
+	_, _ = w.Write([]byte{subnegotiationVersion, messageAbort})
+}
+
+type securityContext interface {
+	Wrap(message []byte, conf bool) ([]byte, error)
+	Unwrap(token []byte) ([]byte, bool, error)
+}
+
+func writeLevel(w io.Writer, ctx securityContext, level Level) error {
+	token, err := ctx.Wrap([]byte{byte(level)}, false)
+	if err != nil {
+		return err
+	}
+
+	return framing{messageProtection}.WriteToken(w, token)
+}
+
+func readLevel(r io.Reader, ctx securityContext) (Level, error) {
+	token, err := framing{messageProtection}.ReadToken(r, maxTokenLength)
+	if err != nil {
+		return 0, err
+	}
+
+	b, _, err := ctx.Unwrap(token)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(b) != 1 {
+		return 0, errBadLevel
+	}
+
+	return Level(b[0]), nil
+}
+
+// Conn is a connection protected with the negotiated protection level, once
+// the sub-negotiation is complete. All further SOCKS messages, and the data
+// that follows them, are encapsulated. Closing it also closes the Initiator
+// or Acceptor.
+type Conn struct {
+	*gssapi.Conn
+
+	closer   io.Closer
+	level    Level
+	peerName *gssapi.Name
+}
+
+func newConn[T gssapi.Initiator | gssapi.Acceptor](ctx *T, c net.Conn, level Level) (*gssapi.Conn, error) {
+	protection, err := level.protection()
+	if err != nil {
+		return nil, err
+	}
+
+	return gssapi.NewConn(ctx, c, gssapi.WithFraming[gssapi.Conn](framing{messageEncapsulation}),
+		gssapi.WithProtection[gssapi.Conn](protection), gssapi.WithMaxSendSize[gssapi.Conn](maxTokenLength),
+		gssapi.WithMaxReceiveSize[gssapi.Conn](maxTokenLength))
+}
+
+// Level returns the negotiated protection level.
+func (c *Conn) Level() Level {
+	return c.level
+}
+
+// PeerName returns the authenticated peer.
+func (c *Conn) PeerName() *gssapi.Name {
+	return c.peerName
+}
+
+// Close closes the connection and the Initiator or Acceptor.
+func (c *Conn) Close() error {
+	return errors.Join(c.Conn.Close(), c.closer.Close())
+}
+
+// Authenticate performs the client side of the sub-negotiation on c, once the
+// server has selected MethodGSSAPI. A context is established with the
+// service using an Initiator created with the given options and then the
+// protection level is requested, either LevelIntegrity or
+// LevelConfidentiality. The server may choose a stronger level but not a
+// weaker one.
+func Authenticate(ctx context.Context, c net.Conn, service string, level Level,
+	options ...gssapi.Option[gssapi.Initiator],
+) (*Conn, error) {
+	if _, err := level.protection(); err != nil {
+		return nil, err
+	}
+
+	initiator, err := gssapi.EstablishInitiator(ctx, gssapi.NewTokenReadWriter(c, framing{messageAuthentication}),
+		service, contextFlags, options...)
+	if err != nil {
+		abort(c)
+
+		return nil, err
+	}
+
+	var chosen Level
+
+	if err = deadline.Run(ctx, c, func() error {
+		if err := writeLevel(c, initiator, level); err != nil {
+			return err
+		}
+
+		var err error
+		if chosen, err = readLevel(c, initiator); err != nil {
+			return err
+		}
+
+		if chosen != LevelConfidentiality && chosen != level {
+			abort(c)
+
+			return fmt.Errorf("%w: %d", errBadLevel, chosen)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, errors.Join(err, initiator.Close())
+	}
+
+	gc, err := newConn(initiator, c, chosen)
+	if err != nil {
+		return nil, errors.Join(err, initiator.Close())
+	}
+
+	return &Conn{Conn: gc, closer: initiator, level: chosen, peerName: initiator.PeerName()}, nil
+}
+
+// chooseLevel returns the protection level the server uses given the level
+// requested by the client and the level it requires.
+func chooseLevel(requested, required Level) (Level, error) {
+	switch requested {
+	case LevelIntegrity, LevelConfidentiality:
+	case LevelSelective:
+		requested = LevelConfidentiality
+	default:
+		return 0, fmt.Errorf("%w: %d", errBadLevel, requested)
+	}
+
+	return max(requested, required), nil
+}
+
+// Accept performs the server side of the sub-negotiation on c, once
+// MethodGSSAPI has been selected. A context is accepted from the client
+// using an Acceptor created with the given options and then the protection
+// level is negotiated; the server uses the level requested by the client
+// unless required is stronger. The SOCKS request should then be read from
+// the returned Conn.
+func Accept(ctx context.Context, c net.Conn, required Level,
+	options ...gssapi.Option[gssapi.Acceptor],
+) (*Conn, error) {
+	if _, err := required.protection(); err != nil {
+		return nil, err
+	}
+
+	acceptor, err := gssapi.EstablishAcceptor(ctx, gssapi.NewTokenReadWriter(c, framing{messageAuthentication}),
+		options...)
+	if err != nil {
+		abort(c)
+
+		return nil, err
+	}
+
+	var chosen Level
+
+	if err = deadline.Run(ctx, c, func() error {
+		requested, err := readLevel(c, acceptor)
+		if err != nil {
+			return err
+		}
+
+		if chosen, err = chooseLevel(requested, required); err != nil {
+			abort(c)
+
+			return err
+		}
+
+		if chosen == LevelConfidentiality && acceptor.Inquire().Flags&krb5gssapi.ContextFlagConf == 0 {
+			abort(c)
+
+			return errConfUnavailable
+		}
+
+		return writeLevel(c, acceptor, chosen)
+	}); err != nil {
+		return nil, errors.Join(err, acceptor.Close())
+	}
+
+	gc, err := newConn(acceptor, c, chosen)
+	if err != nil {
+		return nil, errors.Join(err, acceptor.Close())
+	}
+
+	return &Conn{Conn: gc, closer: acceptor, level: chosen, peerName: acceptor.PeerName()}, nil
+}
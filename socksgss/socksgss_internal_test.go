@@ -0,0 +1,176 @@
+package socksgss
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFraming(t *testing.T) {
+	t.Parallel()
+
+	var b bytes.Buffer
+
+	f := framing{messageAuthentication}
+
+	require.NoError(t, f.WriteToken(&b, []byte("token")))
+	assert.Equal(t, []byte{0x01, 0x01, 0x00, 0x05, 't', 'o', 'k', 'e', 'n'}, b.Bytes())
+
+	token, err := f.ReadToken(&b, maxTokenLength)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("token"), token)
+
+	assert.ErrorIs(t, f.WriteToken(&b, make([]byte, maxTokenLength+1)), errTokenTooLong)
+
+	tables := []struct {
+		name  string
+		input []byte
+		err   error
+	}{
+		{"abort", []byte{0x01, 0xff}, errAborted},
+		{"version", []byte{0x05, 0x01, 0x00, 0x00}, errBadVersion},
+		{"type", []byte{0x01, 0x03, 0x00, 0x00}, errBadMessageType},
+		{"too long", []byte{0x01, 0x01, 0x00, 0x05, 't', 'o', 'k', 'e', 'n'}, errTokenTooLong},
+		{"truncated", []byte{0x01, 0x01, 0x00, 0x03, 't'}, io.ErrUnexpectedEOF},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := f.ReadToken(bytes.NewReader(table.input), 4)
+			assert.ErrorIs(t, err, table.err)
+		})
+	}
+}
+
+func TestChooseLevel(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		requested, required, chosen Level
+		err                         error
+	}{
+		{LevelIntegrity, LevelIntegrity, LevelIntegrity, nil},
+		{LevelIntegrity, LevelConfidentiality, LevelConfidentiality, nil},
+		{LevelConfidentiality, LevelIntegrity, LevelConfidentiality, nil},
+		{LevelSelective, LevelIntegrity, LevelConfidentiality, nil},
+		{Level(0), LevelIntegrity, 0, errBadLevel},
+		{Level(4), LevelIntegrity, 0, errBadLevel},
+	}
+
+	for _, table := range tables {
+		chosen, err := chooseLevel(table.requested, table.required)
+		if table.err != nil {
+			assert.ErrorIs(t, err, table.err)
+
+			continue
+		}
+
+		require.NoError(t, err)
+		assert.Equal(t, table.chosen, chosen)
+	}
+}
+
+func TestConnectRequest(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		address string
+		request []byte
+	}{
+		{"192.0.2.1:80", []byte{0x05, 0x01, 0x00, 0x01, 192, 0, 2, 1, 0x00, 0x50}},
+		{"[2001:db8::1]:443", []byte{
+			0x05, 0x01, 0x00, 0x04,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01,
+			0x01, 0xbb,
+		}},
+		{"example.com:22", append(append([]byte{0x05, 0x01, 0x00, 0x03, 11}, "example.com"...), 0x00, 0x16)},
+	}
+
+	for _, table := range tables {
+		request, err := connectRequest(table.address)
+		require.NoError(t, err)
+		assert.Equal(t, table.request, request)
+	}
+
+	_, err := connectRequest("example.com")
+	assert.Error(t, err)
+
+	_, err = connectRequest("example.com:65536")
+	assert.Error(t, err)
+
+	_, err = connectRequest(string(bytes.Repeat([]byte{'a'}, 256)) + ":80")
+	assert.ErrorIs(t, err, errHostTooLong)
+}
+
+func TestReadReply(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		name  string
+		input []byte
+		err   error
+	}{
+		{"ipv4", []byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}, nil},
+		{"domain", []byte{0x05, 0x00, 0x00, 0x03, 1, 'a', 0, 0}, nil},
+		{"refused", []byte{0x05, 0x05, 0x00, 0x01}, errRequestFailed},
+		{"version", []byte{0x04, 0x00, 0x00, 0x01}, errBadSOCKSVersion},
+		{"address type", []byte{0x05, 0x00, 0x00, 0x02}, errBadAddressType},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := bytes.NewReader(table.input)
+
+			err := readReply(r)
+			if table.err != nil {
+				assert.ErrorIs(t, err, table.err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Zero(t, r.Len())
+		})
+	}
+}
+
+type pipeDialer struct {
+	conn net.Conn
+}
+
+func (d pipeDialer) Dial(_, _ string) (net.Conn, error) {
+	return d.conn, nil
+}
+
+func TestDialer(t *testing.T) {
+	t.Parallel()
+
+	client, server := net.Pipe()
+	defer server.Close()
+
+	d := NewDialer("tcp", "proxy.example.com:1080", "", pipeDialer{client})
+
+	_, err := d.Dial("udp", "192.0.2.1:53")
+	require.ErrorIs(t, err, errUnsupportedNetwork)
+
+	go func() {
+		b := make([]byte, 3)
+		if _, err := io.ReadFull(server, b); assert.NoError(t, err) {
+			assert.Equal(t, []byte{0x05, 0x01, MethodGSSAPI}, b)
+		}
+
+		_, _ = server.Write([]byte{0x05, 0xff})
+	}()
+
+	_, err = d.DialContext(context.Background(), "tcp", "192.0.2.1:80")
+	assert.ErrorIs(t, err, errNoAcceptableMethod)
+}
@@ -0,0 +1,146 @@
+package socksgss_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bodgit/gssapi"
+	"github.com/bodgit/gssapi/socksgss"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func environmentVariables(t *testing.T) (string, string, string, string) {
+	t.Helper()
+
+	var values [4]string
+
+	for i, name := range []string{"TEST_HOST", "TEST_REALM", "TEST_USERNAME", "TEST_PASSWORD"} {
+		var ok bool
+		if values[i], ok = os.LookupEnv(name); !ok {
+			t.Fatalf("%s is not set", name)
+		}
+	}
+
+	return values[0], values[1], values[2], values[3]
+}
+
+// serve handles a single SOCKS5 CONNECT request by echoing back the data
+// sent by the client rather than connecting anywhere.
+func serve(t *testing.T, c net.Conn, username string, required socksgss.Level,
+	options ...gssapi.Option[gssapi.Acceptor],
+) {
+	t.Helper()
+
+	defer c.Close()
+
+	b := make([]byte, 3)
+	if _, err := io.ReadFull(c, b); !assert.NoError(t, err) {
+		return
+	}
+
+	if _, err := c.Write([]byte{0x05, socksgss.MethodGSSAPI}); !assert.NoError(t, err) {
+		return
+	}
+
+	conn, err := socksgss.Accept(context.Background(), c, required, options...)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	defer conn.Close()
+
+	assert.True(t, strings.HasPrefix(conn.PeerName().String(), username+"@"))
+
+	// An IPv4 CONNECT request
+	b = make([]byte, 10)
+	if _, err = io.ReadFull(conn, b); !assert.NoError(t, err) {
+		return
+	}
+
+	if _, err = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); !assert.NoError(t, err) {
+		return
+	}
+
+	_, _ = io.Copy(conn, conn)
+}
+
+func TestSOCKS(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	host, realm, username, password := environmentVariables(t)
+
+	service := "host/" + host
+	principal := types.NewPrincipalName(nametype.KRB_NT_SRV_HST, service)
+
+	initiatorOptions := []gssapi.Option[gssapi.Initiator]{
+		gssapi.WithRealm(realm),
+		gssapi.WithUsername(username),
+		gssapi.WithPassword(password),
+	}
+
+	acceptorOptions := []gssapi.Option[gssapi.Acceptor]{
+		gssapi.WithServicePrincipal(&principal),
+		gssapi.WithClockSkew(5 * time.Second),
+	}
+
+	tables := []struct {
+		name                string
+		requested, required socksgss.Level
+	}{
+		{"integrity", socksgss.LevelIntegrity, socksgss.LevelIntegrity},
+		{"confidentiality", socksgss.LevelConfidentiality, socksgss.LevelIntegrity},
+		{"upgraded", socksgss.LevelIntegrity, socksgss.LevelConfidentiality},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+
+			defer listener.Close()
+
+			go func() {
+				c, err := listener.Accept()
+				if assert.NoError(t, err) {
+					serve(t, c, username, table.required, acceptorOptions...)
+				}
+			}()
+
+			d := socksgss.NewDialer("tcp", listener.Addr().String(), service, nil, initiatorOptions...)
+			d.Level = table.requested
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			c, err := d.DialContext(ctx, "tcp", "192.0.2.1:80")
+			require.NoError(t, err)
+
+			defer c.Close()
+
+			assert.Equal(t, max(table.requested, table.required), c.(*socksgss.Conn).Level()) //nolint:forcetypeassert
+
+			_, err = c.Write([]byte("message"))
+			require.NoError(t, err)
+
+			b := make([]byte, 64)
+
+			n, err := c.Read(b)
+			require.NoError(t, err)
+			assert.Equal(t, []byte("message"), b[:n])
+		})
+	}
+}
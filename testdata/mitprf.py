@@ -0,0 +1,70 @@
+"""Generate the gss_pseudo_random known answers used by prf_internal_test.go.
+
+Usage: KRB5_KTNAME=FILE:krb5.keytab python3 mitprf.py token reply input length
+
+The token is an initial context token created by this package's Initiator
+with mutual authentication requested. It's accepted with MIT Kerberos using
+the service keytab, the AP-REP is written to reply so the Initiator can
+complete the context and recover the acceptor subkey, and then the output of
+gss_pseudo_random is printed for GSS_C_PRF_KEY_FULL and GSS_C_PRF_KEY_PARTIAL.
+
+KRB5_CONFIG must set allow_weak_crypto for rc4-hmac and KRB5RCACHETYPE=none
+allows the same token to be accepted more than once.
+"""
+
+import binascii
+import ctypes
+import sys
+
+GSS_C_PRF_KEY_FULL = 0
+GSS_C_PRF_KEY_PARTIAL = 1
+
+
+class Buffer(ctypes.Structure):
+    _fields_ = [("length", ctypes.c_size_t), ("value", ctypes.c_void_p)]
+
+
+def buffer(b):
+    return Buffer(len(b), ctypes.cast(ctypes.create_string_buffer(b, len(b)), ctypes.c_void_p))
+
+
+def main(token, reply, prf_in, length):
+    gss = ctypes.CDLL("libgssapi_krb5.so.2")
+    gss.gss_pseudo_random.argtypes = [
+        ctypes.c_void_p,
+        ctypes.c_void_p,
+        ctypes.c_int,
+        ctypes.c_void_p,
+        ctypes.c_ssize_t,
+        ctypes.c_void_p,
+    ]
+
+    minor = ctypes.c_uint32()
+    ctx = ctypes.c_void_p()
+    output = Buffer()
+
+    with open(token, "rb") as f:
+        input_token = buffer(f.read())
+
+    major = gss.gss_accept_sec_context(ctypes.byref(minor), ctypes.byref(ctx), None, ctypes.byref(input_token),
+                                       None, None, None, ctypes.byref(output), None, None, None)
+    if major != 0:
+        sys.exit("gss_accept_sec_context: 0x%x, %d" % (major, minor.value))
+
+    with open(reply, "wb") as f:
+        f.write(ctypes.string_at(output.value, output.length))
+
+    for name, prf_key in (("full", GSS_C_PRF_KEY_FULL), ("partial", GSS_C_PRF_KEY_PARTIAL)):
+        prf_in_buffer = buffer(prf_in)
+        prf_out = Buffer()
+
+        major = gss.gss_pseudo_random(ctypes.byref(minor), ctx, prf_key, ctypes.byref(prf_in_buffer), length,
+                                      ctypes.byref(prf_out))
+        if major != 0:
+            sys.exit("gss_pseudo_random: 0x%x, %d" % (major, minor.value))
+
+        print(name, binascii.hexlify(ctypes.string_at(prf_out.value, prf_out.length)).decode())
+
+
+if __name__ == "__main__":
+    main(sys.argv[1], sys.argv[2], sys.argv[3].encode(), int(sys.argv[4]))
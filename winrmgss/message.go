@@ -0,0 +1,180 @@
+package winrmgss
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bodgit/gssapi"
+)
+
+const (
+	protocol = "application/HTTP-SPNEGO-session-encrypted"
+	boundary = "Encrypted Boundary"
+
+	octetStream = "\tContent-Type: application/octet-stream\r\n"
+
+	originalContent = "OriginalContent:"
+	lengthParameter = ";Length="
+)
+
+//nolint:gochecknoglobals
+var (
+	encryptedContentType = `multipart/encrypted;protocol="` + protocol + `";boundary="` + boundary + `"`
+
+	partBoundary = []byte("--" + boundary + "\r\n")
+	endBoundary  = []byte("--" + boundary + "--\r\n")
+)
+
+var (
+	errBadMessage     = errors.New("invalid encrypted message")
+	errNotEncrypted   = errors.New("message is not encrypted")
+	errLengthMismatch = errors.New("decrypted message length does not match")
+)
+
+// securityContext is the part of an Initiator or Acceptor used to protect
+// messages.
+type securityContext interface {
+	WrapIOVLength(conf bool, buffers []gssapi.IOVBuffer) error
+	WrapIOV(conf bool, buffers []gssapi.IOVBuffer) error
+	UnwrapIOV(buffers []gssapi.IOVBuffer) (bool, error)
+}
+
+// encryptBody returns the multipart/encrypted body holding body, which has
+// the given content type. The encrypted part is the length of the token
+// header as a 32-bit little-endian integer, the token header, with the
+// trailer rotated into it, and then the encrypted data.
+func encryptBody(ctx securityContext, body []byte, contentType string) ([]byte, error) {
+	buffers := []gssapi.IOVBuffer{
+		{Type: gssapi.IOVBufferTypeHeader},
+		{Type: gssapi.IOVBufferTypeData, Data: bytes.Clone(body)},
+		{Type: gssapi.IOVBufferTypePadding},
+	}
+
+	if err := ctx.WrapIOVLength(true, buffers); err != nil {
+		return nil, err
+	}
+
+	if err := ctx.WrapIOV(true, buffers); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+
+	b.Write(partBoundary)
+	b.WriteString("\tContent-Type: " + protocol + "\r\n")
+	b.WriteString("\t" + originalContent + " type=" + contentType + lengthParameter + strconv.Itoa(len(body)) + "\r\n")
+	b.Write(partBoundary)
+	b.WriteString(octetStream)
+	b.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(buffers[0].Data)))) //nolint:gosec
+
+	for _, buffer := range buffers {
+		b.Write(buffer.Data)
+	}
+
+	b.Write(endBoundary)
+
+	return b.Bytes(), nil
+}
+
+// originalContentType returns the content type and length of the decrypted
+// message from the headers of the first part.
+func originalContentType(header []byte) (string, int, error) {
+	for _, line := range strings.Split(string(header), "\r\n") {
+		value, ok := strings.CutPrefix(strings.TrimSpace(line), originalContent)
+		if !ok {
+			continue
+		}
+
+		value = strings.TrimPrefix(strings.TrimSpace(value), "type=")
+
+		i := strings.LastIndex(value, lengthParameter)
+		if i < 0 {
+			break
+		}
+
+		length, err := strconv.Atoi(value[i+len(lengthParameter):])
+		if err != nil {
+			return "", 0, fmt.Errorf("%w: %w", errBadMessage, err)
+		}
+
+		return value[:i], length, nil
+	}
+
+	return "", 0, fmt.Errorf("%w: no original content", errBadMessage)
+}
+
+func unwrap(ctx securityContext, payload []byte) ([]byte, error) {
+	payload = bytes.TrimPrefix(payload, []byte(octetStream))
+
+	if len(payload) < 4 {
+		return nil, errBadMessage
+	}
+
+	n := uint64(binary.LittleEndian.Uint32(payload))
+	if n > uint64(len(payload)-4) {
+		return nil, errBadMessage
+	}
+
+	buffers := []gssapi.IOVBuffer{
+		{Type: gssapi.IOVBufferTypeHeader, Data: payload[4 : 4+n]},
+		{Type: gssapi.IOVBufferTypeData, Data: bytes.Clone(payload[4+n:])},
+	}
+
+	conf, err := ctx.UnwrapIOV(buffers)
+	if err != nil {
+		return nil, err
+	}
+
+	if !conf {
+		return nil, errNotEncrypted
+	}
+
+	return buffers[1].Data, nil
+}
+
+// decryptBody returns the decrypted message and its content type from a
+// multipart/encrypted body. Each message may be split across several pairs
+// of parts.
+func decryptBody(ctx securityContext, body []byte) ([]byte, string, error) {
+	var parts [][]byte
+
+	for _, part := range bytes.Split(body, partBoundary) {
+		if len(part) > 0 {
+			parts = append(parts, part)
+		}
+	}
+
+	if len(parts) == 0 || len(parts)%2 != 0 {
+		return nil, "", fmt.Errorf("%w: %d parts", errBadMessage, len(parts))
+	}
+
+	var (
+		message []byte
+		typ     string
+	)
+
+	for i := 0; i < len(parts); i += 2 {
+		t, length, err := originalContentType(parts[i])
+		if err != nil {
+			return nil, "", err
+		}
+
+		b, err := unwrap(ctx, bytes.TrimSuffix(parts[i+1], endBoundary))
+		if err != nil {
+			return nil, "", err
+		}
+
+		if len(b) != length {
+			return nil, "", errLengthMismatch
+		}
+
+		message = append(message, b...)
+		typ = t
+	}
+
+	return message, typ, nil
+}
@@ -0,0 +1,299 @@
+// Package winrmgss provides an http.RoundTripper for WinRM over HTTP that
+// authenticates with Kerberos using the github.com/bodgit/gssapi package and
+// encrypts messages as described in MS-WSMV.
+package winrmgss
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bodgit/gssapi"
+	krb5gssapi "github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+const (
+	authorizationHeader = "Authorization"
+	authenticateHeader  = "WWW-Authenticate"
+	contentTypeHeader   = "Content-Type"
+	negotiatePrefix     = "Negotiate "
+
+	contextFlags = krb5gssapi.ContextFlagMutual | krb5gssapi.ContextFlagConf | krb5gssapi.ContextFlagInteg |
+		krb5gssapi.ContextFlagReplay | krb5gssapi.ContextFlagSequence
+
+	defaultService = "HTTP"
+
+	// negTokenRespTag is the first byte of a SPNEGO NegTokenResp, which
+	// the server may wrap the Kerberos AP-REP in.
+	negTokenRespTag = 0xa1
+)
+
+var (
+	errAuthenticationFailed = errors.New("authentication failed")
+	errNoToken              = errors.New("no negotiate token")
+	errNotEstablished       = errors.New("context not established")
+)
+
+// Transport is an http.RoundTripper that authenticates to the server using
+// Negotiate and then encrypts the body of each request, and decrypts the body
+// of each response, using the multipart/encrypted format with the
+// application/HTTP-SPNEGO-session-encrypted protocol.
+//
+// The server ties the context to the underlying connection so requests are
+// sent one at a time and a new context is established if the connection is
+// replaced. The context requires an AES encryption type.
+type Transport struct {
+	service string
+	base    http.RoundTripper
+	options []gssapi.Option[gssapi.Initiator]
+
+	mu        sync.Mutex
+	initiator *gssapi.Initiator
+}
+
+// NewTransport returns a Transport that sends requests using base and
+// authenticates to the service using an Initiator created with the given
+// options. If service is empty the host-based "HTTP" service of the server
+// is used. If base is nil, a clone of http.DefaultTransport limited to one
+// connection per host is used.
+func NewTransport(service string, base http.RoundTripper, options ...gssapi.Option[gssapi.Initiator]) *Transport {
+	if base == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert
+		transport.MaxConnsPerHost = 1
+
+		base = transport
+	}
+
+	return &Transport{
+		service: service,
+		base:    base,
+		options: options,
+	}
+}
+
+// negotiateToken returns the token from the WWW-Authenticate headers, if
+// any, unwrapping it from a SPNEGO NegTokenResp if necessary.
+func negotiateToken(header http.Header) ([]byte, error) {
+	for _, v := range header.Values(authenticateHeader) {
+		if len(v) < len(negotiatePrefix) || !strings.EqualFold(v[:len(negotiatePrefix)], negotiatePrefix) {
+			continue
+		}
+
+		token, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v[len(negotiatePrefix):]))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(token) > 0 && token[0] == negTokenRespTag {
+			var resp spnego.NegTokenResp
+			if err = resp.Unmarshal(token); err != nil {
+				return nil, err
+			}
+
+			token = resp.ResponseToken
+		}
+
+		return token, nil
+	}
+
+	return nil, errNoToken
+}
+
+// authenticate establishes a new context by sending an empty request with a
+// Negotiate token.
+func (t *Transport) authenticate(req *http.Request) (*gssapi.Initiator, error) {
+	initiator, err := gssapi.NewInitiator(t.options...)
+	if err != nil {
+		return nil, err
+	}
+
+	service := t.service
+	if service == "" {
+		service = defaultService + "@" + req.URL.Hostname()
+	}
+
+	output, _, err := initiator.Initiate(service, contextFlags, nil)
+	if err != nil {
+		return nil, errors.Join(err, initiator.Close())
+	}
+
+	areq, err := http.NewRequestWithContext(req.Context(), http.MethodPost, req.URL.String(), http.NoBody)
+	if err != nil {
+		return nil, errors.Join(err, initiator.Close())
+	}
+
+	areq.Header.Set(authorizationHeader, negotiatePrefix+base64.StdEncoding.EncodeToString(output))
+
+	resp, err := t.base.RoundTrip(areq)
+	if err != nil {
+		return nil, errors.Join(err, initiator.Close())
+	}
+
+	// Drain the body so the connection, and with it the context, is reused
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, errors.Join(fmt.Errorf("%w: %s", errAuthenticationFailed, resp.Status), initiator.Close())
+	}
+
+	input, err := negotiateToken(resp.Header)
+	if err != nil {
+		return nil, errors.Join(err, initiator.Close())
+	}
+
+	if _, _, err = initiator.Initiate(service, contextFlags, input); err != nil {
+		return nil, errors.Join(err, initiator.Close())
+	}
+
+	if !initiator.Established() {
+		return nil, errors.Join(errNotEstablished, initiator.Close())
+	}
+
+	return initiator, nil
+}
+
+func (t *Transport) send(req *http.Request, body []byte) (*http.Response, error) {
+	contentType := req.Header.Get(contentTypeHeader)
+	if contentType == "" {
+		contentType = "application/soap+xml;charset=UTF-8"
+	}
+
+	b, err := encryptBody(t.initiator, body, contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	out := req.Clone(req.Context())
+	out.Body = io.NopCloser(bytes.NewReader(b))
+	out.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+	out.ContentLength = int64(len(b))
+	out.Header.Set(contentTypeHeader, encryptedContentType)
+	out.Header.Del(authorizationHeader)
+
+	return t.base.RoundTrip(out)
+}
+
+func (t *Transport) decrypt(resp *http.Response) (*http.Response, error) {
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get(contentTypeHeader))
+	if err != nil || mediaType != "multipart/encrypted" || !strings.EqualFold(params["protocol"], protocol) {
+		return resp, nil //nolint:nilerr
+	}
+
+	b, err := io.ReadAll(resp.Body)
+
+	if cErr := resp.Body.Close(); err == nil {
+		err = cErr
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	message, contentType, err := decryptBody(t.initiator, b)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(message))
+	resp.ContentLength = int64(len(message))
+	resp.Header.Set(contentTypeHeader, contentType)
+	resp.Header.Set("Content-Length", strconv.Itoa(len(message)))
+
+	return resp, nil
+}
+
+func (t *Transport) reset() {
+	if t.initiator != nil {
+		_ = t.initiator.Close()
+		t.initiator = nil
+	}
+}
+
+// RoundTrip sends the request with its body encrypted, establishing a context
+// first if necessary, and returns the response with its body decrypted. If
+// the server no longer recognises the context, such as after the connection
+// was closed, a new context is established and the request is retried once.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+
+	if req.Body != nil {
+		var err error
+
+		body, err = io.ReadAll(req.Body)
+
+		if cErr := req.Body.Close(); err == nil {
+			err = cErr
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for retried := false; ; retried = true {
+		if t.initiator == nil {
+			initiator, err := t.authenticate(req)
+			if err != nil {
+				return nil, err
+			}
+
+			t.initiator = initiator
+		}
+
+		resp, err := t.send(req, body)
+		if err != nil {
+			t.reset()
+
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized {
+			t.reset()
+
+			if retried {
+				return resp, nil
+			}
+
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+
+			continue
+		}
+
+		if resp, err = t.decrypt(resp); err != nil {
+			t.reset()
+
+			return nil, err
+		}
+
+		return resp, nil
+	}
+}
+
+// CloseIdleConnections closes any idle connections of the underlying
+// RoundTripper. As the context is tied to the connection it is also
+// discarded.
+func (t *Transport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.reset()
+
+	if c, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
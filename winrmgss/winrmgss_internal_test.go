@@ -0,0 +1,317 @@
+package winrmgss
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bodgit/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// xorContext "encrypts" by inverting each byte, which is enough to check the
+// message format.
+type xorContext struct{}
+
+var errBadHeader = errors.New("bad header")
+
+func (xorContext) WrapIOVLength(_ bool, buffers []gssapi.IOVBuffer) error {
+	buffers[0].Data = make([]byte, 4)
+
+	return nil
+}
+
+func (xorContext) WrapIOV(_ bool, buffers []gssapi.IOVBuffer) error {
+	copy(buffers[0].Data, "HDR!")
+
+	for i := range buffers[1].Data {
+		buffers[1].Data[i] ^= 0xff
+	}
+
+	return nil
+}
+
+func (xorContext) UnwrapIOV(buffers []gssapi.IOVBuffer) (bool, error) {
+	if string(buffers[0].Data) != "HDR!" {
+		return false, errBadHeader
+	}
+
+	for i := range buffers[1].Data {
+		buffers[1].Data[i] ^= 0xff
+	}
+
+	return true, nil
+}
+
+func TestMessage(t *testing.T) {
+	t.Parallel()
+
+	var ctx xorContext
+
+	b, err := encryptBody(ctx, []byte("<message/>"), "application/soap+xml;charset=UTF-8")
+	require.NoError(t, err)
+
+	assert.Equal(t, "--Encrypted Boundary\r\n"+
+		"\tContent-Type: application/HTTP-SPNEGO-session-encrypted\r\n"+
+		"\tOriginalContent: type=application/soap+xml;charset=UTF-8;Length=10\r\n"+
+		"--Encrypted Boundary\r\n"+
+		"\tContent-Type: application/octet-stream\r\n"+
+		"\x04\x00\x00\x00HDR!\xc3\x92\x9a\x8c\x8c\x9e\x98\x9a\xd0\xc1"+
+		"--Encrypted Boundary--\r\n", string(b))
+
+	message, contentType, err := decryptBody(ctx, b)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("<message/>"), message)
+	assert.Equal(t, "application/soap+xml;charset=UTF-8", contentType)
+
+	first, err := encryptBody(ctx, []byte("<a/>"), "text/xml")
+	require.NoError(t, err)
+
+	second, err := encryptBody(ctx, []byte("<b/>"), "text/xml")
+	require.NoError(t, err)
+
+	message, _, err = decryptBody(ctx, append(bytes.TrimSuffix(first, endBoundary), second...))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("<a/><b/>"), message)
+
+	tables := []struct {
+		name string
+		body string
+		err  error
+	}{
+		{"empty", "", errBadMessage},
+		{"one part", "--Encrypted Boundary\r\n\tOriginalContent: type=text/xml;Length=4\r\n", errBadMessage},
+		{
+			"no original content",
+			"--Encrypted Boundary\r\n\r\n--Encrypted Boundary\r\nHDR!",
+			errBadMessage,
+		},
+		{
+			"bad length",
+			"--Encrypted Boundary\r\n\tOriginalContent: type=text/xml;Length=x\r\n--Encrypted Boundary\r\nHDR!",
+			errBadMessage,
+		},
+		{
+			"header too long",
+			"--Encrypted Boundary\r\n\tOriginalContent: type=text/xml;Length=4\r\n--Encrypted Boundary\r\n" +
+				"\x05\x00\x00\x00HDR!",
+			errBadMessage,
+		},
+		{
+			"length mismatch",
+			"--Encrypted Boundary\r\n\tOriginalContent: type=text/xml;Length=5\r\n--Encrypted Boundary\r\n" +
+				"\x04\x00\x00\x00HDR!\xc3\x9d\xd0\xc1",
+			errLengthMismatch,
+		},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, _, err := decryptBody(ctx, []byte(table.body))
+			assert.ErrorIs(t, err, table.err)
+		})
+	}
+}
+
+func TestNegotiateToken(t *testing.T) {
+	t.Parallel()
+
+	resp, err := (&spnego.NegTokenResp{ResponseToken: []byte("token")}).Marshal()
+	require.NoError(t, err)
+
+	tables := []struct {
+		name  string
+		value string
+		token []byte
+		err   bool
+	}{
+		{"missing", "", nil, true},
+		{"basic", `Basic realm="WSMAN"`, nil, true},
+		{"bad base64", "Negotiate !!!", nil, true},
+		{"raw", "negotiate dG9rZW4=", []byte("token"), false},
+		{"spnego", "Negotiate " + base64.StdEncoding.EncodeToString(resp), []byte("token"), false},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			header := http.Header{}
+			if table.value != "" {
+				header.Set(authenticateHeader, table.value)
+			}
+
+			token, err := negotiateToken(header)
+			if table.err {
+				assert.Error(t, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, table.token, token)
+		})
+	}
+}
+
+func environmentVariables(t *testing.T) (string, string, string, string) {
+	t.Helper()
+
+	var values [4]string
+
+	for i, name := range []string{"TEST_HOST", "TEST_REALM", "TEST_USERNAME", "TEST_PASSWORD"} {
+		var ok bool
+		if values[i], ok = os.LookupEnv(name); !ok {
+			t.Fatalf("%s is not set", name)
+		}
+	}
+
+	return values[0], values[1], values[2], values[3]
+}
+
+// server is a WinRM endpoint that echoes back each decrypted message. It
+// forgets the context once to check the client establishes a new one.
+type server struct {
+	t        *testing.T
+	options  []gssapi.Option[gssapi.Acceptor]
+	mu       sync.Mutex
+	acceptor *gssapi.Acceptor
+	forget   bool
+}
+
+func (s *server) authenticate(w http.ResponseWriter, r *http.Request) {
+	token, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(r.Header.Get(authorizationHeader),
+		negotiatePrefix))
+	if !assert.NoError(s.t, err) {
+		w.WriteHeader(http.StatusBadRequest)
+
+		return
+	}
+
+	acceptor, err := gssapi.NewAcceptor(s.options...)
+	if !assert.NoError(s.t, err) {
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	output, _, err := acceptor.Accept(token)
+	if !assert.NoError(s.t, err) || !assert.True(s.t, acceptor.Established()) {
+		w.WriteHeader(http.StatusUnauthorized)
+
+		return
+	}
+
+	if s.acceptor != nil {
+		_ = s.acceptor.Close()
+	}
+
+	s.acceptor = acceptor
+
+	w.Header().Set(authenticateHeader, negotiatePrefix+base64.StdEncoding.EncodeToString(output))
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.Header.Get(authorizationHeader) != "" {
+		s.authenticate(w, r)
+
+		return
+	}
+
+	if s.acceptor == nil || s.forget {
+		s.forget = false
+		w.WriteHeader(http.StatusUnauthorized)
+
+		return
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if !assert.NoError(s.t, err) {
+		return
+	}
+
+	assert.Equal(s.t, encryptedContentType, r.Header.Get(contentTypeHeader))
+
+	message, contentType, err := decryptBody(s.acceptor, b)
+	if !assert.NoError(s.t, err) {
+		w.WriteHeader(http.StatusBadRequest)
+
+		return
+	}
+
+	if b, err = encryptBody(s.acceptor, message, contentType); !assert.NoError(s.t, err) {
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set(contentTypeHeader, encryptedContentType)
+	_, _ = w.Write(b)
+}
+
+func TestTransport(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	host, realm, username, password := environmentVariables(t)
+
+	service := "host/" + host
+	principal := types.NewPrincipalName(nametype.KRB_NT_SRV_HST, service)
+
+	s := &server{
+		t: t,
+		options: []gssapi.Option[gssapi.Acceptor]{
+			gssapi.WithServicePrincipal(&principal),
+			gssapi.WithClockSkew(5 * time.Second),
+		},
+	}
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	transport := NewTransport(service, nil, gssapi.WithRealm(realm), gssapi.WithUsername(username),
+		gssapi.WithPassword(password))
+	defer transport.CloseIdleConnections()
+
+	client := &http.Client{Transport: transport}
+
+	for i, message := range []string{"<first/>", "<second/>", "<third/>"} {
+		// Make the server forget the context before the last message
+		if i == 2 {
+			s.mu.Lock()
+			s.forget = true
+			s.mu.Unlock()
+		}
+
+		resp, err := client.Post(ts.URL+"/wsman", "application/soap+xml;charset=UTF-8", strings.NewReader(message))
+		require.NoError(t, err)
+
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/soap+xml;charset=UTF-8", resp.Header.Get(contentTypeHeader))
+		assert.Equal(t, message, string(b))
+	}
+}
@@ -0,0 +1,713 @@
+package gssapi
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/crypto/common"
+	"github.com/jcmturner/gokrb5/v8/crypto/etype"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/types"
+)
+
+// IOVBufferType is the type of an IOVBuffer. The values match those used by
+// MIT Kerberos.
+type IOVBufferType int
+
+const (
+	// IOVBufferTypeEmpty buffers are ignored.
+	IOVBufferTypeEmpty IOVBufferType = 0
+	// IOVBufferTypeData buffers are integrity protected and, if
+	// confidentiality is requested, their contents are replaced with the
+	// ciphertext.
+	IOVBufferTypeData IOVBufferType = 1
+	// IOVBufferTypeHeader is the buffer holding the token header.
+	IOVBufferTypeHeader IOVBufferType = 2
+	// IOVBufferTypeTrailer is the buffer holding the token trailer. If it's
+	// omitted the trailer is rotated into the header.
+	IOVBufferTypeTrailer IOVBufferType = 7
+	// IOVBufferTypePadding is the buffer holding any padding, which is
+	// always empty for the supported encryption types.
+	IOVBufferTypePadding IOVBufferType = 9
+	// IOVBufferTypeSignOnly buffers are integrity protected but never
+	// encrypted.
+	IOVBufferTypeSignOnly IOVBufferType = 11
+)
+
+// IOVBuffer is one of the buffers passed to WrapIOV and UnwrapIOV.
+type IOVBuffer struct {
+	Type IOVBufferType
+	Data []byte
+}
+
+const (
+	wrapTokenHeaderLength = 16
+	wrapTokenFiller       = 0xff
+)
+
+var (
+	errWrapUnsupported = errors.New("wrap tokens not supported for encryption type")
+	errBadWrapToken    = errors.New("invalid wrap token")
+	errWrapIntegrity   = errors.New("wrap token integrity verification failed")
+	errIOVBuffers      = errors.New("invalid IOV buffers")
+	errIOVBufferSize   = errors.New("IOV buffer too small")
+)
+
+//nolint:gochecknoglobals
+var wrapTokenID = []byte{0x05, 0x04}
+
+// segment is a region of a wrap token. All segments are covered by the
+// integrity hash but only encrypted segments form the ciphertext.
+type segment struct {
+	b       []byte
+	encrypt bool
+}
+
+// join concatenates the segments, substituting the encrypted segments with
+// consecutive bytes from replace if it's not nil.
+func join(segments []segment, replace []byte) []byte {
+	var b []byte
+
+	for _, s := range segments {
+		if s.encrypt && replace != nil {
+			b, replace = append(b, replace[:len(s.b)]...), replace[len(s.b):]
+
+			continue
+		}
+
+		b = append(b, s.b...)
+	}
+
+	return b
+}
+
+// scatter copies consecutive bytes from b over the encrypted segments.
+func scatter(segments []segment, b []byte) {
+	for _, s := range segments {
+		if s.encrypt {
+			b = b[copy(s.b, b):]
+		}
+	}
+}
+
+// cfxCipher implements the RFC 3961 simplified profile for the AES
+// encryption types over a list of segments, which allows regions to be
+// integrity protected without being encrypted. The ciphertext and plaintext
+// are identical to encrypting the encrypted segments contiguously.
+type cfxCipher struct {
+	e     etype.EType
+	key   []byte
+	usage uint32
+	// etm is set for the RFC 8009 encryption types which compute the
+	// integrity hash over the ciphertext rather than the plaintext
+	etm bool
+}
+
+func newCFXCipher(key types.EncryptionKey, usage uint32) (*cfxCipher, error) {
+	var etm bool
+
+	switch key.KeyType {
+	case etypeID.AES128_CTS_HMAC_SHA1_96, etypeID.AES256_CTS_HMAC_SHA1_96:
+	case etypeID.AES128_CTS_HMAC_SHA256_128, etypeID.AES256_CTS_HMAC_SHA384_192:
+		etm = true
+	default:
+		return nil, errWrapUnsupported
+	}
+
+	e, err := crypto.GetEtype(key.KeyType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cfxCipher{
+		e:     e,
+		key:   key.KeyValue,
+		usage: usage,
+		etm:   etm,
+	}, nil
+}
+
+func (c *cfxCipher) confounderLength() int {
+	return c.e.GetConfounderByteSize()
+}
+
+func (c *cfxCipher) hashLength() int {
+	return c.e.GetHMACBitLength() / 8
+}
+
+// lengths returns the length of the header and trailer for a wrap token. If
+// there is no trailer then it's rotated into the header and the rotation is
+// returned.
+func (c *cfxCipher) lengths(conf, trailer bool) (int, int, int) {
+	header, tail := wrapTokenHeaderLength, c.hashLength()
+
+	if conf {
+		header += c.confounderLength()
+		tail += wrapTokenHeaderLength
+	}
+
+	if trailer {
+		return header, tail, 0
+	}
+
+	return header + tail, 0, tail
+}
+
+// seal encrypts the encrypted segments, copying the ciphertext back over
+// them, and returns the integrity hash.
+func (c *cfxCipher) seal(segments []segment) ([]byte, error) {
+	ke, err := c.e.DeriveKey(c.key, common.GetUsageKe(c.usage))
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		pt   = join(segments, nil)
+		data []byte
+	)
+
+	for _, s := range segments {
+		if s.encrypt {
+			data = append(data, s.b...)
+		}
+	}
+
+	_, ct, err := c.e.EncryptData(ke, data)
+	if err != nil {
+		return nil, err
+	}
+
+	scatter(segments, ct)
+
+	if c.etm {
+		return common.GetIntegrityHash(append(make([]byte, c.confounderLength()), join(segments, nil)...),
+			c.key, c.usage, c.e)
+	}
+
+	return common.GetIntegrityHash(pt, c.key, c.usage, c.e)
+}
+
+// open verifies the integrity hash and decrypts the encrypted segments,
+// copying the plaintext back over them. The segments are left untouched if
+// verification fails.
+func (c *cfxCipher) open(segments []segment, hash []byte) error {
+	ke, err := c.e.DeriveKey(c.key, common.GetUsageKe(c.usage))
+	if err != nil {
+		return err
+	}
+
+	if c.etm {
+		if err = c.verify(append(make([]byte, c.confounderLength()), join(segments, nil)...), hash); err != nil {
+			return err
+		}
+	}
+
+	var data []byte
+
+	for _, s := range segments {
+		if s.encrypt {
+			data = append(data, s.b...)
+		}
+	}
+
+	pt, err := c.e.DecryptData(ke, data)
+	if err != nil {
+		return err
+	}
+
+	if !c.etm {
+		if err = c.verify(join(segments, pt), hash); err != nil {
+			return err
+		}
+	}
+
+	scatter(segments, pt)
+
+	return nil
+}
+
+func (c *cfxCipher) verify(b, hash []byte) error {
+	expected, err := common.GetIntegrityHash(b, c.key, c.usage, c.e)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(expected, hash) {
+		return errWrapIntegrity
+	}
+
+	return nil
+}
+
+// checksum returns the checksum of the segments used by wrap tokens without
+// confidentiality.
+func (c *cfxCipher) checksum(segments []segment) ([]byte, error) {
+	return c.e.GetChecksumHash(c.key, join(segments, nil), c.usage)
+}
+
+// iovBuffers holds the buffers passed to WrapIOV or UnwrapIOV that have a
+// fixed role in the token.
+type iovBuffers struct {
+	header  *IOVBuffer
+	padding *IOVBuffer
+	trailer *IOVBuffer
+}
+
+func parseIOVBuffers(buffers []IOVBuffer) (iovBuffers, error) {
+	var iov iovBuffers
+
+	for i := range buffers {
+		var p **IOVBuffer
+
+		switch buffers[i].Type {
+		case IOVBufferTypeEmpty, IOVBufferTypeData, IOVBufferTypeSignOnly:
+			continue
+		case IOVBufferTypeHeader:
+			p = &iov.header
+		case IOVBufferTypePadding:
+			p = &iov.padding
+		case IOVBufferTypeTrailer:
+			p = &iov.trailer
+		default:
+			return iov, errIOVBuffers
+		}
+
+		if *p != nil {
+			return iov, errIOVBuffers
+		}
+
+		*p = &buffers[i]
+	}
+
+	if iov.header == nil {
+		return iov, errIOVBuffers
+	}
+
+	return iov, nil
+}
+
+// resize returns b with length n, reusing the underlying array if possible.
+func resize(b []byte, n int) []byte {
+	if cap(b) >= n {
+		return b[:n]
+	}
+
+	return make([]byte, n)
+}
+
+func (ctx *context) wrapUsage(send bool) uint32 {
+	if ctx.acceptor == send {
+		return keyusage.GSSAPI_ACCEPTOR_SEAL
+	}
+
+	return keyusage.GSSAPI_INITIATOR_SEAL
+}
+
+// WrapIOVLength sets the length of the header, padding and trailer buffers
+// required by WrapIOV for the same buffers and conf. The buffers are resized
+// in place, reusing their existing capacity where possible.
+func (ctx *context) WrapIOVLength(conf bool, buffers []IOVBuffer) error {
+	key, _ := ctx.sendKey()
+
+	c, err := newCFXCipher(key, ctx.wrapUsage(true))
+	if err != nil {
+		return err
+	}
+
+	iov, err := parseIOVBuffers(buffers)
+	if err != nil {
+		return err
+	}
+
+	header, trailer, _ := c.lengths(conf, iov.trailer != nil)
+
+	iov.header.Data = resize(iov.header.Data, header)
+
+	if iov.trailer != nil {
+		iov.trailer.Data = resize(iov.trailer.Data, trailer)
+	}
+
+	if iov.padding != nil {
+		iov.padding.Data = iov.padding.Data[:0]
+	}
+
+	return nil
+}
+
+// WrapIOV creates an RFC 4121 wrap token from the buffers. Data buffers are
+// encrypted if conf is set and, along with any sign-only buffers, integrity
+// protected. The header, padding and trailer buffers must be at least as long
+// as set by WrapIOVLength and are truncated to the length used. If there's no
+// trailer buffer then the trailer is rotated into the header and the token is
+// the header followed by the data buffers.
+//
+// The result is written back to the buffers however the data is copied
+// while it's encrypted and hashed so this saves no copying or allocations
+// compared to Wrap; it only avoids assembling the token.
+//
+//nolint:cyclop,funlen
+func (ctx *context) WrapIOV(conf bool, buffers []IOVBuffer) error {
+	key, flags := ctx.sendKey()
+
+	c, err := newCFXCipher(key, ctx.wrapUsage(true))
+	if err != nil {
+		return err
+	}
+
+	iov, err := parseIOVBuffers(buffers)
+	if err != nil {
+		return err
+	}
+
+	headerLength, trailerLength, rrc := c.lengths(conf, iov.trailer != nil)
+
+	if len(iov.header.Data) < headerLength {
+		return errIOVBufferSize
+	}
+
+	header := iov.header.Data[:headerLength]
+	iov.header.Data = header
+
+	var trailer []byte
+
+	if iov.trailer != nil {
+		if len(iov.trailer.Data) < trailerLength {
+			return errIOVBufferSize
+		}
+
+		trailer = iov.trailer.Data[:trailerLength]
+		iov.trailer.Data = trailer
+	}
+
+	if iov.padding != nil {
+		iov.padding.Data = iov.padding.Data[:0]
+	}
+
+	var ec int
+
+	if conf {
+		flags |= gssapi.MICTokenFlagSealed
+	} else {
+		ec = c.hashLength()
+	}
+
+	// The copy of the header protected by the token has a zero RRC and, for
+	// tokens without confidentiality, a zero EC
+	protected := make([]byte, wrapTokenHeaderLength)
+	copy(protected, wrapTokenID)
+	protected[2] = flags
+	protected[3] = wrapTokenFiller
+	binary.BigEndian.PutUint64(protected[8:], ctx.sequenceNumber)
+
+	copy(header, protected)
+	binary.BigEndian.PutUint16(header[4:6], uint16(ec))  //nolint:gosec
+	binary.BigEndian.PutUint16(header[6:8], uint16(rrc)) //nolint:gosec
+
+	segments := make([]segment, 0, len(buffers)+2)
+
+	var confounder []byte
+
+	if conf {
+		copy(protected[4:6], header[4:6])
+
+		confounder = make([]byte, c.confounderLength())
+		if _, err = rand.Read(confounder); err != nil {
+			return err
+		}
+
+		segments = append(segments, segment{b: confounder, encrypt: true})
+	}
+
+	for _, buffer := range buffers {
+		switch buffer.Type { //nolint:exhaustive
+		case IOVBufferTypeData:
+			segments = append(segments, segment{b: buffer.Data, encrypt: conf})
+		case IOVBufferTypeSignOnly:
+			segments = append(segments, segment{b: buffer.Data})
+		}
+	}
+
+	segments = append(segments, segment{b: protected, encrypt: conf})
+
+	var tail []byte
+
+	if conf {
+		hash, err := c.seal(segments)
+		if err != nil {
+			return err
+		}
+
+		tail = append(protected, hash...) //nolint:gocritic
+	} else {
+		if tail, err = c.checksum(segments); err != nil {
+			return err
+		}
+	}
+
+	if trailer != nil {
+		copy(header[wrapTokenHeaderLength:], confounder)
+		copy(trailer, tail)
+	} else {
+		copy(header[wrapTokenHeaderLength:], tail)
+		copy(header[wrapTokenHeaderLength+len(tail):], confounder)
+	}
+
+	ctx.sequenceNumber++
+
+	return nil
+}
+
+// UnwrapIOV verifies and, if necessary, decrypts an RFC 4121 wrap token held
+// in the buffers, writing the plaintext back to the data buffers. As with
+// WrapIOV, the data is copied while it's processed. Any sign-only buffers
+// must match those passed to WrapIOV. It returns whether confidentiality was
+// applied.
+func (ctx *context) UnwrapIOV(buffers []IOVBuffer) (bool, error) {
+	iov, err := parseIOVBuffers(buffers)
+	if err != nil {
+		return false, err
+	}
+
+	header := iov.header.Data
+	if len(header) < wrapTokenHeaderLength {
+		return false, errBadWrapToken
+	}
+
+	var body []byte
+
+	body = append(body, header[wrapTokenHeaderLength:]...)
+
+	for _, buffer := range buffers {
+		if buffer.Type == IOVBufferTypeData {
+			body = append(body, buffer.Data...)
+		}
+	}
+
+	if iov.padding != nil {
+		body = append(body, iov.padding.Data...)
+	}
+
+	if iov.trailer != nil {
+		body = append(body, iov.trailer.Data...)
+	}
+
+	return ctx.unwrap(header[:wrapTokenHeaderLength], body, buffers)
+}
+
+// WrapSizeLimit returns the largest message that Wrap can protect, with or
+// without confidentiality, without the token exceeding maxOutput bytes.
+func (ctx *context) WrapSizeLimit(conf bool, maxOutput int) (int, error) {
+	key, _ := ctx.sendKey()
+
+	if c, ok := newLegacyCipher(key); ok {
+		return legacyWrapSizeLimit(c, maxOutput), nil
+	}
+
+	c, err := newCFXCipher(key, ctx.wrapUsage(true))
+	if err != nil {
+		return 0, err
+	}
+
+	// The AES encryption types use ciphertext stealing so there's never any
+	// padding and the overhead is fixed
+	header, trailer, _ := c.lengths(conf, true)
+
+	return max(maxOutput-header-trailer, 0), nil
+}
+
+// Wrap creates a wrap token containing the message, which is encrypted if
+// conf is set. As with MakeSignature, RFC 1964 or RFC 4757 tokens are used
+// with the DES, Triple DES and RC4 encryption types.
+func (ctx *context) Wrap(message []byte, conf bool) ([]byte, error) {
+	key, _ := ctx.sendKey()
+
+	if c, ok := newLegacyCipher(key); ok {
+		return ctx.legacyWrap(c, message, conf)
+	}
+
+	buffers := []IOVBuffer{
+		{Type: IOVBufferTypeHeader},
+		{Type: IOVBufferTypeData, Data: append([]byte(nil), message...)},
+		{Type: IOVBufferTypeTrailer},
+	}
+
+	if err := ctx.WrapIOVLength(conf, buffers); err != nil {
+		return nil, err
+	}
+
+	if err := ctx.WrapIOV(conf, buffers); err != nil {
+		return nil, err
+	}
+
+	token := make([]byte, 0, len(buffers[0].Data)+len(buffers[1].Data)+len(buffers[2].Data))
+
+	for _, buffer := range buffers {
+		token = append(token, buffer.Data...)
+	}
+
+	return token, nil
+}
+
+// Unwrap verifies and, if necessary, decrypts a wrap token and returns the
+// message along with whether confidentiality was applied.
+func (ctx *context) Unwrap(token []byte) ([]byte, bool, error) {
+	if c, ok := newLegacyCipher(ctx.receiveKey()); ok {
+		return ctx.legacyUnwrap(c, token)
+	}
+
+	if len(token) < wrapTokenHeaderLength {
+		return nil, false, errBadWrapToken
+	}
+
+	buffers := []IOVBuffer{
+		{Type: IOVBufferTypeData},
+	}
+
+	conf, err := ctx.unwrap(token[:wrapTokenHeaderLength],
+		append([]byte(nil), token[wrapTokenHeaderLength:]...), buffers)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return buffers[0].Data, conf, nil
+}
+
+// unwrap verifies the wrap token header and body, which is the remainder of
+// the token in a buffer that can be modified. The message is copied to the
+// data buffers, which must be of the correct total length unless there's a
+// single empty data buffer in which case it's set to the message.
+//
+//nolint:cyclop,funlen
+func (ctx *context) unwrap(header, body []byte, buffers []IOVBuffer) (bool, error) {
+	if !bytes.Equal(header[0:2], wrapTokenID) || header[3] != wrapTokenFiller {
+		return false, errBadWrapToken
+	}
+
+	flags := header[2]
+	if (flags&gssapi.MICTokenFlagSentByAcceptor != 0) == ctx.acceptor {
+		return false, errBadWrapToken
+	}
+
+	var (
+		conf           = flags&gssapi.MICTokenFlagSealed != 0
+		ec             = int(binary.BigEndian.Uint16(header[4:6]))
+		rrc            = int(binary.BigEndian.Uint16(header[6:8]))
+		sequenceNumber = binary.BigEndian.Uint64(header[8:])
+	)
+
+	c, err := newCFXCipher(ctx.receiveKey(), ctx.wrapUsage(false))
+	if err != nil {
+		return false, err
+	}
+
+	if len(body) > 0 {
+		rotated := make([]byte, len(body))
+		copy(rotated[copy(rotated, body[rrc%len(body):]):], body)
+		body = rotated
+	}
+
+	overhead := c.hashLength()
+	if conf {
+		overhead += c.confounderLength() + ec + wrapTokenHeaderLength
+	} else if ec != overhead {
+		return false, errBadWrapToken
+	}
+
+	if len(body) < overhead {
+		return false, errBadWrapToken
+	}
+
+	var (
+		length = len(body) - overhead
+		data   []*IOVBuffer
+		total  int
+	)
+
+	for i := range buffers {
+		if buffers[i].Type == IOVBufferTypeData {
+			data = append(data, &buffers[i])
+			total += len(buffers[i].Data)
+		}
+	}
+
+	if len(data) == 1 && data[0].Data == nil {
+		data[0].Data = make([]byte, length)
+		total = length
+	}
+
+	if total != length {
+		return false, errIOVBufferSize
+	}
+
+	var (
+		segments = make([]segment, 0, len(buffers)+2)
+		offset   int
+	)
+
+	if conf {
+		segments = append(segments, segment{b: body[:c.confounderLength()], encrypt: true})
+		offset = c.confounderLength()
+	}
+
+	for _, buffer := range buffers {
+		switch buffer.Type { //nolint:exhaustive
+		case IOVBufferTypeData:
+			segments = append(segments, segment{b: body[offset : offset+len(buffer.Data)], encrypt: conf})
+			offset += len(buffer.Data)
+		case IOVBufferTypeSignOnly:
+			segments = append(segments, segment{b: buffer.Data})
+		}
+	}
+
+	if conf {
+		protected := body[offset : len(body)-c.hashLength()]
+		segments = append(segments, segment{b: protected, encrypt: true})
+
+		if err = c.open(segments, body[len(body)-c.hashLength():]); err != nil {
+			return false, err
+		}
+
+		// Everything but the RRC must match the outer header
+		protected = protected[ec:]
+		if !bytes.Equal(protected[0:6], header[0:6]) || !bytes.Equal(protected[8:], header[8:]) {
+			return false, errBadWrapToken
+		}
+	} else {
+		protected := make([]byte, wrapTokenHeaderLength)
+		copy(protected[0:4], header[0:4])
+		copy(protected[8:], header[8:])
+
+		segments = append(segments, segment{b: protected})
+
+		checksum, err := c.checksum(segments)
+		if err != nil {
+			return false, err
+		}
+
+		if !hmac.Equal(checksum, body[offset:]) {
+			return false, errWrapIntegrity
+		}
+	}
+
+	if err = ctx.checkSequenceNumber(sequenceNumber); err != nil {
+		return false, err
+	}
+
+	if conf {
+		offset = c.confounderLength()
+	} else {
+		offset = 0
+	}
+
+	for _, buffer := range data {
+		offset += copy(buffer.Data, body[offset:])
+	}
+
+	return conf, nil
+}
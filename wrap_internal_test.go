@@ -0,0 +1,321 @@
+package gssapi
+
+import (
+	"bytes"
+	"crypto/rand"
+	"math"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//nolint:gochecknoglobals
+var wrapEncTypes = []int32{
+	etypeID.AES128_CTS_HMAC_SHA1_96,
+	etypeID.AES256_CTS_HMAC_SHA1_96,
+	etypeID.AES128_CTS_HMAC_SHA256_128,
+	etypeID.AES256_CTS_HMAC_SHA384_192,
+}
+
+//nolint:funlen
+func TestWrap(t *testing.T) {
+	message := []byte("the quick brown fox jumps over the lazy dog")
+
+	for _, etype := range wrapEncTypes {
+		t.Run(encTypeName(etype), func(t *testing.T) {
+			t.Parallel()
+
+			initiator, acceptor := newContextPair(t, etype, gssapi.ContextFlagReplay)
+
+			for _, conf := range []bool{true, false} {
+				token, err := initiator.Wrap(message, conf)
+				require.NoError(t, err)
+
+				b, sealed, err := acceptor.Unwrap(token)
+				require.NoError(t, err)
+				assert.Equal(t, conf, sealed)
+				assert.Equal(t, message, b)
+
+				_, _, err = acceptor.Unwrap(token)
+				assert.ErrorIs(t, err, errDuplicateToken)
+
+				token, err = acceptor.Wrap(message, conf)
+				require.NoError(t, err)
+
+				b, sealed, err = initiator.Unwrap(token)
+				require.NoError(t, err)
+				assert.Equal(t, conf, sealed)
+				assert.Equal(t, message, b)
+
+				// Check against the gokrb5 implementation
+				if conf {
+					b, err = crypto.DecryptMessage(token[wrapTokenHeaderLength:], initiator.receiveKey(),
+						keyusage.GSSAPI_ACCEPTOR_SEAL)
+					require.NoError(t, err)
+					assert.Equal(t, message, b[:len(message)])
+					assert.Equal(t, token[:4], b[len(message):len(message)+4])
+				} else {
+					var wt gssapi.WrapToken
+					require.NoError(t, wt.Unmarshal(token, true))
+
+					ok, err := wt.Verify(initiator.receiveKey(), keyusage.GSSAPI_ACCEPTOR_SEAL)
+					require.NoError(t, err)
+					assert.True(t, ok)
+					assert.Equal(t, message, wt.Payload)
+				}
+
+				token, err = initiator.Wrap(message, conf)
+				require.NoError(t, err)
+
+				token[len(token)-1] ^= 0xff
+
+				_, _, err = acceptor.Unwrap(token)
+				assert.ErrorIs(t, err, errWrapIntegrity)
+
+				// A token can't be reflected back to the sender
+				token, err = initiator.Wrap(message, conf)
+				require.NoError(t, err)
+
+				_, _, err = initiator.Unwrap(token)
+				assert.ErrorIs(t, err, errBadWrapToken)
+			}
+		})
+	}
+}
+
+//nolint:funlen
+func TestWrapIOV(t *testing.T) {
+	for _, etype := range wrapEncTypes {
+		t.Run(encTypeName(etype), func(t *testing.T) {
+			t.Parallel()
+
+			initiator, acceptor := newContextPair(t, etype, 0)
+
+			tables := []struct {
+				name    string
+				conf    bool
+				trailer bool
+			}{
+				{"sealed", true, true},
+				{"sealed without trailer", true, false},
+				{"signed", false, true},
+				{"signed without trailer", false, false},
+			}
+
+			for _, table := range tables {
+				t.Run(table.name, func(t *testing.T) {
+					buffers := []IOVBuffer{
+						{Type: IOVBufferTypeHeader},
+						{Type: IOVBufferTypeSignOnly, Data: []byte("sign only")},
+						{Type: IOVBufferTypeData, Data: []byte("first data buffer")},
+						{Type: IOVBufferTypeSignOnly, Data: []byte("also sign only")},
+						{Type: IOVBufferTypeData, Data: []byte("second")},
+						{Type: IOVBufferTypePadding},
+					}
+
+					if table.trailer {
+						buffers = append(buffers, IOVBuffer{Type: IOVBufferTypeTrailer})
+					}
+
+					require.NoError(t, initiator.WrapIOVLength(table.conf, buffers))
+
+					c, err := newCFXCipher(types.EncryptionKey{KeyType: etype}, 0)
+					require.NoError(t, err)
+
+					header, trailer, _ := c.lengths(table.conf, table.trailer)
+					assert.Len(t, buffers[0].Data, header)
+					assert.Empty(t, buffers[5].Data)
+
+					if table.trailer {
+						assert.Len(t, buffers[6].Data, trailer)
+					}
+
+					require.NoError(t, initiator.WrapIOV(table.conf, buffers))
+
+					assert.Equal(t, []byte("sign only"), buffers[1].Data)
+					assert.Equal(t, []byte("also sign only"), buffers[3].Data)
+					assert.Equal(t, !table.conf, bytes.Equal([]byte("second"), buffers[4].Data))
+
+					// Without the sign-only buffers the token is
+					// contiguous, rotated or not
+					var token []byte
+					for _, buffer := range buffers {
+						if buffer.Type != IOVBufferTypeSignOnly {
+							token = append(token, buffer.Data...)
+						}
+					}
+
+					_, _, err = acceptor.Unwrap(token)
+					require.ErrorIs(t, err, errWrapIntegrity)
+
+					tampered := cloneIOVBuffers(buffers)
+					tampered[3].Data[0] ^= 0xff
+
+					_, err = acceptor.UnwrapIOV(tampered)
+					require.ErrorIs(t, err, errWrapIntegrity)
+
+					conf, err := acceptor.UnwrapIOV(buffers)
+					require.NoError(t, err)
+					assert.Equal(t, table.conf, conf)
+					assert.Equal(t, []byte("first data buffer"), buffers[2].Data)
+					assert.Equal(t, []byte("second"), buffers[4].Data)
+				})
+			}
+		})
+	}
+}
+
+func TestWrapIOVRotated(t *testing.T) {
+	t.Parallel()
+
+	initiator, acceptor := newContextPair(t, etypeID.AES128_CTS_HMAC_SHA256_128, 0)
+
+	for _, conf := range []bool{true, false} {
+		buffers := []IOVBuffer{
+			{Type: IOVBufferTypeHeader},
+			{Type: IOVBufferTypeData, Data: []byte("message")},
+		}
+
+		require.NoError(t, initiator.WrapIOVLength(conf, buffers))
+		require.NoError(t, initiator.WrapIOV(conf, buffers))
+
+		// The trailer is rotated into the header so the token is
+		// contiguous
+		b, sealed, err := acceptor.Unwrap(append(buffers[0].Data, buffers[1].Data...))
+		require.NoError(t, err)
+		assert.Equal(t, conf, sealed)
+		assert.Equal(t, []byte("message"), b)
+	}
+}
+
+func TestWrapSizeLimit(t *testing.T) {
+	t.Parallel()
+
+	tables := []struct {
+		etype    int32
+		conf     bool
+		overhead int
+	}{
+		{etypeID.AES128_CTS_HMAC_SHA1_96, true, 60},
+		{etypeID.AES256_CTS_HMAC_SHA1_96, false, 28},
+		{etypeID.AES128_CTS_HMAC_SHA256_128, true, 64},
+		{etypeID.AES256_CTS_HMAC_SHA384_192, true, 72},
+		{etypeID.AES256_CTS_HMAC_SHA384_192, false, 40},
+	}
+
+	for _, table := range tables {
+		t.Run(encTypeName(table.etype), func(t *testing.T) {
+			t.Parallel()
+
+			initiator, _ := newContextPair(t, table.etype, 0)
+
+			limit, err := initiator.WrapSizeLimit(table.conf, 1024)
+			require.NoError(t, err)
+			assert.Equal(t, 1024-table.overhead, limit)
+
+			token, err := initiator.Wrap(make([]byte, limit), table.conf)
+			require.NoError(t, err)
+			assert.Len(t, token, 1024)
+
+			limit, err = initiator.WrapSizeLimit(table.conf, table.overhead-1)
+			require.NoError(t, err)
+			assert.Zero(t, limit)
+		})
+	}
+}
+
+func TestWrapIOVBuffers(t *testing.T) {
+	t.Parallel()
+
+	initiator, _ := newContextPair(t, etypeID.AES256_CTS_HMAC_SHA1_96, 0)
+
+	tables := []struct {
+		name    string
+		buffers []IOVBuffer
+		err     error
+	}{
+		{"no header", []IOVBuffer{{Type: IOVBufferTypeData}}, errIOVBuffers},
+		{"two headers", []IOVBuffer{{Type: IOVBufferTypeHeader}, {Type: IOVBufferTypeHeader}}, errIOVBuffers},
+		{"unknown type", []IOVBuffer{{Type: IOVBufferTypeHeader}, {Type: 3}}, errIOVBuffers},
+		{"short header", []IOVBuffer{{Type: IOVBufferTypeHeader, Data: make([]byte, 16)}}, errIOVBufferSize},
+	}
+
+	for _, table := range tables {
+		t.Run(table.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.ErrorIs(t, initiator.WrapIOV(true, table.buffers), table.err)
+		})
+	}
+}
+
+func TestWrapUnsupported(t *testing.T) {
+	t.Parallel()
+
+	initiator, _ := newContextPair(t, etypeID.RC4_HMAC, 0)
+
+	// RFC 1964 and RFC 4757 tokens are only supported by Wrap
+	buffers := []IOVBuffer{{Type: IOVBufferTypeHeader}, {Type: IOVBufferTypeData}}
+	assert.ErrorIs(t, initiator.WrapIOVLength(true, buffers), errWrapUnsupported)
+}
+
+// newContextPair returns an established Initiator and Acceptor context
+// sharing a random session key. It's used rather than establishing a context
+// as gokrb5 generates session keys of the wrong length for
+// aes256-cts-hmac-sha384-192.
+func newContextPair(t *testing.T, etype int32, flags int) (*context, *context) {
+	t.Helper()
+
+	var n int
+
+	switch etype {
+	case etypeID.DES_CBC_CRC, etypeID.DES_CBC_MD4, etypeID.DES_CBC_MD5:
+		// gokrb5 doesn't support single DES at all
+		n = 8
+	case etypeID.AES256_CTS_HMAC_SHA384_192:
+		n = 32
+	default:
+		e, err := crypto.GetEtype(etype)
+		require.NoError(t, err)
+
+		n = e.GetKeyByteSize()
+	}
+
+	key := types.EncryptionKey{
+		KeyType:  etype,
+		KeyValue: make([]byte, n),
+	}
+
+	_, err := rand.Read(key.KeyValue)
+	require.NoError(t, err)
+
+	initiator := &context{
+		established:  true,
+		key:          key,
+		flags:        flags,
+		sequenceMask: math.MaxUint32,
+		logger:       logr.Discard(),
+	}
+
+	acceptor := *initiator
+	acceptor.acceptor = true
+
+	return initiator, &acceptor
+}
+
+func cloneIOVBuffers(buffers []IOVBuffer) []IOVBuffer {
+	c := make([]IOVBuffer, len(buffers))
+
+	for i, buffer := range buffers {
+		c[i] = IOVBuffer{Type: buffer.Type, Data: bytes.Clone(buffer.Data)}
+	}
+
+	return c
+}